@@ -57,7 +57,10 @@ func main() {
 		Str("commit", BabbleservCommit).
 		Msg("Booting Babbleserv...")
 
-	cfg := config.NewBabbleConfig(*configFilename, BabbleservCommit)
+	cfg, err := config.NewBabbleConfig(*configFilename, BabbleservCommit)
+	if err != nil {
+		log.Fatal().Err(err).Str("filename", *configFilename).Msg("Failed to load config")
+	}
 
 	if *routes {
 		cfg.RoutesEnabled = true
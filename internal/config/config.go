@@ -2,6 +2,9 @@ package config
 
 import (
 	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/netip"
 	"os"
 	"time"
 
@@ -48,12 +51,22 @@ type BabbleConfig struct {
 		Notifier NotifierConfig `yaml:"notifier"`
 
 		RefreshAccessTokenExpire time.Duration `yaml:"refreshAccessTokenExpire"`
+		// Secret key used to hash access & refresh tokens stored in the database
+		TokenHashKey string `yaml:"tokenHashKey"`
 	}
 
 	Transient struct {
 		Enabled  bool           `yaml:"enabled"`
 		Database databaseConfig `yaml:"database"`
 		Notifier NotifierConfig `yaml:"notifier"`
+
+		Presence struct {
+			Enabled bool `yaml:"enabled"`
+			// Online users become unavailable after this long without activity
+			UnavailableAfter time.Duration `yaml:"unavailableAfter"`
+			// Users become offline after this long without syncing
+			OfflineAfter time.Duration `yaml:"offlineAfter"`
+		} `yaml:"presence"`
 	}
 
 	Media struct {
@@ -71,6 +84,12 @@ type BabbleConfig struct {
 	Workers struct {
 	} `yaml:"workers"`
 
+	Push struct {
+		// IP ranges (CIDR) push gateway URLs may not resolve to, defaults to loopback, private
+		// and link-local ranges. Set to an empty list to allow any address.
+		DeniedIPRanges []string `yaml:"deniedIPRanges"`
+	} `yaml:"push"`
+
 	Federation struct {
 		MaxFetchMissingEvents int `yaml:"maxFetchMissingEvents"`
 	} `yaml:"federation"`
@@ -97,18 +116,35 @@ type BabbleConfig struct {
 	// Internal cache
 	activeSigningKeyID string                        `yaml:"-"`
 	signingKeyCache    map[string]ed25519.PrivateKey `yaml:"-"`
+	pushDeniedPrefixes []netip.Prefix                `yaml:"-"`
+}
+
+var defaultPushDeniedIPRanges = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"224.0.0.0/4",    // multicast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
 }
 
-func NewBabbleConfig(filename string, commitHash string) BabbleConfig {
+func NewBabbleConfig(filename string, commitHash string) (BabbleConfig, error) {
+	var cfg BabbleConfig
+
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return cfg, err
 	}
 
-	var cfg BabbleConfig
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
-		panic(err)
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid config file: %w", err)
 	}
 
 	cfg.UserAgent = "Babbleserv (" + commitHash + ")"
@@ -117,7 +153,7 @@ func NewBabbleConfig(filename string, commitHash string) BabbleConfig {
 	for keyID, key := range cfg.SigningKeys {
 		if key.ExpiredTimestamp == 0 {
 			if hasActiveKey {
-				panic("cannot have more than one active key")
+				return cfg, errors.New("cannot have more than one active key")
 			}
 			hasActiveKey = true
 			cfg.activeSigningKeyID = keyID
@@ -129,8 +165,43 @@ func NewBabbleConfig(filename string, commitHash string) BabbleConfig {
 	if cfg.SigningKeyRefreshInterval == 0 {
 		cfg.SigningKeyRefreshInterval = time.Hour
 	}
+	if cfg.Transient.Presence.UnavailableAfter == 0 {
+		cfg.Transient.Presence.UnavailableAfter = 5 * time.Minute
+	}
+	if cfg.Transient.Presence.OfflineAfter == 0 {
+		cfg.Transient.Presence.OfflineAfter = 5 * time.Minute
+	}
+	if cfg.Push.DeniedIPRanges == nil {
+		cfg.Push.DeniedIPRanges = defaultPushDeniedIPRanges
+	}
+
+	for _, ipRange := range cfg.Push.DeniedIPRanges {
+		prefix, err := netip.ParsePrefix(ipRange)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid push.deniedIPRanges entry: %w", err)
+		}
+		cfg.pushDeniedPrefixes = append(cfg.pushDeniedPrefixes, prefix.Masked())
+	}
+
+	return cfg, cfg.validate()
+}
 
-	return cfg
+func (c *BabbleConfig) validate() error {
+	if c.Accounts.Enabled && c.Accounts.TokenHashKey == "" {
+		return errors.New("accounts.tokenHashKey must be set when accounts are enabled, generate one with: openssl rand -hex 32")
+	}
+	return nil
+}
+
+// Whether push gateways may not be sent to at this address
+func (c *BabbleConfig) IsPushGatewayAddrDenied(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range c.pushDeniedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *BabbleConfig) MustGetSigningKey(keyID string) ed25519.PrivateKey {
@@ -0,0 +1,142 @@
+package accounts
+
+import (
+	"context"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Maximum account data changes delivered in a single sync
+const accountDataSyncLimit = 100
+
+// Get global (empty room ID) or room account data
+func (a *AccountsDatabase) GetAccountData(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	evType string,
+) (*types.AccountDataEvent, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*types.AccountDataEvent, error) {
+		if ev, err := a.accountData.TxnGetAccountData(txn, userID, roomID, evType); err != nil {
+			return nil, err
+		} else if ev == nil {
+			return nil, types.ErrAccountDataNotFound
+		} else {
+			return ev, nil
+		}
+	})
+}
+
+// Set global (empty room ID) or room account data
+func (a *AccountsDatabase) SetAccountData(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	evType string,
+	content []byte,
+) error {
+	log := a.getTxnLogContext(ctx, "SetAccountData").
+		Str("user_id", userID.String()).
+		Str("room_id", roomID.String()).
+		Str("type", evType).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		return nil, a.accountData.TxnSetAccountData(txn, userID, roomID, evType, content, 0)
+	}); err != nil {
+		return err
+	}
+
+	a.notifiers.Accounts.SendChange(notifier.Change{UserIDs: []id.UserID{userID}})
+	log.Debug().Msg("Set account data")
+
+	return nil
+}
+
+// Returns all account data for a user along with the version to sync from next
+func (a *AccountsDatabase) InitAccountDataForUser(
+	ctx context.Context,
+	userID id.UserID,
+) (tuple.Versionstamp, []*types.AccountDataEvent, error) {
+	var nextVersion tuple.Versionstamp
+
+	evs, err := util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]*types.AccountDataEvent, error) {
+		nextVersion = util.TxnGetLatestWriteVersion(ctx, txn)
+		return a.accountData.TxnLookupUserAccountData(txn, userID)
+	})
+	if err != nil {
+		return types.ZeroVersionstamp, nil, err
+	}
+
+	// Clients expect push rules in the initial sync even if the user has never changed them
+	if !slices.ContainsFunc(evs, func(ev *types.AccountDataEvent) bool {
+		return ev.RoomID == "" && ev.Type == event.AccountDataPushRules.Type
+	}) {
+		evs = append(evs, defaultPushRulesAccountDataEvent(userID))
+	}
+
+	return nextVersion, evs, nil
+}
+
+// Returns all account data for a user in each of the given rooms
+func (a *AccountsDatabase) GetRoomAccountDataForUser(
+	ctx context.Context,
+	userID id.UserID,
+	roomIDs []id.RoomID,
+) ([]*types.AccountDataEvent, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]*types.AccountDataEvent, error) {
+		evs := make([]*types.AccountDataEvent, 0)
+		for _, roomID := range roomIDs {
+			roomEvs, err := a.accountData.TxnLookupUserRoomAccountData(txn, userID, roomID)
+			if err != nil {
+				return nil, err
+			}
+			evs = append(evs, roomEvs...)
+		}
+		return evs, nil
+	})
+}
+
+// Returns account data changed after the from version, along with the version to sync from next
+func (a *AccountsDatabase) SyncAccountDataForUser(
+	ctx context.Context,
+	userID id.UserID,
+	from tuple.Versionstamp,
+) (tuple.Versionstamp, []*types.AccountDataEvent, error) {
+	var nextVersion tuple.Versionstamp
+
+	evs, err := util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]*types.AccountDataEvent, error) {
+		nextVersion = util.TxnGetLatestWriteVersion(ctx, txn)
+
+		fromVersion := from
+		if from != types.ZeroVersionstamp {
+			// Bump the from version, FDB range starts are inclusive but we want changes *after*
+			fromVersion.UserVersion += 1
+		}
+
+		evs, err := a.accountData.TxnPaginateUserAccountDataChanges(txn, userID, fromVersion, accountDataSyncLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(evs) == accountDataSyncLimit {
+			// There may be more changes, only move the position up to the last one we're returning
+			nextVersion = evs[len(evs)-1].Version
+		}
+
+		return evs, nil
+	})
+	if err != nil {
+		return from, nil, err
+	}
+
+	return nextVersion, evs, nil
+}
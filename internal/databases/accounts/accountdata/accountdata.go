@@ -0,0 +1,216 @@
+package accountdata
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Global & per-room account data, global account data is stored with an empty room ID
+type AccountDataDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserRoomType,
+	byUserVersion subspace.Subspace
+}
+
+func NewAccountDataDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *AccountDataDirectory {
+	accountDataDir, err := parentDir.CreateOrOpen(db, []string{"accountdata"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "accountdata").Logger()
+	log.Debug().
+		Bytes("prefix", accountDataDir.Bytes()).
+		Msg("Init accounts/accountdata directory")
+
+	return &AccountDataDirectory{
+		log: log,
+		db:  db,
+
+		byUserRoomType: accountDataDir.Sub("urt"), // userID/roomID/type -> (version, content)
+		byUserVersion:  accountDataDir.Sub("uv"),  // userID/version -> (roomID, type)
+	}
+}
+
+func (a *AccountDataDirectory) KeyForAccountData(userID id.UserID, roomID id.RoomID, evType string) fdb.Key {
+	return a.byUserRoomType.Pack(tuple.Tuple{userID.String(), roomID.String(), evType})
+}
+
+func (a *AccountDataDirectory) TxnGetAccountData(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	evType string,
+) (*types.AccountDataEvent, error) {
+	value, err := txn.Get(a.KeyForAccountData(userID, roomID, evType)).Get()
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return valueToAccountDataEvent(value, roomID, evType)
+}
+
+// As TxnGetAccountData for the same room & type for many users, the reads are issued concurrently.
+// Users without the account data are not included.
+func (a *AccountDataDirectory) TxnGetUsersAccountData(
+	txn fdb.ReadTransaction,
+	userIDs []id.UserID,
+	roomID id.RoomID,
+	evType string,
+) (map[id.UserID]*types.AccountDataEvent, error) {
+	futures := make([]fdb.FutureByteSlice, 0, len(userIDs))
+	for _, userID := range userIDs {
+		futures = append(futures, txn.Get(a.KeyForAccountData(userID, roomID, evType)))
+	}
+
+	evs := make(map[id.UserID]*types.AccountDataEvent, len(userIDs))
+	for i, future := range futures {
+		value, err := future.Get()
+		if err != nil {
+			return nil, err
+		} else if value == nil {
+			continue
+		}
+		if evs[userIDs[i]], err = valueToAccountDataEvent(value, roomID, evType); err != nil {
+			return nil, err
+		}
+	}
+	return evs, nil
+}
+
+// Set account data, replacing any existing content. The change is appended to the users change log
+// and any previous change log entry for the same room/type is removed.
+func (a *AccountDataDirectory) TxnSetAccountData(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	evType string,
+	content []byte,
+	userVersion uint16,
+) error {
+	key := a.KeyForAccountData(userID, roomID, evType)
+
+	if existing, err := txn.Get(key).Get(); err != nil {
+		return err
+	} else if existing != nil {
+		ev, err := valueToAccountDataEvent(existing, roomID, evType)
+		if err != nil {
+			return err
+		}
+		txn.Clear(a.byUserVersion.Pack(tuple.Tuple{userID.String(), ev.Version}))
+	}
+
+	version := tuple.IncompleteVersionstamp(userVersion)
+
+	changeKey, err := a.byUserVersion.PackWithVersionstamp(tuple.Tuple{userID.String(), version})
+	if err != nil {
+		return err
+	}
+	txn.SetVersionstampedKey(changeKey, tuple.Tuple{roomID.String(), evType}.Pack())
+
+	value, err := tuple.Tuple{version, content}.PackWithVersionstamp(nil)
+	if err != nil {
+		return err
+	}
+	txn.SetVersionstampedValue(key, value)
+
+	return nil
+}
+
+// Returns all global & room account data for a user
+func (a *AccountDataDirectory) TxnLookupUserAccountData(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+) ([]*types.AccountDataEvent, error) {
+	return a.txnLookupAccountDataRange(txn, a.byUserRoomType.Sub(userID.String()))
+}
+
+// Returns all account data for a user in a single room
+func (a *AccountDataDirectory) TxnLookupUserRoomAccountData(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+) ([]*types.AccountDataEvent, error) {
+	return a.txnLookupAccountDataRange(txn, a.byUserRoomType.Sub(userID.String(), roomID.String()))
+}
+
+func (a *AccountDataDirectory) txnLookupAccountDataRange(
+	txn fdb.ReadTransaction,
+	rng fdb.Range,
+) ([]*types.AccountDataEvent, error) {
+	iter := txn.GetRange(rng, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).Iterator()
+
+	evs := make([]*types.AccountDataEvent, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := a.byUserRoomType.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		ev, err := valueToAccountDataEvent(kv.Value, id.RoomID(keyTup[1].(string)), keyTup[2].(string))
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+
+	return evs, nil
+}
+
+// Paginate account data changed since (inclusive) the given version, returns the current content
+// of each changed room/type in change order.
+func (a *AccountDataDirectory) TxnPaginateUserAccountDataChanges(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	fromVersion tuple.Versionstamp,
+	limit int,
+) ([]*types.AccountDataEvent, error) {
+	kvs, err := txn.GetRange(
+		types.GetVersionRange(a.byUserVersion, fromVersion, types.ZeroVersionstamp, userID.String()),
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	evs := make([]*types.AccountDataEvent, 0, len(kvs))
+
+	for _, kv := range kvs {
+		valTup, err := tuple.Unpack(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		ev, err := a.TxnGetAccountData(txn, userID, id.RoomID(valTup[0].(string)), valTup[1].(string))
+		if err != nil {
+			return nil, err
+		} else if ev != nil {
+			evs = append(evs, ev)
+		}
+	}
+
+	return evs, nil
+}
+
+func valueToAccountDataEvent(value []byte, roomID id.RoomID, evType string) (*types.AccountDataEvent, error) {
+	valTup, err := tuple.Unpack(value)
+	if err != nil {
+		return nil, err
+	}
+	return &types.AccountDataEvent{
+		RoomID:  roomID,
+		Type:    evType,
+		Content: valTup[1].([]byte),
+		Version: valTup[0].(tuple.Versionstamp),
+	}, nil
+}
@@ -1,6 +1,7 @@
 package accounts
 
 import (
+	"context"
 	"sync"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -8,8 +9,14 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases/accounts/accountdata"
+	"github.com/beeper/babbleserv/internal/databases/accounts/backups"
 	"github.com/beeper/babbleserv/internal/databases/accounts/devices"
+	"github.com/beeper/babbleserv/internal/databases/accounts/filters"
+	"github.com/beeper/babbleserv/internal/databases/accounts/lazymembers"
+	"github.com/beeper/babbleserv/internal/databases/accounts/pushers"
 	"github.com/beeper/babbleserv/internal/databases/accounts/tokens"
+	"github.com/beeper/babbleserv/internal/databases/accounts/uia"
 	"github.com/beeper/babbleserv/internal/databases/accounts/users"
 	"github.com/beeper/babbleserv/internal/notifier"
 )
@@ -19,19 +26,30 @@ const API_VERSION = 710
 type AccountsDatabase struct {
 	backgroundWg sync.WaitGroup
 
-	log      zerolog.Logger
-	db       fdb.Database
-	config   config.BabbleConfig
-	notifier *notifier.Notifier
+	log       zerolog.Logger
+	db        fdb.Database
+	config    config.BabbleConfig
+	notifiers *notifier.Notifiers
 
-	users   *users.UsersDirectory
-	tokens  *tokens.TokensDirectory
-	devices *devices.DevicesDirectory
+	// Cancelled on stop so any background jobs (legacy token migration) exit early
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	users       *users.UsersDirectory
+	tokens      *tokens.TokensDirectory
+	devices     *devices.DevicesDirectory
+	backups     *backups.BackupsDirectory
+	uia         *uia.UIADirectory
+	accountData *accountdata.AccountDataDirectory
+	pushers     *pushers.PushersDirectory
+	filters     *filters.FiltersDirectory
+	lazyMembers *lazymembers.LazyMembersDirectory
 }
 
 func NewAccountsDatabase(
 	cfg config.BabbleConfig,
 	logger zerolog.Logger,
+	notifiers *notifier.Notifiers,
 ) *AccountsDatabase {
 	log := logger.With().
 		Str("database", "accounts").
@@ -55,18 +73,46 @@ func NewAccountsDatabase(
 		Bytes("prefix", accountsDir.Bytes()).
 		Msg("Init accounts directory")
 
-	return &AccountsDatabase{
-		log:    log,
-		db:     db,
-		config: cfg,
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+
+	accounts := &AccountsDatabase{
+		log:       log,
+		db:        db,
+		config:    cfg,
+		notifiers: notifiers,
 
-		users:   users.NewUsersDirectory(log, db, accountsDir),
-		tokens:  tokens.NewTokensDirectory(log, db, accountsDir),
-		devices: devices.NewDevicesDirectory(log, db, accountsDir),
+		ctx:    ctx,
+		cancel: cancel,
+
+		users:       users.NewUsersDirectory(log, db, accountsDir),
+		tokens:      tokens.NewTokensDirectory(log, db, accountsDir, []byte(cfg.Accounts.TokenHashKey)),
+		devices:     devices.NewDevicesDirectory(log, db, accountsDir),
+		backups:     backups.NewBackupsDirectory(log, db, accountsDir),
+		uia:         uia.NewUIADirectory(log, db, accountsDir),
+		accountData: accountdata.NewAccountDataDirectory(log, db, accountsDir),
+		pushers:     pushers.NewPushersDirectory(log, db, accountsDir),
+		filters:     filters.NewFiltersDirectory(log, db, accountsDir),
+		lazyMembers: lazymembers.NewLazyMembersDirectory(log, db, accountsDir),
 	}
+
+	accounts.backgroundWg.Add(1)
+	go func() {
+		defer accounts.backgroundWg.Done()
+		accounts.migrateLegacyTokens(accounts.ctx)
+	}()
+
+	return accounts
 }
 
 func (a *AccountsDatabase) Stop() {
 	a.log.Debug().Msg("Waiting for any background jobs to complete...")
+	a.cancel()
 	a.backgroundWg.Wait()
 }
+
+func (a *AccountsDatabase) getTxnLogContext(ctx context.Context, name string) zerolog.Context {
+	return zerolog.Ctx(ctx).With().
+		Str("component", "database").
+		Str("database", "accounts").
+		Str("transaction", name)
+}
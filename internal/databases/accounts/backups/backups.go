@@ -0,0 +1,262 @@
+package backups
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Server-side room key backups
+// https://spec.matrix.org/v1.11/client-server-api/#server-side-key-backups
+type BackupsDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserVersion,
+	userVersionSessions subspace.Subspace
+}
+
+func NewBackupsDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *BackupsDirectory {
+	backupsDir, err := parentDir.CreateOrOpen(db, []string{"backups"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "backups").Logger()
+	log.Debug().
+		Bytes("prefix", backupsDir.Bytes()).
+		Msg("Init accounts/backups directory")
+
+	return &BackupsDirectory{
+		log: log,
+		db:  db,
+
+		byUserVersion:       backupsDir.Sub("uv"),  // userID/version -> backup msgpack bytes
+		userVersionSessions: backupsDir.Sub("uvs"), // userID/version/roomID/sessionID -> KeyBackupData JSON (CSAPI)
+	}
+}
+
+// Versions are opaque strings to clients, internally we use incrementing integers
+func parseVersion(version id.KeyBackupVersion) (int64, bool) {
+	v, err := strconv.ParseInt(string(version), 10, 64)
+	return v, err == nil && v > 0
+}
+
+func (b *BackupsDirectory) KeyForBackup(userID id.UserID, version int64) fdb.Key {
+	return b.byUserVersion.Pack(tuple.Tuple{userID.String(), version})
+}
+
+func (b *BackupsDirectory) TxnGetBackup(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+) (*types.RoomKeysBackup, error) {
+	v, ok := parseVersion(version)
+	if !ok {
+		return nil, nil
+	}
+	if value, err := txn.Get(b.KeyForBackup(userID, v)).Get(); err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, nil
+	} else if backup := types.MustNewRoomKeysBackupFromBytes(value, version); backup.Deleted {
+		return nil, nil
+	} else {
+		return backup, nil
+	}
+}
+
+// Returns the most recently created backup that has not been deleted
+func (b *BackupsDirectory) TxnGetLatestBackup(txn fdb.ReadTransaction, userID id.UserID) (*types.RoomKeysBackup, error) {
+	iter := txn.GetRange(
+		b.byUserVersion.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeIterator, Reverse: true},
+	).Iterator()
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := b.byUserVersion.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		version := id.KeyBackupVersion(strconv.FormatInt(keyTup[1].(int64), 10))
+		if backup := types.MustNewRoomKeysBackupFromBytes(kv.Value, version); !backup.Deleted {
+			return backup, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (b *BackupsDirectory) TxnCreateBackup(
+	txn fdb.Transaction,
+	userID id.UserID,
+	algorithm id.KeyBackupAlgorithm,
+	authData json.RawMessage,
+) (*types.RoomKeysBackup, error) {
+	// Find the last version, including deleted ones, so versions are never re-used
+	var lastVersion int64
+	kvs, err := txn.GetRange(
+		b.byUserVersion.Sub(userID.String()),
+		fdb.RangeOptions{Limit: 1, Reverse: true},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	} else if len(kvs) == 1 {
+		keyTup, err := b.byUserVersion.Unpack(kvs[0].Key)
+		if err != nil {
+			return nil, err
+		}
+		lastVersion = keyTup[1].(int64)
+	}
+
+	backup := &types.RoomKeysBackup{
+		Version:   id.KeyBackupVersion(strconv.FormatInt(lastVersion+1, 10)),
+		Algorithm: algorithm,
+		AuthData:  authData,
+	}
+	b.TxnSetBackup(txn, userID, backup)
+	return backup, nil
+}
+
+func (b *BackupsDirectory) TxnSetBackup(txn fdb.Transaction, userID id.UserID, backup *types.RoomKeysBackup) {
+	v, ok := parseVersion(backup.Version)
+	if !ok {
+		panic("invalid backup version: " + string(backup.Version))
+	}
+	txn.Set(b.KeyForBackup(userID, v), backup.ToMsgpack())
+}
+
+// Mark a backup as deleted and remove all of its sessions
+func (b *BackupsDirectory) TxnDeleteBackup(txn fdb.Transaction, userID id.UserID, backup *types.RoomKeysBackup) {
+	backup.Deleted = true
+	backup.AuthData = nil
+	backup.Count = 0
+	b.TxnSetBackup(txn, userID, backup)
+
+	v, _ := parseVersion(backup.Version)
+	txn.ClearRange(b.userVersionSessions.Sub(userID.String(), v))
+}
+
+func (b *BackupsDirectory) KeyForSession(userID id.UserID, version id.KeyBackupVersion, roomID id.RoomID, sessionID id.SessionID) fdb.Key {
+	v, _ := parseVersion(version)
+	return b.userVersionSessions.Pack(tuple.Tuple{userID.String(), v, roomID.String(), sessionID.String()})
+}
+
+func (b *BackupsDirectory) TxnGetSession(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) (*types.RoomKeyBackupSession, error) {
+	value, err := txn.Get(b.KeyForSession(userID, version, roomID, sessionID)).Get()
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var session types.RoomKeyBackupSession
+	if err := json.Unmarshal(value, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (b *BackupsDirectory) TxnSetSession(
+	txn fdb.Transaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+	session *types.RoomKeyBackupSession,
+) {
+	value, err := json.Marshal(session)
+	if err != nil {
+		panic(err)
+	}
+	txn.Set(b.KeyForSession(userID, version, roomID, sessionID), value)
+}
+
+// Returns the range of sessions within a backup, optionally limited to a room or room & session
+func (b *BackupsDirectory) rangeForSessions(
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) fdb.ExactRange {
+	v, _ := parseVersion(version)
+	if roomID == "" {
+		return b.userVersionSessions.Sub(userID.String(), v)
+	} else if sessionID == "" {
+		return b.userVersionSessions.Sub(userID.String(), v, roomID.String())
+	}
+	key := b.KeyForSession(userID, version, roomID, sessionID)
+	return fdb.KeyRange{Begin: key, End: fdb.Key(append(key, 0x00))}
+}
+
+func (b *BackupsDirectory) TxnLookupSessions(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) (map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession, error) {
+	iter := txn.GetRange(
+		b.rangeForSessions(userID, version, roomID, sessionID),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	sessions := make(map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := b.userVersionSessions.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		var session types.RoomKeyBackupSession
+		if err := json.Unmarshal(kv.Value, &session); err != nil {
+			return nil, err
+		}
+		roomID := id.RoomID(keyTup[2].(string))
+		if _, found := sessions[roomID]; !found {
+			sessions[roomID] = make(map[id.SessionID]*types.RoomKeyBackupSession)
+		}
+		sessions[roomID][id.SessionID(keyTup[3].(string))] = &session
+	}
+
+	return sessions, nil
+}
+
+// Clear sessions within a backup, optionally limited to a room or room & session, returns the
+// number of sessions removed.
+func (b *BackupsDirectory) TxnClearSessions(
+	txn fdb.Transaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) (int, error) {
+	sessionsRange := b.rangeForSessions(userID, version, roomID, sessionID)
+
+	kvs, err := txn.GetRange(sessionsRange, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+	if err != nil {
+		return 0, err
+	}
+
+	txn.ClearRange(sessionsRange)
+	return len(kvs), nil
+}
@@ -0,0 +1,340 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/tidwall/sjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Note: like device keys cross-signing keys are stored as the raw JSON uploaded by the client, this
+// struct only holds the parsed bits we need to verify signatures.
+type crossSigningKey struct {
+	raw          []byte
+	keyID        string
+	publicKey    ed25519.PublicKey
+	publicKeyB64 string
+}
+
+func parseCrossSigningKey(b []byte, userID id.UserID, usage id.CrossSigningUsage) (*crossSigningKey, error) {
+	var keys mautrix.CrossSigningKeys
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrInvalidCrossSigningKey, err)
+	} else if keys.UserID != userID {
+		return nil, fmt.Errorf("%w: user ID mismatch", types.ErrInvalidCrossSigningKey)
+	} else if !slices.Contains(keys.Usage, usage) {
+		return nil, fmt.Errorf("%w: missing usage %s", types.ErrInvalidCrossSigningKey, usage)
+	} else if len(keys.Keys) != 1 {
+		return nil, fmt.Errorf("%w: must contain exactly one key", types.ErrInvalidCrossSigningKey)
+	}
+
+	for keyID, key := range keys.Keys {
+		algorithm, publicKeyB64 := keyID.Parse()
+		if algorithm != id.KeyAlgorithmEd25519 || publicKeyB64 != key.String() {
+			return nil, fmt.Errorf("%w: invalid key ID %s", types.ErrInvalidCrossSigningKey, keyID)
+		}
+		publicKey, err := util.Base64Decode(publicKeyB64)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid public key", types.ErrInvalidCrossSigningKey)
+		}
+		return &crossSigningKey{
+			raw:          b,
+			keyID:        keyID.String(),
+			publicKey:    publicKey,
+			publicKeyB64: publicKeyB64,
+		}, nil
+	}
+
+	panic("unreachable")
+}
+
+func (a *AccountsDatabase) txnGetCrossSigningKey(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	usage id.CrossSigningUsage,
+) (*crossSigningKey, error) {
+	b, err := a.users.TxnGetCrossSigningKey(txn, userID.Localpart(), usage)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return parseCrossSigningKey(b, userID, usage)
+}
+
+func (a *AccountsDatabase) HasCrossSigningMasterKey(ctx context.Context, userID id.UserID) (bool, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (bool, error) {
+		b, err := a.users.TxnGetCrossSigningKey(txn, userID.Localpart(), id.XSUsageMaster)
+		return b != nil, err
+	})
+}
+
+// Merge signatures uploaded via the signatures upload endpoint into the keys JSON, only signatures
+// from the given signer users are included.
+func (a *AccountsDatabase) txnMergeKeySignatures(
+	txn fdb.ReadTransaction,
+	keys []byte,
+	targetUserID id.UserID,
+	targetKey string,
+	signerUserIDs ...id.UserID,
+) ([]byte, error) {
+	signatures, err := a.users.TxnLookupKeySignatures(txn, targetUserID, targetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, signerUserID := range signerUserIDs {
+		for keyID, signature := range signatures[signerUserID] {
+			// Escape dots in the user ID & key ID which sjson would otherwise treat as path separators
+			path := "signatures." + escapeJSONPath(signerUserID.String()) + "." + escapeJSONPath(keyID.String())
+			if keys, err = sjson.SetBytes(keys, path, signature); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+func escapeJSONPath(s string) string {
+	var buf bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case '.', '*', '?', '|', '#', '@', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// Upload cross-signing keys for a user, any nil keys are left unchanged. Self & user signing keys
+// must be signed by the master key, either the one being uploaded or the one already stored.
+func (a *AccountsDatabase) UploadCrossSigningKeys(
+	ctx context.Context,
+	userID id.UserID,
+	masterKey, selfSigningKey, userSigningKey []byte,
+) error {
+	log := a.getTxnLogContext(ctx, "UploadCrossSigningKeys").
+		Str("user_id", userID.String()).
+		Logger()
+
+	username := userID.Localpart()
+
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		var master *crossSigningKey
+		var err error
+
+		if masterKey != nil {
+			if master, err = parseCrossSigningKey(masterKey, userID, id.XSUsageMaster); err != nil {
+				return nil, err
+			}
+		} else if master, err = a.txnGetCrossSigningKey(txn, userID, id.XSUsageMaster); err != nil {
+			return nil, err
+		} else if master == nil {
+			return nil, fmt.Errorf("%w: no master key", types.ErrInvalidCrossSigningKey)
+		}
+
+		for usage, b := range map[id.CrossSigningUsage][]byte{
+			id.XSUsageSelfSigning: selfSigningKey,
+			id.XSUsageUserSigning: userSigningKey,
+		} {
+			if b == nil {
+				continue
+			}
+			if _, err := parseCrossSigningKey(b, userID, usage); err != nil {
+				return nil, err
+			}
+			if err := util.VerifyJSON(b, userID.String(), master.keyID, master.publicKey); err != nil {
+				return nil, fmt.Errorf("%w: %w", types.ErrInvalidSignature, err)
+			}
+			a.users.TxnSetCrossSigningKey(txn, username, usage, b)
+		}
+
+		if masterKey != nil {
+			a.users.TxnSetCrossSigningKey(txn, username, id.XSUsageMaster, masterKey)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug().
+		Bool("master_key", masterKey != nil).
+		Bool("self_signing_key", selfSigningKey != nil).
+		Bool("user_signing_key", userSigningKey != nil).
+		Msg("Uploaded cross-signing keys")
+
+	return nil
+}
+
+// Upload signatures of device & cross-signing keys made by the user. The signers allowed depend on
+// the target key:
+//
+// - own device keys: signed by the users self-signing key
+// - own master key: signed by one of the users devices
+// - other users master key: signed by the users user-signing key
+//
+// Returns any per-key failures, these do not prevent other signatures from being stored.
+func (a *AccountsDatabase) UploadSignatures(
+	ctx context.Context,
+	userID id.UserID,
+	signedKeys map[id.UserID]map[string]json.RawMessage,
+) (map[id.UserID]map[string]error, error) {
+	log := a.getTxnLogContext(ctx, "UploadSignatures").
+		Str("user_id", userID.String()).
+		Logger()
+
+	var added int
+
+	failures, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (map[id.UserID]map[string]error, error) {
+		added = 0
+		failures := make(map[id.UserID]map[string]error)
+
+		for targetUserID, keys := range signedKeys {
+			for targetKey, signedKey := range keys {
+				n, err := a.txnUploadKeySignatures(txn, userID, targetUserID, targetKey, signedKey)
+				if err != nil {
+					if !errors.Is(err, types.ErrInvalidSignature) && !errors.Is(err, types.ErrKeyNotFound) {
+						return nil, err
+					}
+					if _, found := failures[targetUserID]; !found {
+						failures[targetUserID] = make(map[string]error)
+					}
+					failures[targetUserID][targetKey] = err
+					continue
+				}
+				added += n
+			}
+		}
+
+		return failures, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Int("signatures", added).
+		Int("failures", len(failures)).
+		Msg("Uploaded key signatures")
+
+	return failures, nil
+}
+
+func (a *AccountsDatabase) txnUploadKeySignatures(
+	txn fdb.Transaction,
+	userID, targetUserID id.UserID,
+	targetKey string,
+	signedKey []byte,
+) (int, error) {
+	var storedKey []byte
+	// Signer key ID -> public key of the keys allowed to sign the target
+	signers := make(map[string]ed25519.PublicKey)
+
+	if targetUserID == userID {
+		deviceKeys, err := a.devices.TxnGetDeviceKeys(txn, userID, id.DeviceID(targetKey))
+		if err != nil {
+			return 0, err
+		}
+
+		if deviceKeys != nil {
+			storedKey = deviceKeys
+			selfSigningKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageSelfSigning)
+			if err != nil {
+				return 0, err
+			} else if selfSigningKey != nil {
+				signers[selfSigningKey.keyID] = selfSigningKey.publicKey
+			}
+		} else {
+			masterKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageMaster)
+			if err != nil {
+				return 0, err
+			} else if masterKey == nil || masterKey.publicKeyB64 != targetKey {
+				return 0, fmt.Errorf("%w: %s", types.ErrKeyNotFound, targetKey)
+			}
+			storedKey = masterKey.raw
+
+			allDeviceKeys, err := a.devices.TxnLookupUserDeviceKeys(txn, userID)
+			if err != nil {
+				return 0, err
+			}
+			for deviceID, b := range allDeviceKeys {
+				var keys mautrix.DeviceKeys
+				if err := json.Unmarshal(b, &keys); err != nil {
+					continue
+				}
+				publicKey, err := util.Base64Decode(keys.Keys.GetEd25519(deviceID).String())
+				if err != nil || len(publicKey) != ed25519.PublicKeySize {
+					continue
+				}
+				signers[id.NewDeviceKeyID(id.KeyAlgorithmEd25519, deviceID).String()] = publicKey
+			}
+		}
+	} else {
+		masterKey, err := a.txnGetCrossSigningKey(txn, targetUserID, id.XSUsageMaster)
+		if err != nil {
+			return 0, err
+		} else if masterKey == nil || masterKey.publicKeyB64 != targetKey {
+			return 0, fmt.Errorf("%w: %s", types.ErrKeyNotFound, targetKey)
+		}
+		storedKey = masterKey.raw
+
+		userSigningKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageUserSigning)
+		if err != nil {
+			return 0, err
+		} else if userSigningKey != nil {
+			signers[userSigningKey.keyID] = userSigningKey.publicKey
+		}
+	}
+
+	// The signed object must be exactly the key we have stored, minus signatures/unsigned
+	storedSignable, err := util.GetJSONSignableBytes(storedKey)
+	if err != nil {
+		return 0, err
+	}
+	signable, err := util.GetJSONSignableBytes(signedKey)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrInvalidSignature, err)
+	} else if !bytes.Equal(storedSignable, signable) {
+		return 0, fmt.Errorf("%w: signed object does not match stored key", types.ErrInvalidSignature)
+	}
+
+	extract := struct {
+		Signatures map[id.UserID]map[id.KeyID]string `json:"signatures"`
+	}{}
+	if err := json.Unmarshal(signedKey, &extract); err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrInvalidSignature, err)
+	}
+
+	var added int
+	for keyID, signature := range extract.Signatures[userID] {
+		publicKey, found := signers[keyID.String()]
+		if !found {
+			// Ignore signatures from keys we don't know, the client may include existing ones
+			continue
+		}
+		if err := util.VerifyJSON(signedKey, userID.String(), keyID.String(), publicKey); err != nil {
+			return 0, fmt.Errorf("%w: %w", types.ErrInvalidSignature, err)
+		}
+		a.users.TxnAddKeySignature(txn, targetUserID, targetKey, userID, keyID, signature)
+		added++
+	}
+
+	if added == 0 {
+		return 0, fmt.Errorf("%w: no valid signatures", types.ErrInvalidSignature)
+	}
+
+	return added, nil
+}
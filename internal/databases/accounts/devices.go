@@ -0,0 +1,83 @@
+package accounts
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func (a *AccountsDatabase) GetUserDevices(ctx context.Context, userID id.UserID) ([]*types.Device, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]*types.Device, error) {
+		return a.devices.TxnLookupUserDevices(txn, userID)
+	})
+}
+
+func (a *AccountsDatabase) GetUserDevice(ctx context.Context, userID id.UserID, deviceID id.DeviceID) (*types.Device, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*types.Device, error) {
+		if device, err := a.devices.TxnGetDevice(txn, userID, deviceID); err != nil {
+			return nil, err
+		} else if device == nil {
+			return nil, types.ErrDeviceNotFound
+		} else {
+			return device, nil
+		}
+	})
+}
+
+func (a *AccountsDatabase) UpdateUserDeviceDisplayName(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	displayName string,
+) error {
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		device, err := a.devices.TxnGetDevice(txn, userID, deviceID)
+		if err != nil {
+			return nil, err
+		} else if device == nil {
+			return nil, types.ErrDeviceNotFound
+		}
+		device.DisplayName = displayName
+		a.devices.TxnSetDevice(txn, userID, device)
+		return nil, nil
+	})
+	return err
+}
+
+// Delete devices along with their access/refresh tokens, E2EE keys, any signatures of the device
+// keys and lazy loaded members sent to them. Devices that don't exist are ignored.
+func (a *AccountsDatabase) DeleteUserDevices(ctx context.Context, userID id.UserID, deviceIDs []id.DeviceID) error {
+	log := a.getTxnLogContext(ctx, "DeleteUserDevices").
+		Str("user_id", userID.String()).
+		Logger()
+
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		for _, deviceID := range deviceIDs {
+			if err := a.txnDeleteUserDevice(txn, userID, deviceID); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Int("devices", len(deviceIDs)).Msg("Deleted user devices")
+
+	return nil
+}
+
+func (a *AccountsDatabase) txnDeleteUserDevice(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) error {
+	if err := a.tokens.TxnClearUserDeviceTokens(txn, userID, deviceID); err != nil {
+		return err
+	}
+	a.devices.TxnDeleteDevice(txn, userID, deviceID)
+	a.users.TxnClearKeySignatures(txn, userID, deviceID.String())
+	a.lazyMembers.TxnClearDeviceSentMembers(txn, userID, deviceID)
+	return nil
+}
@@ -42,8 +42,8 @@ func NewDevicesDirectory(logger zerolog.Logger, db fdb.Database, parentDir direc
 		byUserDeviceID:         devicesDir.Sub("udi"), // userID/deviceID -> device msgpack bytes
 		userDeviceLastSeen:     devicesDir.Sub("uds"), // userID/deviceID -> (lastIP, lastSeenTS)
 		userDeviceKeys:         devicesDir.Sub("udk"), // userID/deviceID -> DeviceKeys JSON (CSAPI)
-		userDeviceOneTimeKeys:  devicesDir.Sub("otk"), // userID/deviceID/keyID -> KeyObject JSON (CSAPI)
-		userDeviceFallbackKeys: devicesDir.Sub("otk"), // userID/deviceID -> KeyObject JSON (CSAPI)
+		userDeviceOneTimeKeys:  devicesDir.Sub("otk"), // userID/deviceID/algorithm/keyID -> KeyObject JSON (CSAPI)
+		userDeviceFallbackKeys: devicesDir.Sub("fbk"), // userID/deviceID/algorithm -> (keyID, KeyObject JSON, used)
 	}
 }
 
@@ -55,9 +55,16 @@ func (d *DevicesDirectory) KeyForDeviceLastSeen(userID id.UserID, deviceID id.De
 	return d.userDeviceLastSeen.Pack(tuple.Tuple{userID.String(), deviceID.String()})
 }
 
+func (d *DevicesDirectory) KeyForDeviceKeys(userID id.UserID, deviceID id.DeviceID) fdb.Key {
+	return d.userDeviceKeys.Pack(tuple.Tuple{userID.String(), deviceID.String()})
+}
+
 func (d *DevicesDirectory) TxnDeleteDevice(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) {
 	txn.Clear(d.KeyForDevice(userID, deviceID))
 	txn.Clear(d.KeyForDeviceLastSeen(userID, deviceID))
+	txn.Clear(d.KeyForDeviceKeys(userID, deviceID))
+	txn.ClearRange(d.userDeviceOneTimeKeys.Sub(userID.String(), deviceID.String()))
+	txn.ClearRange(d.userDeviceFallbackKeys.Sub(userID.String(), deviceID.String()))
 }
 
 func (d *DevicesDirectory) TxnGetOrCreateDevice(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID, initialDisplayName string) (*types.Device, error) {
@@ -74,6 +81,20 @@ func (d *DevicesDirectory) TxnGetOrCreateDevice(txn fdb.Transaction, userID id.U
 	}
 }
 
+func (d *DevicesDirectory) TxnGetDevice(txn fdb.ReadTransaction, userID id.UserID, deviceID id.DeviceID) (*types.Device, error) {
+	if kv, err := txn.Get(d.KeyForDevice(userID, deviceID)).Get(); err != nil {
+		return nil, err
+	} else if kv == nil {
+		return nil, nil
+	} else {
+		return types.NewDeviceFromBytes(kv, deviceID)
+	}
+}
+
+func (d *DevicesDirectory) TxnSetDevice(txn fdb.Transaction, userID id.UserID, device *types.Device) {
+	txn.Set(d.KeyForDevice(userID, device.ID), device.ToMsgpack())
+}
+
 func (d *DevicesDirectory) TxnSetDeviceLastSeen(
 	txn fdb.Transaction,
 	userID id.UserID,
@@ -85,3 +106,30 @@ func (d *DevicesDirectory) TxnSetDeviceLastSeen(
 	value := tuple.Tuple{ip, time}.Pack()
 	txn.Set(key, value)
 }
+
+func (d *DevicesDirectory) TxnLookupUserDevices(txn fdb.ReadTransaction, userID id.UserID) ([]*types.Device, error) {
+	iter := txn.GetRange(
+		d.byUserDeviceID.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	devices := make([]*types.Device, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := d.byUserDeviceID.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		device, err := types.NewDeviceFromBytes(kv.Value, id.DeviceID(keyTup[1].(string)))
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
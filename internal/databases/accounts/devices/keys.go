@@ -0,0 +1,198 @@
+package devices
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+)
+
+// Device, one-time & fallback keys are stored as the raw JSON uploaded by the client, we never
+// modify these since they are signed by the device.
+
+func (d *DevicesDirectory) TxnSetDeviceKeys(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID, keys []byte) {
+	txn.Set(d.KeyForDeviceKeys(userID, deviceID), keys)
+}
+
+func (d *DevicesDirectory) TxnGetDeviceKeys(txn fdb.ReadTransaction, userID id.UserID, deviceID id.DeviceID) ([]byte, error) {
+	return txn.Get(d.KeyForDeviceKeys(userID, deviceID)).Get()
+}
+
+func (d *DevicesDirectory) TxnLookupUserDeviceKeys(txn fdb.ReadTransaction, userID id.UserID) (map[id.DeviceID][]byte, error) {
+	iter := txn.GetRange(
+		d.userDeviceKeys.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	keys := make(map[id.DeviceID][]byte)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := d.userDeviceKeys.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys[id.DeviceID(keyTup[1].(string))] = kv.Value
+	}
+
+	return keys, nil
+}
+
+func (d *DevicesDirectory) KeyForOneTimeKey(userID id.UserID, deviceID id.DeviceID, keyID id.KeyID) fdb.Key {
+	algorithm, name := keyID.Parse()
+	return d.userDeviceOneTimeKeys.Pack(tuple.Tuple{userID.String(), deviceID.String(), string(algorithm), name})
+}
+
+// Add a one-time key, existing keys are left as-is, returns true if the key was added
+func (d *DevicesDirectory) TxnAddOneTimeKey(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	keyID id.KeyID,
+	key []byte,
+) (bool, error) {
+	otkKey := d.KeyForOneTimeKey(userID, deviceID, keyID)
+	if existing, err := txn.Get(otkKey).Get(); err != nil {
+		return false, err
+	} else if existing != nil {
+		return false, nil
+	}
+	txn.Set(otkKey, key)
+	return true, nil
+}
+
+func (d *DevicesDirectory) TxnCountOneTimeKeys(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+) (map[id.KeyAlgorithm]int, error) {
+	iter := txn.GetRange(
+		d.userDeviceOneTimeKeys.Sub(userID.String(), deviceID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	counts := make(map[id.KeyAlgorithm]int)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := d.userDeviceOneTimeKeys.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		counts[id.KeyAlgorithm(keyTup[2].(string))]++
+	}
+
+	return counts, nil
+}
+
+// Claim (remove and return) a single one-time key for the algorithm, returns an empty key ID if
+// there are none left.
+func (d *DevicesDirectory) TxnClaimOneTimeKey(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	algorithm id.KeyAlgorithm,
+) (id.KeyID, []byte, error) {
+	kvs, err := txn.GetRange(
+		d.userDeviceOneTimeKeys.Sub(userID.String(), deviceID.String(), string(algorithm)),
+		fdb.RangeOptions{Limit: 1},
+	).GetSliceWithError()
+	if err != nil {
+		return "", nil, err
+	} else if len(kvs) == 0 {
+		return "", nil, nil
+	}
+
+	keyTup, err := d.userDeviceOneTimeKeys.Unpack(kvs[0].Key)
+	if err != nil {
+		return "", nil, err
+	}
+	txn.Clear(kvs[0].Key)
+
+	return id.NewKeyID(algorithm, keyTup[3].(string)), kvs[0].Value, nil
+}
+
+func (d *DevicesDirectory) KeyForFallbackKey(userID id.UserID, deviceID id.DeviceID, algorithm id.KeyAlgorithm) fdb.Key {
+	return d.userDeviceFallbackKeys.Pack(tuple.Tuple{userID.String(), deviceID.String(), string(algorithm)})
+}
+
+// Set the fallback key for an algorithm, replacing any previous one
+func (d *DevicesDirectory) TxnSetFallbackKey(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	keyID id.KeyID,
+	key []byte,
+) {
+	algorithm, _ := keyID.Parse()
+	value := tuple.Tuple{string(keyID), key, false}.Pack()
+	txn.Set(d.KeyForFallbackKey(userID, deviceID, algorithm), value)
+}
+
+// Claim the fallback key for an algorithm, unlike one-time keys these are not removed but marked
+// as used. Returns an empty key ID if there is no fallback key.
+func (d *DevicesDirectory) TxnClaimFallbackKey(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	algorithm id.KeyAlgorithm,
+) (id.KeyID, []byte, error) {
+	fbkKey := d.KeyForFallbackKey(userID, deviceID, algorithm)
+	b, err := txn.Get(fbkKey).Get()
+	if err != nil {
+		return "", nil, err
+	} else if b == nil {
+		return "", nil, nil
+	}
+
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return "", nil, err
+	}
+	keyID, key := id.KeyID(tup[0].(string)), tup[1].([]byte)
+
+	if used := tup[2].(bool); !used {
+		txn.Set(fbkKey, tuple.Tuple{string(keyID), key, true}.Pack())
+	}
+
+	return keyID, key, nil
+}
+
+func (d *DevicesDirectory) TxnLookupUnusedFallbackKeyAlgorithms(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+) ([]id.KeyAlgorithm, error) {
+	iter := txn.GetRange(
+		d.userDeviceFallbackKeys.Sub(userID.String(), deviceID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	algorithms := make([]id.KeyAlgorithm, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		tup, err := tuple.Unpack(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		if used := tup[2].(bool); used {
+			continue
+		}
+		keyTup, err := d.userDeviceFallbackKeys.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, id.KeyAlgorithm(keyTup[2].(string)))
+	}
+
+	return algorithms, nil
+}
@@ -0,0 +1,41 @@
+package accounts
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func (a *AccountsDatabase) CreateFilter(ctx context.Context, userID id.UserID, filterJSON []byte) (string, error) {
+	log := a.getTxnLogContext(ctx, "CreateFilter").
+		Str("user_id", userID.String()).
+		Logger()
+
+	filterID, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (string, error) {
+		return a.filters.TxnCreateFilter(txn, userID, filterJSON)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug().Str("filter_id", filterID).Msg("Created filter")
+
+	return filterID, nil
+}
+
+// Returns the filter JSON as uploaded
+func (a *AccountsDatabase) GetFilter(ctx context.Context, userID id.UserID, filterID string) ([]byte, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]byte, error) {
+		filterJSON, err := a.filters.TxnGetFilter(txn, userID, filterID)
+		if err != nil {
+			return nil, err
+		} else if filterJSON == nil {
+			return nil, types.ErrFilterNotFound
+		}
+		return filterJSON, nil
+	})
+}
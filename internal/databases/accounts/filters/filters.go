@@ -0,0 +1,81 @@
+package filters
+
+import (
+	"strconv"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// Sync filters uploaded by users, stored as the JSON provided
+// https://spec.matrix.org/v1.11/client-server-api/#filtering
+type FiltersDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserID subspace.Subspace
+}
+
+func NewFiltersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *FiltersDirectory {
+	filtersDir, err := parentDir.CreateOrOpen(db, []string{"filters"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "filters").Logger()
+	log.Debug().
+		Bytes("prefix", filtersDir.Bytes()).
+		Msg("Init accounts/filters directory")
+
+	return &FiltersDirectory{
+		log: log,
+		db:  db,
+
+		byUserID: filtersDir.Sub("ui"), // userID/filterID -> filter JSON
+	}
+}
+
+// Filter IDs are opaque strings to clients, internally we use incrementing integers
+func parseFilterID(filterID string) (int64, bool) {
+	v, err := strconv.ParseInt(filterID, 10, 64)
+	return v, err == nil && v > 0
+}
+
+func (f *FiltersDirectory) KeyForFilter(userID id.UserID, filterID int64) fdb.Key {
+	return f.byUserID.Pack(tuple.Tuple{userID.String(), filterID})
+}
+
+func (f *FiltersDirectory) TxnGetFilter(txn fdb.ReadTransaction, userID id.UserID, filterID string) ([]byte, error) {
+	v, ok := parseFilterID(filterID)
+	if !ok {
+		return nil, nil
+	}
+	return txn.Get(f.KeyForFilter(userID, v)).Get()
+}
+
+// Store a new filter, returning the filter ID
+func (f *FiltersDirectory) TxnCreateFilter(txn fdb.Transaction, userID id.UserID, filterJSON []byte) (string, error) {
+	// Filters are never deleted so the next ID is always the last plus one
+	var lastFilterID int64
+	kvs, err := txn.GetRange(
+		f.byUserID.Sub(userID.String()),
+		fdb.RangeOptions{Limit: 1, Reverse: true},
+	).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 1 {
+		keyTup, err := f.byUserID.Unpack(kvs[0].Key)
+		if err != nil {
+			return "", err
+		}
+		lastFilterID = keyTup[1].(int64)
+	}
+
+	filterID := lastFilterID + 1
+	txn.Set(f.KeyForFilter(userID, filterID), filterJSON)
+	return strconv.FormatInt(filterID, 10), nil
+}
@@ -0,0 +1,208 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/tidwall/sjson"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func (a *AccountsDatabase) UploadKeys(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	deviceKeys []byte,
+	oneTimeKeys map[id.KeyID][]byte,
+	fallbackKeys map[id.KeyID][]byte,
+) (map[id.KeyAlgorithm]int, error) {
+	log := a.getTxnLogContext(ctx, "UploadKeys").
+		Str("user_id", userID.String()).
+		Str("device_id", deviceID.String()).
+		Logger()
+
+	var added int
+
+	counts, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (map[id.KeyAlgorithm]int, error) {
+		added = 0
+
+		if deviceKeys != nil {
+			a.devices.TxnSetDeviceKeys(txn, userID, deviceID, deviceKeys)
+		}
+		for keyID, key := range oneTimeKeys {
+			if ok, err := a.devices.TxnAddOneTimeKey(txn, userID, deviceID, keyID, key); err != nil {
+				return nil, err
+			} else if ok {
+				added++
+			}
+		}
+		for keyID, key := range fallbackKeys {
+			a.devices.TxnSetFallbackKey(txn, userID, deviceID, keyID, key)
+		}
+
+		return a.devices.TxnCountOneTimeKeys(txn, userID, deviceID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Bool("device_keys", deviceKeys != nil).
+		Int("one_time_keys", added).
+		Int("fallback_keys", len(fallbackKeys)).
+		Msg("Uploaded keys")
+
+	return counts, nil
+}
+
+type QueryKeysResults struct {
+	DeviceKeys      map[id.UserID]map[id.DeviceID]json.RawMessage
+	MasterKeys      map[id.UserID]json.RawMessage
+	SelfSigningKeys map[id.UserID]json.RawMessage
+	UserSigningKeys map[id.UserID]json.RawMessage
+}
+
+// Query device & cross-signing keys for users, an empty device list returns keys for all of the
+// users devices. The user-signing key is only ever returned for the requesting user.
+func (a *AccountsDatabase) QueryKeys(
+	ctx context.Context,
+	requesterID id.UserID,
+	query map[id.UserID][]id.DeviceID,
+) (*QueryKeysResults, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*QueryKeysResults, error) {
+		results := &QueryKeysResults{
+			DeviceKeys:      make(map[id.UserID]map[id.DeviceID]json.RawMessage, len(query)),
+			MasterKeys:      make(map[id.UserID]json.RawMessage),
+			SelfSigningKeys: make(map[id.UserID]json.RawMessage),
+			UserSigningKeys: make(map[id.UserID]json.RawMessage),
+		}
+
+		for userID, deviceIDs := range query {
+			devices, err := a.devices.TxnLookupUserDevices(txn, userID)
+			if err != nil {
+				return nil, err
+			}
+			displayNames := make(map[id.DeviceID]string, len(devices))
+			for _, device := range devices {
+				displayNames[device.ID] = device.DisplayName
+			}
+
+			var deviceKeys map[id.DeviceID][]byte
+			if len(deviceIDs) == 0 {
+				deviceKeys, err = a.devices.TxnLookupUserDeviceKeys(txn, userID)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				deviceKeys = make(map[id.DeviceID][]byte, len(deviceIDs))
+				for _, deviceID := range deviceIDs {
+					if keys, err := a.devices.TxnGetDeviceKeys(txn, userID, deviceID); err != nil {
+						return nil, err
+					} else if keys != nil {
+						deviceKeys[deviceID] = keys
+					}
+				}
+			}
+
+			userResults := make(map[id.DeviceID]json.RawMessage, len(deviceKeys))
+			for deviceID, keys := range deviceKeys {
+				// Unsigned data is excluded from the signature so we can safely add the name here
+				if displayName := displayNames[deviceID]; displayName != "" {
+					if keys, err = sjson.SetBytes(keys, "unsigned.device_display_name", displayName); err != nil {
+						return nil, err
+					}
+				}
+				// Device keys are only ever signed by the owners self-signing key
+				if keys, err = a.txnMergeKeySignatures(txn, keys, userID, deviceID.String(), userID); err != nil {
+					return nil, err
+				}
+				userResults[deviceID] = keys
+			}
+			results.DeviceKeys[userID] = userResults
+
+			// Master keys include signatures from the owners devices and the requesters user-signing key
+			if masterKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageMaster); err != nil {
+				return nil, err
+			} else if masterKey != nil {
+				b, err := a.txnMergeKeySignatures(txn, masterKey.raw, userID, masterKey.publicKeyB64, userID, requesterID)
+				if err != nil {
+					return nil, err
+				}
+				results.MasterKeys[userID] = b
+			}
+			if selfSigningKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageSelfSigning); err != nil {
+				return nil, err
+			} else if selfSigningKey != nil {
+				results.SelfSigningKeys[userID] = selfSigningKey.raw
+			}
+			if userID == requesterID {
+				if userSigningKey, err := a.txnGetCrossSigningKey(txn, userID, id.XSUsageUserSigning); err != nil {
+					return nil, err
+				} else if userSigningKey != nil {
+					results.UserSigningKeys[userID] = userSigningKey.raw
+				}
+			}
+		}
+
+		return results, nil
+	})
+}
+
+// Claim one-time keys for devices, falling back to the fallback key if a device has no one-time
+// keys left for the algorithm.
+func (a *AccountsDatabase) ClaimKeys(
+	ctx context.Context,
+	claims map[id.UserID]map[id.DeviceID]id.KeyAlgorithm,
+) (map[id.UserID]map[id.DeviceID]map[id.KeyID]json.RawMessage, error) {
+	return util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (map[id.UserID]map[id.DeviceID]map[id.KeyID]json.RawMessage, error) {
+		results := make(map[id.UserID]map[id.DeviceID]map[id.KeyID]json.RawMessage, len(claims))
+
+		for userID, devices := range claims {
+			userResults := make(map[id.DeviceID]map[id.KeyID]json.RawMessage, len(devices))
+
+			for deviceID, algorithm := range devices {
+				keyID, key, err := a.devices.TxnClaimOneTimeKey(txn, userID, deviceID, algorithm)
+				if err != nil {
+					return nil, err
+				} else if keyID == "" {
+					keyID, key, err = a.devices.TxnClaimFallbackKey(txn, userID, deviceID, algorithm)
+					if err != nil {
+						return nil, err
+					} else if keyID == "" {
+						continue
+					}
+				}
+				userResults[deviceID] = map[id.KeyID]json.RawMessage{keyID: key}
+			}
+
+			results[userID] = userResults
+		}
+
+		return results, nil
+	})
+}
+
+func (a *AccountsDatabase) GetDeviceKeyCounts(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+) (map[id.KeyAlgorithm]int, []id.KeyAlgorithm, error) {
+	var unusedFallbackAlgorithms []id.KeyAlgorithm
+
+	counts, err := util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (map[id.KeyAlgorithm]int, error) {
+		counts, err := a.devices.TxnCountOneTimeKeys(txn, userID, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		unusedFallbackAlgorithms, err = a.devices.TxnLookupUnusedFallbackKeyAlgorithms(txn, userID, deviceID)
+		return counts, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return counts, unusedFallbackAlgorithms, nil
+}
@@ -0,0 +1,65 @@
+package accounts
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Returns the members in each room whose member events have not yet been sent to the device
+func (a *AccountsDatabase) FilterUnsentRoomMembers(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	roomMembers map[id.RoomID][]id.UserID,
+) (map[id.RoomID][]id.UserID, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (map[id.RoomID][]id.UserID, error) {
+		unsent := make(map[id.RoomID][]id.UserID, len(roomMembers))
+		for roomID, memberIDs := range roomMembers {
+			unsentMemberIDs, err := a.lazyMembers.TxnFilterUnsentMembers(txn, userID, deviceID, roomID, memberIDs)
+			if err != nil {
+				return nil, err
+			} else if len(unsentMemberIDs) > 0 {
+				unsent[roomID] = unsentMemberIDs
+			}
+		}
+		return unsent, nil
+	})
+}
+
+// Record the members in each room whose member events have been sent to the device
+func (a *AccountsDatabase) SetSentRoomMembers(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	roomMembers map[id.RoomID][]id.UserID,
+) error {
+	log := a.getTxnLogContext(ctx, "SetSentRoomMembers").
+		Str("user_id", userID.String()).
+		Str("device_id", deviceID.String()).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		for roomID, memberIDs := range roomMembers {
+			a.lazyMembers.TxnSetSentMembers(txn, userID, deviceID, roomID, memberIDs)
+		}
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+
+	log.Debug().Int("rooms", len(roomMembers)).Msg("Set sent room members")
+	return nil
+}
+
+// Forget all members sent to the device, used when the device starts a new initial sync
+func (a *AccountsDatabase) ClearSentRoomMembers(ctx context.Context, userID id.UserID, deviceID id.DeviceID) error {
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		a.lazyMembers.TxnClearDeviceSentMembers(txn, userID, deviceID)
+		return nil, nil
+	})
+	return err
+}
@@ -0,0 +1,83 @@
+package lazymembers
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// Tracks which room member events have been sent to each device when lazy loading members in sync
+// https://spec.matrix.org/v1.11/client-server-api/#lazy-loading-room-members
+type LazyMembersDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserDeviceRoomMember subspace.Subspace
+}
+
+func NewLazyMembersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *LazyMembersDirectory {
+	lazyMembersDir, err := parentDir.CreateOrOpen(db, []string{"lazymembers"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "lazymembers").Logger()
+	log.Debug().
+		Bytes("prefix", lazyMembersDir.Bytes()).
+		Msg("Init accounts/lazymembers directory")
+
+	return &LazyMembersDirectory{
+		log: log,
+		db:  db,
+
+		byUserDeviceRoomMember: lazyMembersDir.Sub("udrm"), // userID/deviceID/roomID/memberID -> ''
+	}
+}
+
+func (l *LazyMembersDirectory) KeyForSentMember(userID id.UserID, deviceID id.DeviceID, roomID id.RoomID, memberID id.UserID) fdb.Key {
+	return l.byUserDeviceRoomMember.Pack(tuple.Tuple{userID.String(), deviceID.String(), roomID.String(), memberID.String()})
+}
+
+// Returns the member IDs that have not already been sent to the device
+func (l *LazyMembersDirectory) TxnFilterUnsentMembers(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	roomID id.RoomID,
+	memberIDs []id.UserID,
+) ([]id.UserID, error) {
+	futs := make([]fdb.FutureByteSlice, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		futs = append(futs, txn.Get(l.KeyForSentMember(userID, deviceID, roomID, memberID)))
+	}
+
+	unsentMemberIDs := make([]id.UserID, 0, len(memberIDs))
+	for i, fut := range futs {
+		b, err := fut.Get()
+		if err != nil {
+			return nil, err
+		} else if b == nil {
+			unsentMemberIDs = append(unsentMemberIDs, memberIDs[i])
+		}
+	}
+	return unsentMemberIDs, nil
+}
+
+func (l *LazyMembersDirectory) TxnSetSentMembers(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	roomID id.RoomID,
+	memberIDs []id.UserID,
+) {
+	for _, memberID := range memberIDs {
+		txn.Set(l.KeyForSentMember(userID, deviceID, roomID, memberID), nil)
+	}
+}
+
+func (l *LazyMembersDirectory) TxnClearDeviceSentMembers(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) {
+	txn.ClearRange(l.byUserDeviceRoomMember.Sub(userID.String(), deviceID.String()))
+}
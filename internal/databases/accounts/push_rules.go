@@ -0,0 +1,127 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Push rules are stored as m.push_rules global account data so changes are synced like any other
+// account data, users who have never changed their rules get the server-default rules.
+// https://spec.matrix.org/v1.11/client-server-api/#push-rules
+
+func defaultPushRulesAccountDataEvent(userID id.UserID) *types.AccountDataEvent {
+	content, err := json.Marshal(types.PushRulesContent{Global: types.DefaultPushRuleset(userID)})
+	if err != nil {
+		panic(err)
+	}
+	return &types.AccountDataEvent{
+		Type:    event.AccountDataPushRules.Type,
+		Content: content,
+	}
+}
+
+func (a *AccountsDatabase) txnGetPushRules(txn fdb.ReadTransaction, userID id.UserID) (*pushrules.PushRuleset, error) {
+	ev, err := a.accountData.TxnGetAccountData(txn, userID, "", event.AccountDataPushRules.Type)
+	if err != nil {
+		return nil, err
+	}
+	return pushRulesFromAccountData(userID, ev)
+}
+
+func pushRulesFromAccountData(userID id.UserID, ev *types.AccountDataEvent) (*pushrules.PushRuleset, error) {
+	if ev == nil {
+		return types.DefaultPushRuleset(userID), nil
+	}
+
+	var content types.PushRulesContent
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return nil, err
+	} else if content.Global == nil {
+		return types.DefaultPushRuleset(userID), nil
+	}
+	return content.Global, nil
+}
+
+// Returns the users global push ruleset
+func (a *AccountsDatabase) GetPushRules(ctx context.Context, userID id.UserID) (*pushrules.PushRuleset, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*pushrules.PushRuleset, error) {
+		return a.txnGetPushRules(txn, userID)
+	})
+}
+
+// Returns the global push ruleset of each user and which of them have any pushers, read in a
+// single transaction for evaluating an event against every member of a room.
+func (a *AccountsDatabase) GetPushRulesAndHasPushers(
+	ctx context.Context,
+	userIDs []id.UserID,
+) (map[id.UserID]*pushrules.PushRuleset, map[id.UserID]bool, error) {
+	var hasPushers map[id.UserID]bool
+
+	rulesets, err := util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (map[id.UserID]*pushrules.PushRuleset, error) {
+		evs, err := a.accountData.TxnGetUsersAccountData(txn, userIDs, "", event.AccountDataPushRules.Type)
+		if err != nil {
+			return nil, err
+		}
+		pusherUserIDs, err := a.pushers.TxnFilterUsersWithPushers(txn, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		hasPushers = make(map[id.UserID]bool, len(pusherUserIDs))
+		for _, userID := range pusherUserIDs {
+			hasPushers[userID] = true
+		}
+
+		rulesets := make(map[id.UserID]*pushrules.PushRuleset, len(userIDs))
+		for _, userID := range userIDs {
+			if rulesets[userID], err = pushRulesFromAccountData(userID, evs[userID]); err != nil {
+				return nil, err
+			}
+		}
+		return rulesets, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rulesets, hasPushers, nil
+}
+
+// Modify the users global push ruleset, any error returned by the update function aborts the change
+func (a *AccountsDatabase) UpdatePushRules(
+	ctx context.Context,
+	userID id.UserID,
+	update func(*pushrules.PushRuleset) error,
+) error {
+	log := a.getTxnLogContext(ctx, "UpdatePushRules").
+		Str("user_id", userID.String()).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		rs, err := a.txnGetPushRules(txn, userID)
+		if err != nil {
+			return nil, err
+		} else if err := update(rs); err != nil {
+			return nil, err
+		}
+		content, err := json.Marshal(types.PushRulesContent{Global: rs})
+		if err != nil {
+			return nil, err
+		}
+		return nil, a.accountData.TxnSetAccountData(txn, userID, "", event.AccountDataPushRules.Type, content, 0)
+	}); err != nil {
+		return err
+	}
+
+	a.notifiers.Accounts.SendChange(notifier.Change{UserIDs: []id.UserID{userID}})
+	log.Debug().Msg("Updated push rules")
+
+	return nil
+}
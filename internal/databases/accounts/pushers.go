@@ -0,0 +1,72 @@
+package accounts
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func (a *AccountsDatabase) GetPushers(ctx context.Context, userID id.UserID) ([]*types.Pusher, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) ([]*types.Pusher, error) {
+		return a.pushers.TxnLookupUserPushers(txn, userID)
+	})
+}
+
+// Create or replace a pusher, unless appending any pushers with the same app ID & pushkey
+// belonging to other users are deleted.
+func (a *AccountsDatabase) SetPusher(ctx context.Context, userID id.UserID, pusher *types.Pusher, appendPusher bool) error {
+	log := a.getTxnLogContext(ctx, "SetPusher").
+		Str("user_id", userID.String()).
+		Str("app_id", pusher.AppID).
+		Logger()
+
+	pusher.PushkeyTS = time.Now().Unix()
+
+	deleted, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (int, error) {
+		var deleted int
+		if !appendPusher {
+			userIDs, err := a.pushers.TxnLookupPushkeyUserIDs(txn, pusher.AppID, pusher.Pushkey)
+			if err != nil {
+				return 0, err
+			}
+			for _, otherUserID := range userIDs {
+				if otherUserID != userID {
+					a.pushers.TxnDeletePusher(txn, otherUserID, pusher.AppID, pusher.Pushkey)
+					deleted++
+				}
+			}
+		}
+		a.pushers.TxnSetPusher(txn, userID, pusher)
+		return deleted, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Int("deleted_other_pushers", deleted).Msg("Set pusher")
+
+	return nil
+}
+
+func (a *AccountsDatabase) DeletePusher(ctx context.Context, userID id.UserID, appID, pushkey string) error {
+	log := a.getTxnLogContext(ctx, "DeletePusher").
+		Str("user_id", userID.String()).
+		Str("app_id", appID).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		a.pushers.TxnDeletePusher(txn, userID, appID, pushkey)
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+
+	log.Debug().Msg("Deleted pusher")
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package pushers
+
+import (
+	"bytes"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Pushers registered by users to receive notifications via a push gateway
+// https://spec.matrix.org/v1.11/client-server-api/#push-notifications
+type PushersDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserAppPushkey,
+	byAppPushkeyUser subspace.Subspace
+}
+
+func NewPushersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *PushersDirectory {
+	pushersDir, err := parentDir.CreateOrOpen(db, []string{"pushers"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "pushers").Logger()
+	log.Debug().
+		Bytes("prefix", pushersDir.Bytes()).
+		Msg("Init accounts/pushers directory")
+
+	return &PushersDirectory{
+		log: log,
+		db:  db,
+
+		byUserAppPushkey: pushersDir.Sub("uap"), // userID/appID/pushkey -> pusher msgpack bytes
+		byAppPushkeyUser: pushersDir.Sub("apu"), // appID/pushkey/userID -> ''
+	}
+}
+
+func (p *PushersDirectory) KeyForPusher(userID id.UserID, appID, pushkey string) fdb.Key {
+	return p.byUserAppPushkey.Pack(tuple.Tuple{userID.String(), appID, pushkey})
+}
+
+func (p *PushersDirectory) TxnLookupUserPushers(txn fdb.ReadTransaction, userID id.UserID) ([]*types.Pusher, error) {
+	iter := txn.GetRange(
+		p.byUserAppPushkey.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	pushers := make([]*types.Pusher, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		pusher, err := types.NewPusherFromBytes(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+
+	return pushers, nil
+}
+
+// Returns the subset of users with at least one pusher, the reads are issued concurrently
+func (p *PushersDirectory) TxnFilterUsersWithPushers(txn fdb.ReadTransaction, userIDs []id.UserID) ([]id.UserID, error) {
+	prefixes := make([]fdb.Key, 0, len(userIDs))
+	futures := make([]fdb.FutureKey, 0, len(userIDs))
+	for _, userID := range userIDs {
+		prefix := p.byUserAppPushkey.Sub(userID.String()).FDBKey()
+		prefixes = append(prefixes, prefix)
+		futures = append(futures, txn.GetKey(fdb.FirstGreaterThan(prefix)))
+	}
+
+	filtered := make([]id.UserID, 0)
+	for i, future := range futures {
+		key, err := future.Get()
+		if err != nil {
+			return nil, err
+		} else if bytes.HasPrefix(key, prefixes[i]) {
+			filtered = append(filtered, userIDs[i])
+		}
+	}
+	return filtered, nil
+}
+
+// Returns the users with a pusher for the app ID & pushkey
+func (p *PushersDirectory) TxnLookupPushkeyUserIDs(txn fdb.ReadTransaction, appID, pushkey string) ([]id.UserID, error) {
+	kvs, err := txn.GetRange(
+		p.byAppPushkeyUser.Sub(appID, pushkey),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]id.UserID, 0, len(kvs))
+	for _, kv := range kvs {
+		keyTup, err := p.byAppPushkeyUser.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(keyTup[2].(string)))
+	}
+	return userIDs, nil
+}
+
+// Set a pusher, replacing any existing pusher for the same user, app ID & pushkey
+func (p *PushersDirectory) TxnSetPusher(txn fdb.Transaction, userID id.UserID, pusher *types.Pusher) {
+	txn.Set(p.KeyForPusher(userID, pusher.AppID, pusher.Pushkey), pusher.ToMsgpack())
+	txn.Set(p.byAppPushkeyUser.Pack(tuple.Tuple{pusher.AppID, pusher.Pushkey, userID.String()}), nil)
+}
+
+func (p *PushersDirectory) TxnDeletePusher(txn fdb.Transaction, userID id.UserID, appID, pushkey string) {
+	txn.Clear(p.KeyForPusher(userID, appID, pushkey))
+	txn.Clear(p.byAppPushkeyUser.Pack(tuple.Tuple{appID, pushkey, userID.String()}))
+}
+
+// Delete all pushers for a user, ie when deactivating their account
+func (p *PushersDirectory) TxnDeleteUserPushers(txn fdb.Transaction, userID id.UserID) error {
+	pushers, err := p.TxnLookupUserPushers(txn, userID)
+	if err != nil {
+		return err
+	}
+	for _, pusher := range pushers {
+		p.TxnDeletePusher(txn, userID, pusher.AppID, pusher.Pushkey)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func (a *AccountsDatabase) CreateRoomKeysBackup(
+	ctx context.Context,
+	userID id.UserID,
+	algorithm id.KeyBackupAlgorithm,
+	authData json.RawMessage,
+) (id.KeyBackupVersion, error) {
+	log := a.getTxnLogContext(ctx, "CreateRoomKeysBackup").
+		Str("user_id", userID.String()).
+		Logger()
+
+	backup, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*types.RoomKeysBackup, error) {
+		return a.backups.TxnCreateBackup(txn, userID, algorithm, authData)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug().Str("version", string(backup.Version)).Msg("Created room keys backup")
+
+	return backup.Version, nil
+}
+
+// Get a backup by version, an empty version returns the latest backup
+func (a *AccountsDatabase) GetRoomKeysBackup(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+) (*types.RoomKeysBackup, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*types.RoomKeysBackup, error) {
+		return a.txnGetRoomKeysBackup(txn, userID, version)
+	})
+}
+
+func (a *AccountsDatabase) txnGetRoomKeysBackup(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+) (*types.RoomKeysBackup, error) {
+	var backup *types.RoomKeysBackup
+	var err error
+	if version == "" {
+		backup, err = a.backups.TxnGetLatestBackup(txn, userID)
+	} else {
+		backup, err = a.backups.TxnGetBackup(txn, userID, version)
+	}
+	if err != nil {
+		return nil, err
+	} else if backup == nil {
+		return nil, types.ErrRoomKeysBackupNotFound
+	}
+	return backup, nil
+}
+
+// Get the latest backup, which must match the given version, for modifying keys
+func (a *AccountsDatabase) txnGetCurrentRoomKeysBackup(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+) (*types.RoomKeysBackup, error) {
+	backup, err := a.txnGetRoomKeysBackup(txn, userID, "")
+	if err != nil {
+		return nil, err
+	} else if backup.Version != version {
+		return nil, types.ErrWrongRoomKeysVersion
+	}
+	return backup, nil
+}
+
+// Update the auth data of a backup, the algorithm cannot be changed
+func (a *AccountsDatabase) UpdateRoomKeysBackup(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	algorithm id.KeyBackupAlgorithm,
+	authData json.RawMessage,
+) error {
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		backup, err := a.txnGetRoomKeysBackup(txn, userID, version)
+		if err != nil {
+			return nil, err
+		} else if backup.Algorithm != algorithm {
+			return nil, types.ErrRoomKeysAlgorithmMismatch
+		}
+		backup.AuthData = authData
+		a.backups.TxnSetBackup(txn, userID, backup)
+		return nil, nil
+	})
+	return err
+}
+
+func (a *AccountsDatabase) DeleteRoomKeysBackup(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+) error {
+	log := a.getTxnLogContext(ctx, "DeleteRoomKeysBackup").
+		Str("user_id", userID.String()).
+		Logger()
+
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		backup, err := a.txnGetRoomKeysBackup(txn, userID, version)
+		if err != nil {
+			return nil, err
+		}
+		a.backups.TxnDeleteBackup(txn, userID, backup)
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("version", string(version)).Msg("Deleted room keys backup")
+
+	return nil
+}
+
+// Upload sessions to a backup, which must be the latest version. Existing sessions are only
+// replaced by better ones, see types.RoomKeyBackupSession.IsBetterThan. Returns the updated backup
+// for the count & etag.
+func (a *AccountsDatabase) PutRoomKeys(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	sessions map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession,
+) (*types.RoomKeysBackup, error) {
+	return util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*types.RoomKeysBackup, error) {
+		backup, err := a.txnGetCurrentRoomKeysBackup(txn, userID, version)
+		if err != nil {
+			return nil, err
+		}
+
+		var changed bool
+		for roomID, roomSessions := range sessions {
+			for sessionID, session := range roomSessions {
+				existing, err := a.backups.TxnGetSession(txn, userID, version, roomID, sessionID)
+				if err != nil {
+					return nil, err
+				} else if existing == nil {
+					backup.Count++
+				} else if !session.IsBetterThan(existing) {
+					continue
+				}
+				a.backups.TxnSetSession(txn, userID, version, roomID, sessionID, session)
+				changed = true
+			}
+		}
+
+		if changed {
+			backup.Etag++
+			a.backups.TxnSetBackup(txn, userID, backup)
+		}
+
+		return backup, nil
+	})
+}
+
+// Get sessions from a backup, optionally limited to a room or room & session
+func (a *AccountsDatabase) GetRoomKeys(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) (map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession, error) {
+		if _, err := a.txnGetRoomKeysBackup(txn, userID, version); err != nil {
+			return nil, err
+		}
+		return a.backups.TxnLookupSessions(txn, userID, version, roomID, sessionID)
+	})
+}
+
+// Delete sessions from a backup, optionally limited to a room or room & session. Returns the
+// updated backup for the count & etag.
+func (a *AccountsDatabase) DeleteRoomKeys(
+	ctx context.Context,
+	userID id.UserID,
+	version id.KeyBackupVersion,
+	roomID id.RoomID,
+	sessionID id.SessionID,
+) (*types.RoomKeysBackup, error) {
+	return util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*types.RoomKeysBackup, error) {
+		backup, err := a.txnGetCurrentRoomKeysBackup(txn, userID, version)
+		if err != nil {
+			return nil, err
+		}
+
+		removed, err := a.backups.TxnClearSessions(txn, userID, version, roomID, sessionID)
+		if err != nil {
+			return nil, err
+		} else if removed > 0 {
+			backup.Count -= removed
+			backup.Etag++
+			a.backups.TxnSetBackup(txn, userID, backup)
+		}
+
+		return backup, nil
+	})
+}
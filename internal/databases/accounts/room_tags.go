@@ -0,0 +1,104 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Room tags are stored as m.tag room account data so changes are synced like any other account data
+// https://spec.matrix.org/v1.11/client-server-api/#room-tagging
+
+type roomTagsContent struct {
+	Tags map[string]json.RawMessage `json:"tags"`
+}
+
+func (a *AccountsDatabase) txnGetRoomTags(txn fdb.ReadTransaction, userID id.UserID, roomID id.RoomID) (map[string]json.RawMessage, error) {
+	content := roomTagsContent{}
+	if ev, err := a.accountData.TxnGetAccountData(txn, userID, roomID, event.AccountDataRoomTags.Type); err != nil {
+		return nil, err
+	} else if ev != nil {
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			return nil, err
+		}
+	}
+	if content.Tags == nil {
+		content.Tags = make(map[string]json.RawMessage)
+	}
+	return content.Tags, nil
+}
+
+// Returns tag -> tag data (ie order) for a room
+func (a *AccountsDatabase) GetRoomTags(ctx context.Context, userID id.UserID, roomID id.RoomID) (map[string]json.RawMessage, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (map[string]json.RawMessage, error) {
+		return a.txnGetRoomTags(txn, userID, roomID)
+	})
+}
+
+// Add or replace a tag on a room
+func (a *AccountsDatabase) SetRoomTag(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	tag string,
+	tagData json.RawMessage,
+) error {
+	return a.updateRoomTags(ctx, "SetRoomTag", userID, roomID, func(tags map[string]json.RawMessage) bool {
+		tags[tag] = tagData
+		return true
+	})
+}
+
+// Remove a tag from a room, removing a tag that doesn't exist is a noop
+func (a *AccountsDatabase) DeleteRoomTag(ctx context.Context, userID id.UserID, roomID id.RoomID, tag string) error {
+	return a.updateRoomTags(ctx, "DeleteRoomTag", userID, roomID, func(tags map[string]json.RawMessage) bool {
+		if _, found := tags[tag]; !found {
+			return false
+		}
+		delete(tags, tag)
+		return true
+	})
+}
+
+func (a *AccountsDatabase) updateRoomTags(
+	ctx context.Context,
+	name string,
+	userID id.UserID,
+	roomID id.RoomID,
+	update func(map[string]json.RawMessage) bool,
+) error {
+	log := a.getTxnLogContext(ctx, name).
+		Str("user_id", userID.String()).
+		Str("room_id", roomID.String()).
+		Logger()
+
+	changed, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (bool, error) {
+		tags, err := a.txnGetRoomTags(txn, userID, roomID)
+		if err != nil {
+			return false, err
+		} else if !update(tags) {
+			return false, nil
+		}
+		content, err := json.Marshal(roomTagsContent{Tags: tags})
+		if err != nil {
+			return false, err
+		}
+		return true, a.accountData.TxnSetAccountData(txn, userID, roomID, event.AccountDataRoomTags.Type, content, 0)
+	})
+	if err != nil {
+		return err
+	} else if !changed {
+		return nil
+	}
+
+	a.notifiers.Accounts.SendChange(notifier.Change{UserIDs: []id.UserID{userID}})
+	log.Debug().Msg("Updated room tags")
+
+	return nil
+}
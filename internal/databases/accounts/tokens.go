@@ -0,0 +1,114 @@
+package accounts
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/beeper/babbleserv/internal/databases/accounts/tokens"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type refreshResp struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMs  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// Exchange a refresh token for a new access & refresh token pair. Refresh tokens are single use,
+// presenting an already used token revokes all tokens for the device since either the client or
+// an attacker holds a stolen token.
+func (a *AccountsDatabase) RefreshTokens(ctx context.Context, refreshToken string) (refreshResp, error) {
+	log := a.getTxnLogContext(ctx, "RefreshTokens").Logger()
+
+	var reused *tokens.RefreshTokenTup
+
+	resp, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (refreshResp, error) {
+		var resp refreshResp
+		reused = nil
+
+		tup, err := a.tokens.TxnGetRefreshTokenTup(txn, refreshToken)
+		if err != nil {
+			return resp, err
+		} else if tup == nil {
+			return resp, types.ErrTokenNotFound
+		} else if tup.Used {
+			// Note: we can't return an error here as that would roll back the revocation
+			reused = tup
+			return resp, a.tokens.TxnClearUserDeviceTokens(txn, tup.UserID, tup.DeviceID)
+		}
+
+		if err := a.tokens.TxnMigrateLegacyUserDeviceTokens(txn, tup.UserID, tup.DeviceID); err != nil {
+			return resp, err
+		}
+
+		// Keep this token (marked used) to detect reuse, but clear any older used tokens
+		if err := a.tokens.TxnClearUserDeviceRefreshTokens(txn, tup.UserID, tup.DeviceID, true); err != nil {
+			return resp, err
+		}
+		a.tokens.TxnMarkRefreshTokenUsed(txn, refreshToken, tup)
+
+		if err := a.tokens.TxnClearUserDeviceAuthTokens(txn, tup.UserID, tup.DeviceID); err != nil {
+			return resp, err
+		}
+
+		expire := a.config.Accounts.RefreshAccessTokenExpire
+		resp.AccessToken = a.tokens.TxnCreateAuthToken(txn, tup.UserID, tup.DeviceID, expire)
+		resp.RefreshToken = a.tokens.TxnCreateRefreshToken(txn, tup.UserID, tup.DeviceID)
+		resp.ExpiresInMs = expire.Milliseconds()
+
+		return resp, nil
+	})
+	if err != nil {
+		return resp, err
+	} else if reused != nil {
+		log.Warn().
+			Str("user_id", reused.UserID.String()).
+			Str("device_id", reused.DeviceID.String()).
+			Msg("Refresh token reused, revoked device tokens")
+		return resp, types.ErrTokenReused
+	}
+
+	return resp, nil
+}
+
+const legacyTokensMigrateBatchSize = 100
+
+// Migrate any plaintext tokens to hashed ones, see tokens/migrate.go. This runs on startup of
+// every instance, which is safe since each batch is a transaction, and stops early when the
+// context is cancelled (on database stop).
+func (a *AccountsDatabase) migrateLegacyTokens(ctx context.Context) {
+	log := a.getTxnLogContext(ctx, "migrateLegacyTokens").Logger()
+
+	var migrated int
+
+	for {
+		n, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (int, error) {
+			userDevices, err := a.tokens.TxnLookupLegacyTokenUserDevices(txn, legacyTokensMigrateBatchSize)
+			if err != nil {
+				return 0, err
+			}
+			for _, userDevice := range userDevices {
+				if err := a.tokens.TxnMigrateLegacyUserDeviceTokens(txn, userDevice.UserID, userDevice.DeviceID); err != nil {
+					return 0, err
+				}
+			}
+			return len(userDevices), nil
+		})
+		if err != nil && ctx.Err() != nil {
+			log.Info().Int("devices", migrated).Msg("Stopped migrating legacy plaintext tokens")
+			return
+		} else if err != nil {
+			log.Err(err).Msg("Failed to migrate legacy tokens")
+			return
+		} else if n == 0 {
+			break
+		}
+		migrated += n
+	}
+
+	if migrated > 0 {
+		log.Info().Int("devices", migrated).Msg("Migrated legacy plaintext tokens")
+	}
+}
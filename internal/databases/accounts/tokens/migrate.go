@@ -0,0 +1,84 @@
+package tokens
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Tokens used to be stored in plaintext in the legacy subspaces, these are migrated to hashed
+// tokens in the background on startup and per device whenever a devices tokens are modified.
+// Lookups fallback to the legacy subspaces until the migration is complete.
+
+type UserDevice struct {
+	UserID   id.UserID
+	DeviceID id.DeviceID
+}
+
+// Returns up to limit user devices with legacy tokens remaining
+func (t *TokensDirectory) TxnLookupLegacyTokenUserDevices(txn fdb.ReadTransaction, limit int) ([]UserDevice, error) {
+	userDevices := make([]UserDevice, 0)
+	seen := make(map[UserDevice]struct{})
+
+	for _, byDeviceID := range []subspace.Subspace{t.legacyAuthTokensByDeviceID, t.legacyRefreshTokensByDeviceID} {
+		kvs, err := txn.GetRange(byDeviceID, fdb.RangeOptions{Limit: limit}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			tup, err := byDeviceID.Unpack(kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			userDevice := UserDevice{id.UserID(tup[0].(string)), id.DeviceID(tup[1].(string))}
+			if _, found := seen[userDevice]; !found {
+				seen[userDevice] = struct{}{}
+				userDevices = append(userDevices, userDevice)
+			}
+		}
+	}
+
+	return userDevices, nil
+}
+
+// Move any plaintext tokens for a device to the hashed subspaces
+func (t *TokensDirectory) TxnMigrateLegacyUserDeviceTokens(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) error {
+	if err := util.TxnIterAllRange(txn, t.legacyAuthTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
+		tup, err := t.legacyAuthTokensByDeviceID.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		token := tup[2].(string)
+		key := t.legacyAuthTokens.Pack(tuple.Tuple{token})
+		if v, err := txn.Get(key).Get(); err != nil {
+			return err
+		} else if v != nil {
+			t.txnSetAuthToken(txn, t.hashToken(token), tokenPrefix(token), v)
+		}
+		txn.Clear(key)
+		txn.Clear(kv.Key)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return util.TxnIterAllRange(txn, t.legacyRefreshTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
+		tup, err := t.legacyRefreshTokensByDeviceID.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		token := tup[2].(string)
+		key := t.legacyRefreshTokens.Pack(tuple.Tuple{token})
+		if v, err := txn.Get(key).Get(); err != nil {
+			return err
+		} else if v != nil {
+			t.txnSetRefreshToken(txn, t.hashToken(token), tokenPrefix(token), v)
+		}
+		txn.Clear(key)
+		txn.Clear(kv.Key)
+		return nil
+	})
+}
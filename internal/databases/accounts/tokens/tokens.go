@@ -1,6 +1,8 @@
 package tokens
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -22,19 +24,41 @@ type AuthTokenTup struct {
 type RefreshTokenTup struct {
 	UserID   id.UserID
 	DeviceID id.DeviceID
+	// Refresh tokens are single use, used tokens are kept to detect reuse
+	Used bool
 }
 
+// Tokens are never stored directly, instead we store a keyed hash (HMAC-SHA256) of each token so
+// read access to the database does not allow impersonating users. The by device indexes store a
+// short prefix of the token for the admin/debug views.
 type TokensDirectory struct {
-	log zerolog.Logger
-	db  fdb.Database
+	log     zerolog.Logger
+	db      fdb.Database
+	hashKey []byte
 
 	authTokens,
 	authTokensByDeviceID,
 	refreshTokens,
 	refreshTokensByDeviceID subspace.Subspace
+
+	// Plaintext tokens stored before hashing, see migrate.go
+	legacyAuthTokens,
+	legacyAuthTokensByDeviceID,
+	legacyRefreshTokens,
+	legacyRefreshTokensByDeviceID subspace.Subspace
 }
 
-func NewTokensDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *TokensDirectory {
+func NewTokensDirectory(
+	logger zerolog.Logger,
+	db fdb.Database,
+	parentDir directory.Directory,
+	hashKey []byte,
+) *TokensDirectory {
+	if len(hashKey) == 0 {
+		// Should never happen, the config loader rejects an empty key
+		panic("missing token hash key")
+	}
+
 	tokensDir, err := parentDir.CreateOrOpen(db, []string{"tokens"}, nil)
 	if err != nil {
 		panic(err)
@@ -46,27 +70,77 @@ func NewTokensDirectory(logger zerolog.Logger, db fdb.Database, parentDir direct
 		Msg("Init accounts/tokens directory")
 
 	return &TokensDirectory{
-		log: log,
-		db:  db,
+		log:     log,
+		db:      db,
+		hashKey: hashKey,
+
+		authTokens:              tokensDir.Sub("ath"),  // tokenHash -> AuthTokenTup
+		authTokensByDeviceID:    tokensDir.Sub("athd"), // userID/deviceID/tokenHash -> token prefix
+		refreshTokens:           tokensDir.Sub("rfh"),  // tokenHash -> RefreshTokenTup (userID, deviceID, used)
+		refreshTokensByDeviceID: tokensDir.Sub("rfhd"), // userID/deviceID/tokenHash -> token prefix
+
+		legacyAuthTokens:              tokensDir.Sub("at"),  // token -> AuthTokenTup
+		legacyAuthTokensByDeviceID:    tokensDir.Sub("atd"), // userID/deviceID/token -> ''
+		legacyRefreshTokens:           tokensDir.Sub("ref"), // token -> RefreshTokenTup
+		legacyRefreshTokensByDeviceID: tokensDir.Sub("rfd"), // userID/deviceID/token -> ''
+	}
+}
 
-		authTokens:              tokensDir.Sub("at"),  // token -> AuthTokenTup
-		authTokensByDeviceID:    tokensDir.Sub("atd"), // userID/deviceID/token -> ''
-		refreshTokens:           tokensDir.Sub("ref"), // token -> RefreshTokenTup
-		refreshTokensByDeviceID: tokensDir.Sub("rfd"), // userID/deviceID/token -> ''
+func (t *TokensDirectory) hashToken(token string) []byte {
+	mac := hmac.New(sha256.New, t.hashKey)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+// Length of the token prefix stored in the by device indexes
+const tokenPrefixLength = 7
+
+func tokenPrefix(token string) []byte {
+	if len(token) <= tokenPrefixLength {
+		return []byte("...")
 	}
+	return []byte(token[:tokenPrefixLength] + "...")
 }
 
 func (t *TokensDirectory) TxnGetAuthTokenTup(txn fdb.ReadTransaction, token string) (*AuthTokenTup, error) {
-	key := t.authTokens.Pack(tuple.Tuple{token})
+	key := t.authTokens.Pack(tuple.Tuple{t.hashToken(token)})
 	v, err := txn.Get(key).Get()
 	if err != nil {
 		return nil, err
 	} else if v == nil {
-		return nil, nil
+		// Fallback to plaintext tokens that have not been migrated yet
+		if v, err = txn.Get(t.legacyAuthTokens.Pack(tuple.Tuple{token})).Get(); err != nil {
+			return nil, err
+		} else if v == nil {
+			return nil, nil
+		}
 	}
 	return valueToAuthTokenTup(v), nil
 }
 
+func (t *TokensDirectory) TxnGetRefreshTokenTup(txn fdb.ReadTransaction, token string) (*RefreshTokenTup, error) {
+	key := t.refreshTokens.Pack(tuple.Tuple{t.hashToken(token)})
+	v, err := txn.Get(key).Get()
+	if err != nil {
+		return nil, err
+	} else if v == nil {
+		// Fallback to plaintext tokens that have not been migrated yet
+		if v, err = txn.Get(t.legacyRefreshTokens.Pack(tuple.Tuple{token})).Get(); err != nil {
+			return nil, err
+		} else if v == nil {
+			return nil, nil
+		}
+	}
+	return valueToRefreshTokenTup(v), nil
+}
+
+// Note: callers must migrate any legacy tokens for the device first (TxnMigrateLegacyUserDeviceTokens)
+func (t *TokensDirectory) TxnMarkRefreshTokenUsed(txn fdb.Transaction, token string, tup *RefreshTokenTup) {
+	key := t.refreshTokens.Pack(tuple.Tuple{t.hashToken(token)})
+	value := tuple.Tuple{tup.UserID.String(), tup.DeviceID.String(), true}.Pack()
+	txn.Set(key, value)
+}
+
 func (t *TokensDirectory) TxnCreateAuthToken(
 	txn fdb.Transaction,
 	userID id.UserID,
@@ -80,16 +154,18 @@ func (t *TokensDirectory) TxnCreateAuthToken(
 		expireTs = time.Now().UTC().Add(expires).UnixMicro()
 	}
 
-	dKey := t.authTokensByDeviceID.Pack(tuple.Tuple{userID.String(), deviceID.String(), token})
-	txn.Set(dKey, nil)
-
-	key := t.authTokens.Pack(tuple.Tuple{token})
-	value := tuple.Tuple{userID.String(), deviceID.String(), expireTs}.Pack()
-	txn.Set(key, value)
+	t.txnSetAuthToken(txn, t.hashToken(token), tokenPrefix(token), tuple.Tuple{userID.String(), deviceID.String(), expireTs}.Pack())
 
 	return token
 }
 
+func (t *TokensDirectory) txnSetAuthToken(txn fdb.Transaction, tokenHash, prefix, value []byte) {
+	tup := valueToAuthTokenTup(value)
+	dKey := t.authTokensByDeviceID.Pack(tuple.Tuple{tup.UserID.String(), tup.DeviceID.String(), tokenHash})
+	txn.Set(dKey, prefix)
+	txn.Set(t.authTokens.Pack(tuple.Tuple{tokenHash}), value)
+}
+
 func (t *TokensDirectory) TxnCreateRefreshToken(
 	txn fdb.Transaction,
 	userID id.UserID,
@@ -97,24 +173,28 @@ func (t *TokensDirectory) TxnCreateRefreshToken(
 ) string {
 	token := util.GenerateRandomString(48)
 
-	dKey := t.refreshTokensByDeviceID.Pack(tuple.Tuple{userID.String(), deviceID.String(), token})
-	txn.Set(dKey, nil)
-
-	key := t.refreshTokens.Pack(tuple.Tuple{token})
-	value := tuple.Tuple{userID.String(), deviceID.String()}.Pack()
-	txn.Set(key, value)
+	t.txnSetRefreshToken(txn, t.hashToken(token), tokenPrefix(token), tuple.Tuple{userID.String(), deviceID.String(), false}.Pack())
 
 	return token
 }
 
+func (t *TokensDirectory) txnSetRefreshToken(txn fdb.Transaction, tokenHash, prefix, value []byte) {
+	tup := valueToRefreshTokenTup(value)
+	dKey := t.refreshTokensByDeviceID.Pack(tuple.Tuple{tup.UserID.String(), tup.DeviceID.String(), tokenHash})
+	txn.Set(dKey, prefix)
+	txn.Set(t.refreshTokens.Pack(tuple.Tuple{tokenHash}), value)
+}
+
 func (t *TokensDirectory) TxnCreateNewTokensForUserDevice(
 	txn fdb.Transaction,
 	userID id.UserID,
 	deviceID id.DeviceID,
 	withRefreshToken bool,
 	accessTokenExpire time.Duration,
-) (string, string) {
-	t.TxnClearUserDeviceTokens(txn, userID, deviceID)
+) (string, string, error) {
+	if err := t.TxnClearUserDeviceTokens(txn, userID, deviceID); err != nil {
+		return "", "", err
+	}
 
 	var expire time.Duration
 	var refreshToken string
@@ -126,7 +206,7 @@ func (t *TokensDirectory) TxnCreateNewTokensForUserDevice(
 
 	accessToken := t.TxnCreateAuthToken(txn, userID, deviceID, expire)
 
-	return accessToken, refreshToken
+	return accessToken, refreshToken, nil
 }
 
 func (t *TokensDirectory) TxnClearUserDeviceTokens(
@@ -134,61 +214,97 @@ func (t *TokensDirectory) TxnClearUserDeviceTokens(
 	userID id.UserID,
 	deviceID id.DeviceID,
 ) error {
-	if err := util.TxnIterAllRange(txn, t.refreshTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
-		txn.Clear(t.refreshTokens.Pack(tuple.Tuple{kv.Value}))
-		txn.Clear(kv.Key)
-		return nil
-	}); err != nil {
+	if err := t.TxnMigrateLegacyUserDeviceTokens(txn, userID, deviceID); err != nil {
 		return err
 	}
+	if err := t.TxnClearUserDeviceRefreshTokens(txn, userID, deviceID, false); err != nil {
+		return err
+	}
+	return t.TxnClearUserDeviceAuthTokens(txn, userID, deviceID)
+}
 
-	if err := util.TxnIterAllRange(txn, t.authTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
-		txn.Clear(t.authTokens.Pack(tuple.Tuple{kv.Value}))
+func (t *TokensDirectory) TxnClearUserDeviceAuthTokens(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+) error {
+	return util.TxnIterAllRange(txn, t.authTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
+		tup, err := t.authTokensByDeviceID.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		txn.Clear(t.authTokens.Pack(tuple.Tuple{tup[2].([]byte)}))
 		txn.Clear(kv.Key)
 		return nil
-	}); err != nil {
-		return err
-	}
+	})
+}
 
-	return nil
+// Clear refresh tokens for a device, optionally only those already used
+func (t *TokensDirectory) TxnClearUserDeviceRefreshTokens(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	onlyUsed bool,
+) error {
+	return util.TxnIterAllRange(txn, t.refreshTokensByDeviceID.Sub(userID.String(), deviceID.String()), func(kv fdb.KeyValue) error {
+		tup, err := t.refreshTokensByDeviceID.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		key := t.refreshTokens.Pack(tuple.Tuple{tup[2].([]byte)})
+		if onlyUsed {
+			if v, err := txn.Get(key).Get(); err != nil {
+				return err
+			} else if v != nil && !valueToRefreshTokenTup(v).Used {
+				return nil
+			}
+		}
+		txn.Clear(key)
+		txn.Clear(kv.Key)
+		return nil
+	})
 }
 
 func (t *TokensDirectory) TxnListUserDeviceAuthTokenPrefixes(
 	txn fdb.ReadTransaction,
 	userID id.UserID,
 ) (map[id.DeviceID][]string, error) {
-	tokens := make(map[id.DeviceID][]string, 5)
-
-	if err := util.TxnIterAllRange(txn, t.authTokensByDeviceID.Sub(userID.String()), func(kv fdb.KeyValue) error {
-		tup, _ := t.authTokensByDeviceID.Unpack(kv.Key)
-		deviceID := id.DeviceID(tup[1].(string))
-		tokenPrefix := tup[2].(string)[:7] + "..."
-		tokens[deviceID] = append(tokens[deviceID], tokenPrefix)
-		return nil
-	}); err != nil {
-		return nil, err
-	} else {
-		return tokens, nil
-	}
+	return t.txnListUserDeviceTokenPrefixes(txn, userID, t.authTokensByDeviceID, t.legacyAuthTokensByDeviceID)
 }
 
 func (t *TokensDirectory) TxnListUserDeviceRefreshTokenPrefixes(
 	txn fdb.ReadTransaction,
 	userID id.UserID,
+) (map[id.DeviceID][]string, error) {
+	return t.txnListUserDeviceTokenPrefixes(txn, userID, t.refreshTokensByDeviceID, t.legacyRefreshTokensByDeviceID)
+}
+
+func (t *TokensDirectory) txnListUserDeviceTokenPrefixes(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	byDeviceID, legacyByDeviceID subspace.Subspace,
 ) (map[id.DeviceID][]string, error) {
 	tokens := make(map[id.DeviceID][]string, 5)
 
-	if err := util.TxnIterAllRange(txn, t.refreshTokensByDeviceID.Sub(userID.String()), func(kv fdb.KeyValue) error {
-		tup, _ := t.refreshTokensByDeviceID.Unpack(kv.Key)
+	if err := util.TxnIterAllRange(txn, byDeviceID.Sub(userID.String()), func(kv fdb.KeyValue) error {
+		tup, _ := byDeviceID.Unpack(kv.Key)
 		deviceID := id.DeviceID(tup[1].(string))
-		tokenPrefix := tup[2].(string)[:7] + "..."
-		tokens[deviceID] = append(tokens[deviceID], tokenPrefix)
+		tokens[deviceID] = append(tokens[deviceID], string(kv.Value))
 		return nil
 	}); err != nil {
 		return nil, err
-	} else {
-		return tokens, nil
 	}
+
+	if err := util.TxnIterAllRange(txn, legacyByDeviceID.Sub(userID.String()), func(kv fdb.KeyValue) error {
+		tup, _ := legacyByDeviceID.Unpack(kv.Key)
+		deviceID := id.DeviceID(tup[1].(string))
+		tokens[deviceID] = append(tokens[deviceID], string(tokenPrefix(tup[2].(string))))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
 }
 
 func valueToAuthTokenTup(v []byte) *AuthTokenTup {
@@ -202,8 +318,13 @@ func valueToAuthTokenTup(v []byte) *AuthTokenTup {
 
 func valueToRefreshTokenTup(v []byte) *RefreshTokenTup {
 	tup, _ := tuple.Unpack(v)
-	return &RefreshTokenTup{
+	refreshToken := &RefreshTokenTup{
 		UserID:   id.UserID(tup[0].(string)),
 		DeviceID: id.DeviceID(tup[1].(string)),
 	}
+	// Tokens created before reuse detection have no used flag
+	if len(tup) > 2 {
+		refreshToken.Used = tup[2].(bool)
+	}
+	return refreshToken
 }
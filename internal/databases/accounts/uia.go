@@ -0,0 +1,98 @@
+package accounts
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	uiaSessionLifetime         = 10 * time.Minute
+	uiaExpiredSessionsPerClean = 100
+)
+
+// Create a new UIA session for the given user (empty for unauthenticated requests) and request,
+// expired sessions are cleaned up at the same time.
+func (a *AccountsDatabase) CreateUIASession(ctx context.Context, userID id.UserID, request string) (*types.UIASession, error) {
+	now := time.Now().UTC()
+	session := &types.UIASession{
+		ID:        util.GenerateRandomString(24),
+		UserID:    userID,
+		Request:   request,
+		Completed: []mautrix.AuthType{},
+		ExpiresTs: now.Add(uiaSessionLifetime).UnixMilli(),
+	}
+
+	log := a.getTxnLogContext(ctx, "CreateUIASession").
+		Str("user_id", userID.String()).
+		Str("request", request).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if err := a.uia.TxnDeleteExpiredSessions(txn, now.UnixMilli(), uiaExpiredSessionsPerClean); err != nil {
+			return nil, err
+		}
+		a.uia.TxnSetSession(txn, session)
+		return nil, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("session_id", session.ID).Msg("Created UIA session")
+	return session, nil
+}
+
+func (a *AccountsDatabase) GetUIASession(ctx context.Context, sessionID string) (*types.UIASession, error) {
+	return util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*types.UIASession, error) {
+		if session, err := a.uia.TxnGetSession(txn, sessionID, time.Now().UTC().UnixMilli()); err != nil {
+			return nil, err
+		} else if session == nil {
+			return nil, types.ErrUIASessionNotFound
+		} else {
+			return session, nil
+		}
+	})
+}
+
+func (a *AccountsDatabase) CompleteUIASessionStage(
+	ctx context.Context,
+	sessionID string,
+	stage mautrix.AuthType,
+) (*types.UIASession, error) {
+	return util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*types.UIASession, error) {
+		session, err := a.uia.TxnGetSession(txn, sessionID, time.Now().UTC().UnixMilli())
+		if err != nil {
+			return nil, err
+		} else if session == nil {
+			return nil, types.ErrUIASessionNotFound
+		}
+		if !slices.Contains(session.Completed, stage) {
+			session.Completed = append(session.Completed, stage)
+			a.uia.TxnSetSession(txn, session)
+		}
+		return session, nil
+	})
+}
+
+// Delete a session once it has been used to authenticate a request. Returns ErrUIASessionNotFound
+// if the session was already used, so concurrent requests can't both use the same session.
+func (a *AccountsDatabase) ConsumeUIASession(ctx context.Context, sessionID string) error {
+	_, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		session, err := a.uia.TxnGetSession(txn, sessionID, time.Now().UTC().UnixMilli())
+		if err != nil {
+			return nil, err
+		} else if session == nil {
+			return nil, types.ErrUIASessionNotFound
+		}
+		a.uia.TxnDeleteSession(txn, session)
+		return nil, nil
+	})
+	return err
+}
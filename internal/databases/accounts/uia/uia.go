@@ -0,0 +1,93 @@
+package uia
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// User-interactive authentication sessions
+type UIADirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	bySessionID,
+	byExpires subspace.Subspace
+}
+
+func NewUIADirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *UIADirectory {
+	uiaDir, err := parentDir.CreateOrOpen(db, []string{"uia"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "uia").Logger()
+	log.Debug().
+		Bytes("prefix", uiaDir.Bytes()).
+		Msg("Init accounts/uia directory")
+
+	return &UIADirectory{
+		log: log,
+		db:  db,
+
+		bySessionID: uiaDir.Sub("s"), // sessionID -> session msgpack bytes
+		byExpires:   uiaDir.Sub("e"), // expiresTs/sessionID -> ''
+	}
+}
+
+func (u *UIADirectory) KeyForSession(sessionID string) fdb.Key {
+	return u.bySessionID.Pack(tuple.Tuple{sessionID})
+}
+
+// Returns the session, or nil if it does not exist or has expired
+func (u *UIADirectory) TxnGetSession(txn fdb.ReadTransaction, sessionID string, nowTs int64) (*types.UIASession, error) {
+	if value, err := txn.Get(u.KeyForSession(sessionID)).Get(); err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, nil
+	} else if session := types.MustNewUIASessionFromBytes(value, sessionID); session.ExpiresTs < nowTs {
+		return nil, nil
+	} else {
+		return session, nil
+	}
+}
+
+func (u *UIADirectory) TxnSetSession(txn fdb.Transaction, session *types.UIASession) {
+	txn.Set(u.KeyForSession(session.ID), session.ToMsgpack())
+	txn.Set(u.byExpires.Pack(tuple.Tuple{session.ExpiresTs, session.ID}), nil)
+}
+
+func (u *UIADirectory) TxnDeleteSession(txn fdb.Transaction, session *types.UIASession) {
+	txn.Clear(u.KeyForSession(session.ID))
+	txn.Clear(u.byExpires.Pack(tuple.Tuple{session.ExpiresTs, session.ID}))
+}
+
+// Delete up to limit sessions that expired before the given timestamp
+func (u *UIADirectory) TxnDeleteExpiredSessions(txn fdb.Transaction, nowTs int64, limit int) error {
+	begin, _ := u.byExpires.FDBRangeKeys()
+	kvs, err := txn.GetRange(
+		fdb.KeyRange{
+			Begin: begin,
+			End:   u.byExpires.Pack(tuple.Tuple{nowTs}),
+		},
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range kvs {
+		keyTup, err := u.byExpires.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		txn.Clear(u.KeyForSession(keyTup[1].(string)))
+		txn.Clear(kv.Key)
+	}
+
+	return nil
+}
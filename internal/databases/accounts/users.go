@@ -38,10 +38,32 @@ func (a *AccountsDatabase) GetUserDeviceForAuthToken(ctx context.Context, token
 	})
 }
 
+func (a *AccountsDatabase) txnCheckUserPassword(txn fdb.ReadTransaction, username, password string) error {
+	hashedPassword, err := a.users.TxnGetLocalUserPasswordHash(txn, username)
+	if err != nil {
+		return err
+	} else if hashedPassword == nil {
+		return types.ErrUserNotFound
+	}
+	if err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err != nil {
+		return types.ErrInvalidPassword
+	}
+	return nil
+}
+
+// Returns nil if the password matches, ErrUserNotFound or ErrInvalidPassword if not
+func (a *AccountsDatabase) CheckUserPassword(ctx context.Context, username, password string) error {
+	_, err := util.DoReadTransaction(ctx, a.db, func(txn fdb.ReadTransaction) (*struct{}, error) {
+		return nil, a.txnCheckUserPassword(txn, username, password)
+	})
+	return err
+}
+
 type authResp struct {
 	DeviceID     id.DeviceID `json:"device_id"`
 	AccessToken  string      `json:"access_token"`
 	RefreshToken string      `json:"refresh_token,omitempty"`
+	ExpiresInMs  int64       `json:"expires_in_ms,omitempty"`
 }
 
 func (a *AccountsDatabase) LoginWithPassword(
@@ -57,28 +79,28 @@ func (a *AccountsDatabase) LoginWithPassword(
 	resp := authResp{
 		DeviceID: deviceID,
 	}
+	if withRefreshToken {
+		resp.ExpiresInMs = a.config.Accounts.RefreshAccessTokenExpire.Milliseconds()
+	}
 
 	return util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (authResp, error) {
-		hashedPassword, err := a.users.TxnGetLocalUserPasswordHash(txn, username)
-		if err != nil {
+		if err := a.txnCheckUserPassword(txn, username, password); err != nil {
 			return resp, err
-		} else if hashedPassword == nil {
-			return resp, types.ErrUserNotFound
-		}
-		if err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err != nil {
-			return resp, types.ErrInvalidPassword
 		}
 
 		userID := id.UserID("@" + username + ":" + a.config.ServerName)
-		resp.AccessToken, resp.RefreshToken = a.tokens.TxnCreateNewTokensForUserDevice(
+		var err error
+		if resp.AccessToken, resp.RefreshToken, err = a.tokens.TxnCreateNewTokensForUserDevice(
 			txn,
 			userID,
 			deviceID,
 			withRefreshToken,
 			a.config.Accounts.RefreshAccessTokenExpire,
-		)
+		); err != nil {
+			return resp, err
+		}
 
-		if _, err = a.devices.TxnGetOrCreateDevice(txn, userID, deviceID, initialDeviceDisplayName); err != nil {
+		if _, err := a.devices.TxnGetOrCreateDevice(txn, userID, deviceID, initialDeviceDisplayName); err != nil {
 			return resp, err
 		}
 
@@ -102,6 +124,9 @@ func (a *AccountsDatabase) RegisterWithPassword(
 	resp := authResp{
 		DeviceID: deviceID,
 	}
+	if withRefreshToken {
+		resp.ExpiresInMs = a.config.Accounts.RefreshAccessTokenExpire.Milliseconds()
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword(password, 12)
 	if err != nil {
@@ -120,13 +145,15 @@ func (a *AccountsDatabase) RegisterWithPassword(
 		}
 
 		userID := user.UserID()
-		resp.AccessToken, resp.RefreshToken = a.tokens.TxnCreateNewTokensForUserDevice(
+		if resp.AccessToken, resp.RefreshToken, err = a.tokens.TxnCreateNewTokensForUserDevice(
 			txn,
 			userID,
 			deviceID,
 			withRefreshToken,
 			a.config.Accounts.RefreshAccessTokenExpire,
-		)
+		); err != nil {
+			return nil, err
+		}
 
 		if _, err = a.devices.TxnGetOrCreateDevice(txn, userID, deviceID, initialDeviceDisplayName); err != nil {
 			return nil, err
@@ -168,3 +195,80 @@ func (a *AccountsDatabase) GetUserDeviceTokenPrefixes(
 		return tokens, nil
 	}
 }
+
+func (a *AccountsDatabase) ChangePassword(ctx context.Context, userID id.UserID, newPassword []byte) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword(newPassword, 12)
+	if err != nil {
+		return err
+	}
+
+	_, err = util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) (*struct{}, error) {
+		user, err := a.users.TxnGetLocalUser(txn, userID.Localpart(), a.config.ServerName)
+		if err != nil {
+			return nil, err
+		} else if user.Deactivated {
+			return nil, types.ErrUserNotFound
+		}
+		a.users.TxnSetLocalUserPasswordHash(txn, user.Username, hashedPassword)
+		return nil, nil
+	})
+	return err
+}
+
+// Deactivate a local user, deleting all of their devices (along with tokens & keys), cross-signing
+// keys, key backups and password. The user itself is kept so the username cannot be re-used.
+// Returns the deleted device IDs, rooms data is cleaned up separately.
+func (a *AccountsDatabase) DeactivateUser(ctx context.Context, userID id.UserID) ([]id.DeviceID, error) {
+	log := a.getTxnLogContext(ctx, "DeactivateUser").
+		Str("user_id", userID.String()).
+		Logger()
+
+	deviceIDs, err := util.DoWriteTransaction(ctx, a.db, func(txn fdb.Transaction) ([]id.DeviceID, error) {
+		user, err := a.users.TxnGetLocalUser(txn, userID.Localpart(), a.config.ServerName)
+		if err != nil {
+			return nil, err
+		}
+
+		devices, err := a.devices.TxnLookupUserDevices(txn, userID)
+		if err != nil {
+			return nil, err
+		}
+		deviceIDs := make([]id.DeviceID, 0, len(devices))
+		for _, device := range devices {
+			if err := a.txnDeleteUserDevice(txn, userID, device.ID); err != nil {
+				return nil, err
+			}
+			deviceIDs = append(deviceIDs, device.ID)
+		}
+
+		a.users.TxnClearCrossSigningKeys(txn, user.Username)
+		a.users.TxnClearUserKeySignatures(txn, userID)
+
+		for {
+			backup, err := a.backups.TxnGetLatestBackup(txn, userID)
+			if err != nil {
+				return nil, err
+			} else if backup == nil {
+				break
+			}
+			a.backups.TxnDeleteBackup(txn, userID, backup)
+		}
+
+		if err := a.pushers.TxnDeleteUserPushers(txn, userID); err != nil {
+			return nil, err
+		}
+
+		a.users.TxnClearLocalUserPasswordHash(txn, user.Username)
+		user.Deactivated = true
+		a.users.TxnSetUser(txn, user)
+
+		return deviceIDs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Int("devices", len(deviceIDs)).Msg("Deactivated user")
+
+	return deviceIDs, nil
+}
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+)
+
+func (u *UsersDirectory) subspaceForCrossSigningUsage(usage id.CrossSigningUsage) subspace.Subspace {
+	switch usage {
+	case id.XSUsageMaster:
+		return u.userMasterKeys
+	case id.XSUsageSelfSigning:
+		return u.userSelfSigningKeys
+	case id.XSUsageUserSigning:
+		return u.userUserSigningKeys
+	default:
+		panic(fmt.Sprintf("invalid cross-signing usage: %s", usage))
+	}
+}
+
+func (u *UsersDirectory) TxnGetCrossSigningKey(
+	txn fdb.ReadTransaction,
+	username string,
+	usage id.CrossSigningUsage,
+) ([]byte, error) {
+	key := u.subspaceForCrossSigningUsage(usage).Pack(tuple.Tuple{username})
+	return txn.Get(key).Get()
+}
+
+func (u *UsersDirectory) TxnSetCrossSigningKey(
+	txn fdb.Transaction,
+	username string,
+	usage id.CrossSigningUsage,
+	crossSigningKey []byte,
+) {
+	key := u.subspaceForCrossSigningUsage(usage).Pack(tuple.Tuple{username})
+	txn.Set(key, crossSigningKey)
+}
+
+func (u *UsersDirectory) TxnClearCrossSigningKeys(txn fdb.Transaction, username string) {
+	for _, usage := range []id.CrossSigningUsage{id.XSUsageMaster, id.XSUsageSelfSigning, id.XSUsageUserSigning} {
+		txn.Clear(u.subspaceForCrossSigningUsage(usage).Pack(tuple.Tuple{username}))
+	}
+}
+
+// Target key is either a device ID (for device keys) or the public key (for cross-signing keys)
+func (u *UsersDirectory) TxnAddKeySignature(
+	txn fdb.Transaction,
+	targetUserID id.UserID,
+	targetKey string,
+	signerUserID id.UserID,
+	signerKeyID id.KeyID,
+	signature string,
+) {
+	key := u.keySignatures.Pack(tuple.Tuple{
+		targetUserID.String(), targetKey, signerUserID.String(), signerKeyID.String(),
+	})
+	txn.Set(key, []byte(signature))
+}
+
+// Returns signer user ID -> signer key ID -> signature for the target key
+func (u *UsersDirectory) TxnLookupKeySignatures(
+	txn fdb.ReadTransaction,
+	targetUserID id.UserID,
+	targetKey string,
+) (map[id.UserID]map[id.KeyID]string, error) {
+	iter := txn.GetRange(
+		u.keySignatures.Sub(targetUserID.String(), targetKey),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	signatures := make(map[id.UserID]map[id.KeyID]string)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := u.keySignatures.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		signerUserID := id.UserID(keyTup[2].(string))
+		if _, found := signatures[signerUserID]; !found {
+			signatures[signerUserID] = make(map[id.KeyID]string)
+		}
+		signatures[signerUserID][id.KeyID(keyTup[3].(string))] = string(kv.Value)
+	}
+
+	return signatures, nil
+}
+
+func (u *UsersDirectory) TxnClearKeySignatures(txn fdb.Transaction, targetUserID id.UserID, targetKey string) {
+	txn.ClearRange(u.keySignatures.Sub(targetUserID.String(), targetKey))
+}
+
+// Clear all signatures of any of the target users keys
+func (u *UsersDirectory) TxnClearUserKeySignatures(txn fdb.Transaction, targetUserID id.UserID) {
+	txn.ClearRange(u.keySignatures.Sub(targetUserID.String()))
+}
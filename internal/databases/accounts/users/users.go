@@ -23,6 +23,10 @@ type UsersDirectory struct {
 	userMasterKeys,
 	userSelfSigningKeys,
 	userUserSigningKeys subspace.Subspace
+
+	// Signatures uploaded for device & cross-signing keys
+	// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keyssignaturesupload
+	keySignatures subspace.Subspace
 }
 
 func NewUsersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *UsersDirectory {
@@ -47,6 +51,8 @@ func NewUsersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directo
 		userMasterKeys:      usersDir.Sub("key"), // username -> CrossSigningKey JSON (CSAPI)
 		userSelfSigningKeys: usersDir.Sub("ssk"), // username -> CrossSigningKey JSON (CSAPI)
 		userUserSigningKeys: usersDir.Sub("usk"), // username -> CrossSigningKey JSON (CSAPI)
+
+		keySignatures: usersDir.Sub("sig"), // targetUserID/targetKey/signerUserID/signerKeyID -> signature
 	}
 }
 
@@ -60,6 +66,11 @@ func (u *UsersDirectory) TxnSetLocalUserPasswordHash(txn fdb.Transaction, userna
 	txn.Set(key, hash)
 }
 
+func (u *UsersDirectory) TxnClearLocalUserPasswordHash(txn fdb.Transaction, username string) {
+	key := u.userPasswordHashes.Pack(tuple.Tuple{username})
+	txn.Clear(key)
+}
+
 func (u *UsersDirectory) TxnGetLocalUser(txn fdb.ReadTransaction, username, serverName string) (*types.User, error) {
 	key := u.keyForUser(username)
 
@@ -96,6 +107,10 @@ func (u *UsersDirectory) TxnCreateUser(txn fdb.Transaction, user *types.User, ha
 	return nil
 }
 
+func (u *UsersDirectory) TxnSetUser(txn fdb.Transaction, user *types.User) {
+	txn.Set(u.keyForUser(user.Username), user.ToMsgpack())
+}
+
 func (u *UsersDirectory) keyForUser(username string) fdb.Key {
 	return u.byUsername.Pack(tuple.Tuple{username})
 }
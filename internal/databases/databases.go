@@ -3,9 +3,8 @@
 // functionality lives here (ie sync). Currently we have:
 //
 // rooms - events, receipts, room account data
-// TBC users - user profiles, global cacount data
-// TBC devices - to-device events
-// TBC presence - presence status
+// accounts - users, devices, tokens
+// transient - typing notifications, to-device events, presence status
 
 package databases
 
@@ -21,7 +20,9 @@ import (
 )
 
 type Databases struct {
-	log zerolog.Logger
+	log       zerolog.Logger
+	config    config.BabbleConfig
+	notifiers *notifier.Notifiers
 
 	Rooms     *rooms.RoomsDatabase
 	Accounts  *accounts.AccountsDatabase
@@ -38,18 +39,17 @@ func NewDatabases(
 		Str("component", "databases").
 		Logger()
 
-	dbs := Databases{log: log}
+	dbs := Databases{log: log, config: cfg, notifiers: notifiers}
 
 	if cfg.Rooms.Enabled {
 		dbs.Rooms = rooms.NewRoomsDatabase(cfg, log, notifiers)
 	}
 	if cfg.Accounts.Enabled {
-		dbs.Accounts = accounts.NewAccountsDatabase(cfg, log)
+		dbs.Accounts = accounts.NewAccountsDatabase(cfg, log, notifiers)
+	}
+	if cfg.Transient.Enabled {
+		dbs.Transient = transient.NewTransientDatabase(cfg, log, notifiers)
 	}
-	// doesn't exist'
-	// if cfg.Transient.Enabled {
-	// 	dbs.Transient = transient.NewTransientDatabase(cfg, log)
-	// }
 	// technically exists but is basically a dummy module
 	// if cfg.Media.Enabled {
 	// 	dbs.Media = media.NewMediaDatabase(cfg, log)
@@ -71,9 +71,9 @@ func (d *Databases) Stop() {
 	if d.Accounts != nil {
 		d.Accounts.Stop()
 	}
-	// if d.Transient != nil {
-	// 	d.Transient.Stop()
-	// }
+	if d.Transient != nil {
+		d.Transient.Stop()
+	}
 	// if d.Media != nil {
 	// 	d.Media.Stop()
 	// }
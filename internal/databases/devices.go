@@ -0,0 +1,25 @@
+package databases
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Delete user devices from the accounts database and clear any pending to-device events for them
+// from the transient database.
+func (d *Databases) DeleteUserDevices(ctx context.Context, userID id.UserID, deviceIDs []id.DeviceID) error {
+	if err := d.Accounts.DeleteUserDevices(ctx, userID, deviceIDs); err != nil {
+		return err
+	}
+
+	if d.Transient != nil {
+		for _, deviceID := range deviceIDs {
+			if err := d.Transient.ClearToDeviceForUserDevice(ctx, userID, deviceID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package databases
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Run a queued job, jobs must be idempotent as they are retried until they succeed
+func (d *Databases) RunJob(ctx context.Context, job *types.Job) error {
+	switch job.Type {
+	case types.JobTypeDeactivateUser:
+		return d.runDeactivateUserJob(ctx, id.UserID(job.Key))
+	default:
+		return fmt.Errorf("unknown job type: %s", job.Type)
+	}
+}
+
+func (d *Databases) runDeactivateUserJob(ctx context.Context, userID id.UserID) error {
+	if err := d.Rooms.EraseUserProfile(ctx, userID); err != nil {
+		return err
+	}
+
+	left, err := d.Rooms.LeaveAllUserRooms(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("user_id", userID.String()).
+		Int("rooms_left", left).
+		Msg("Left rooms for deactivated user")
+
+	return nil
+}
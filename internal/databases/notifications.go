@@ -0,0 +1,59 @@
+package databases
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Evaluate the push rules of each local user in the room against a newly stored event, storing
+// any resulting notifications which are counted in the users sync and queueing pushes for users
+// with pushers.
+func (d *Databases) HandleEventNotifications(ctx context.Context, evTup types.EventIDTupWithVersion) error {
+	pushCtx, err := d.Rooms.GetEventPushContext(ctx, evTup.EventID)
+	if err != nil {
+		return err
+	} else if len(pushCtx.MemberEvents) == 0 {
+		return nil
+	}
+
+	userIDs := slices.Collect(maps.Keys(pushCtx.MemberEvents))
+	rulesets, hasPushers, err := d.Accounts.GetPushRulesAndHasPushers(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	ev := pushCtx.Event.MautrixEvent()
+	notifications := make([]types.EventNotification, 0, len(pushCtx.MemberEvents))
+
+	for userID, memberEv := range pushCtx.MemberEvents {
+		should := types.EvaluatePushRules(rulesets[userID], &types.PushRulesRoom{
+			MemberCount:    pushCtx.Room.MemberCount,
+			OwnDisplayname: gjson.GetBytes(memberEv.Content, "displayname").String(),
+			PowerLevels:    pushCtx.PowerLevels,
+		}, ev)
+
+		if !should.Notify {
+			continue
+		}
+
+		notification := types.EventNotification{
+			UserID:    userID,
+			Highlight: should.Highlight,
+			Push:      hasPushers[userID],
+		}
+		if should.PlaySound {
+			notification.Sound = should.SoundName
+		}
+		notifications = append(notifications, notification)
+	}
+
+	if len(notifications) == 0 {
+		return nil
+	}
+	return d.Rooms.AddEventNotifications(ctx, evTup, notifications)
+}
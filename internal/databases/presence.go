@@ -0,0 +1,71 @@
+package databases
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+)
+
+func (d *Databases) SetUserPresence(
+	ctx context.Context,
+	userID id.UserID,
+	state event.Presence,
+	statusMsg string,
+) error {
+	if changed, err := d.Transient.SetUserPresence(ctx, userID, state, statusMsg); err != nil {
+		return err
+	} else if changed {
+		return d.notifyPresenceChanges(ctx, []id.UserID{userID})
+	}
+	return nil
+}
+
+func (d *Databases) SetUserPresenceFromSync(ctx context.Context, userID id.UserID, state event.Presence) error {
+	if changed, err := d.Transient.SetUserPresenceFromSync(ctx, userID, state); err != nil {
+		return err
+	} else if changed {
+		return d.notifyPresenceChanges(ctx, []id.UserID{userID})
+	}
+	return nil
+}
+
+func (d *Databases) TimeoutUserPresences(ctx context.Context) (int, error) {
+	userIDs, err := d.Transient.TimeoutUserPresences(
+		ctx,
+		d.config.Transient.Presence.UnavailableAfter,
+		d.config.Transient.Presence.OfflineAfter,
+	)
+	if err != nil {
+		return 0, err
+	} else if len(userIDs) == 0 {
+		return 0, nil
+	}
+	return len(userIDs), d.notifyPresenceChanges(ctx, userIDs)
+}
+
+// Presence changes are delivered to anyone sharing a room with the user, so we notify by both the
+// user and all their joined rooms to wake up any syncing users.
+func (d *Databases) notifyPresenceChanges(ctx context.Context, userIDs []id.UserID) error {
+	roomIDs := make([]id.RoomID, 0)
+
+	for _, userID := range userIDs {
+		memberships, err := d.Rooms.GetUserMemberships(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for roomID, membershipTup := range memberships {
+			if membershipTup.Membership == event.MembershipJoin {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+
+	d.notifiers.Transient.SendChange(notifier.Change{
+		UserIDs: userIDs,
+		RoomIDs: roomIDs,
+	})
+	return nil
+}
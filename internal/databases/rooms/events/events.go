@@ -1,6 +1,8 @@
 package events
 
 import (
+	"fmt"
+
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
@@ -28,7 +30,8 @@ type EventsDirectory struct {
 	byRoomCurrentServers,
 	byRoomRelation,
 	byRoomReaction,
-	byRoomThread subspace.Subspace
+	byRoomThread,
+	byRoomThreadParticipant subspace.Subspace
 }
 
 func NewEventsDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *EventsDirectory {
@@ -66,6 +69,8 @@ func NewEventsDirectory(logger zerolog.Logger, db fdb.Database, parentDir direct
 		byRoomRelation: eventsDir.Sub("rel"), // event by room/rel-to-ev/version
 		byRoomReaction: eventsDir.Sub("rea"), // event by room/rel-to-ev/uid/key
 		byRoomThread:   eventsDir.Sub("rth"), // root event by room/root-ev-version
+
+		byRoomThreadParticipant: eventsDir.Sub("rtp"), // thread repliers by room/root-ev/uid
 	}
 }
 
@@ -220,6 +225,10 @@ func (e *EventsDirectory) RangeForRoomCurrentState(roomID id.RoomID) fdb.Range {
 	return e.byRoomCurrentStateTup.Sub(roomID.String())
 }
 
+func (e *EventsDirectory) RangeForRoomCurrentStateType(roomID id.RoomID, evType event.Type) fdb.Range {
+	return e.byRoomCurrentStateTup.Sub(roomID.String(), evType.String())
+}
+
 // Room version state tups
 //
 
@@ -257,16 +266,64 @@ func (e *EventsDirectory) KeyForRoomRelation(roomID id.RoomID, relEvID id.EventI
 	}
 }
 
+// Legacy relation keys were stored with txn.Set and so contain the incomplete versionstamp, these
+// are rejected here and excluded from RangeForRoomRelations.
+func (e *EventsDirectory) KeyToRoomRelationVersion(key fdb.Key) (tuple.Versionstamp, error) {
+	tup, err := e.byRoomRelation.Unpack(key)
+	if err != nil {
+		return types.ZeroVersionstamp, fmt.Errorf("%w: %w", types.ErrInvalidVersion, err)
+	} else if len(tup) != 3 {
+		return types.ZeroVersionstamp, types.ErrInvalidVersion
+	}
+	version, ok := tup[2].(tuple.Versionstamp)
+	if !ok || types.IsIncompleteVersionstamp(version) {
+		return types.ZeroVersionstamp, types.ErrInvalidVersion
+	}
+	return version, nil
+}
+
+func (e *EventsDirectory) RangeForRoomRelations(
+	roomID id.RoomID,
+	relEvID id.EventID,
+	fromVersion, toVersion tuple.Versionstamp,
+) fdb.Range {
+	if toVersion == types.ZeroVersionstamp {
+		toVersion = types.IncompleteVersionstampRangeEnd
+	}
+	return types.GetVersionRange(e.byRoomRelation, fromVersion, toVersion, roomID.String(), relEvID.String())
+}
+
 func (e *EventsDirectory) KeyForRoomReaction(roomID id.RoomID, relEvID id.EventID, userID id.UserID, key string) fdb.Key {
 	return e.byRoomReaction.Pack(tuple.Tuple{roomID.String(), relEvID.String(), userID.String(), key})
 }
 
+func (e *EventsDirectory) RangeForRoomReactions(roomID id.RoomID, relEvID id.EventID) fdb.Range {
+	return e.byRoomReaction.Sub(roomID.String(), relEvID.String())
+}
+
+// Note: thread keys use the version of the root event, which is incomplete when the root is stored
+// in the same transaction (and the key must be set with SetVersionstampedKey).
 func (e *EventsDirectory) KeyForRoomThread(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byRoomThread.PackWithVersionstamp(tuple.Tuple{
-		roomID.String(), version,
-	}); err != nil {
+	tup := tuple.Tuple{roomID.String(), version}
+	if incomplete, _ := tup.HasIncompleteVersionstamp(); !incomplete {
+		return e.byRoomThread.Pack(tup)
+	}
+	if key, err := e.byRoomThread.PackWithVersionstamp(tup); err != nil {
 		panic(err)
 	} else {
 		return key
 	}
 }
+
+func (e *EventsDirectory) KeyToRoomThreadVersion(key fdb.Key) tuple.Versionstamp {
+	tup, _ := e.byRoomThread.Unpack(key)
+	return tup[1].(tuple.Versionstamp)
+}
+
+func (e *EventsDirectory) RangeForRoomThreads(roomID id.RoomID, fromVersion, toVersion tuple.Versionstamp) fdb.Range {
+	return types.GetVersionRange(e.byRoomThread, fromVersion, toVersion, roomID.String())
+}
+
+func (e *EventsDirectory) KeyForRoomThreadParticipant(roomID id.RoomID, rootEvID id.EventID, userID id.UserID) fdb.Key {
+	return e.byRoomThreadParticipant.Pack(tuple.Tuple{roomID.String(), rootEvID.String(), userID.String()})
+}
@@ -42,17 +42,20 @@ func (e *EventsDirectory) TxnPaginateAllEventRoomIDTups(
 	return evIDs, nil
 }
 
+// Paginate event ID tups in a room, reverse returns the latest events first
 func (e *EventsDirectory) TxnPaginateRoomEventIDTups(
 	txn fdb.ReadTransaction,
 	roomID id.RoomID,
 	fromVersion, toVersion tuple.Versionstamp,
 	limit int,
+	reverse bool,
 	eventsProvider *TxnEventsProvider,
 ) ([]types.EventIDTupWithVersion, error) {
 	iter := txn.GetRange(
 		e.RangeForRoomVersion(roomID, fromVersion, toVersion),
 		fdb.RangeOptions{
-			Limit: limit,
+			Limit:   limit,
+			Reverse: reverse,
 		},
 	).Iterator()
 
@@ -66,6 +69,7 @@ func (e *EventsDirectory) TxnPaginateRoomEventIDTups(
 		version := e.KeyToRoomVersion(kv.Key)
 		tup := types.EventIDTupWithVersion{
 			EventIDTup: types.EventIDTup{
+				RoomID:  roomID,
 				EventID: id.EventID(kv.Value),
 			},
 			Version: version,
@@ -78,3 +82,29 @@ func (e *EventsDirectory) TxnPaginateRoomEventIDTups(
 
 	return evIDs, nil
 }
+
+// Lookup the latest event in a room before (exclusive) the given version, returns a zero version
+// if there are no events.
+func (e *EventsDirectory) TxnLookupLatestRoomEventIDTup(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	toVersion tuple.Versionstamp,
+) (types.EventIDTupWithVersion, error) {
+	kvs, err := txn.GetRange(
+		e.RangeForRoomVersion(roomID, types.ZeroVersionstamp, toVersion),
+		fdb.RangeOptions{
+			Limit:   1,
+			Reverse: true,
+		},
+	).GetSliceWithError()
+	if err != nil || len(kvs) == 0 {
+		return types.EventIDTupWithVersion{}, err
+	}
+	return types.EventIDTupWithVersion{
+		EventIDTup: types.EventIDTup{
+			RoomID:  roomID,
+			EventID: id.EventID(kvs[0].Value),
+		},
+		Version: e.KeyToRoomVersion(kvs[0].Key),
+	}, nil
+}
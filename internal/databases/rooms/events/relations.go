@@ -0,0 +1,217 @@
+package events
+
+import (
+	"errors"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Paginate relations (excluding annotations) to an event, reverse returns the latest first. A zero
+// limit returns all relations in the range.
+func (e *EventsDirectory) TxnPaginateRoomRelationTups(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	relEvID id.EventID,
+	fromVersion, toVersion tuple.Versionstamp,
+	limit int,
+	reverse bool,
+	eventsProvider *TxnEventsProvider,
+) ([]types.RelationTupWithVersion, error) {
+	iter := txn.GetRange(
+		e.RangeForRoomRelations(roomID, relEvID, fromVersion, toVersion),
+		fdb.RangeOptions{
+			Limit:   limit,
+			Reverse: reverse,
+		},
+	).Iterator()
+
+	tups := make([]types.RelationTupWithVersion, 0, limit)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		relationTup, err := types.ValueToRelationTup(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		version, err := e.KeyToRoomRelationVersion(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		tup := types.RelationTupWithVersion{RelationTup: relationTup, Version: version}
+		tups = append(tups, tup)
+		if eventsProvider != nil {
+			eventsProvider.WillGet(tup.EventID)
+		}
+	}
+
+	return tups, nil
+}
+
+// Lookup all annotations to an event with their versions, the reactions index is ordered by user
+// and key so these are unsorted.
+func (e *EventsDirectory) TxnLookupRoomReactionTups(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	relEvID id.EventID,
+	eventsProvider *TxnEventsProvider,
+) ([]types.RelationTupWithVersion, error) {
+	kvs, err := txn.GetRange(
+		e.RangeForRoomReactions(roomID, relEvID),
+		fdb.RangeOptions{
+			Mode: fdb.StreamingModeWantAll,
+		},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	futs := make([]fdb.FutureByteSlice, 0, len(kvs))
+	for _, kv := range kvs {
+		futs = append(futs, txn.Get(e.KeyForIDToVersion(id.EventID(kv.Value))))
+		if eventsProvider != nil {
+			eventsProvider.WillGet(id.EventID(kv.Value))
+		}
+	}
+
+	tups := make([]types.RelationTupWithVersion, 0, len(kvs))
+	for i, kv := range kvs {
+		b, err := futs[i].Get()
+		if err != nil {
+			return nil, err
+		}
+		version, err := types.ValueToVersionstamp(b)
+		if err != nil {
+			return nil, err
+		}
+		tups = append(tups, types.RelationTupWithVersion{
+			RelationTup: types.RelationTup{
+				EventID: id.EventID(kv.Value),
+				RelType: event.RelAnnotation,
+			},
+			Version: version,
+		})
+	}
+
+	return tups, nil
+}
+
+// Paginate thread roots in a room by root event version, reverse returns the latest roots first
+func (e *EventsDirectory) TxnPaginateRoomThreadRootTups(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	fromVersion, toVersion tuple.Versionstamp,
+	limit int,
+	reverse bool,
+	eventsProvider *TxnEventsProvider,
+) ([]types.EventIDTupWithVersion, error) {
+	iter := txn.GetRange(
+		e.RangeForRoomThreads(roomID, fromVersion, toVersion),
+		fdb.RangeOptions{
+			Limit:   limit,
+			Reverse: reverse,
+		},
+	).Iterator()
+
+	tups := make([]types.EventIDTupWithVersion, 0, limit)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		tup := types.EventIDTupWithVersion{
+			EventIDTup: types.EventIDTup{
+				RoomID:  roomID,
+				EventID: id.EventID(kv.Value),
+			},
+			Version: e.KeyToRoomThreadVersion(kv.Key),
+		}
+		tups = append(tups, tup)
+		if eventsProvider != nil {
+			eventsProvider.WillGet(tup.EventID)
+		}
+	}
+
+	return tups, nil
+}
+
+// Whether an event is a thread root (with replies) or an m.thread relation to the root, checked
+// against the thread and relation indices.
+func (e *EventsDirectory) TxnIsEventInThread(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	rootEvID, eventID id.EventID,
+) (bool, error) {
+	if eventID == rootEvID {
+		rootVersion, err := e.TxnLookupVersionForEventID(txn, rootEvID)
+		if errors.Is(err, types.ErrEventNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		b, err := txn.Get(e.KeyForRoomThread(roomID, rootVersion)).Get()
+		return b != nil, err
+	}
+
+	version, err := e.TxnLookupVersionForEventID(txn, eventID)
+	if err != nil {
+		return false, err
+	}
+	b, err := txn.Get(e.byRoomRelation.Pack(tuple.Tuple{roomID.String(), rootEvID.String(), version})).Get()
+	if err != nil || b == nil {
+		return false, err
+	}
+	relationTup, err := types.ValueToRelationTup(b)
+	if err != nil {
+		return false, err
+	}
+	return relationTup.RelType == event.RelThread, nil
+}
+
+// Clear up to limit legacy rows from the relations index starting at the given key, returns the key
+// to continue from or nil once the whole index has been checked. Legacy rows have keys containing
+// an incomplete versionstamp (see KeyToRoomRelationVersion) and values storing the relation type
+// as bytes, annotations were also stored here before having their own index.
+func (e *EventsDirectory) TxnCleanupLegacyRoomRelations(
+	txn fdb.Transaction,
+	fromKey fdb.Key,
+	limit int,
+) (fdb.Key, int, error) {
+	begin, end := e.byRoomRelation.FDBRangeKeys()
+	if fromKey != nil {
+		begin = fromKey
+	}
+
+	kvs, err := txn.GetRange(
+		fdb.KeyRange{Begin: begin, End: end},
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var cleared int
+	for _, kv := range kvs {
+		if _, err := e.KeyToRoomRelationVersion(kv.Key); err == nil {
+			if relationTup, err := types.ValueToRelationTup(kv.Value); err == nil && relationTup.RelType != event.RelAnnotation {
+				continue
+			}
+		}
+		txn.Clear(kv.Key)
+		cleared++
+	}
+
+	if len(kvs) < limit {
+		return nil, cleared, nil
+	}
+	lastKey := kvs[len(kvs)-1].Key
+	return append(lastKey[:len(lastKey):len(lastKey)], 0x00), cleared, nil
+}
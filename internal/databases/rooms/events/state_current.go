@@ -2,6 +2,8 @@ package events
 
 import (
 	"context"
+	"maps"
+	"slices"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"maunium.net/go/mautrix/event"
@@ -189,3 +191,108 @@ func (e *EventsDirectory) TxnLookupCurrentRoomAuthAndSpecificMemberStateMap(
 	}
 	return stateMap, nil
 }
+
+// Lookup current state event IDs matching any of the (type, state_key) pairs and start fetching
+// events, either may be the * wildcard. Exact pairs are fetched directly and state key wildcards
+// only range over that type, a type wildcard has to read the rooms entire current state.
+func (e *EventsDirectory) TxnLookupCurrentRoomStateMapForPairs(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	pairs [][2]string,
+	eventsProvider *TxnEventsProvider,
+) (types.StateMap, error) {
+	matchPair := func(tup types.StateTup) bool {
+		for _, pair := range pairs {
+			if (pair[0] == types.SlidingSyncWildcard || pair[0] == tup.Type.Type) &&
+				(pair[1] == types.SlidingSyncWildcard || pair[1] == tup.StateKey) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ids := make(types.StateMap)
+	addMatching := func(state types.StateMap) {
+		for tup, evID := range state {
+			if matchPair(tup) {
+				ids[tup] = evID
+			}
+		}
+	}
+
+	if slices.ContainsFunc(pairs, func(pair [2]string) bool { return pair[0] == types.SlidingSyncWildcard }) {
+		stateMap, err := e.TxnLookupCurrentRoomStateMap(txn, roomID, nil)
+		if err != nil {
+			return nil, err
+		}
+		addMatching(stateMap)
+		memberMap, err := e.TxnLookupCurrentRoomMemberStateMap(txn, roomID, nil)
+		if err != nil {
+			return nil, err
+		}
+		addMatching(memberMap)
+	} else {
+		var memberUserIDs []id.UserID
+		var allMembers bool
+		allTypes := make(map[event.Type]struct{})
+		tupToFut := make(map[types.StateTup]fdb.FutureByteSlice)
+
+		for _, pair := range pairs {
+			tup := types.StateTup{Type: event.NewEventType(pair[0]), StateKey: pair[1]}
+			switch {
+			case tup.Type == event.StateMember && tup.StateKey == types.SlidingSyncWildcard:
+				allMembers = true
+			case tup.Type == event.StateMember:
+				memberUserIDs = append(memberUserIDs, id.UserID(tup.StateKey))
+			case tup.StateKey == types.SlidingSyncWildcard:
+				allTypes[tup.Type] = struct{}{}
+			default:
+				if _, found := tupToFut[tup]; !found {
+					tupToFut[tup] = txn.Get(e.KeyForRoomCurrentStateTup(roomID, tup.Type, &tup.StateKey))
+				}
+			}
+		}
+
+		for evType := range allTypes {
+			kvs, err := txn.GetRange(
+				e.RangeForRoomCurrentStateType(roomID, evType),
+				fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+			).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range kvs {
+				stateTup := e.CurrentRoomStateKeyValueToStateTup(kv)
+				ids[stateTup.StateTup] = stateTup.EventID
+			}
+		}
+
+		var memberMap types.StateMap
+		var err error
+		if allMembers {
+			memberMap, err = e.TxnLookupCurrentRoomMemberStateMap(txn, roomID, nil)
+		} else if len(memberUserIDs) > 0 {
+			memberMap, err = e.TxnLookupCurrentSpecificRoomMemberStateMap(txn, roomID, memberUserIDs, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(ids, memberMap)
+
+		for tup, fut := range tupToFut {
+			b, err := fut.Get()
+			if err != nil {
+				return nil, err
+			} else if b != nil {
+				ids[tup] = id.EventID(b)
+			}
+		}
+	}
+
+	if eventsProvider != nil {
+		for _, evID := range ids {
+			eventsProvider.WillGet(evID)
+		}
+	}
+	return ids, nil
+}
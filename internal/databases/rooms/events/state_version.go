@@ -27,6 +27,25 @@ func (e *EventsDirectory) TxnLookupVersionForEventID(
 	return types.ValueToVersionstamp(b)
 }
 
+// Lookup versionstamp for a given event, returning ErrEventNotFound if the event is not in the room
+func (e *EventsDirectory) TxnLookupRoomVersionForEventID(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	eventID id.EventID,
+) (tuple.Versionstamp, error) {
+	version, err := e.TxnLookupVersionForEventID(txn, eventID)
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	}
+	b, err := txn.Get(e.byRoomVersion.Pack(tuple.Tuple{roomID.String(), version})).Get()
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	} else if b == nil {
+		return types.ZeroVersionstamp, types.ErrEventNotFound
+	}
+	return version, nil
+}
+
 func (e *EventsDirectory) TxnMustLookupVersionForEventID(
 	txn fdb.ReadTransaction,
 	eventID id.EventID,
@@ -117,6 +117,27 @@ func (r *RoomsDatabase) GetCurrentRoomMemberEvents(ctx context.Context, roomID i
 	}
 }
 
+func (r *RoomsDatabase) GetCurrentRoomSpecificMemberEvents(ctx context.Context, roomID id.RoomID, userIDs []id.UserID) ([]*types.Event, error) {
+	memberEvs, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.Event, error) {
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		memberMap, err := r.events.TxnLookupCurrentSpecificRoomMemberStateMap(txn, roomID, userIDs, eventsProvider)
+		if err != nil {
+			return nil, err
+		}
+		evs := make([]*types.Event, 0, len(memberMap))
+		for _, evID := range memberMap {
+			evs = append(evs, eventsProvider.MustGet(evID))
+		}
+		return evs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	util.SortEventList(memberEvs)
+	return memberEvs, nil
+}
+
 func (r *RoomsDatabase) GetCurrentRoomStateEvents(ctx context.Context, roomID id.RoomID) ([]*types.Event, error) {
 	stateEvs, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.Event, error) {
 		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
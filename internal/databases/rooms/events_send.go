@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -910,18 +911,37 @@ func (r *RoomsDatabase) txnStoreEvents(
 		// Relation events indices
 		relEvID, relType := ev.RelatesTo()
 		if relEvID != "" {
-			txn.Set(
-				r.events.KeyForRoomRelation(ev.RoomID, relEvID, version),
-				tuple.Tuple{ev.ID.String(), []byte(relType)}.Pack(),
-			)
+			if relType != event.RelAnnotation {
+				// room-ev-relations/rel-ev/version -> RelationTup
+				txn.SetVersionstampedKey(
+					r.events.KeyForRoomRelation(ev.RoomID, relEvID, version),
+					types.RelationTupToValue(types.RelationTup{EventID: ev.ID, RelType: relType}),
+				)
+			}
 
 			if relType == event.RelThread {
 				// room-threads/root-ev-version -> root event ID - only if this
 				// doesn't already exist (so the first reply in a thread creates).
-				relEvVersion := r.events.TxnMustLookupVersionForEventID(txn, relEvID)
-				threadKey := r.events.KeyForRoomThread(ev.RoomID, relEvVersion)
-				if txn.Get(threadKey).MustGet() == nil {
-					txn.Set(threadKey, []byte(relEvID))
+				// The root must be in the same room, either earlier in this batch
+				// or already stored, otherwise the reply isn't indexed as a thread.
+				rootIdx := slices.IndexFunc(evs[:i], func(rootEv *types.Event) bool {
+					return rootEv.ID == relEvID && !rootEv.Outlier && !rootEv.SoftFailed
+				})
+				if rootIdx >= 0 {
+					if evs[rootIdx].RoomID == ev.RoomID {
+						threadKey := r.events.KeyForRoomThread(ev.RoomID, tuple.IncompleteVersionstamp(uint16(rootIdx)))
+						txn.SetVersionstampedKey(threadKey, []byte(relEvID))
+						// room-thread-participants/root-ev/uid -> ''
+						txn.Set(r.events.KeyForRoomThreadParticipant(ev.RoomID, relEvID, ev.Sender), nil)
+					}
+				} else if relEvVersion, err := r.events.TxnLookupRoomVersionForEventID(txn, ev.RoomID, relEvID); err == nil {
+					threadKey := r.events.KeyForRoomThread(ev.RoomID, relEvVersion)
+					if txn.Get(threadKey).MustGet() == nil {
+						txn.Set(threadKey, []byte(relEvID))
+					}
+					txn.Set(r.events.KeyForRoomThreadParticipant(ev.RoomID, relEvID, ev.Sender), nil)
+				} else if !errors.Is(err, types.ErrEventNotFound) {
+					panic(err)
 				}
 			}
 
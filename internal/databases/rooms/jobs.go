@@ -0,0 +1,67 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	jobRetryBaseInterval = 5 * time.Second
+	jobRetryMaxInterval  = time.Hour
+)
+
+// Add a job to the queue, does nothing if the job is already queued
+func (r *RoomsDatabase) EnqueueJob(ctx context.Context, jobType types.JobType, key string) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if existing, err := r.jobs.TxnGetJob(txn, jobType, key); err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, nil
+		}
+		r.jobs.TxnSetJob(txn, &types.Job{
+			Type:          jobType,
+			Key:           key,
+			NextAttemptTs: time.Now().UTC().UnixMilli(),
+		}, nil)
+		return nil, nil
+	})
+	return err
+}
+
+func (r *RoomsDatabase) GetDueJobs(ctx context.Context, limit int) ([]*types.Job, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.Job, error) {
+		return r.jobs.TxnLookupDueJobs(txn, time.Now().UTC().UnixMilli(), limit)
+	})
+}
+
+func (r *RoomsDatabase) CompleteJob(ctx context.Context, job *types.Job) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.jobs.TxnDeleteJob(txn, job)
+		return nil, nil
+	})
+	return err
+}
+
+// Reschedule a failed job with exponential backoff
+func (r *RoomsDatabase) RetryJob(ctx context.Context, job *types.Job, jobErr error) error {
+	retryJob := *job
+	retryJob.Attempts++
+	retryJob.LastError = jobErr.Error()
+
+	interval := jobRetryMaxInterval
+	if retryJob.Attempts < 20 {
+		interval = min(jobRetryBaseInterval*(1<<retryJob.Attempts), jobRetryMaxInterval)
+	}
+	retryJob.NextAttemptTs = time.Now().UTC().Add(interval).UnixMilli()
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.jobs.TxnSetJob(txn, &retryJob, job)
+		return nil, nil
+	})
+	return err
+}
@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type JobsDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byTypeKey,
+	byNextAttempt subspace.Subspace
+}
+
+func NewJobsDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *JobsDirectory {
+	jobsDir, err := parentDir.CreateOrOpen(db, []string{"jobs"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "jobs").Logger()
+	log.Debug().
+		Bytes("prefix", jobsDir.Bytes()).
+		Msg("Init rooms/jobs directory")
+
+	return &JobsDirectory{
+		log: log,
+		db:  db,
+
+		byTypeKey:     jobsDir.Sub("j"), // type/key -> job msgpack bytes
+		byNextAttempt: jobsDir.Sub("n"), // nextAttemptTs/type/key -> ''
+	}
+}
+
+func (j *JobsDirectory) KeyForJob(jobType types.JobType, key string) fdb.Key {
+	return j.byTypeKey.Pack(tuple.Tuple{string(jobType), key})
+}
+
+func (j *JobsDirectory) keyForJobNextAttempt(job *types.Job) fdb.Key {
+	return j.byNextAttempt.Pack(tuple.Tuple{job.NextAttemptTs, string(job.Type), job.Key})
+}
+
+func (j *JobsDirectory) TxnGetJob(txn fdb.ReadTransaction, jobType types.JobType, key string) (*types.Job, error) {
+	if value, err := txn.Get(j.KeyForJob(jobType, key)).Get(); err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, nil
+	} else {
+		return types.NewJobFromBytes(value, jobType, key)
+	}
+}
+
+// Set a job, the previous version of the job (if any) must be passed to update the attempt index
+func (j *JobsDirectory) TxnSetJob(txn fdb.Transaction, job, prevJob *types.Job) {
+	if prevJob != nil {
+		txn.Clear(j.keyForJobNextAttempt(prevJob))
+	}
+	txn.Set(j.KeyForJob(job.Type, job.Key), job.ToMsgpack())
+	txn.Set(j.keyForJobNextAttempt(job), nil)
+}
+
+func (j *JobsDirectory) TxnDeleteJob(txn fdb.Transaction, job *types.Job) {
+	txn.Clear(j.KeyForJob(job.Type, job.Key))
+	txn.Clear(j.keyForJobNextAttempt(job))
+}
+
+// Returns up to limit jobs due to be attempted at the given timestamp, oldest first
+func (j *JobsDirectory) TxnLookupDueJobs(txn fdb.ReadTransaction, nowTs int64, limit int) ([]*types.Job, error) {
+	begin, _ := j.byNextAttempt.FDBRangeKeys()
+	kvs, err := txn.GetRange(
+		fdb.KeyRange{
+			Begin: begin,
+			End:   j.byNextAttempt.Pack(tuple.Tuple{nowTs + 1}),
+		},
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*types.Job, 0, len(kvs))
+	for _, kv := range kvs {
+		keyTup, err := j.byNextAttempt.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		job, err := j.TxnGetJob(txn, types.JobType(keyTup[1].(string)), keyTup[2].(string))
+		if err != nil {
+			return nil, err
+		} else if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,256 @@
+package rooms
+
+import (
+	"context"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Maximum index rows scanned by a single filtered pagination, when reached the results end at the
+// last scanned row so sparse filters can't scan an entire room in one request.
+const maxPaginationScanned = 1000
+
+type PaginateRoomEventsOptions struct {
+	// Position to paginate from (exclusive), zero starts from the latest/earliest event
+	From tuple.Versionstamp
+	// Position to stop at (exclusive), zero for no limit
+	To        tuple.Versionstamp
+	Backwards bool
+	Limit     int
+	// Filter events, may be nil
+	Filter *types.Filter
+}
+
+type PaginateRoomEventsResults struct {
+	// Events in pagination order, so latest first when paginating backwards
+	Events []*types.Event
+	// Member events for the senders of the events, as of the latest event
+	State []*types.Event
+	// Position to continue paginating from, zero if there are no more events
+	// (may be set with fewer results than the limit once maxPaginationScanned rows are scanned)
+	End tuple.Versionstamp
+	// The latest version at the time, when paginating from the latest event
+	LatestVersion tuple.Versionstamp
+}
+
+// Paginate events in a room in either direction, positions are event versions so are compatible
+// with the rooms version in sync next batch tokens.
+func (r *RoomsDatabase) PaginateRoomEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	options PaginateRoomEventsOptions,
+) (*PaginateRoomEventsResults, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*PaginateRoomEventsResults, error) {
+		results, err := r.txnPaginateRoomEvents(ctx, txn, roomID, options)
+		if err != nil || len(results.Events) == 0 {
+			return results, err
+		}
+
+		latestEv := results.Events[len(results.Events)-1]
+		if options.Backwards {
+			latestEv = results.Events[0]
+		}
+
+		// Member events in the page are already sent, so only lookup other senders
+		memberIDs := make([]id.UserID, 0)
+		for _, ev := range results.Events {
+			if !slices.Contains(memberIDs, ev.Sender) && !slices.ContainsFunc(results.Events, func(memberEv *types.Event) bool {
+				return memberEv.Type == event.StateMember && memberEv.StateKey != nil && *memberEv.StateKey == ev.Sender.String()
+			}) {
+				memberIDs = append(memberIDs, ev.Sender)
+			}
+		}
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		memberMap, err := r.events.TxnLookupSpecificRoomMemberStateMapAtEvent(ctx, txn, roomID, memberIDs, latestEv.ID, eventsProvider)
+		if err != nil {
+			return nil, err
+		}
+		results.State = make([]*types.Event, 0, len(memberMap))
+		for _, evID := range memberMap {
+			results.State = append(results.State, eventsProvider.MustGet(evID))
+		}
+		util.SortEventList(results.State)
+
+		return results, nil
+	})
+}
+
+// Paginate events up to the limit, skipping (but continuing past) any that don't match the filter
+func (r *RoomsDatabase) txnPaginateRoomEvents(
+	ctx context.Context,
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	options PaginateRoomEventsOptions,
+) (*PaginateRoomEventsResults, error) {
+	results := &PaginateRoomEventsResults{
+		Events:        make([]*types.Event, 0, options.Limit),
+		LatestVersion: util.TxnGetLatestWriteVersion(ctx, txn),
+	}
+
+	// Range starts are inclusive but ends are exclusive, so bump the start to exclude it
+	beginVersion, endVersion := options.From, options.To
+	if options.Backwards {
+		beginVersion, endVersion = options.To, options.From
+	}
+	if beginVersion != types.ZeroVersionstamp {
+		beginVersion.UserVersion += 1
+	}
+
+	var scanned int
+	for {
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		tups, err := r.events.TxnPaginateRoomEventIDTups(
+			txn, roomID, beginVersion, endVersion, options.Limit, options.Backwards, eventsProvider,
+		)
+		if err != nil {
+			return nil, err
+		}
+		scanned += len(tups)
+
+		for _, tup := range tups {
+			ev := eventsProvider.MustGet(tup.EventID)
+			if !options.Filter.MatchTimelineEvent(ev) {
+				continue
+			}
+			results.Events = append(results.Events, ev)
+			if len(results.Events) == options.Limit {
+				results.End = tup.Version
+				return results, nil
+			}
+		}
+
+		if len(tups) < options.Limit {
+			// No more events in the range
+			return results, nil
+		}
+
+		// Continue after the last event, skipping any filtered out
+		lastVersion := tups[len(tups)-1].Version
+		if scanned >= maxPaginationScanned {
+			results.End = lastVersion
+			return results, nil
+		}
+		if options.Backwards {
+			endVersion = lastVersion
+		} else {
+			beginVersion = lastVersion
+			beginVersion.UserVersion += 1
+		}
+	}
+}
+
+type RoomEventContextResults struct {
+	Event *types.Event
+	// Events before the event, latest first
+	EventsBefore []*types.Event
+	EventsAfter  []*types.Event
+	// Room state as of the last event returned
+	State []*types.Event
+	// Positions to paginate backwards/forwards from
+	Start, End tuple.Versionstamp
+}
+
+// Get events either side of an event, the limit is split between the before and after events. The
+// filter only applies to the surrounding events (not the event itself or the state), except for
+// lazy loading members.
+func (r *RoomsDatabase) GetRoomEventContext(
+	ctx context.Context,
+	roomID id.RoomID,
+	eventID id.EventID,
+	limit int,
+	filter *types.Filter,
+) (*RoomEventContextResults, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*RoomEventContextResults, error) {
+		version, err := r.events.TxnLookupVersionForEventID(txn, eventID)
+		if err != nil {
+			return nil, err
+		}
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		ev, err := eventsProvider.Get(eventID)
+		if err != nil {
+			return nil, err
+		} else if ev.RoomID != roomID {
+			return nil, types.ErrEventNotFound
+		}
+
+		results := &RoomEventContextResults{
+			Event:        ev,
+			EventsBefore: make([]*types.Event, 0),
+			EventsAfter:  make([]*types.Event, 0),
+			Start:        version,
+			End:          version,
+		}
+
+		// A zero limit would paginate everything, so only paginate if we want events
+		beforeLimit := limit / 2
+		afterLimit := limit - beforeLimit
+		if beforeLimit > 0 {
+			before, err := r.txnPaginateRoomEvents(ctx, txn, roomID, PaginateRoomEventsOptions{
+				From:      version,
+				Backwards: true,
+				Limit:     beforeLimit,
+				Filter:    filter,
+			})
+			if err != nil {
+				return nil, err
+			}
+			results.EventsBefore = before.Events
+		}
+		if afterLimit > 0 {
+			after, err := r.txnPaginateRoomEvents(ctx, txn, roomID, PaginateRoomEventsOptions{
+				From:   version,
+				Limit:  afterLimit,
+				Filter: filter,
+			})
+			if err != nil {
+				return nil, err
+			}
+			results.EventsAfter = after.Events
+		}
+
+		// Tokens are exclusive so paginating from the outermost events continues past them
+		lastEv := ev
+		if len(results.EventsBefore) > 0 {
+			results.Start = r.events.TxnMustLookupVersionForEventID(txn, results.EventsBefore[len(results.EventsBefore)-1].ID)
+		}
+		if len(results.EventsAfter) > 0 {
+			lastEv = results.EventsAfter[len(results.EventsAfter)-1]
+			results.End = r.events.TxnMustLookupVersionForEventID(txn, lastEv.ID)
+		}
+
+		stateMap, err := r.events.TxnLookupRoomStateEventIDsAtEvent(txn, roomID, lastEv.ID, eventsProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		var senders []id.UserID
+		if filter.LazyLoadMembers() {
+			senders = []id.UserID{ev.Sender}
+			for _, ev := range slices.Concat(results.EventsBefore, results.EventsAfter) {
+				if !slices.Contains(senders, ev.Sender) {
+					senders = append(senders, ev.Sender)
+				}
+			}
+		}
+
+		results.State = make([]*types.Event, 0, len(stateMap))
+		for stateTup, evID := range stateMap {
+			if senders != nil && stateTup.Type == event.StateMember && !slices.Contains(senders, id.UserID(stateTup.StateKey)) {
+				continue
+			}
+			results.State = append(results.State, eventsProvider.MustGet(evID))
+		}
+		util.SortEventList(results.State)
+
+		return results, nil
+	})
+}
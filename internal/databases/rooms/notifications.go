@@ -0,0 +1,337 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Receipt types that mark a room as read and clear notifications
+var readReceiptTypes = []event.ReceiptType{event.ReceiptTypeRead, event.ReceiptTypeReadPrivate}
+
+// Room state needed to evaluate push rules against an event for each local user it may notify
+type EventPushContext struct {
+	Event       *types.Event
+	Room        *types.Room
+	PowerLevels *event.PowerLevelsEventContent
+	// Current member events of local users to evaluate push rules for, excluding the sender
+	MemberEvents map[id.UserID]*types.Event
+}
+
+// Returns the event along with the current room state needed to evaluate push rules, note this is
+// the state at the time of the call not at the event.
+func (r *RoomsDatabase) GetEventPushContext(ctx context.Context, eventID id.EventID) (*EventPushContext, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*EventPushContext, error) {
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+
+		ev, err := eventsProvider.Get(eventID)
+		if err != nil {
+			return nil, err
+		}
+
+		roomBytes, err := txn.Get(r.KeyForRoom(ev.RoomID)).Get()
+		if err != nil {
+			return nil, err
+		} else if roomBytes == nil {
+			return nil, types.ErrEventNotFound
+		}
+		room, err := types.NewRoomFromBytes(roomBytes, ev.RoomID)
+		if err != nil {
+			return nil, err
+		}
+
+		stateMap, err := r.events.TxnLookupCurrentRoomStateMap(txn, ev.RoomID, nil)
+		if err != nil {
+			return nil, err
+		}
+		powerLevelsEventID, hasPowerLevels := stateMap[types.StateTup{Type: event.StatePowerLevels}]
+		if hasPowerLevels {
+			eventsProvider.WillGet(powerLevelsEventID)
+		}
+
+		memberEventIDs := make(map[id.UserID]id.EventID)
+
+		iter := txn.GetRange(
+			r.events.RangeForCurrentRoomMembers(ev.RoomID),
+			fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+		).Iterator()
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, err
+			}
+			stateTup, membershipTup := r.events.CurrentRoomMemberKeyValueToTups(kv)
+			userID := id.UserID(stateTup.StateKey)
+			if membershipTup.Membership != event.MembershipJoin || userID == ev.Sender || userID.Homeserver() != r.config.ServerName {
+				continue
+			}
+			memberEventIDs[userID] = membershipTup.EventID
+			eventsProvider.WillGet(membershipTup.EventID)
+		}
+
+		// Invites notify the (local) invitee who is not yet joined
+		if ev.Type == event.StateMember && ev.Membership() == event.MembershipInvite {
+			if userID := id.UserID(*ev.StateKey); userID.Homeserver() == r.config.ServerName {
+				memberEventIDs[userID] = ev.ID
+			}
+		}
+
+		pushCtx := &EventPushContext{
+			Event:        ev,
+			Room:         room,
+			MemberEvents: make(map[id.UserID]*types.Event, len(memberEventIDs)),
+		}
+
+		if hasPowerLevels {
+			powerLevelsEv, err := eventsProvider.Get(powerLevelsEventID)
+			if err != nil {
+				return nil, err
+			}
+			pushCtx.PowerLevels = &event.PowerLevelsEventContent{}
+			if err := json.Unmarshal(powerLevelsEv.Content, pushCtx.PowerLevels); err != nil {
+				return nil, err
+			}
+		}
+
+		for userID, memberEventID := range memberEventIDs {
+			if pushCtx.MemberEvents[userID], err = eventsProvider.Get(memberEventID); err != nil {
+				return nil, err
+			}
+		}
+
+		return pushCtx, nil
+	})
+}
+
+// Returns the latest version the user has read up to in a thread (or the main timeline if the
+// thread ID is empty), considering both unthreaded and threaded read receipts.
+func (r *RoomsDatabase) txnGetUserReadVersion(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	threadID id.EventID,
+) (tuple.Versionstamp, error) {
+	receiptThreadID := event.ReadReceiptThreadMain
+	if threadID != "" {
+		receiptThreadID = threadID
+	}
+
+	var readVersion tuple.Versionstamp
+	for _, rType := range readReceiptTypes {
+		for _, rcThreadID := range []string{"", receiptThreadID.String()} {
+			rc, err := r.receipts.TxnGetUserReceipt(txn, roomID, rType, rcThreadID, userID)
+			if err != nil {
+				return readVersion, err
+			} else if rc == nil {
+				continue
+			}
+			version, err := r.events.TxnLookupVersionForEventID(txn, rc.EventID)
+			if err != nil {
+				return readVersion, err
+			} else if types.CompareVersionstamps(version, readVersion) > 0 {
+				readVersion = version
+			}
+		}
+	}
+	return readVersion, nil
+}
+
+// Store notifications for an event, users who have already read past the event (in its thread) are skipped. Any
+// pushes are queued alongside the notification.
+func (r *RoomsDatabase) AddEventNotifications(
+	ctx context.Context,
+	evTup types.EventIDTupWithVersion,
+	notifications []types.EventNotification,
+) error {
+	log := r.getTxnLogContext(ctx, "AddEventNotifications").
+		Str("room_id", evTup.RoomID.String()).
+		Str("event_id", evTup.EventID.String()).
+		Logger()
+
+	userIDs, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) ([]id.UserID, error) {
+		userIDs := make([]id.UserID, 0, len(notifications))
+
+		ev, err := r.events.NewTxnEventsProvider(ctx, txn).Get(evTup.EventID)
+		if err != nil {
+			return nil, err
+		}
+		threadID := ev.ThreadRootID()
+
+		for _, notification := range notifications {
+			readVersion, err := r.txnGetUserReadVersion(txn, notification.UserID, evTup.RoomID, threadID)
+			if err != nil {
+				return nil, err
+			} else if types.CompareVersionstamps(readVersion, evTup.Version) >= 0 {
+				continue
+			}
+			// The events iterator replays events if it fails to save its position, skip users
+			// already notified so pushes aren't queued again once sent.
+			if notified, err := r.notifications.TxnHasNotification(txn, notification.UserID, evTup.RoomID, evTup.Version); err != nil {
+				return nil, err
+			} else if notified {
+				continue
+			}
+
+			r.notifications.TxnAddNotification(txn, notification.UserID, evTup.RoomID, threadID, evTup.Version, notification.Highlight)
+			if notification.Push {
+				r.notifications.TxnQueuePush(txn, &types.QueuedPush{
+					UserID:    notification.UserID,
+					RoomID:    evTup.RoomID,
+					EventID:   evTup.EventID,
+					Version:   evTup.Version,
+					Highlight: notification.Highlight,
+					Sound:     notification.Sound,
+				})
+			}
+			if err := r.notifications.TxnMarkCountsChanged(txn, notification.UserID, evTup.RoomID, 0); err != nil {
+				return nil, err
+			}
+			userIDs = append(userIDs, notification.UserID)
+		}
+
+		return userIDs, nil
+	})
+	if err != nil {
+		return err
+	} else if len(userIDs) == 0 {
+		return nil
+	}
+
+	r.notifiers.Rooms.SendChange(notifier.Change{UserIDs: userIDs})
+	log.Debug().Int("users", len(userIDs)).Msg("Added event notifications")
+
+	return nil
+}
+
+func (r *RoomsDatabase) txnLookupNotificationCounts(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomIDs []id.RoomID,
+	counts map[id.RoomID]*types.NotificationCounts,
+) error {
+	for _, roomID := range roomIDs {
+		if _, found := counts[roomID]; found {
+			continue
+		}
+		roomCounts, err := r.notifications.TxnLookupNotificationCounts(txn, userID, roomID)
+		if err != nil {
+			return err
+		}
+		counts[roomID] = roomCounts
+	}
+	return nil
+}
+
+// Returns notification counts for each of the given rooms
+func (r *RoomsDatabase) GetNotificationCountsForUser(
+	ctx context.Context,
+	userID id.UserID,
+	roomIDs []id.RoomID,
+) (map[id.RoomID]*types.NotificationCounts, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (map[id.RoomID]*types.NotificationCounts, error) {
+		counts := make(map[id.RoomID]*types.NotificationCounts, len(roomIDs))
+		return counts, r.txnLookupNotificationCounts(txn, userID, roomIDs, counts)
+	})
+}
+
+// Returns notification counts for each of the given rooms and any other joined rooms where the
+// users counts changed between the two versions (inclusive).
+func (r *RoomsDatabase) SyncNotificationCountsForUser(
+	ctx context.Context,
+	userID id.UserID,
+	roomIDs []id.RoomID,
+	fromVersion, toVersion tuple.Versionstamp,
+) (map[id.RoomID]*types.NotificationCounts, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (map[id.RoomID]*types.NotificationCounts, error) {
+		changedRoomIDs, err := r.notifications.TxnLookupChangedRoomIDs(txn, userID, fromVersion, toVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		joinedChangedRoomIDs := make([]id.RoomID, 0, len(changedRoomIDs))
+		for _, roomID := range changedRoomIDs {
+			if joined, err := r.users.TxnIsUserInRoom(txn, userID, roomID); err != nil {
+				return nil, err
+			} else if joined {
+				joinedChangedRoomIDs = append(joinedChangedRoomIDs, roomID)
+			}
+		}
+
+		counts := make(map[id.RoomID]*types.NotificationCounts, len(roomIDs)+len(joinedChangedRoomIDs))
+		if err := r.txnLookupNotificationCounts(txn, userID, roomIDs, counts); err != nil {
+			return nil, err
+		}
+		return counts, r.txnLookupNotificationCounts(txn, userID, joinedChangedRoomIDs, counts)
+	})
+}
+
+// Returns all users with queued pushes
+func (r *RoomsDatabase) GetPushUserIDs(ctx context.Context) ([]id.UserID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]id.UserID, error) {
+		return r.notifications.TxnLookupPushUserIDs(txn)
+	})
+}
+
+func (r *RoomsDatabase) HasQueuedPushes(ctx context.Context, userID id.UserID) (bool, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (bool, error) {
+		return r.notifications.TxnHasQueuedPushes(txn, userID)
+	})
+}
+
+type QueuedPushesResults struct {
+	Pushes []*types.QueuedPush
+	// Total unread notifications for the user across all rooms
+	UnreadCount int
+}
+
+// Returns the oldest queued pushes for a user, pushes for notifications that have since been
+// cleared by read receipts are marked as such.
+func (r *RoomsDatabase) GetQueuedPushes(ctx context.Context, userID id.UserID, limit int) (*QueuedPushesResults, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*QueuedPushesResults, error) {
+		pushes, err := r.notifications.TxnLookupQueuedPushes(txn, userID, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, push := range pushes {
+			hasNotification, err := r.notifications.TxnHasNotification(txn, userID, push.RoomID, push.Version)
+			if err != nil {
+				return nil, err
+			}
+			push.Cleared = !hasNotification
+		}
+
+		unreadCount, err := r.notifications.TxnLookupUserNotificationCount(txn, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &QueuedPushesResults{
+			Pushes:      pushes,
+			UnreadCount: unreadCount,
+		}, nil
+	})
+}
+
+// Clear queued pushes up to and including the given event version
+func (r *RoomsDatabase) ClearQueuedPushes(
+	ctx context.Context,
+	userID id.UserID,
+	eventVersion tuple.Versionstamp,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		// Ensure lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		return nil, r.notifications.TxnClearQueuedPushes(txn, userID, eventVersion)
+	})
+	return err
+}
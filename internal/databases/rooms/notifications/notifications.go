@@ -0,0 +1,335 @@
+package notifications
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Unread notifications for local users, produced by evaluating push rules against new events and
+// cleared by read receipts. Each change to a users counts in a room is logged so sync can return
+// counts that changed without any new events in the room. Notifications for users with pushers
+// are also queued until sent to their push gateways.
+type NotificationsDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserRoomVersion,
+	byUserVersion,
+	byUserRoom,
+	pushesByUserVersion,
+	pushUsers subspace.Subspace
+}
+
+func NewNotificationsDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *NotificationsDirectory {
+	notificationsDir, err := parentDir.CreateOrOpen(db, []string{"notifications"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "notifications").Logger()
+	log.Debug().
+		Bytes("prefix", notificationsDir.Bytes()).
+		Msg("Init rooms/notifications directory")
+
+	return &NotificationsDirectory{
+		log: log,
+		db:  db,
+
+		byUserRoomVersion: notificationsDir.Sub("urv"), // userID/roomID/eventVersion -> (highlight, threadID)
+		byUserVersion:     notificationsDir.Sub("uv"),  // userID/version -> roomID
+		byUserRoom:        notificationsDir.Sub("ur"),  // userID/roomID -> version
+
+		pushesByUserVersion: notificationsDir.Sub("pq"), // userID/eventVersion -> (roomID, eventID, highlight, sound)
+		pushUsers:           notificationsDir.Sub("pu"), // userID -> ''
+	}
+}
+
+func (n *NotificationsDirectory) KeyForNotification(userID id.UserID, roomID id.RoomID, eventVersion tuple.Versionstamp) fdb.Key {
+	return n.byUserRoomVersion.Pack(tuple.Tuple{userID.String(), roomID.String(), eventVersion})
+}
+
+// Add a notification, the thread ID is the thread root event ID or empty for the main timeline
+func (n *NotificationsDirectory) TxnAddNotification(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	threadID id.EventID,
+	eventVersion tuple.Versionstamp,
+	highlight bool,
+) {
+	txn.Set(n.KeyForNotification(userID, roomID, eventVersion), tuple.Tuple{highlight, threadID.String()}.Pack())
+}
+
+func valueToNotification(value []byte) (highlight bool, threadID id.EventID, err error) {
+	valTup, err := tuple.Unpack(value)
+	if err != nil {
+		return false, "", err
+	}
+	return valTup[0].(bool), id.EventID(valTup[1].(string)), nil
+}
+
+// Clear notifications for events up to and including the given event version
+func (n *NotificationsDirectory) TxnClearNotifications(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	eventVersion tuple.Versionstamp,
+) {
+	eventVersion.UserVersion += 1
+	txn.ClearRange(types.GetVersionRange(
+		n.byUserRoomVersion, types.ZeroVersionstamp, eventVersion, userID.String(), roomID.String(),
+	))
+}
+
+// Clear notifications in a single thread (or the main timeline if empty) for events up to and
+// including the given event version.
+func (n *NotificationsDirectory) TxnClearThreadNotifications(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	threadID id.EventID,
+	eventVersion tuple.Versionstamp,
+) error {
+	eventVersion.UserVersion += 1
+	iter := txn.GetRange(
+		types.GetVersionRange(n.byUserRoomVersion, types.ZeroVersionstamp, eventVersion, userID.String(), roomID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return err
+		}
+		if _, notificationThreadID, err := valueToNotification(kv.Value); err != nil {
+			return err
+		} else if notificationThreadID == threadID {
+			txn.Clear(kv.Key)
+		}
+	}
+
+	return nil
+}
+
+// Log a change to the users notification counts in a room, replacing any previous change entry
+func (n *NotificationsDirectory) TxnMarkCountsChanged(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	userVersion uint16,
+) error {
+	key := n.byUserRoom.Pack(tuple.Tuple{userID.String(), roomID.String()})
+
+	if existing, err := txn.Get(key).Get(); err != nil {
+		return err
+	} else if existing != nil {
+		prevVersion, err := types.ValueToVersionstamp(existing)
+		if err != nil {
+			return err
+		}
+		txn.Clear(n.byUserVersion.Pack(tuple.Tuple{userID.String(), prevVersion}))
+	}
+
+	version := tuple.IncompleteVersionstamp(userVersion)
+
+	changeKey, err := n.byUserVersion.PackWithVersionstamp(tuple.Tuple{userID.String(), version})
+	if err != nil {
+		return err
+	}
+	txn.SetVersionstampedKey(changeKey, []byte(roomID.String()))
+	txn.SetVersionstampedValue(key, types.VersionstampToValue(version))
+
+	return nil
+}
+
+func (n *NotificationsDirectory) TxnHasNotification(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	eventVersion tuple.Versionstamp,
+) (bool, error) {
+	value, err := txn.Get(n.KeyForNotification(userID, roomID, eventVersion)).Get()
+	return value != nil, err
+}
+
+func (n *NotificationsDirectory) TxnLookupNotificationCounts(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+) (*types.NotificationCounts, error) {
+	iter := txn.GetRange(
+		n.byUserRoomVersion.Sub(userID.String(), roomID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	counts := &types.NotificationCounts{}
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		highlight, threadID, err := valueToNotification(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		counts.NotificationCount++
+		if highlight {
+			counts.HighlightCount++
+		}
+
+		if threadID != "" {
+			if counts.Threads == nil {
+				counts.Threads = make(map[id.EventID]*types.NotificationCounts)
+			}
+			threadCounts, found := counts.Threads[threadID]
+			if !found {
+				threadCounts = &types.NotificationCounts{}
+				counts.Threads[threadID] = threadCounts
+			}
+			threadCounts.NotificationCount++
+			if highlight {
+				threadCounts.HighlightCount++
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// Returns the total number of unread notifications for a user across all rooms
+func (n *NotificationsDirectory) TxnLookupUserNotificationCount(txn fdb.ReadTransaction, userID id.UserID) (int, error) {
+	kvs, err := txn.GetRange(
+		n.byUserRoomVersion.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).GetSliceWithError()
+	return len(kvs), err
+}
+
+// Returns rooms where the users notification counts changed between the two versions (inclusive)
+func (n *NotificationsDirectory) TxnLookupChangedRoomIDs(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	fromVersion, toVersion tuple.Versionstamp,
+) ([]id.RoomID, error) {
+	if toVersion != types.ZeroVersionstamp {
+		toVersion.UserVersion += 1
+	}
+
+	kvs, err := txn.GetRange(
+		types.GetVersionRange(n.byUserVersion, fromVersion, toVersion, userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	roomIDs := make([]id.RoomID, 0, len(kvs))
+	for _, kv := range kvs {
+		roomIDs = append(roomIDs, id.RoomID(kv.Value))
+	}
+	return roomIDs, nil
+}
+
+// Push queue
+//
+
+func (n *NotificationsDirectory) TxnQueuePush(txn fdb.Transaction, push *types.QueuedPush) {
+	txn.Set(
+		n.pushesByUserVersion.Pack(tuple.Tuple{push.UserID.String(), push.Version}),
+		tuple.Tuple{push.RoomID.String(), push.EventID.String(), push.Highlight, push.Sound}.Pack(),
+	)
+	txn.Set(n.pushUsers.Pack(tuple.Tuple{push.UserID.String()}), nil)
+}
+
+// Returns all users with queued pushes
+func (n *NotificationsDirectory) TxnLookupPushUserIDs(txn fdb.ReadTransaction) ([]id.UserID, error) {
+	kvs, err := txn.GetRange(
+		n.pushUsers,
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]id.UserID, 0, len(kvs))
+	for _, kv := range kvs {
+		keyTup, err := n.pushUsers.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(keyTup[0].(string)))
+	}
+	return userIDs, nil
+}
+
+func (n *NotificationsDirectory) TxnHasQueuedPushes(txn fdb.ReadTransaction, userID id.UserID) (bool, error) {
+	value, err := txn.Get(n.pushUsers.Pack(tuple.Tuple{userID.String()})).Get()
+	return value != nil, err
+}
+
+// Returns the oldest queued pushes for a user
+func (n *NotificationsDirectory) TxnLookupQueuedPushes(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	limit int,
+) ([]*types.QueuedPush, error) {
+	kvs, err := txn.GetRange(
+		n.pushesByUserVersion.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll, Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	pushes := make([]*types.QueuedPush, 0, len(kvs))
+	for _, kv := range kvs {
+		keyTup, err := n.pushesByUserVersion.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		valTup, err := tuple.Unpack(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		pushes = append(pushes, &types.QueuedPush{
+			UserID:    userID,
+			Version:   keyTup[1].(tuple.Versionstamp),
+			RoomID:    id.RoomID(valTup[0].(string)),
+			EventID:   id.EventID(valTup[1].(string)),
+			Highlight: valTup[2].(bool),
+			Sound:     valTup[3].(string),
+		})
+	}
+	return pushes, nil
+}
+
+// Clear queued pushes up to and including the given event version, the user is removed from the
+// push users once their queue is empty.
+func (n *NotificationsDirectory) TxnClearQueuedPushes(
+	txn fdb.Transaction,
+	userID id.UserID,
+	eventVersion tuple.Versionstamp,
+) error {
+	eventVersion.UserVersion += 1
+	txn.ClearRange(types.GetVersionRange(
+		n.pushesByUserVersion, types.ZeroVersionstamp, eventVersion, userID.String(),
+	))
+
+	kvs, err := txn.GetRange(
+		n.pushesByUserVersion.Sub(userID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll, Limit: 1},
+	).GetSliceWithError()
+	if err != nil {
+		return err
+	} else if len(kvs) == 0 {
+		txn.Clear(n.pushUsers.Pack(tuple.Tuple{userID.String()}))
+	}
+	return nil
+}
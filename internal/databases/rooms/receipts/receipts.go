@@ -88,3 +88,19 @@ func (r *ReceiptsDirectory) TxnGetCurrentReceiptsForRoom(
 
 	return receipts, nil
 }
+
+// Returns a users current receipt of a given type & thread in a room, or nil if there is none
+func (r *ReceiptsDirectory) TxnGetUserReceipt(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	rType event.ReceiptType,
+	threadID string,
+	userID id.UserID,
+) (*types.Receipt, error) {
+	key := r.byRoomTypeThread.Pack(tuple.Tuple{roomID.String(), string(rType), threadID, userID.String()})
+	value, err := txn.Get(key).Get()
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return r.KeyValueToReceipt(fdb.KeyValue{Key: key, Value: value}), nil
+}
@@ -2,8 +2,10 @@ package rooms
 
 import (
 	"context"
+	"slices"
 	"sync"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -46,6 +48,7 @@ func (r *RoomsDatabase) SendReceipts(
 
 		allowedReceipts := make([]*types.Receipt, 0, len(rcs))
 		rejectedReceipts := make([]RejectedReceipt, 0)
+		clearedUserIDs := make(map[id.UserID]struct{})
 
 		for i, rc := range rcs {
 			if rc.RoomID != roomID {
@@ -74,6 +77,20 @@ func (r *RoomsDatabase) SendReceipts(
 					rejectedReceipts = append(rejectedReceipts, RejectedReceipt{rc, types.ErrEventNotFound})
 					continue
 				}
+
+				if rc.ThreadID != "" && rc.ThreadID != event.ReadReceiptThreadMain.String() {
+					if inThread, err := r.events.TxnIsEventInThread(txn, roomID, id.EventID(rc.ThreadID), rc.EventID); err != nil {
+						return nil, err
+					} else if !inThread {
+						log.Warn().
+							Stringer("user_id", rc.UserID).
+							Stringer("event_id", rc.EventID).
+							Str("thread_id", rc.ThreadID).
+							Msg("Ignoring threaded receipt from local user for event not in thread")
+						rejectedReceipts = append(rejectedReceipts, RejectedReceipt{rc, types.ErrEventNotInThread})
+						continue
+					}
+				}
 			}
 
 			kv := r.receipts.KeyValueForReceipt(rc)
@@ -82,6 +99,33 @@ func (r *RoomsDatabase) SendReceipts(
 			version := tuple.IncompleteVersionstamp(uint16(i))
 			r.txnAddReceiptToSuperStream(txn, rc, version)
 
+			if rc.UserID.Homeserver() == r.config.ServerName && slices.Contains(readReceiptTypes, rc.Type) {
+				// Read receipts from local users clear notifications up to the event, threaded
+				// receipts only clear notifications in that thread (or the main timeline).
+				evVersion, err := r.events.TxnLookupVersionForEventID(txn, rc.EventID)
+				if err != nil {
+					return nil, err
+				}
+				switch rc.ThreadID {
+				case "":
+					r.notifications.TxnClearNotifications(txn, rc.UserID, roomID, evVersion)
+				case event.ReadReceiptThreadMain.String():
+					err = r.notifications.TxnClearThreadNotifications(txn, rc.UserID, roomID, "", evVersion)
+				default:
+					err = r.notifications.TxnClearThreadNotifications(txn, rc.UserID, roomID, id.EventID(rc.ThreadID), evVersion)
+				}
+				if err != nil {
+					return nil, err
+				}
+				// Only log one change per user, the change entry cannot be read back in this txn
+				if _, found := clearedUserIDs[rc.UserID]; !found {
+					if err := r.notifications.TxnMarkCountsChanged(txn, rc.UserID, roomID, uint16(i)); err != nil {
+						return nil, err
+					}
+					clearedUserIDs[rc.UserID] = struct{}{}
+				}
+			}
+
 			allowedReceipts = append(allowedReceipts, rc)
 		}
 
@@ -0,0 +1,240 @@
+package rooms
+
+import (
+	"context"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// How many levels of relations to follow when recursing, matches Synapse
+const MaxRelationsRecursionDepth = 3
+
+const (
+	legacyRelationsCleanupBatchSize = 1000
+	legacyRelationsMigrationName    = "cleanup_legacy_relations"
+)
+
+type PaginateRoomRelationsOptions struct {
+	// Positions to paginate from/to (both exclusive), zero for the latest/earliest relation
+	From, To  tuple.Versionstamp
+	Backwards bool
+	Limit     int
+	// Only return relations of this type, annotations are only returned when this is m.annotation
+	RelType event.RelationType
+	// Only return events of this type
+	EventType string
+	// Include relations to relations, up to MaxRelationsRecursionDepth
+	Recurse bool
+}
+
+type PaginateRoomRelationsResults struct {
+	Events []*types.Event
+	// Position to continue paginating from, zero if there are no more relations
+	// (may be set with fewer results than the limit once maxPaginationScanned rows are scanned)
+	End tuple.Versionstamp
+}
+
+// Paginate events relating to an event, positions are event versions so are compatible with room
+// message pagination tokens.
+func (r *RoomsDatabase) PaginateRoomRelations(
+	ctx context.Context,
+	roomID id.RoomID,
+	eventID id.EventID,
+	options PaginateRoomRelationsOptions,
+) (*PaginateRoomRelationsResults, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*PaginateRoomRelationsResults, error) {
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		if ev, err := eventsProvider.Get(eventID); err != nil {
+			return nil, err
+		} else if ev.RoomID != roomID {
+			return nil, types.ErrEventNotFound
+		}
+
+		results := &PaginateRoomRelationsResults{
+			Events: make([]*types.Event, 0, options.Limit),
+		}
+
+		// Add the event for a relation if it matches, returns true once the limit is reached
+		addRelation := func(tup types.RelationTupWithVersion) bool {
+			if options.RelType != "" && tup.RelType != options.RelType {
+				return false
+			}
+			ev := eventsProvider.MustGet(tup.EventID)
+			if options.EventType != "" && ev.Type.Type != options.EventType {
+				return false
+			}
+			results.Events = append(results.Events, ev)
+			if len(results.Events) == options.Limit {
+				results.End = tup.Version
+				return true
+			}
+			return false
+		}
+
+		// Range starts are inclusive but ends are exclusive, so bump the start to exclude it
+		beginVersion, endVersion := options.From, options.To
+		if options.Backwards {
+			beginVersion, endVersion = options.To, options.From
+		}
+		if beginVersion != types.ZeroVersionstamp {
+			beginVersion.UserVersion += 1
+		}
+
+		if options.RelType == event.RelAnnotation || options.Recurse {
+			// Reactions aren't indexed by version and recursion can't be paginated directly, so
+			// fetch every relation and sort them by version.
+			var tups []types.RelationTupWithVersion
+			var err error
+			if options.RelType == event.RelAnnotation {
+				tups, err = r.events.TxnLookupRoomReactionTups(txn, roomID, eventID, eventsProvider)
+			} else {
+				tups, err = r.txnLookupRecursiveRoomRelationTups(txn, roomID, eventID, eventsProvider)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			slices.SortFunc(tups, func(a, b types.RelationTupWithVersion) int {
+				if options.Backwards {
+					return types.CompareVersionstamps(b.Version, a.Version)
+				}
+				return types.CompareVersionstamps(a.Version, b.Version)
+			})
+			for _, tup := range tups {
+				if types.CompareVersionstamps(tup.Version, beginVersion) < 0 ||
+					(endVersion != types.ZeroVersionstamp && types.CompareVersionstamps(tup.Version, endVersion) >= 0) {
+					continue
+				}
+				if addRelation(tup) {
+					break
+				}
+			}
+			return results, nil
+		}
+
+		var scanned int
+		for {
+			tups, err := r.events.TxnPaginateRoomRelationTups(
+				txn, roomID, eventID, beginVersion, endVersion, options.Limit, options.Backwards, eventsProvider,
+			)
+			if err != nil {
+				return nil, err
+			}
+			scanned += len(tups)
+
+			for _, tup := range tups {
+				if addRelation(tup) {
+					return results, nil
+				}
+			}
+
+			if len(tups) < options.Limit {
+				// No more relations in the range
+				return results, nil
+			}
+
+			// Continue after the last relation, skipping any filtered out
+			lastVersion := tups[len(tups)-1].Version
+			if scanned >= maxPaginationScanned {
+				results.End = lastVersion
+				return results, nil
+			}
+			if options.Backwards {
+				endVersion = lastVersion
+			} else {
+				beginVersion = lastVersion
+				beginVersion.UserVersion += 1
+			}
+		}
+	})
+}
+
+// Lookup all relations to an event and to those relations, up to the max recursion depth
+func (r *RoomsDatabase) txnLookupRecursiveRoomRelationTups(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	eventID id.EventID,
+	eventsProvider *events.TxnEventsProvider,
+) ([]types.RelationTupWithVersion, error) {
+	var allTups []types.RelationTupWithVersion
+	relEvIDs := []id.EventID{eventID}
+
+	for depth := 0; depth < MaxRelationsRecursionDepth && len(relEvIDs) > 0; depth++ {
+		var nextRelEvIDs []id.EventID
+		for _, relEvID := range relEvIDs {
+			tups, err := r.events.TxnPaginateRoomRelationTups(
+				txn, roomID, relEvID, types.ZeroVersionstamp, types.ZeroVersionstamp, 0, false, eventsProvider,
+			)
+			if err != nil {
+				return nil, err
+			}
+			for _, tup := range tups {
+				allTups = append(allTups, tup)
+				nextRelEvIDs = append(nextRelEvIDs, tup.EventID)
+			}
+		}
+		relEvIDs = nextRelEvIDs
+	}
+
+	return allTups, nil
+}
+
+// Clear legacy rows from the relations index, see events.TxnCleanupLegacyRoomRelations. This runs
+// on startup of every instance until one completes, each batch is a transaction and reads skip
+// legacy rows so it is safe to run alongside requests and stop part way.
+func (r *RoomsDatabase) cleanupLegacyRelations(ctx context.Context) {
+	log := r.getTxnLogContext(ctx, "cleanupLegacyRelations").Logger()
+	migrationKey := r.migrations.Pack(tuple.Tuple{legacyRelationsMigrationName})
+
+	if done, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (bool, error) {
+		b, err := txn.Get(migrationKey).Get()
+		return b != nil, err
+	}); err != nil {
+		log.Err(err).Msg("Failed to check legacy relations cleanup")
+		return
+	} else if done {
+		return
+	}
+
+	var fromKey fdb.Key
+	var cleared int
+
+	for {
+		var n int
+		nextKey, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (fdb.Key, error) {
+			var nextKey fdb.Key
+			var err error
+			nextKey, n, err = r.events.TxnCleanupLegacyRoomRelations(txn, fromKey, legacyRelationsCleanupBatchSize)
+			if err != nil {
+				return nil, err
+			} else if nextKey == nil {
+				txn.Set(migrationKey, []byte{})
+			}
+			return nextKey, nil
+		})
+		if err != nil && ctx.Err() != nil {
+			log.Info().Int("cleared", cleared).Msg("Stopped cleaning up legacy relations")
+			return
+		} else if err != nil {
+			log.Err(err).Msg("Failed to cleanup legacy relations")
+			return
+		}
+		cleared += n
+		if nextKey == nil {
+			break
+		}
+		fromKey = nextKey
+	}
+
+	if cleared > 0 {
+		log.Info().Int("cleared", cleared).Msg("Cleaned up legacy relations")
+	}
+}
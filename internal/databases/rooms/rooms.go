@@ -18,6 +18,8 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/databases/rooms/jobs"
+	"github.com/beeper/babbleserv/internal/databases/rooms/notifications"
 	"github.com/beeper/babbleserv/internal/databases/rooms/receipts"
 	"github.com/beeper/babbleserv/internal/databases/rooms/servers"
 	"github.com/beeper/babbleserv/internal/databases/rooms/users"
@@ -36,13 +38,21 @@ type RoomsDatabase struct {
 	config    config.BabbleConfig
 	notifiers *notifier.Notifiers
 
+	// Cancelled on stop so any background jobs (legacy index cleanup) exit early
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	events   *events.EventsDirectory
 	users    *users.UsersDirectory
 	servers  *servers.ServersDirectory
 	receipts *receipts.ReceiptsDirectory
+	jobs     *jobs.JobsDirectory
+
+	notifications *notifications.NotificationsDirectory
 
-	root  subspace.Subspace
-	locks subspace.Subspace
+	root       subspace.Subspace
+	locks      subspace.Subspace
+	migrations subspace.Subspace
 
 	byID,
 	byAlias,
@@ -86,19 +96,28 @@ func NewRoomsDatabase(
 		Bytes("prefix", roomsDir.Bytes()).
 		Msg("Init rooms directory")
 
-	return &RoomsDatabase{
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+
+	rooms := &RoomsDatabase{
 		log:       log,
 		db:        db,
 		config:    cfg,
 		notifiers: notifiers,
 
-		root:  roomsDir,
-		locks: roomsDir.Sub("lck"),
+		ctx:    ctx,
+		cancel: cancel,
+
+		root:       roomsDir,
+		locks:      roomsDir.Sub("lck"),
+		migrations: roomsDir.Sub("mig"), // migration name -> '' once complete
 
 		events:   events.NewEventsDirectory(log, db, roomsDir),
 		users:    users.NewUsersDirectory(log, db, roomsDir),
 		servers:  servers.NewServersDirectory(log, db, roomsDir),
 		receipts: receipts.NewReceiptsDirectory(log, db, roomsDir),
+		jobs:     jobs.NewJobsDirectory(log, db, roomsDir),
+
+		notifications: notifications.NewNotificationsDirectory(log, db, roomsDir),
 
 		byID:     roomsDir.Sub("id"),
 		byAlias:  roomsDir.Sub("as"),
@@ -108,10 +127,19 @@ func NewRoomsDatabase(
 		localSuperStream:           roomsDir.Sub("ls"),
 		superStreamReceiptVersions: roomsDir.Sub("ssrv"), // superstream receipt versions by user/room/type
 	}
+
+	rooms.backgroundWg.Add(1)
+	go func() {
+		defer rooms.backgroundWg.Done()
+		rooms.cleanupLegacyRelations(rooms.ctx)
+	}()
+
+	return rooms
 }
 
 func (r *RoomsDatabase) Stop() {
 	r.log.Debug().Msg("Waiting for any background jobs to complete...")
+	r.cancel()
 	r.backgroundWg.Wait()
 }
 
@@ -0,0 +1,557 @@
+package rooms
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// Rooms looked up per transaction when fetching candidates
+	slidingSyncCandidatesBatchSize = 100
+	// Maximum candidate (or room) transactions in flight per request
+	slidingSyncCandidatesWorkers = 8
+)
+
+type SlidingSyncOptions struct {
+	// Position to get changes *after*, zero for an initial sync
+	From              tuple.Versionstamp
+	Lists             map[string]*types.SlidingSyncList
+	RoomSubscriptions map[id.RoomID]*types.SlidingSyncRoomConfig
+}
+
+type SlidingSyncRoomsResults struct {
+	// Position to sync rooms from next
+	NextVersion tuple.Versionstamp
+	Lists       map[string]*types.SlidingSyncListResult
+	// Rooms with changes, or that are new to the client
+	Rooms map[id.RoomID]*types.SlidingSyncRoom
+	// Every room within a lists window or subscribed to, whether or not it has changes
+	VisibleRoomIDs []id.RoomID
+}
+
+// A room the user has a membership in along with the versions needed to sort and sync it
+type slidingSyncCandidate struct {
+	membership types.MembershipTup
+	// Version of the membership event, zero if we don't have the event (remote invites), or for
+	// joined rooms in initial syncs or unchanged since the from version where it isn't needed
+	membershipVersion tuple.Versionstamp
+	// Exclusive end of the events visible to the user
+	toVersion tuple.Versionstamp
+	// Latest event visible to the user, used to sort rooms by recency
+	bump types.EventIDTupWithVersion
+	// Latest event visible at the from version, used to find the rooms previously in each window
+	prevBump types.EventIDTupWithVersion
+}
+
+// Only joined rooms (or rooms we left) have a timeline, we can't see events in invited/knocked rooms
+func (c *slidingSyncCandidate) hasTimeline() bool {
+	switch c.membership.Membership {
+	case event.MembershipJoin:
+		return true
+	case event.MembershipLeave, event.MembershipBan:
+		return c.membershipVersion != types.ZeroVersionstamp
+	}
+	return false
+}
+
+// Implements the rooms part of simplified sliding sync (MSC4186). Rooms are sorted by their latest
+// event and each list returns the rooms within its ranges, along with any subscribed rooms. For an
+// incremental sync only rooms with changes after the from version are returned, except rooms that
+// have moved into a lists window, which are returned as if initial.
+func (r *RoomsDatabase) SlidingSyncRoomsForUser(
+	ctx context.Context,
+	userID id.UserID,
+	options SlidingSyncOptions,
+) (*SlidingSyncRoomsResults, error) {
+	initial := options.From == types.ZeroVersionstamp
+	// Bump the from version, FDB range starts are inclusive but we want changes *after* the version
+	fromVersion := options.From
+	if !initial {
+		fromVersion.UserVersion += 1
+	}
+
+	var latestVersion tuple.Versionstamp
+	memberships, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (types.Memberships, error) {
+		latestVersion = util.TxnGetLatestWriteVersion(ctx, txn)
+		return r.users.TxnLookupUserMemberships(txn, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := r.getSlidingSyncCandidates(ctx, memberships, latestVersion, fromVersion, initial)
+	if err != nil {
+		return nil, err
+	}
+
+	// Most recent rooms first, falling back to room ID so the order is stable
+	sortCandidates := func(candidates []*slidingSyncCandidate, getBump func(*slidingSyncCandidate) tuple.Versionstamp) {
+		slices.SortFunc(candidates, func(a, b *slidingSyncCandidate) int {
+			if c := types.CompareVersionstamps(getBump(b), getBump(a)); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.membership.RoomID, b.membership.RoomID)
+		})
+	}
+	sortCandidates(candidates, func(c *slidingSyncCandidate) tuple.Versionstamp { return c.bump.Version })
+
+	candidatesByRoomID := make(map[id.RoomID]*slidingSyncCandidate, len(candidates))
+	for _, candidate := range candidates {
+		candidatesByRoomID[candidate.membership.RoomID] = candidate
+	}
+
+	lists := make(map[string]*types.SlidingSyncListResult, len(options.Lists))
+	roomConfigs := make(map[id.RoomID]*types.SlidingSyncRoomConfig)
+	initialRoomIDs := make(map[id.RoomID]struct{})
+
+	addRoomConfig := func(roomID id.RoomID, config *types.SlidingSyncRoomConfig) {
+		existing, found := roomConfigs[roomID]
+		if !found {
+			existing = &types.SlidingSyncRoomConfig{}
+			roomConfigs[roomID] = existing
+		}
+		existing.RequiredState = append(existing.RequiredState, config.RequiredState...)
+		existing.TimelineLimit = max(existing.TimelineLimit, config.TimelineLimit)
+	}
+
+	for name, list := range options.Lists {
+		listCandidates := slices.DeleteFunc(slices.Clone(candidates), func(c *slidingSyncCandidate) bool {
+			return !matchSlidingSyncListFilters(list.Filters, c)
+		})
+		lists[name] = &types.SlidingSyncListResult{Count: len(listCandidates)}
+
+		for _, candidate := range slidingSyncListWindow(list, listCandidates) {
+			addRoomConfig(candidate.membership.RoomID, &list.SlidingSyncRoomConfig)
+		}
+
+		if initial {
+			continue
+		}
+
+		// Work out which rooms were in the window at the from version, any others have moved into
+		// the window and the client won't have them yet. Rooms joined (or invited to) since then are
+		// always new, rooms left since then are not as they were joined at the from version.
+		prevCandidates := slices.DeleteFunc(slices.Clone(listCandidates), func(c *slidingSyncCandidate) bool {
+			switch c.membership.Membership {
+			case event.MembershipLeave, event.MembershipBan:
+				return false
+			}
+			return types.CompareVersionstamps(c.membershipVersion, fromVersion) >= 0
+		})
+		sortCandidates(prevCandidates, func(c *slidingSyncCandidate) tuple.Versionstamp { return c.prevBump.Version })
+		prevWindow := slidingSyncListWindow(list, prevCandidates)
+
+		for _, candidate := range slidingSyncListWindow(list, listCandidates) {
+			if !slices.Contains(prevWindow, candidate) {
+				initialRoomIDs[candidate.membership.RoomID] = struct{}{}
+			}
+		}
+	}
+
+	for roomID, config := range options.RoomSubscriptions {
+		if _, found := candidatesByRoomID[roomID]; found {
+			addRoomConfig(roomID, config)
+		}
+	}
+
+	rooms, err := r.getSlidingSyncRooms(ctx, userID, candidatesByRoomID, roomConfigs, initialRoomIDs, fromVersion, initial)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := r.GetNotificationCountsForUser(ctx, userID, slices.Collect(maps.Keys(rooms)))
+	if err != nil {
+		return nil, err
+	}
+	for roomID, roomCounts := range counts {
+		if room, found := rooms[roomID]; found {
+			room.NotificationCount = roomCounts.NotificationCount
+			room.HighlightCount = roomCounts.HighlightCount
+		}
+	}
+
+	return &SlidingSyncRoomsResults{
+		NextVersion:    latestVersion,
+		Lists:          lists,
+		Rooms:          rooms,
+		VisibleRoomIDs: slices.Collect(maps.Keys(roomConfigs)),
+	}, nil
+}
+
+// Fetch each room within a lists window or subscribed to, with a bounded number of rooms being
+// fetched at once. Rooms without changes are not included in the results.
+func (r *RoomsDatabase) getSlidingSyncRooms(
+	ctx context.Context,
+	userID id.UserID,
+	candidatesByRoomID map[id.RoomID]*slidingSyncCandidate,
+	roomConfigs map[id.RoomID]*types.SlidingSyncRoomConfig,
+	initialRoomIDs map[id.RoomID]struct{},
+	fromVersion tuple.Versionstamp,
+	initial bool,
+) (map[id.RoomID]*types.SlidingSyncRoom, error) {
+	roomIDsCh := make(chan id.RoomID, len(roomConfigs))
+	for roomID := range roomConfigs {
+		roomIDsCh <- roomID
+	}
+	close(roomIDsCh)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var err error
+	rooms := make(map[id.RoomID]*types.SlidingSyncRoom, len(roomConfigs))
+
+	for range min(slidingSyncCandidatesWorkers, len(roomConfigs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for roomID := range roomIDsCh {
+				_, roomInitial := initialRoomIDs[roomID]
+				room, roomErr := r.getSlidingSyncRoom(
+					ctx, userID, candidatesByRoomID[roomID], roomConfigs[roomID], fromVersion, initial || roomInitial,
+				)
+
+				lock.Lock()
+				if roomErr != nil {
+					err = roomErr
+				} else if room != nil {
+					rooms[roomID] = room
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return rooms, err
+}
+
+// Fetch the membership & latest event versions of every room the user has a membership in. Rooms
+// the user has left are only included in incremental syncs if they left after the from version.
+// Rooms are looked up in batches, one transaction per batch, with a bounded number in flight.
+func (r *RoomsDatabase) getSlidingSyncCandidates(
+	ctx context.Context,
+	memberships types.Memberships,
+	latestVersion, fromVersion tuple.Versionstamp,
+	initial bool,
+) ([]*slidingSyncCandidate, error) {
+	batches := slices.Collect(slices.Chunk(slices.Collect(maps.Values(memberships)), slidingSyncCandidatesBatchSize))
+	batchesCh := make(chan []types.MembershipTup, len(batches))
+	for _, batch := range batches {
+		batchesCh <- batch
+	}
+	close(batchesCh)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var err error
+	candidates := make([]*slidingSyncCandidate, 0, len(memberships))
+
+	for range min(slidingSyncCandidatesWorkers, len(batches)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for batch := range batchesCh {
+				batchCandidates, batchErr := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*slidingSyncCandidate, error) {
+					batchCandidates := make([]*slidingSyncCandidate, 0, len(batch))
+					for _, membershipTup := range batch {
+						candidate, err := r.txnGetSlidingSyncCandidate(txn, membershipTup, latestVersion, fromVersion, initial)
+						if err != nil {
+							return nil, err
+						} else if candidate != nil {
+							batchCandidates = append(batchCandidates, candidate)
+						}
+					}
+					return batchCandidates, nil
+				})
+
+				lock.Lock()
+				if batchErr != nil {
+					err = batchErr
+				} else {
+					candidates = append(candidates, batchCandidates...)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return candidates, err
+}
+
+// Lookup a single candidate, returns nil if the room should not be included. Joined rooms only need
+// their latest event looking up, unless there are events since the from version.
+func (r *RoomsDatabase) txnGetSlidingSyncCandidate(
+	txn fdb.ReadTransaction,
+	membershipTup types.MembershipTup,
+	latestVersion, fromVersion tuple.Versionstamp,
+	initial bool,
+) (*slidingSyncCandidate, error) {
+	candidate := &slidingSyncCandidate{
+		membership: membershipTup,
+		toVersion:  latestVersion,
+	}
+
+	var err error
+
+	if membershipTup.Membership == event.MembershipJoin {
+		if candidate.bump, err = r.events.TxnLookupLatestRoomEventIDTup(txn, membershipTup.RoomID, candidate.toVersion); err != nil {
+			return nil, err
+		}
+		if initial || types.CompareVersionstamps(candidate.bump.Version, fromVersion) < 0 {
+			// Initial syncs don't compare against previous windows, and if nothing has happened in
+			// the room since the from version we joined before it and the room was at the same
+			// position then.
+			candidate.prevBump = candidate.bump
+			return candidate, nil
+		}
+	}
+
+	membershipVersion, err := r.events.TxnLookupVersionForEventID(txn, membershipTup.EventID)
+	if err != nil && !errors.Is(err, types.ErrEventNotFound) {
+		return nil, err
+	}
+	candidate.membershipVersion = membershipVersion
+
+	switch membershipTup.Membership {
+	case event.MembershipJoin:
+	case event.MembershipLeave, event.MembershipBan:
+		if initial || types.CompareVersionstamps(membershipVersion, fromVersion) < 0 {
+			return nil, nil
+		}
+		fallthrough
+	default:
+		// Events after the membership are not visible, but include the membership itself
+		candidate.toVersion = membershipVersion
+		candidate.toVersion.UserVersion += 1
+	}
+
+	if candidate.hasTimeline() {
+		if membershipTup.Membership != event.MembershipJoin {
+			if candidate.bump, err = r.events.TxnLookupLatestRoomEventIDTup(txn, membershipTup.RoomID, candidate.toVersion); err != nil {
+				return nil, err
+			}
+		}
+		if !initial && types.CompareVersionstamps(candidate.toVersion, fromVersion) > 0 {
+			if candidate.prevBump, err = r.events.TxnLookupLatestRoomEventIDTup(txn, membershipTup.RoomID, fromVersion); err != nil {
+				return nil, err
+			}
+		} else {
+			candidate.prevBump = candidate.bump
+		}
+	} else {
+		candidate.bump.Version = membershipVersion
+		candidate.prevBump.Version = membershipVersion
+	}
+
+	return candidate, nil
+}
+
+// Fetch the state, timeline & receipts for a room. For incremental syncs of rooms the client
+// already has, returns nil if nothing has changed. State is only included for initial rooms or
+// when the timeline is limited, otherwise any state changes are in the timeline.
+func (r *RoomsDatabase) getSlidingSyncRoom(
+	ctx context.Context,
+	userID id.UserID,
+	candidate *slidingSyncCandidate,
+	config *types.SlidingSyncRoomConfig,
+	fromVersion tuple.Versionstamp,
+	initial bool,
+) (*types.SlidingSyncRoom, error) {
+	roomID := candidate.membership.RoomID
+	room := &types.SlidingSyncRoom{Initial: initial}
+
+	if !candidate.hasTimeline() {
+		if !initial && types.CompareVersionstamps(candidate.membershipVersion, fromVersion) < 0 {
+			return nil, nil
+		}
+		inviteStateEvs, err := r.GetCurrentRoomInviteStateEvents(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		room.InviteState = inviteStateEvs
+		room.Name = slidingSyncRoomName(inviteStateEvs)
+		return room, nil
+	}
+
+	paginateFrom := fromVersion
+	if initial {
+		paginateFrom = types.ZeroVersionstamp
+	}
+
+	var timelineItems, receiptItems []SuperStreamItem
+	if _, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*struct{}, error) {
+		var err error
+		timelineItems, receiptItems, room.Limited, err = r.txnPaginateRoomSuperStreamTimeline(
+			txn, roomID, paginateFrom, candidate.toVersion, config.TimelineLimit,
+		)
+		return nil, err
+	}); err != nil {
+		return nil, err
+	}
+
+	if !initial && len(timelineItems) == 0 && len(receiptItems) == 0 {
+		return nil, nil
+	}
+
+	// State is only needed for the required state pairs and the room name
+	var statePairs [][2]string
+	if initial || room.Limited {
+		statePairs = make([][2]string, 0, len(config.RequiredState)+1)
+		for _, pair := range config.RequiredState {
+			if pair[1] == types.SlidingSyncStateKeyMe {
+				pair[1] = userID.String()
+			}
+			statePairs = append(statePairs, pair)
+		}
+		statePairs = append(statePairs, [2]string{event.StateRoomName.Type, ""})
+	}
+
+	now := time.Now()
+	var stateEvs []*types.Event
+	if _, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*struct{}, error) {
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		if candidate.bump.EventID != "" {
+			eventsProvider.WillGet(candidate.bump.EventID)
+		}
+		for _, item := range timelineItems {
+			eventsProvider.WillGet(item.EventIDTup.EventID)
+		}
+
+		if statePairs != nil {
+			stateMap, err := r.events.TxnLookupCurrentRoomStateMapForPairs(txn, roomID, statePairs, eventsProvider)
+			if err != nil {
+				return nil, err
+			}
+			stateEvs = make([]*types.Event, 0, len(stateMap))
+			for _, evID := range stateMap {
+				stateEvs = append(stateEvs, eventsProvider.MustGet(evID))
+			}
+		}
+
+		// Items are latest first, the timeline is oldest first
+		room.Timeline = make([]*types.Event, 0, len(timelineItems))
+		for _, item := range slices.Backward(timelineItems) {
+			ev := eventsProvider.MustGet(item.EventIDTup.EventID)
+			ev.Unsigned = map[string]any{
+				"age":      now.UnixMilli() - ev.Timestamp,
+				"hs.order": util.Base64EncodeURLSafe(types.VersionstampToValue(item.Version)),
+			}
+			room.Timeline = append(room.Timeline, ev)
+		}
+
+		if candidate.bump.EventID != "" {
+			room.BumpStamp = eventsProvider.MustGet(candidate.bump.EventID).Timestamp
+		}
+
+		// If the timeline is limited we may have missed receipts, so send the current ones
+		if initial || room.Limited {
+			var err error
+			room.Receipts, err = r.receipts.TxnGetCurrentReceiptsForRoom(txn, roomID, event.ReceiptTypeRead)
+			return nil, err
+		}
+		for _, item := range slices.Backward(receiptItems) {
+			room.Receipts = append(room.Receipts, item.Receipt)
+		}
+		return nil, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if statePairs != nil {
+		util.SortEventList(stateEvs)
+		for _, ev := range stateEvs {
+			if config.MatchRequiredState(userID, ev.Type.Type, *ev.StateKey) {
+				room.RequiredState = append(room.RequiredState, ev)
+			}
+		}
+		room.Name = slidingSyncRoomName(stateEvs)
+	}
+
+	return room, nil
+}
+
+// Paginate backwards through a rooms super stream collecting up to limit events, along with any
+// receipts in between. Both are returned latest first.
+func (r *RoomsDatabase) txnPaginateRoomSuperStreamTimeline(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	fromVersion, toVersion tuple.Versionstamp,
+	limit int,
+) ([]SuperStreamItem, []SuperStreamItem, bool, error) {
+	var timelineItems, receiptItems []SuperStreamItem
+
+	for {
+		items, err := r.txnPaginateRoomSuperStream(txn, roomID, fromVersion, toVersion, limit+1, true, nil)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		for _, item := range items {
+			switch item.Type {
+			case SuperStreamEvent:
+				if len(timelineItems) == limit {
+					return timelineItems, receiptItems, true, nil
+				}
+				timelineItems = append(timelineItems, item)
+			case SuperStreamReceipt:
+				receiptItems = append(receiptItems, item)
+			}
+		}
+
+		if len(items) <= limit {
+			return timelineItems, receiptItems, false, nil
+		}
+		// Range ends are exclusive so continue from the last (earliest) item
+		toVersion = items[len(items)-1].Version
+	}
+}
+
+func matchSlidingSyncListFilters(filters *types.SlidingSyncListFilters, candidate *slidingSyncCandidate) bool {
+	if filters == nil {
+		return true
+	}
+	if filters.IsInvite != nil && *filters.IsInvite != (candidate.membership.Membership == event.MembershipInvite) {
+		return false
+	}
+	return true
+}
+
+// Returns the (sorted) candidates within any of the lists ranges
+func slidingSyncListWindow(list *types.SlidingSyncList, candidates []*slidingSyncCandidate) []*slidingSyncCandidate {
+	window := make([]*slidingSyncCandidate, 0)
+	for i, candidate := range candidates {
+		if slices.ContainsFunc(list.Ranges, func(rng [2]int) bool { return i >= rng[0] && i <= rng[1] }) {
+			window = append(window, candidate)
+		}
+	}
+	return window
+}
+
+// Returns the m.room.name from the state events, if present
+func slidingSyncRoomName(stateEvs []*types.Event) string {
+	for _, ev := range stateEvs {
+		if ev.Type == event.StateRoomName && ev.StateKey != nil && *ev.StateKey == "" {
+			return gjson.GetBytes(ev.Content, "name").String()
+		}
+	}
+	return ""
+}
@@ -21,6 +21,8 @@ type SyncOptions struct {
 	From tuple.Versionstamp
 	// Limit of events returned
 	Limit int
+	// Filter rooms, events & receipts, may be nil
+	Filter *types.Filter
 }
 
 func (r *RoomsDatabase) SyncRoomsForUser(
@@ -38,7 +40,7 @@ func (r *RoomsDatabase) SyncRoomsForUser(
 			return r.users.TxnLookupUserMembershipChanges(txn, userID, fromVersion, toVersion)
 		},
 		func(txn fdb.ReadTransaction, roomID id.RoomID, fromVersion, toVersion tuple.Versionstamp, eventsProvider *events.TxnEventsProvider) ([]SuperStreamItem, error) {
-			return r.txnPaginateRoomSuperStream(txn, roomID, fromVersion, toVersion, options.Limit, eventsProvider)
+			return r.txnPaginateRoomSuperStream(txn, roomID, fromVersion, toVersion, options.Limit, false, eventsProvider)
 		},
 	)
 }
@@ -91,7 +93,9 @@ func (r *RoomsDatabase) syncRoomEvents(
 
 	membershipsWithRanges := make(map[types.MembershipTup]*versionRange, len(memberships))
 	for _, membershipTup := range memberships {
-		membershipsWithRanges[membershipTup] = &versionRange{options.From, latestVersion}
+		if options.Filter.IncludeRoom(membershipTup.RoomID) {
+			membershipsWithRanges[membershipTup] = &versionRange{options.From, latestVersion}
+		}
 	}
 
 	// Get membership changes options.From -> toVersion
@@ -99,6 +103,9 @@ func (r *RoomsDatabase) syncRoomEvents(
 		return getMembershipChanges(txn, options.From, latestVersion)
 	})
 	for _, membershipChange := range membershipChanges {
+		if !options.Filter.IncludeRoom(membershipChange.RoomID) {
+			continue
+		}
 		vRange, found := membershipsWithRanges[membershipChange.MembershipTup]
 		if !found {
 			// TODO: does this logic (default from/latest) actually make sense? Should this even
@@ -164,20 +171,22 @@ func (r *RoomsDatabase) syncRoomEvents(
 	// the first up to our limit, discarding the rest. We'll also need a room -> membership map.
 	roomIDToMembership := make(map[id.RoomID]types.MembershipTup, len(membershipsWithRanges))
 	allItems := make([]SuperStreamItem, 0, len(membershipsWithRanges)*options.Limit)
+	// Rooms that filled their page may have more items after the last one, so we can't include
+	// anything beyond the earliest of those until the next batch.
+	var maxVersion tuple.Versionstamp
 	for _, memAndEvs := range allResults {
 		roomIDToMembership[memAndEvs.membership.RoomID] = memAndEvs.membership
 		allItems = append(allItems, memAndEvs.items...)
+
+		if len(memAndEvs.items) == options.Limit {
+			lastVersion := memAndEvs.items[len(memAndEvs.items)-1].Version
+			if maxVersion == types.ZeroVersionstamp || types.CompareVersionstamps(lastVersion, maxVersion) < 0 {
+				maxVersion = lastVersion
+			}
+		}
 	}
 
-	// Sort and grab the first events up to our limit (or the entire slice)
 	types.SortVersioners(allItems)
-	items := allItems[:util.MinInt(options.Limit, len(allItems))]
-
-	if len(items) == options.Limit {
-		// If our batch is full override the next batch to the greatest of this one as we're not
-		// up to date with latestVersion.
-		latestVersion = items[len(items)-1].Version
-	}
 
 	// We finally have the events we need, now let's fetch them!
 	rooms := make(map[types.MembershipTup]*types.SyncRoom, len(membershipsWithRanges))
@@ -194,14 +203,28 @@ func (r *RoomsDatabase) syncRoomEvents(
 	if _, err = util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*struct{}, error) {
 		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
 
-		for _, item := range items {
+		// Grab the items in order up to our limit, skipping any that don't match the filter. If
+		// our batch is full (or we reach the max version) override the next batch to the last
+		// item considered as we're not up to date with latestVersion.
+		var included int
+		for _, item := range allItems {
+			if maxVersion != types.ZeroVersionstamp && types.CompareVersionstamps(item.Version, maxVersion) > 0 {
+				break
+			}
+
 			switch item.Type {
 			case SuperStreamReceipt:
+				if !options.Filter.MatchEphemeral(item.Receipt.RoomID, event.EphemeralEventReceipt) {
+					continue
+				}
 				room := getSyncRoom(item.Receipt.RoomID)
 				room.Receipts = append(room.Receipts, item.Receipt)
 			case SuperStreamEvent:
 				evIDTup := item.EventIDTup
 				ev := eventsProvider.MustGet(evIDTup.EventID)
+				if !options.Filter.MatchTimelineEvent(ev) {
+					continue
+				}
 				ev.Unsigned = map[string]any{
 					"age":      now.UnixMilli() - ev.Timestamp,
 					"hs.order": util.Base64EncodeURLSafe(types.VersionstampToValue(item.Version)),
@@ -209,8 +232,17 @@ func (r *RoomsDatabase) syncRoomEvents(
 				room := getSyncRoom(evIDTup.RoomID)
 				room.TimelineEvents = append(room.TimelineEvents, ev)
 			}
+
+			included++
+			if included == options.Limit {
+				latestVersion = item.Version
+				return nil, nil
+			}
 		}
 
+		if maxVersion != types.ZeroVersionstamp {
+			latestVersion = maxVersion
+		}
 		return nil, nil
 	}); err != nil {
 		return types.ZeroVersionstamp, nil, err
@@ -13,9 +13,13 @@ import (
 	"github.com/beeper/babbleserv/internal/util"
 )
 
+// Returns the current state & receipts of each room the user is a member of, filtered by the
+// (optional) filter. When the filter lazy loads members no member events are included, these are
+// added separately depending on the timeline senders.
 func (r *RoomsDatabase) InitRoomsForUser(
 	ctx context.Context,
 	userID id.UserID,
+	filter *types.Filter,
 ) (tuple.Versionstamp, map[types.MembershipTup]*types.SyncRoom, error) {
 	// Get current memberships and latest event version in transaction, this means the memberships
 	// are valid at that version.
@@ -49,16 +53,34 @@ func (r *RoomsDatabase) InitRoomsForUser(
 	}()
 
 	for roomID, membershipTup := range memberships {
+		if !filter.IncludeRoom(roomID) {
+			continue
+		} else if !filter.IncludeLeave() && (membershipTup.Membership == event.MembershipLeave || membershipTup.Membership == event.MembershipBan) {
+			continue
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
 			syncRoom := &types.SyncRoom{}
 
-			syncRoom.StateEvents, err = r.GetCurrentRoomStateEvents(ctx, roomID)
+			stateEvents, err := r.GetCurrentRoomStateEvents(ctx, roomID)
 			if err != nil {
 				panic(err)
 			}
+			for _, ev := range stateEvents {
+				if filter.LazyLoadMembers() && ev.Type == event.StateMember {
+					continue
+				} else if filter.MatchStateEvent(ev) {
+					syncRoom.StateEvents = append(syncRoom.StateEvents, ev)
+				}
+			}
+
+			if !filter.MatchEphemeral(roomID, event.EphemeralEventReceipt) {
+				resultsCh <- membershipAndSyncRoom{membershipTup, syncRoom}
+				return
+			}
 
 			// Receipts may not be exactly aligned with the state events since we're using two txns
 			syncRoom.Receipts, err = util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.Receipt, error) {
@@ -173,18 +173,20 @@ func (r *RoomsDatabase) txnAddReceiptToSuperStream(
 // Super stream pagination
 //
 
-// Paginate a rooms super stream items for client sync
+// Paginate a rooms super stream items for client sync, reverse returns the latest items first
 func (r *RoomsDatabase) txnPaginateRoomSuperStream(
 	txn fdb.ReadTransaction,
 	roomID id.RoomID,
 	fromVersion, toVersion tuple.Versionstamp,
 	limit int,
+	reverse bool,
 	eventsProvider *events.TxnEventsProvider,
 ) ([]SuperStreamItem, error) {
 	iter := txn.GetRange(
 		r.rangeForSuperStream(roomID, fromVersion, toVersion),
 		fdb.RangeOptions{
-			Limit: limit,
+			Limit:   limit,
+			Reverse: reverse,
 		},
 	).Iterator()
 
@@ -0,0 +1,100 @@
+package rooms
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type PaginateRoomThreadsOptions struct {
+	// Root event version to paginate back from (exclusive), zero starts from the latest root
+	From  tuple.Versionstamp
+	Limit int
+	// Only return threads the user started or replied to
+	Participated bool
+}
+
+type PaginateRoomThreadsResults struct {
+	// Thread root events, latest root first
+	Events []*types.Event
+	// Position to continue paginating from, zero if there are no more threads
+	// (may be set with fewer results than the limit once maxPaginationScanned rows are scanned)
+	End tuple.Versionstamp
+}
+
+// Paginate thread roots in a room, latest first, roots are only indexed once they have a reply
+func (r *RoomsDatabase) PaginateRoomThreads(
+	ctx context.Context,
+	roomID id.RoomID,
+	userID id.UserID,
+	options PaginateRoomThreadsOptions,
+) (*PaginateRoomThreadsResults, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*PaginateRoomThreadsResults, error) {
+		results := &PaginateRoomThreadsResults{
+			Events: make([]*types.Event, 0, options.Limit),
+		}
+
+		endVersion := options.From
+		var scanned int
+		for {
+			eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+			tups, err := r.events.TxnPaginateRoomThreadRootTups(
+				txn, roomID, types.ZeroVersionstamp, endVersion, options.Limit, true, eventsProvider,
+			)
+			if err != nil {
+				return nil, err
+			}
+			scanned += len(tups)
+
+			for _, tup := range tups {
+				ev := eventsProvider.MustGet(tup.EventID)
+				if ev.RoomID != roomID {
+					// Thread replies may reference events in other rooms, never return those
+					continue
+				}
+				if options.Participated {
+					if participated, err := r.txnHasUserParticipatedInThread(txn, ev, userID); err != nil {
+						return nil, err
+					} else if !participated {
+						continue
+					}
+				}
+				results.Events = append(results.Events, ev)
+				if len(results.Events) == options.Limit {
+					results.End = tup.Version
+					return results, nil
+				}
+			}
+
+			if len(tups) < options.Limit {
+				// No more threads in the room
+				return results, nil
+			}
+
+			// Continue before the last root, skipping any the user didn't participate in
+			endVersion = tups[len(tups)-1].Version
+			if scanned >= maxPaginationScanned {
+				results.End = endVersion
+				return results, nil
+			}
+		}
+	})
+}
+
+// Whether the user sent the thread root or any reply in the thread
+func (r *RoomsDatabase) txnHasUserParticipatedInThread(
+	txn fdb.ReadTransaction,
+	rootEv *types.Event,
+	userID id.UserID,
+) (bool, error) {
+	if rootEv.Sender == userID {
+		return true, nil
+	}
+	b, err := txn.Get(r.events.KeyForRoomThreadParticipant(rootEv.RoomID, rootEv.ID, userID)).Get()
+	return b != nil, err
+}
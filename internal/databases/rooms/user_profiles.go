@@ -120,3 +120,12 @@ func (r *RoomsDatabase) UpdateUserProfile(ctx context.Context, userID id.UserID,
 
 	return nil
 }
+
+// Remove the users profile without sending any member event updates, used when deactivating users
+func (r *RoomsDatabase) EraseUserProfile(ctx context.Context, userID id.UserID) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		txn.Clear(r.users.KeyForUserProfile(userID))
+		return nil, nil
+	})
+	return err
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/types"
@@ -27,3 +29,91 @@ func (r *RoomsDatabase) GetUserOutlierMemberships(ctx context.Context, userID id
 		return r.users.TxnLookupUserOutlierMemberships(txn, userID)
 	})
 }
+
+// Filter the user IDs down to those joined to any of the given rooms
+func (r *RoomsDatabase) FilterUsersInAnyRoom(ctx context.Context, userIDs []id.UserID, roomIDs []id.RoomID) ([]id.UserID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]id.UserID, error) {
+		filtered := make([]id.UserID, 0, len(userIDs))
+		for _, userID := range userIDs {
+			memberships, err := r.users.TxnLookupUserMemberships(txn, userID)
+			if err != nil {
+				return nil, err
+			}
+			for _, roomID := range roomIDs {
+				if membershipTup, found := memberships[roomID]; found && membershipTup.Membership == event.MembershipJoin {
+					filtered = append(filtered, userID)
+					break
+				}
+			}
+		}
+		return filtered, nil
+	})
+}
+
+// Returns the (deduplicated) users currently joined to any of the given rooms
+func (r *RoomsDatabase) GetJoinedMembersForRooms(ctx context.Context, roomIDs []id.RoomID) ([]id.UserID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]id.UserID, error) {
+		seen := make(map[id.UserID]struct{})
+		userIDs := make([]id.UserID, 0)
+		for _, roomID := range roomIDs {
+			iter := txn.GetRange(
+				r.events.RangeForCurrentRoomMembers(roomID),
+				fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+			).Iterator()
+			for iter.Advance() {
+				kv, err := iter.Get()
+				if err != nil {
+					return nil, err
+				}
+				stateTup, membershipTup := r.events.CurrentRoomMemberKeyValueToTups(kv)
+				userID := id.UserID(stateTup.StateKey)
+				if _, found := seen[userID]; found || membershipTup.Membership != event.MembershipJoin {
+					continue
+				}
+				seen[userID] = struct{}{}
+				userIDs = append(userIDs, userID)
+			}
+		}
+		return userIDs, nil
+	})
+}
+
+// Leave every room the user is joined, invited or knocking in. Rooms already left are skipped so
+// this is safe to retry. Returns the number of rooms left.
+func (r *RoomsDatabase) LeaveAllUserRooms(ctx context.Context, userID id.UserID) (int, error) {
+	memberships, err := r.GetUserMemberships(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	log := zerolog.Ctx(ctx)
+	sKey := userID.String()
+
+	var left int
+	for roomID, membershipTup := range memberships {
+		switch membershipTup.Membership {
+		case event.MembershipJoin, event.MembershipInvite, event.MembershipKnock:
+		default:
+			continue
+		}
+
+		content := map[string]any{"membership": event.MembershipLeave}
+		partialEv := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
+
+		results, err := r.SendLocalEvents(ctx, roomID, []*types.PartialEvent{partialEv}, SendLocalEventsOptions{})
+		if err != nil {
+			return left, err
+		} else if len(results.Rejected) > 0 {
+			log.Warn().
+				Err(results.Rejected[0].Error).
+				Str("room_id", roomID.String()).
+				Msg("Leave event not allowed")
+			continue
+		}
+		left++
+	}
+
+	// TODO: reject any outlier (remote) invites over federation
+
+	return left, nil
+}
@@ -0,0 +1,101 @@
+package databases
+
+import (
+	"context"
+	"slices"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Simplified sliding sync (MSC4186), the versions map is used as the position in the same way as
+// regular sync. Extensions are only synced when enabled in the request.
+func (d *Databases) SlidingSyncForUser(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	versions types.VersionMap,
+	req *types.SlidingSyncRequest,
+) (*types.SlidingSync, error) {
+	roomsResults, err := d.Rooms.SlidingSyncRoomsForUser(ctx, userID, rooms.SlidingSyncOptions{
+		From:              versions[types.RoomsVersionKey],
+		Lists:             req.Lists,
+		RoomSubscriptions: req.RoomSubscriptions,
+	})
+	if err != nil {
+		return nil, err
+	} else {
+		versions[types.RoomsVersionKey] = roomsResults.NextVersion
+	}
+
+	sync := types.NewSlidingSync()
+	sync.Lists = roomsResults.Lists
+	sync.Rooms = roomsResults.Rooms
+
+	if req.Extensions.Receipts.Enabled {
+		sync.SetReceipts()
+	}
+
+	if req.Extensions.ToDevice.Enabled && d.Transient != nil && deviceID != "" {
+		nextDevicesVersion, toDeviceEvs, err := d.Transient.SyncToDeviceForUserDevice(ctx, userID, deviceID, versions[types.DevicesVersionKey], false)
+		if err != nil {
+			return nil, err
+		} else {
+			versions[types.DevicesVersionKey] = nextDevicesVersion
+		}
+		sync.SetToDeviceEvents(util.Base64EncodeURLSafe(types.VersionstampToValue(nextDevicesVersion)), toDeviceEvs)
+	}
+
+	if req.Extensions.E2EE.Enabled && d.Accounts != nil && deviceID != "" {
+		counts, unusedFallbackAlgorithms, err := d.Accounts.GetDeviceKeyCounts(ctx, userID, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		sync.SetDeviceKeyCounts(counts, unusedFallbackAlgorithms)
+	}
+
+	if req.Extensions.AccountData.Enabled && d.Accounts != nil {
+		nextAccountsVersion := versions[types.AccountsVersionKey]
+		var accountDataEvs []*types.AccountDataEvent
+		initialAccounts := nextAccountsVersion == types.ZeroVersionstamp
+		if initialAccounts {
+			nextAccountsVersion, accountDataEvs, err = d.Accounts.InitAccountDataForUser(ctx, userID)
+		} else {
+			nextAccountsVersion, accountDataEvs, err = d.Accounts.SyncAccountDataForUser(ctx, userID, nextAccountsVersion)
+		}
+		if err != nil {
+			return nil, err
+		} else {
+			versions[types.AccountsVersionKey] = nextAccountsVersion
+		}
+
+		// Changes are only sent for visible rooms, so rooms new to the client may be missing
+		// account data changed while they were out of view. Send everything for those rooms.
+		var initialRoomIDs []id.RoomID
+		if !initialAccounts {
+			for roomID, room := range roomsResults.Rooms {
+				if room.Initial {
+					initialRoomIDs = append(initialRoomIDs, roomID)
+				}
+			}
+		}
+		if len(initialRoomIDs) > 0 {
+			roomAccountDataEvs, err := d.Accounts.GetRoomAccountDataForUser(ctx, userID, initialRoomIDs)
+			if err != nil {
+				return nil, err
+			}
+			accountDataEvs = slices.DeleteFunc(accountDataEvs, func(ev *types.AccountDataEvent) bool {
+				return slices.Contains(initialRoomIDs, ev.RoomID)
+			})
+			accountDataEvs = append(accountDataEvs, roomAccountDataEvs...)
+		}
+
+		sync.SetAccountDataEvents(accountDataEvs, roomsResults.VisibleRoomIDs)
+	}
+
+	sync.Pos = util.VersionMapToString(versions)
+	return sync, nil
+}
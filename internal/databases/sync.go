@@ -2,7 +2,10 @@ package databases
 
 import (
 	"context"
+	"maps"
+	"slices"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/databases/rooms"
@@ -10,8 +13,18 @@ import (
 	"github.com/beeper/babbleserv/internal/util"
 )
 
+// Matches the /messages limit
+const maxSyncTimelineLimit = 100
+
 type SyncOptions struct {
 	Limit int
+	// Device to sync to-device events for, if empty to-device events are not synced
+	DeviceID id.DeviceID
+	// Filter applied to the sync, may be nil
+	Filter *types.Filter
+	// Don't delete to-device events up to the since position, used by the sync stream which
+	// acknowledges positions itself once the client has had time to receive them
+	RetainToDevice bool
 }
 
 func (d *Databases) SyncForUser(
@@ -20,9 +33,17 @@ func (d *Databases) SyncForUser(
 	versions types.VersionMap,
 	options SyncOptions,
 ) (*types.Sync, error) {
+	// The filter timeline limit replaces the limit on events fetched across all rooms in this batch,
+	// it is not applied per room. Capped like /messages so a filter can't request unbounded batches.
+	if limit := options.Filter.TimelineLimit(); limit > 0 {
+		options.Limit = min(limit, maxSyncTimelineLimit)
+	}
+
+	fromRoomsVersion := versions[types.RoomsVersionKey]
 	nextRoomsVersion, rooms, err := d.Rooms.SyncRoomsForUser(ctx, userID, rooms.SyncOptions{
-		From:  versions[types.RoomsVersionKey],
-		Limit: options.Limit,
+		From:   fromRoomsVersion,
+		Limit:  options.Limit,
+		Filter: options.Filter,
 	})
 	if err != nil {
 		return nil, err
@@ -32,14 +53,299 @@ func (d *Databases) SyncForUser(
 
 	sync := types.NewSyncFromRooms(rooms)
 
+	if err := d.syncLazyLoadedMembers(ctx, userID, options.DeviceID, options.Filter, sync); err != nil {
+		return nil, err
+	}
+
+	if fromRoomsVersion != types.ZeroVersionstamp {
+		// Bump the from version, FDB range starts are inclusive but we want changes *after*
+		fromRoomsVersion.UserVersion += 1
+	}
+	counts, err := d.Rooms.SyncNotificationCountsForUser(
+		ctx, userID, slices.Collect(maps.Keys(sync.Rooms.Join)), fromRoomsVersion, nextRoomsVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sync.SetNotificationCounts(filterNotificationCounts(options.Filter, counts), options.Filter.UnreadThreadNotifications())
+
+	if d.Transient != nil {
+		if err := d.syncTransientForUser(ctx, userID, options.DeviceID, options.Filter, options.RetainToDevice, versions, sync); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Accounts != nil {
+		nextAccountsVersion, accountDataEvs, err := d.Accounts.SyncAccountDataForUser(ctx, userID, versions[types.AccountsVersionKey])
+		if err != nil {
+			return nil, err
+		} else {
+			versions[types.AccountsVersionKey] = nextAccountsVersion
+		}
+		if err := d.setSyncAccountDataEvents(ctx, userID, sync, filterAccountDataEvents(options.Filter, accountDataEvs)); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Accounts != nil && options.DeviceID != "" {
+		if err := d.syncAccountsForUserDevice(ctx, userID, options.DeviceID, sync); err != nil {
+			return nil, err
+		}
+	}
+
 	// TODO
-	// 1. get joined rooms
-	// 2. parallel sync transient db x rooms + accounts + to-device
+	// parallel sync transient db x rooms + accounts
 
 	sync.NextBatch = util.VersionMapToString(versions)
 	return sync, nil
 }
 
+func filterNotificationCounts(
+	filter *types.Filter,
+	counts map[id.RoomID]*types.NotificationCounts,
+) map[id.RoomID]*types.NotificationCounts {
+	maps.DeleteFunc(counts, func(roomID id.RoomID, _ *types.NotificationCounts) bool {
+		return !filter.IncludeRoom(roomID)
+	})
+	return counts
+}
+
+func filterAccountDataEvents(filter *types.Filter, evs []*types.AccountDataEvent) []*types.AccountDataEvent {
+	return slices.DeleteFunc(evs, func(ev *types.AccountDataEvent) bool {
+		return !filter.MatchAccountData(ev)
+	})
+}
+
+// Merges account data into the sync, room account data for joined rooms not otherwise in the sync
+// is added to the joined rooms.
+func (d *Databases) setSyncAccountDataEvents(
+	ctx context.Context,
+	userID id.UserID,
+	sync *types.Sync,
+	evs []*types.AccountDataEvent,
+) error {
+	var memberships types.Memberships
+
+	for _, ev := range evs {
+		if ev.RoomID == "" || sync.Room(ev.RoomID) != nil {
+			continue
+		}
+		if memberships == nil {
+			var err error
+			if memberships, err = d.Rooms.GetUserMemberships(ctx, userID); err != nil {
+				return err
+			}
+		}
+		if membershipTup, found := memberships[ev.RoomID]; found && membershipTup.Membership == event.MembershipJoin {
+			sync.JoinedRoom(ev.RoomID)
+		}
+	}
+
+	sync.SetAccountDataEvents(evs)
+	return nil
+}
+
+// Adds the current member events of timeline senders (and the syncing user) to the state of each
+// joined/left room when the filter lazy loads members. Members already sent to the device are
+// skipped unless the filter includes redundant members.
+func (d *Databases) syncLazyLoadedMembers(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	filter *types.Filter,
+	sync *types.Sync,
+) error {
+	if !filter.LazyLoadMembers() {
+		return nil
+	}
+
+	// Only track sent members if we know the device
+	trackSent := d.Accounts != nil && deviceID != ""
+
+	syncRooms := make(map[id.RoomID]*types.SyncRoom, len(sync.Rooms.Join)+len(sync.Rooms.Leave))
+	maps.Copy(syncRooms, sync.Rooms.Join)
+	maps.Copy(syncRooms, sync.Rooms.Leave)
+
+	neededMembers := make(map[id.RoomID][]id.UserID, len(syncRooms))
+	sentMembers := make(map[id.RoomID][]id.UserID, len(syncRooms))
+
+	for roomID, room := range syncRooms {
+		// Member events already in the sync are sent as-is, no need to lazy load them
+		var sent []id.UserID
+		for _, ev := range slices.Concat(room.StateEvents, room.TimelineEvents) {
+			if ev.Type == event.StateMember && ev.StateKey != nil {
+				sent = append(sent, id.UserID(*ev.StateKey))
+			}
+		}
+		sentMembers[roomID] = sent
+
+		needed := []id.UserID{userID}
+		for _, ev := range room.TimelineEvents {
+			needed = append(needed, ev.Sender)
+		}
+		slices.Sort(needed)
+		needed = slices.DeleteFunc(slices.Compact(needed), func(memberID id.UserID) bool {
+			return slices.Contains(sent, memberID)
+		})
+		if len(needed) > 0 {
+			neededMembers[roomID] = needed
+		}
+	}
+
+	if trackSent && !filter.IncludeRedundantMembers() {
+		var err error
+		if neededMembers, err = d.Accounts.FilterUnsentRoomMembers(ctx, userID, deviceID, neededMembers); err != nil {
+			return err
+		}
+	}
+
+	for roomID, memberIDs := range neededMembers {
+		memberEvs, err := d.Rooms.GetCurrentRoomSpecificMemberEvents(ctx, roomID, memberIDs)
+		if err != nil {
+			return err
+		}
+		room := syncRooms[roomID]
+		for _, ev := range memberEvs {
+			if filter.MatchStateEvent(ev) {
+				room.StateEvents = append(room.StateEvents, ev)
+				sentMembers[roomID] = append(sentMembers[roomID], id.UserID(*ev.StateKey))
+			}
+		}
+	}
+
+	if trackSent {
+		maps.DeleteFunc(sentMembers, func(_ id.RoomID, memberIDs []id.UserID) bool {
+			return len(memberIDs) == 0
+		})
+		if len(sentMembers) > 0 {
+			return d.Accounts.SetSentRoomMembers(ctx, userID, deviceID, sentMembers)
+		}
+	}
+
+	return nil
+}
+
+// Merges the device's E2EE key counts into the sync
+func (d *Databases) syncAccountsForUserDevice(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	sync *types.Sync,
+) error {
+	counts, unusedFallbackAlgorithms, err := d.Accounts.GetDeviceKeyCounts(ctx, userID, deviceID)
+	if err != nil {
+		return err
+	}
+	sync.DeviceOneTimeKeysCount = counts
+	sync.DeviceUnusedFallbackKeyTypes = unusedFallbackAlgorithms
+	return nil
+}
+
+// Merges transient data (typing for the users joined rooms, presence of users sharing a room,
+// to-device events for the device) into the sync.
+func (d *Databases) syncTransientForUser(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	filter *types.Filter,
+	retainToDevice bool,
+	versions types.VersionMap,
+	sync *types.Sync,
+) error {
+	memberships, err := d.Rooms.GetUserMemberships(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	roomIDs := make([]id.RoomID, 0, len(memberships))
+	for roomID, membershipTup := range memberships {
+		if membershipTup.Membership == event.MembershipJoin {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+
+	// Note: typing & presence share the transient position, we sync typing first so any presence
+	// changes after the typing transaction are returned again next sync rather than skipped.
+	fromTransientVersion := versions[types.TransientVersionKey]
+
+	nextTransientVersion, typing, err := d.Transient.SyncTypingForRooms(ctx, roomIDs, fromTransientVersion)
+	if err != nil {
+		return err
+	} else {
+		versions[types.TransientVersionKey] = nextTransientVersion
+	}
+
+	for roomID, userIDs := range typing {
+		if filter.MatchEphemeral(roomID, event.EphemeralEventTyping) {
+			sync.JoinedRoom(roomID).Typing = userIDs
+		}
+	}
+
+	if d.config.Transient.Presence.Enabled {
+		var presences map[id.UserID]*types.Presence
+		var sharedUserIDs []id.UserID
+
+		if fromTransientVersion == types.ZeroVersionstamp {
+			// Initial sync, rather than every users presence on the server get the presence of
+			// ourselves and users we share a room with directly.
+			sharedUserIDs, err = d.Rooms.GetJoinedMembersForRooms(ctx, roomIDs)
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(sharedUserIDs, userID) {
+				sharedUserIDs = append(sharedUserIDs, userID)
+			}
+			if presences, err = d.Transient.GetUserPresences(ctx, sharedUserIDs); err != nil {
+				return err
+			}
+			sharedUserIDs = slices.DeleteFunc(sharedUserIDs, func(sharedUserID id.UserID) bool {
+				_, found := presences[sharedUserID]
+				return !found
+			})
+		} else {
+			if _, presences, err = d.Transient.SyncPresence(ctx, fromTransientVersion); err != nil {
+				return err
+			}
+
+			// Only include presence for ourselves and users we share a room with
+			changedUserIDs := make([]id.UserID, 0, len(presences))
+			for presenceUserID := range presences {
+				if presenceUserID != userID {
+					changedUserIDs = append(changedUserIDs, presenceUserID)
+				}
+			}
+			if sharedUserIDs, err = d.Rooms.FilterUsersInAnyRoom(ctx, changedUserIDs, roomIDs); err != nil {
+				return err
+			}
+			if _, found := presences[userID]; found {
+				sharedUserIDs = append(sharedUserIDs, userID)
+			}
+		}
+
+		presenceEvs := make([]*types.PresenceEvent, 0, len(sharedUserIDs))
+		for _, sharedUserID := range sharedUserIDs {
+			if filter.MatchPresence(sharedUserID) {
+				presenceEvs = append(presenceEvs, types.NewPresenceEvent(sharedUserID, presences[sharedUserID]))
+			}
+		}
+		sync.SetPresenceEvents(presenceEvs)
+	}
+
+	if deviceID != "" {
+		nextDevicesVersion, toDeviceEvs, err := d.Transient.SyncToDeviceForUserDevice(
+			ctx, userID, deviceID, versions[types.DevicesVersionKey], retainToDevice,
+		)
+		if err != nil {
+			return err
+		} else {
+			versions[types.DevicesVersionKey] = nextDevicesVersion
+		}
+		sync.SetToDeviceEvents(toDeviceEvs)
+	}
+
+	return nil
+}
+
 func (d *Databases) SyncForServer(
 	ctx context.Context,
 	serverName string,
@@ -2,6 +2,8 @@ package databases
 
 import (
 	"context"
+	"maps"
+	"slices"
 
 	"maunium.net/go/mautrix/id"
 
@@ -12,10 +14,19 @@ import (
 func (d *Databases) InitForUser(
 	ctx context.Context,
 	userID id.UserID,
+	deviceID id.DeviceID,
+	filter *types.Filter,
 ) (*types.Sync, error) {
-	versions := make(types.VersionMap, 3)
+	versions := make(types.VersionMap, 4)
 
-	nextRoomsVersion, rooms, err := d.Rooms.InitRoomsForUser(ctx, userID)
+	// The client is starting over so has none of the previously lazy loaded members
+	if filter.LazyLoadMembers() && d.Accounts != nil && deviceID != "" {
+		if err := d.Accounts.ClearSentRoomMembers(ctx, userID, deviceID); err != nil {
+			return nil, err
+		}
+	}
+
+	nextRoomsVersion, rooms, err := d.Rooms.InitRoomsForUser(ctx, userID, filter)
 	if err != nil {
 		return nil, err
 	} else {
@@ -24,6 +35,40 @@ func (d *Databases) InitForUser(
 
 	sync := types.NewSyncFromRooms(rooms)
 
+	if err := d.syncLazyLoadedMembers(ctx, userID, deviceID, filter, sync); err != nil {
+		return nil, err
+	}
+
+	counts, err := d.Rooms.GetNotificationCountsForUser(ctx, userID, slices.Collect(maps.Keys(sync.Rooms.Join)))
+	if err != nil {
+		return nil, err
+	}
+	sync.SetNotificationCounts(filterNotificationCounts(filter, counts), filter.UnreadThreadNotifications())
+
+	if d.Transient != nil {
+		if err := d.syncTransientForUser(ctx, userID, deviceID, filter, false, versions, sync); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Accounts != nil {
+		nextAccountsVersion, accountDataEvs, err := d.Accounts.InitAccountDataForUser(ctx, userID)
+		if err != nil {
+			return nil, err
+		} else {
+			versions[types.AccountsVersionKey] = nextAccountsVersion
+		}
+		if err := d.setSyncAccountDataEvents(ctx, userID, sync, filterAccountDataEvents(filter, accountDataEvs)); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Accounts != nil && deviceID != "" {
+		if err := d.syncAccountsForUserDevice(ctx, userID, deviceID, sync); err != nil {
+			return nil, err
+		}
+	}
+
 	sync.NextBatch = util.VersionMapToString(versions)
 	return sync, nil
 }
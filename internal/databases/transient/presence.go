@@ -0,0 +1,223 @@
+package transient
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// How often a sync request refreshes the users last sync (and when online, last active)
+	// timestamp, avoids a write every sync. Must be well below the presence timeouts.
+	presenceSyncRefreshInterval = 30 * time.Second
+	// Maximum users moved to each of unavailable and offline per timeouts call
+	presenceTimeoutsBatchSize = 1000
+)
+
+func newOfflinePresence() *types.Presence {
+	return &types.Presence{Presence: event.PresenceOffline}
+}
+
+func (t *TransientDatabase) GetUserPresence(ctx context.Context, userID id.UserID) (*types.Presence, error) {
+	return util.DoReadTransaction(ctx, t.db, func(txn fdb.ReadTransaction) (*types.Presence, error) {
+		presence, err := t.presence.TxnGetUserPresence(txn, userID)
+		if err != nil {
+			return nil, err
+		} else if presence == nil {
+			return newOfflinePresence(), nil
+		}
+		return presence, nil
+	})
+}
+
+// Explicitly set a users presence (the presence API), returns true if the presence changed
+func (t *TransientDatabase) SetUserPresence(
+	ctx context.Context,
+	userID id.UserID,
+	state event.Presence,
+	statusMsg string,
+) (bool, error) {
+	return util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (bool, error) {
+		presence, err := t.presence.TxnGetUserPresence(txn, userID)
+		if err != nil {
+			return false, err
+		} else if presence == nil {
+			presence = newOfflinePresence()
+		}
+
+		changed := presence.Presence != state || presence.StatusMsg != statusMsg
+
+		now := time.Now().UnixMilli()
+		presence.Presence = state
+		presence.StatusMsg = statusMsg
+		presence.LastActiveTs = now
+		presence.LastSyncTs = now
+
+		return changed, t.presence.TxnSetUserPresence(txn, userID, presence, changed)
+	})
+}
+
+// Update a users presence following a sync request, as per the sync set_presence parameter. Online
+// marks the user online and active, unavailable only moves the user out of offline or online. A
+// user already in the requested state is only written once presenceSyncRefreshInterval has passed
+// since their last sync. Unavailable -> offline is handled by timeouts. Returns true if the
+// presence changed.
+func (t *TransientDatabase) SetUserPresenceFromSync(
+	ctx context.Context,
+	userID id.UserID,
+	state event.Presence,
+) (bool, error) {
+	if state == event.PresenceOffline {
+		// Client explicitly does not want to be marked online by this sync
+		return false, nil
+	}
+
+	now := time.Now()
+
+	// Check if there's anything to do before starting a write transaction
+	if presence, err := t.GetUserPresence(ctx, userID); err != nil {
+		return false, err
+	} else if presence.Presence == state && now.Sub(time.UnixMilli(presence.LastSyncTs)) < presenceSyncRefreshInterval {
+		return false, nil
+	}
+
+	return util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (bool, error) {
+		presence, err := t.presence.TxnGetUserPresence(txn, userID)
+		if err != nil {
+			return false, err
+		} else if presence == nil {
+			presence = newOfflinePresence()
+		}
+
+		changed := presence.Presence != state
+		if changed || state == event.PresenceOnline {
+			presence.LastActiveTs = now.UnixMilli()
+		}
+		presence.Presence = state
+		presence.LastSyncTs = now.UnixMilli()
+
+		return changed, t.presence.TxnSetUserPresence(txn, userID, presence, changed)
+	})
+}
+
+// Move online users to unavailable and online/unavailable users to offline after the given
+// durations of inactivity. Only users due a timeout are read, up to presenceTimeoutsBatchSize of
+// each per call. Returns the users whose presence changed.
+func (t *TransientDatabase) TimeoutUserPresences(
+	ctx context.Context,
+	unavailableAfter, offlineAfter time.Duration,
+) ([]id.UserID, error) {
+	return util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) ([]id.UserID, error) {
+		now := time.Now()
+		changedUserIDs := make([]id.UserID, 0)
+
+		offlineUserIDs, err := t.presence.TxnLookupUserIDsSyncedBefore(
+			txn, now.Add(-offlineAfter).UnixMilli(), presenceTimeoutsBatchSize,
+		)
+		if err != nil {
+			return nil, err
+		}
+		unavailableUserIDs, err := t.presence.TxnLookupUserIDsActiveBefore(
+			txn, now.Add(-unavailableAfter).UnixMilli(), presenceTimeoutsBatchSize,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		setPresence := func(userID id.UserID, state event.Presence) error {
+			presence, err := t.presence.TxnGetUserPresence(txn, userID)
+			if err != nil || presence == nil || presence.Presence == state {
+				return err
+			}
+			presence.Presence = state
+			if err := t.presence.TxnSetUserPresence(txn, userID, presence, true); err != nil {
+				return err
+			}
+			changedUserIDs = append(changedUserIDs, userID)
+			return nil
+		}
+
+		for _, userID := range offlineUserIDs {
+			if err := setPresence(userID, event.PresenceOffline); err != nil {
+				return nil, err
+			}
+		}
+		for _, userID := range unavailableUserIDs {
+			if slices.Contains(offlineUserIDs, userID) {
+				continue
+			}
+			if err := setPresence(userID, event.PresenceUnavailable); err != nil {
+				return nil, err
+			}
+		}
+
+		return changedUserIDs, nil
+	})
+}
+
+// Returns the current presence of each user that has one set
+func (t *TransientDatabase) GetUserPresences(
+	ctx context.Context,
+	userIDs []id.UserID,
+) (map[id.UserID]*types.Presence, error) {
+	return util.DoReadTransaction(ctx, t.db, func(txn fdb.ReadTransaction) (map[id.UserID]*types.Presence, error) {
+		presences := make(map[id.UserID]*types.Presence, len(userIDs))
+		for _, userID := range userIDs {
+			presence, err := t.presence.TxnGetUserPresence(txn, userID)
+			if err != nil {
+				return nil, err
+			} else if presence != nil {
+				presences[userID] = presence
+			}
+		}
+		return presences, nil
+	})
+}
+
+// Returns the presence of all users changed after the from version. Callers are expected to filter
+// this down to the users they are interested in, initial syncs should use GetUserPresences instead.
+func (t *TransientDatabase) SyncPresence(
+	ctx context.Context,
+	from tuple.Versionstamp,
+) (tuple.Versionstamp, map[id.UserID]*types.Presence, error) {
+	var nextVersion tuple.Versionstamp
+
+	// Bump the from version, FDB range starts are inclusive but we want changes *after* the version
+	if from != types.ZeroVersionstamp {
+		from.UserVersion += 1
+	}
+
+	presences, err := util.DoReadTransaction(ctx, t.db, func(txn fdb.ReadTransaction) (map[id.UserID]*types.Presence, error) {
+		nextVersion = util.TxnGetLatestWriteVersion(ctx, txn)
+
+		userIDs, err := t.presence.TxnLookupChangedUserIDs(txn, from)
+		if err != nil {
+			return nil, err
+		}
+
+		presences := make(map[id.UserID]*types.Presence, len(userIDs))
+		for _, userID := range userIDs {
+			presence, err := t.presence.TxnGetUserPresence(txn, userID)
+			if err != nil {
+				return nil, err
+			} else if presence != nil {
+				presences[userID] = presence
+			}
+		}
+
+		return presences, nil
+	})
+	if err != nil {
+		return nextVersion, nil, err
+	}
+
+	return nextVersion, presences, nil
+}
@@ -0,0 +1,203 @@
+package presence
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type PresenceDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserID,
+	userVersion,
+	byVersion,
+	bySyncTs,
+	byActiveTs subspace.Subspace
+}
+
+func NewPresenceDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *PresenceDirectory {
+	presenceDir, err := parentDir.CreateOrOpen(db, []string{"presence"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "presence").Logger()
+	log.Debug().
+		Bytes("prefix", presenceDir.Bytes()).
+		Msg("Init transient/presence directory")
+
+	return &PresenceDirectory{
+		log: log,
+		db:  db,
+
+		byUserID:    presenceDir.Sub("u"),  // userID -> presence msgpack
+		userVersion: presenceDir.Sub("uv"), // userID -> version of latest change
+		byVersion:   presenceDir.Sub("v"),  // version -> userID
+		bySyncTs:    presenceDir.Sub("st"), // lastSyncTs/userID -> '' for users not offline
+		byActiveTs:  presenceDir.Sub("at"), // lastActiveTs/userID -> '' for online users
+	}
+}
+
+func (p *PresenceDirectory) KeyForUser(userID id.UserID) fdb.Key {
+	return p.byUserID.Pack(tuple.Tuple{userID.String()})
+}
+
+func (p *PresenceDirectory) KeyForUserVersion(userID id.UserID) fdb.Key {
+	return p.userVersion.Pack(tuple.Tuple{userID.String()})
+}
+
+func (p *PresenceDirectory) KeyForUserSyncTs(userID id.UserID, ts int64) fdb.Key {
+	return p.bySyncTs.Pack(tuple.Tuple{ts, userID.String()})
+}
+
+func (p *PresenceDirectory) KeyForUserActiveTs(userID id.UserID, ts int64) fdb.Key {
+	return p.byActiveTs.Pack(tuple.Tuple{ts, userID.String()})
+}
+
+// Returns the users presence or nil if never set
+func (p *PresenceDirectory) TxnGetUserPresence(txn fdb.ReadTransaction, userID id.UserID) (*types.Presence, error) {
+	b, err := txn.Get(p.KeyForUser(userID)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewPresenceFromBytes(b)
+}
+
+// Store a users presence, if changed is true the change log is updated such that syncing users
+// receive the new presence.
+func (p *PresenceDirectory) TxnSetUserPresence(
+	txn fdb.Transaction,
+	userID id.UserID,
+	presence *types.Presence,
+	changed bool,
+) error {
+	prevPresence, err := p.TxnGetUserPresence(txn, userID)
+	if err != nil {
+		return err
+	} else if prevPresence != nil {
+		p.txnClearUserTimestamps(txn, userID, prevPresence)
+	}
+
+	txn.Set(p.KeyForUser(userID), presence.ToMsgpack())
+	p.txnSetUserTimestamps(txn, userID, presence)
+
+	if !changed {
+		return nil
+	}
+
+	// Only keep the latest change per user in the log
+	versionKey := p.KeyForUserVersion(userID)
+	if b, err := txn.Get(versionKey).Get(); err != nil {
+		return err
+	} else if b != nil {
+		prevVersion, err := types.ValueToVersionstamp(b)
+		if err != nil {
+			return err
+		}
+		txn.Clear(p.byVersion.Pack(tuple.Tuple{prevVersion}))
+	}
+
+	version := tuple.IncompleteVersionstamp(0)
+	key, err := p.byVersion.PackWithVersionstamp(tuple.Tuple{version})
+	if err != nil {
+		panic(err)
+	}
+	txn.SetVersionstampedKey(key, []byte(userID.String()))
+	txn.SetVersionstampedValue(versionKey, types.VersionstampToValue(version))
+
+	return nil
+}
+
+// Users are indexed by last sync while not offline and by last activity while online, so timeouts
+// only need to read the users that are due.
+func (p *PresenceDirectory) txnSetUserTimestamps(txn fdb.Transaction, userID id.UserID, presence *types.Presence) {
+	if presence.Presence != event.PresenceOffline {
+		txn.Set(p.KeyForUserSyncTs(userID, presence.LastSyncTs), []byte{})
+	}
+	if presence.Presence == event.PresenceOnline {
+		txn.Set(p.KeyForUserActiveTs(userID, presence.LastActiveTs), []byte{})
+	}
+}
+
+func (p *PresenceDirectory) txnClearUserTimestamps(txn fdb.Transaction, userID id.UserID, presence *types.Presence) {
+	txn.Clear(p.KeyForUserSyncTs(userID, presence.LastSyncTs))
+	txn.Clear(p.KeyForUserActiveTs(userID, presence.LastActiveTs))
+}
+
+// Lookup up to limit users not offline whose last sync was before (exclusive) the timestamp
+func (p *PresenceDirectory) TxnLookupUserIDsSyncedBefore(
+	txn fdb.ReadTransaction,
+	ts int64,
+	limit int,
+) ([]id.UserID, error) {
+	return p.txnLookupUserIDsBefore(txn, p.bySyncTs, ts, limit)
+}
+
+// Lookup up to limit online users whose last activity was before (exclusive) the timestamp
+func (p *PresenceDirectory) TxnLookupUserIDsActiveBefore(
+	txn fdb.ReadTransaction,
+	ts int64,
+	limit int,
+) ([]id.UserID, error) {
+	return p.txnLookupUserIDsBefore(txn, p.byActiveTs, ts, limit)
+}
+
+func (p *PresenceDirectory) txnLookupUserIDsBefore(
+	txn fdb.ReadTransaction,
+	sub subspace.Subspace,
+	ts int64,
+	limit int,
+) ([]id.UserID, error) {
+	begin, _ := sub.FDBRangeKeys()
+	kvs, err := txn.GetRange(
+		fdb.KeyRange{Begin: begin, End: sub.Pack(tuple.Tuple{ts})},
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]id.UserID, 0, len(kvs))
+	for _, kv := range kvs {
+		keyTup, err := sub.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(keyTup[1].(string)))
+	}
+
+	return userIDs, nil
+}
+
+// Lookup users whose presence changed after (inclusive) the from version
+func (p *PresenceDirectory) TxnLookupChangedUserIDs(
+	txn fdb.ReadTransaction,
+	fromVersion tuple.Versionstamp,
+) ([]id.UserID, error) {
+	iter := txn.GetRange(
+		types.GetVersionRange(p.byVersion, fromVersion, types.ZeroVersionstamp),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	userIDs := make([]id.UserID, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(kv.Value))
+	}
+
+	return userIDs, nil
+}
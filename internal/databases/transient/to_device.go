@@ -0,0 +1,174 @@
+package transient
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// Maximum to-device events delivered to a device in a single sync
+	toDeviceSyncLimit = 100
+
+	// How long a sending device's transaction IDs are remembered for, retries of the same request
+	// within this window are ignored.
+	toDeviceTxnIDExpiry = 24 * time.Hour
+	// Expired transaction IDs cleared for the sending device on each send
+	toDeviceTxnIDClearLimit = 100
+)
+
+// Store to-device events for delivery, messages map user ID -> device ID -> content. Device IDs
+// must already be resolved by the caller (ie no "*" wildcard). Sending again with the same
+// transaction ID from the same device is a no-op, an empty sender device or transaction ID skips
+// this check.
+func (t *TransientDatabase) SendToDeviceEvents(
+	ctx context.Context,
+	sender id.UserID,
+	senderDeviceID id.DeviceID,
+	txnID string,
+	evType string,
+	messages map[id.UserID]map[id.DeviceID]json.RawMessage,
+) error {
+	log := t.getTxnLogContext(ctx, "SendToDeviceEvents").
+		Str("sender", sender.String()).
+		Str("sender_device_id", senderDeviceID.String()).
+		Str("txn_id", txnID).
+		Str("type", evType).
+		Logger()
+
+	checkTxnID := senderDeviceID != "" && txnID != ""
+
+	userIDs := make([]id.UserID, 0, len(messages))
+	var sent int
+
+	duplicate, err := util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (bool, error) {
+		userIDs = userIDs[:0]
+		sent = 0
+
+		if checkTxnID {
+			now := time.Now()
+			expiredBefore := now.Add(-toDeviceTxnIDExpiry)
+			if seen, err := t.toDevice.TxnHasSentTxnIDAfter(txn, sender, senderDeviceID, txnID, expiredBefore); err != nil {
+				return false, err
+			} else if seen {
+				return true, nil
+			}
+			if err := t.toDevice.TxnClearSentTxnIDsBefore(
+				txn, sender, senderDeviceID, expiredBefore, toDeviceTxnIDClearLimit,
+			); err != nil {
+				return false, err
+			}
+			t.toDevice.TxnAddSentTxnID(txn, sender, senderDeviceID, txnID, now)
+		}
+
+		for userID, devices := range messages {
+			for deviceID, content := range devices {
+				// See DoWriteTransaction, the final user version is reserved
+				if sent >= math.MaxUint16-1 {
+					return false, types.ErrTooManyToDeviceEvents
+				}
+				ev := &types.ToDeviceEvent{
+					Sender:  sender,
+					Type:    evType,
+					Content: content,
+				}
+				t.toDevice.TxnAddToDeviceEvent(txn, userID, deviceID, ev, tuple.IncompleteVersionstamp(uint16(sent)))
+				sent++
+			}
+			userIDs = append(userIDs, userID)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	} else if duplicate {
+		log.Debug().Msg("Ignoring to-device events for already used transaction ID")
+		return nil
+	}
+
+	t.notifiers.Transient.SendChange(notifier.Change{UserIDs: userIDs})
+	log.Debug().Int("events", sent).Msg("Sent to-device events")
+
+	return nil
+}
+
+// Sync to-device events for a device. Any events up to and including the from version have been
+// seen by the client (it is using a since token containing that version) and are deleted, unless
+// retain is set because the client hasn't acknowledged the from version yet.
+func (t *TransientDatabase) SyncToDeviceForUserDevice(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	from tuple.Versionstamp,
+	retain bool,
+) (tuple.Versionstamp, []*types.ToDeviceEvent, error) {
+	var nextVersion tuple.Versionstamp
+
+	evs, err := util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) ([]*types.ToDeviceEvent, error) {
+		// Snapshot read the latest version, this key is written by every transaction so we'd
+		// otherwise conflict with any concurrent write.
+		nextVersion = util.TxnGetLatestWriteVersion(ctx, txn.Snapshot())
+
+		fromVersion := from
+		if from != types.ZeroVersionstamp {
+			if !retain {
+				t.toDevice.TxnClearUserDeviceEventsUpTo(txn, userID, deviceID, from)
+			}
+			// Bump the from version, FDB range starts are inclusive but we want events *after*
+			fromVersion.UserVersion += 1
+		}
+
+		evs, err := t.toDevice.TxnPaginateUserDeviceEvents(txn, userID, deviceID, fromVersion, toDeviceSyncLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(evs) == toDeviceSyncLimit {
+			// There may be more events, only move the position up to the last one we're returning
+			nextVersion = evs[len(evs)-1].Version
+		}
+
+		return evs, nil
+	})
+	if err != nil {
+		return from, nil, err
+	}
+
+	return nextVersion, evs, nil
+}
+
+// Delete to-device events up to and including the version, which the client has acknowledged
+func (t *TransientDatabase) AckToDeviceForUserDevice(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	version tuple.Versionstamp,
+) error {
+	_, err := util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (*struct{}, error) {
+		t.toDevice.TxnClearUserDeviceEventsUpTo(txn, userID, deviceID, version)
+		return nil, nil
+	})
+	return err
+}
+
+func (t *TransientDatabase) ClearToDeviceForUserDevice(
+	ctx context.Context,
+	userID id.UserID,
+	deviceID id.DeviceID,
+) error {
+	_, err := util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (*struct{}, error) {
+		t.toDevice.TxnClearUserDeviceEvents(txn, userID, deviceID)
+		t.toDevice.TxnClearSentTxnIDs(txn, userID, deviceID)
+		return nil, nil
+	})
+	return err
+}
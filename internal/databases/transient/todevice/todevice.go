@@ -0,0 +1,192 @@
+package todevice
+
+import (
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type ToDeviceDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byUserDeviceVersion subspace.Subspace
+	byUserDeviceTxnID   subspace.Subspace
+	byUserDeviceTxnTs   subspace.Subspace
+}
+
+func NewToDeviceDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *ToDeviceDirectory {
+	toDeviceDir, err := parentDir.CreateOrOpen(db, []string{"todevice"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "todevice").Logger()
+	log.Debug().
+		Bytes("prefix", toDeviceDir.Bytes()).
+		Msg("Init transient/todevice directory")
+
+	return &ToDeviceDirectory{
+		log: log,
+		db:  db,
+
+		byUserDeviceVersion: toDeviceDir.Sub("udv"),  // userID/deviceID/version -> (sender, type, content)
+		byUserDeviceTxnID:   toDeviceDir.Sub("udt"),  // senderID/deviceID/txnID -> sent timestamp
+		byUserDeviceTxnTs:   toDeviceDir.Sub("udts"), // senderID/deviceID/sent timestamp/txnID -> ''
+	}
+}
+
+func (t *ToDeviceDirectory) TxnAddToDeviceEvent(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	ev *types.ToDeviceEvent,
+	version tuple.Versionstamp,
+) {
+	key, err := t.byUserDeviceVersion.PackWithVersionstamp(tuple.Tuple{userID.String(), deviceID.String(), version})
+	if err != nil {
+		panic(err)
+	}
+	value := tuple.Tuple{ev.Sender.String(), ev.Type, []byte(ev.Content)}.Pack()
+	txn.SetVersionstampedKey(key, value)
+}
+
+// Clear all events up to and including the given version
+func (t *ToDeviceDirectory) TxnClearUserDeviceEventsUpTo(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	toVersion tuple.Versionstamp,
+) {
+	// Range ends are exclusive, bump the user version to include the event at exactly toVersion
+	toVersion.UserVersion += 1
+	txn.ClearRange(types.GetVersionRange(
+		t.byUserDeviceVersion,
+		types.ZeroVersionstamp,
+		toVersion,
+		userID.String(), deviceID.String(),
+	))
+}
+
+func (t *ToDeviceDirectory) TxnClearUserDeviceEvents(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) {
+	txn.ClearRange(t.byUserDeviceVersion.Sub(userID.String(), deviceID.String()))
+}
+
+// Paginate events for a device starting from (inclusive) the given version
+func (t *ToDeviceDirectory) TxnPaginateUserDeviceEvents(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	fromVersion tuple.Versionstamp,
+	limit int,
+) ([]*types.ToDeviceEvent, error) {
+	iter := txn.GetRange(
+		types.GetVersionRange(
+			t.byUserDeviceVersion,
+			fromVersion,
+			types.ZeroVersionstamp,
+			userID.String(), deviceID.String(),
+		),
+		fdb.RangeOptions{Limit: limit},
+	).Iterator()
+
+	evs := make([]*types.ToDeviceEvent, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		keyTup, err := t.byUserDeviceVersion.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		valTup, err := tuple.Unpack(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, &types.ToDeviceEvent{
+			Sender:  id.UserID(valTup[0].(string)),
+			Type:    valTup[1].(string),
+			Content: valTup[2].([]byte),
+			Version: keyTup[2].(tuple.Versionstamp),
+		})
+	}
+
+	return evs, nil
+}
+
+// Whether the sending device already used a transaction ID after the given time
+func (t *ToDeviceDirectory) TxnHasSentTxnIDAfter(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	txnID string,
+	after time.Time,
+) (bool, error) {
+	b, err := txn.Get(t.byUserDeviceTxnID.Pack(tuple.Tuple{userID.String(), deviceID.String(), txnID})).Get()
+	if err != nil || b == nil {
+		return false, err
+	}
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return false, err
+	}
+	return time.UnixMilli(tup[0].(int64)).After(after), nil
+}
+
+func (t *ToDeviceDirectory) TxnAddSentTxnID(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	txnID string,
+	ts time.Time,
+) {
+	key := t.byUserDeviceTxnID.Pack(tuple.Tuple{userID.String(), deviceID.String(), txnID})
+	if b := txn.Get(key).MustGet(); b != nil {
+		// Re-using an expired transaction ID, clear the old timestamp index
+		if tup, err := tuple.Unpack(b); err == nil {
+			txn.Clear(t.byUserDeviceTxnTs.Pack(tuple.Tuple{userID.String(), deviceID.String(), tup[0], txnID}))
+		}
+	}
+	txn.Set(key, tuple.Tuple{ts.UnixMilli()}.Pack())
+	txn.Set(t.byUserDeviceTxnTs.Pack(tuple.Tuple{userID.String(), deviceID.String(), ts.UnixMilli(), txnID}), []byte{})
+}
+
+// Clear up to limit transaction IDs the sending device used before the given time
+func (t *ToDeviceDirectory) TxnClearSentTxnIDsBefore(
+	txn fdb.Transaction,
+	userID id.UserID,
+	deviceID id.DeviceID,
+	before time.Time,
+	limit int,
+) error {
+	begin := t.byUserDeviceTxnTs.Pack(tuple.Tuple{userID.String(), deviceID.String()})
+	end := t.byUserDeviceTxnTs.Pack(tuple.Tuple{userID.String(), deviceID.String(), before.UnixMilli()})
+
+	kvs, err := txn.GetRange(fdb.KeyRange{Begin: begin, End: end}, fdb.RangeOptions{Limit: limit}).GetSliceWithError()
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		keyTup, err := t.byUserDeviceTxnTs.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		txn.Clear(kv.Key)
+		txn.Clear(t.byUserDeviceTxnID.Pack(tuple.Tuple{userID.String(), deviceID.String(), keyTup[3]}))
+	}
+	return nil
+}
+
+func (t *ToDeviceDirectory) TxnClearSentTxnIDs(txn fdb.Transaction, userID id.UserID, deviceID id.DeviceID) {
+	txn.ClearRange(t.byUserDeviceTxnID.Sub(userID.String(), deviceID.String()))
+	txn.ClearRange(t.byUserDeviceTxnTs.Sub(userID.String(), deviceID.String()))
+}
@@ -1,3 +1,104 @@
-// stub to get it to build :3
+// The transient database provides short lived Matrix data: typing notifications,
+// to-device events and presence. Nothing here is kept beyond the sync window.
+
 package transient
-type TransientDatabase struct {}
+
+import (
+	"context"
+	"sync"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases/transient/presence"
+	"github.com/beeper/babbleserv/internal/databases/transient/todevice"
+	"github.com/beeper/babbleserv/internal/databases/transient/typing"
+	"github.com/beeper/babbleserv/internal/notifier"
+)
+
+const API_VERSION = 710
+
+type TransientDatabase struct {
+	backgroundWg sync.WaitGroup
+
+	log       zerolog.Logger
+	db        fdb.Database
+	config    config.BabbleConfig
+	notifiers *notifier.Notifiers
+
+	// Cancelled on stop so any pending background expiry jobs exit early
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	locks subspace.Subspace
+
+	typing   *typing.TypingDirectory
+	toDevice *todevice.ToDeviceDirectory
+	presence *presence.PresenceDirectory
+}
+
+func NewTransientDatabase(
+	cfg config.BabbleConfig,
+	logger zerolog.Logger,
+	notifiers *notifier.Notifiers,
+) *TransientDatabase {
+	log := logger.With().
+		Str("database", "transient").
+		Logger()
+
+	fdb.MustAPIVersion(API_VERSION)
+	db := fdb.MustOpenDatabase(cfg.Transient.Database.ClusterFilePath)
+	log.Debug().
+		Str("cluster_file", cfg.Transient.Database.ClusterFilePath).
+		Msg("Connected to FoundationDB")
+
+	db.Options().SetTransactionTimeout(cfg.Transient.Database.TransactionTimeout)
+	db.Options().SetTransactionRetryLimit(cfg.Transient.Database.TransactionRetryLimit)
+
+	transientDir, err := directory.CreateOrOpen(db, []string{"transient"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Debug().
+		Bytes("prefix", transientDir.Bytes()).
+		Msg("Init transient directory")
+
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+
+	return &TransientDatabase{
+		log:       log,
+		db:        db,
+		config:    cfg,
+		notifiers: notifiers,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		locks: transientDir.Sub("lck"),
+
+		typing:   typing.NewTypingDirectory(log, db, transientDir),
+		toDevice: todevice.NewToDeviceDirectory(log, db, transientDir),
+		presence: presence.NewPresenceDirectory(log, db, transientDir),
+	}
+}
+
+func (t *TransientDatabase) Stop() {
+	t.log.Debug().Msg("Waiting for any background jobs to complete...")
+	t.cancel()
+	t.backgroundWg.Wait()
+}
+
+func (t *TransientDatabase) GetLockPrimitives() (fdb.Database, subspace.Subspace) {
+	return t.db, t.locks
+}
+
+func (t *TransientDatabase) getTxnLogContext(ctx context.Context, name string) zerolog.Context {
+	return zerolog.Ctx(ctx).With().
+		Str("component", "database").
+		Str("database", "transient").
+		Str("transaction", name)
+}
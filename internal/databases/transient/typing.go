@@ -0,0 +1,141 @@
+package transient
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Cap how long a client can claim to be typing for, clients are expected to re-send the typing
+// notification well before this.
+const maxTypingTimeout = 2 * time.Minute
+
+func (t *TransientDatabase) SetUserTyping(
+	ctx context.Context,
+	roomID id.RoomID,
+	userID id.UserID,
+	typing bool,
+	timeout time.Duration,
+) error {
+	if timeout <= 0 || timeout > maxTypingTimeout {
+		timeout = maxTypingTimeout
+	}
+	expires := time.Now().Add(timeout)
+
+	log := t.getTxnLogContext(ctx, "SetUserTyping").
+		Str("room_id", roomID.String()).
+		Str("user_id", userID.String()).
+		Bool("typing", typing).
+		Logger()
+
+	if _, err := util.DoWriteTransaction(ctx, t.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if typing {
+			t.typing.TxnSetUserTyping(txn, roomID, userID, expires)
+		} else {
+			t.typing.TxnClearUserTyping(txn, roomID, userID)
+		}
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+
+	t.notifiers.Transient.SendChange(notifier.Change{RoomIDs: []id.RoomID{roomID}})
+	log.Debug().Msg("Set user typing")
+
+	if typing {
+		t.expireUserTypingAfter(ctx, roomID, userID, timeout)
+	}
+
+	return nil
+}
+
+// Kicks off a background job to clear the typing status once it has expired, so that syncing
+// clients are notified the user stopped typing.
+func (t *TransientDatabase) expireUserTypingAfter(
+	ctx context.Context,
+	roomID id.RoomID,
+	userID id.UserID,
+	timeout time.Duration,
+) {
+	backgroundCtx := zerolog.Ctx(ctx).With().
+		Str("background_task", "ExpireUserTyping").
+		Logger().
+		WithContext(t.ctx)
+	log := zerolog.Ctx(backgroundCtx)
+
+	t.backgroundWg.Add(1)
+	go func() {
+		defer t.backgroundWg.Done()
+
+		select {
+		case <-backgroundCtx.Done():
+			return
+		case <-time.After(timeout):
+		}
+
+		cleared, err := util.DoWriteTransaction(backgroundCtx, t.db, func(txn fdb.Transaction) (bool, error) {
+			expires, err := t.typing.TxnGetUserTypingExpires(txn, roomID, userID)
+			if err != nil {
+				return false, err
+			} else if expires.IsZero() || expires.After(time.Now()) {
+				// Either already cleared or the user has sent another typing notification
+				return false, nil
+			}
+			t.typing.TxnClearUserTyping(txn, roomID, userID)
+			return true, nil
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to expire user typing")
+		} else if cleared {
+			t.notifiers.Transient.SendChange(notifier.Change{RoomIDs: []id.RoomID{roomID}})
+		}
+	}()
+}
+
+// Returns the current typing users for any of the given rooms that have changed after the from
+// version. When from is zero (initial sync) only rooms with someone typing are returned.
+func (t *TransientDatabase) SyncTypingForRooms(
+	ctx context.Context,
+	roomIDs []id.RoomID,
+	from tuple.Versionstamp,
+) (tuple.Versionstamp, map[id.RoomID][]id.UserID, error) {
+	var nextVersion tuple.Versionstamp
+
+	typing, err := util.DoReadTransaction(ctx, t.db, func(txn fdb.ReadTransaction) (map[id.RoomID][]id.UserID, error) {
+		nextVersion = util.TxnGetLatestWriteVersion(ctx, txn)
+
+		typing := make(map[id.RoomID][]id.UserID)
+
+		for _, roomID := range roomIDs {
+			changed, err := t.typing.TxnRoomChangedAfter(txn, roomID, from)
+			if err != nil {
+				return nil, err
+			} else if !changed {
+				continue
+			}
+
+			userIDs, err := t.typing.TxnLookupRoomTypingUserIDs(txn, roomID)
+			if err != nil {
+				return nil, err
+			} else if len(userIDs) == 0 && from == types.ZeroVersionstamp {
+				continue
+			}
+			typing[roomID] = userIDs
+		}
+
+		return typing, nil
+	})
+	if err != nil {
+		return nextVersion, nil, err
+	}
+
+	return nextVersion, typing, nil
+}
@@ -0,0 +1,144 @@
+package typing
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type TypingDirectory struct {
+	log zerolog.Logger
+	db  fdb.Database
+
+	byRoomUser,
+	roomVersion subspace.Subspace
+}
+
+func NewTypingDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *TypingDirectory {
+	typingDir, err := parentDir.CreateOrOpen(db, []string{"typing"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	log := logger.With().Str("directory", "typing").Logger()
+	log.Debug().
+		Bytes("prefix", typingDir.Bytes()).
+		Msg("Init transient/typing directory")
+
+	return &TypingDirectory{
+		log: log,
+		db:  db,
+
+		byRoomUser:  typingDir.Sub("ru"), // roomID/userID -> (expiresTs)
+		roomVersion: typingDir.Sub("rv"), // roomID -> version of last typing change
+	}
+}
+
+func (t *TypingDirectory) KeyForRoomUser(roomID id.RoomID, userID id.UserID) fdb.Key {
+	return t.byRoomUser.Pack(tuple.Tuple{roomID.String(), userID.String()})
+}
+
+func (t *TypingDirectory) KeyForRoomVersion(roomID id.RoomID) fdb.Key {
+	return t.roomVersion.Pack(tuple.Tuple{roomID.String()})
+}
+
+func (t *TypingDirectory) txnBumpRoomVersion(txn fdb.Transaction, roomID id.RoomID) {
+	txn.SetVersionstampedValue(
+		t.KeyForRoomVersion(roomID),
+		types.VersionstampToValue(tuple.IncompleteVersionstamp(0)),
+	)
+}
+
+func (t *TypingDirectory) TxnSetUserTyping(
+	txn fdb.Transaction,
+	roomID id.RoomID,
+	userID id.UserID,
+	expires time.Time,
+) {
+	txn.Set(t.KeyForRoomUser(roomID, userID), tuple.Tuple{expires.UnixMilli()}.Pack())
+	t.txnBumpRoomVersion(txn, roomID)
+}
+
+func (t *TypingDirectory) TxnClearUserTyping(txn fdb.Transaction, roomID id.RoomID, userID id.UserID) {
+	txn.Clear(t.KeyForRoomUser(roomID, userID))
+	t.txnBumpRoomVersion(txn, roomID)
+}
+
+// Returns the time the users typing expires, or zero if they are not typing
+func (t *TypingDirectory) TxnGetUserTypingExpires(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	userID id.UserID,
+) (time.Time, error) {
+	b, err := txn.Get(t.KeyForRoomUser(roomID, userID)).Get()
+	if err != nil {
+		return time.Time{}, err
+	} else if b == nil {
+		return time.Time{}, nil
+	}
+	return valueToExpires(b), nil
+}
+
+// Lookup users currently typing in a room, ignoring any expired entries that haven't yet been
+// cleared by the background expiry job.
+func (t *TypingDirectory) TxnLookupRoomTypingUserIDs(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+) ([]id.UserID, error) {
+	iter := txn.GetRange(
+		t.byRoomUser.Sub(roomID.String()),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	now := time.Now()
+	userIDs := make([]id.UserID, 0)
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		if valueToExpires(kv.Value).Before(now) {
+			continue
+		}
+		keyTup, err := t.byRoomUser.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(keyTup[1].(string)))
+	}
+
+	return userIDs, nil
+}
+
+// Returns true if the typing for a room has changed after the given version
+func (t *TypingDirectory) TxnRoomChangedAfter(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	fromVersion tuple.Versionstamp,
+) (bool, error) {
+	b, err := txn.Get(t.KeyForRoomVersion(roomID)).Get()
+	if err != nil {
+		return false, err
+	} else if b == nil {
+		return false, nil
+	}
+	version, err := types.ValueToVersionstamp(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Compare(version.Bytes(), fromVersion.Bytes()) > 0, nil
+}
+
+func valueToExpires(value []byte) time.Time {
+	tup, _ := tuple.Unpack(value)
+	return time.UnixMilli(tup[0].(int64))
+}
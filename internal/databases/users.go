@@ -0,0 +1,39 @@
+package databases
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Deactivate a user, removing all accounts data immediately and queueing a job to leave all rooms
+// and erase the profile in the rooms database. The job is queued first so if deactivating the
+// account fails the whole request can be retried. Requires the rooms database, otherwise the user
+// would be left in their rooms.
+func (d *Databases) DeactivateUser(ctx context.Context, userID id.UserID) error {
+	if d.Rooms == nil {
+		return errors.New("cannot deactivate user without the rooms database enabled")
+	}
+
+	if err := d.Rooms.EnqueueJob(ctx, types.JobTypeDeactivateUser, userID.String()); err != nil {
+		return err
+	}
+
+	deviceIDs, err := d.Accounts.DeactivateUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if d.Transient != nil {
+		for _, deviceID := range deviceIDs {
+			if err := d.Transient.ClearToDeviceForUserDevice(ctx, userID, deviceID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -72,6 +72,14 @@ func GetRequestUserID(r *http.Request) id.UserID {
 	return getRequestUserDevice(r).UserID
 }
 
+// Returns an empty user ID if there's no request user
+func MaybeGetRequestUserID(r *http.Request) id.UserID {
+	if u := getRequestUserDevice(r); u != nil {
+		return u.UserID
+	}
+	return ""
+}
+
 // Panics if there's no request user
 func GetRequestDeviceID(r *http.Request) id.DeviceID {
 	return getRequestUserDevice(r).DeviceID
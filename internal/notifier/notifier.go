@@ -106,6 +106,7 @@ func NewNotifier(name string, cfg config.NotifierConfig, logger zerolog.Logger)
 		roomIDToChan:       make(map[id.RoomID]map[chan any]struct{}),
 		eventChs:           make(map[chan any]struct{}),
 		serverChs:          make(map[chan any]struct{}),
+		userChs:            make(map[chan any]struct{}),
 	}
 }
 
@@ -26,7 +26,7 @@ func NewNotifiers(cfg config.BabbleConfig, logger zerolog.Logger) *Notifiers {
 		notifiers.Accounts = NewNotifier("accounts", cfg.Accounts.Notifier, log)
 	}
 	if cfg.Transient.Enabled {
-		notifiers.Transient = NewNotifier("accounts", cfg.Transient.Notifier, log)
+		notifiers.Transient = NewNotifier("transient", cfg.Transient.Notifier, log)
 	}
 
 	return &notifiers
@@ -8,6 +8,7 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 
+	"github.com/beeper/babbleserv/internal/middleware"
 	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
@@ -102,3 +103,132 @@ func (c *ClientRoutes) Register(w http.ResponseWriter, r *http.Request) {
 		util.ResponseJSON(w, r, http.StatusOK, resp)
 	}
 }
+
+type reqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3refresh
+func (c *ClientRoutes) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req reqRefresh
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.RefreshToken == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing refresh token")
+		return
+	}
+
+	resp, err := c.db.Accounts.RefreshTokens(r.Context(), req.RefreshToken)
+	if err == types.ErrTokenNotFound || err == types.ErrTokenReused {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MUnknownToken, "Invalid refresh token")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3logout
+func (c *ClientRoutes) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+
+	// Logging out deletes the device along with its tokens & keys
+	if err := c.db.DeleteUserDevices(r.Context(), userID, []id.DeviceID{deviceID}); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3logoutall
+func (c *ClientRoutes) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUserID(r)
+
+	devices, err := c.db.Accounts.GetUserDevices(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	deviceIDs := make([]id.DeviceID, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+
+	if err := c.db.DeleteUserDevices(r.Context(), userID, deviceIDs); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+type reqChangePassword struct {
+	NewPassword   string `json:"new_password"`
+	LogoutDevices *bool  `json:"logout_devices"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3accountpassword
+func (c *ClientRoutes) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req reqChangePassword
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.NewPassword == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing or empty password")
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+
+	if err := c.db.Accounts.ChangePassword(r.Context(), userID, []byte(req.NewPassword)); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Logout all other devices unless explicitly told not to
+	if req.LogoutDevices == nil || *req.LogoutDevices {
+		devices, err := c.db.Accounts.GetUserDevices(r.Context(), userID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+
+		requestDeviceID := middleware.GetRequestDeviceID(r)
+		deviceIDs := make([]id.DeviceID, 0, len(devices))
+		for _, device := range devices {
+			if device.ID != requestDeviceID {
+				deviceIDs = append(deviceIDs, device.ID)
+			}
+		}
+
+		if err := c.db.DeleteUserDevices(r.Context(), userID, deviceIDs); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+type respDeactivate struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3accountdeactivate
+func (c *ClientRoutes) Deactivate(w http.ResponseWriter, r *http.Request) {
+	if err := c.db.DeactivateUser(r.Context(), middleware.GetRequestUserID(r)); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Babbleserv has no 3PID support so there's nothing to unbind
+	util.ResponseJSON(w, r, http.StatusOK, respDeactivate{
+		IDServerUnbindResult: "no-support",
+	})
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Account data types managed by the server that clients cannot set directly
+var serverManagedAccountDataTypes = map[string]struct{}{
+	event.AccountDataFullyRead.Type: {},
+	event.AccountDataPushRules.Type: {},
+}
+
+// Returns the requesting user ID and the room ID (empty for global account data) if the user ID
+// param matches the requesting user.
+func accountDataParamsFromRequest(r *http.Request) (id.UserID, id.RoomID, bool) {
+	userID := middleware.GetRequestUserID(r)
+	if util.UserIDFromRequestURLParam(r, "userID") != userID {
+		return userID, "", false
+	}
+	return userID, util.RoomIDFromRequestURLParam(r, "roomID"), true
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3useruseridaccount_datatype
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3useruseridroomsroomidaccount_datatype
+func (c *ClientRoutes) GetAccountData(w http.ResponseWriter, r *http.Request) {
+	userID, roomID, ok := accountDataParamsFromRequest(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot get account data for other users")
+		return
+	}
+
+	ev, err := c.db.Accounts.GetAccountData(r.Context(), userID, roomID, chi.URLParam(r, "type"))
+	if errors.Is(err, types.ErrAccountDataNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Account data not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseRawJSON(w, r, http.StatusOK, ev.Content)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3useruseridaccount_datatype
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3useruseridroomsroomidaccount_datatype
+func (c *ClientRoutes) PutAccountData(w http.ResponseWriter, r *http.Request) {
+	userID, roomID, ok := accountDataParamsFromRequest(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot add account data for other users")
+		return
+	}
+
+	evType := chi.URLParam(r, "type")
+	if _, found := serverManagedAccountDataTypes[evType]; found {
+		util.ResponseJSON(w, r, http.StatusMethodNotAllowed, &mautrix.RespError{
+			ErrCode: mautrix.MBadJSON.ErrCode,
+			Err:     "Cannot set account data managed by the server",
+		})
+		return
+	}
+
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	// Content must be a JSON object
+	var contentObj map[string]json.RawMessage
+	if err := json.Unmarshal(content, &contentObj); err != nil || contentObj == nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	if err := c.db.Accounts.SetAccountData(r.Context(), userID, roomID, evType, content); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
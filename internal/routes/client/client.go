@@ -62,6 +62,8 @@ func (c *ClientRoutes) AddClientRoutes(rtr chi.Router) {
 
 	if c.config.Rooms.Enabled && c.config.Accounts.Enabled && c.config.Transient.Enabled {
 		rtr.MethodFunc(http.MethodGet, "/v3/sync", middleware.RequireUserAuth(c.Sync))
+		rtr.MethodFunc(http.MethodPost, "/unstable/org.matrix.simplified_msc3575/sync", middleware.RequireUserAuth(c.SlidingSync))
+		rtr.MethodFunc(http.MethodGet, "/unstable/com.beeper.babbleserv/sync/stream", middleware.RequireUserAuth(c.SyncStream))
 	}
 
 	if c.config.Rooms.Enabled {
@@ -85,6 +87,12 @@ func (c *ClientRoutes) AddClientRoutes(rtr chi.Router) {
 		rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/event/{eventID}", middleware.RequireUserAuth(c.GetRoomEvent))
 		rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/state", middleware.RequireUserAuth(c.GetRoomState))
 		rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/members", middleware.RequireUserAuth(c.GetRoomMembers))
+		rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/messages", middleware.RequireUserAuth(c.GetRoomMessages))
+		rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/context/{eventID}", middleware.RequireUserAuth(c.GetRoomEventContext))
+		rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/relations/{eventID}", middleware.RequireUserAuth(c.GetRoomRelations))
+		rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/relations/{eventID}/{relType}", middleware.RequireUserAuth(c.GetRoomRelations))
+		rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", middleware.RequireUserAuth(c.GetRoomRelations))
+		rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/threads", middleware.RequireUserAuth(c.GetRoomThreads))
 
 		// Profile routes - note the spec has the GET endpoints un-authenticated but Babbleserv disagrees
 		rtr.MethodFunc(http.MethodGet, "/v3/profile/{userID}", middleware.RequireUserAuth(c.GetProfile))
@@ -92,21 +100,92 @@ func (c *ClientRoutes) AddClientRoutes(rtr chi.Router) {
 		rtr.MethodFunc(http.MethodPut, "/v3/profile/{userID}/{key}", middleware.RequireUserAuth(c.PutProfile))
 
 		// Receipts routes
-		rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/receipt/{receiptType}/{eventID}", c.SendRoomReadReceipt)
-		rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/read_markers", c.SendRoomReadMarkers)
+		rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/receipt/{receiptType}/{eventID}", middleware.RequireUserAuth(c.SendRoomReadReceipt))
+		rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/read_markers", middleware.RequireUserAuth(c.SendRoomReadMarkers))
 	}
 
 	if c.config.Accounts.Enabled {
-		rtr.MethodFunc(http.MethodPost, "/v3/register", c.Register)
+		rtr.MethodFunc(http.MethodPost, "/v3/register", c.RequireUIA(uiaFlowsDummy, c.Register))
 		rtr.MethodFunc(http.MethodGet, "/v3/login", c.GetLogin)
 		rtr.MethodFunc(http.MethodPost, "/v3/login", c.Login)
+		rtr.MethodFunc(http.MethodPost, "/v3/refresh", c.Refresh)
+		rtr.MethodFunc(http.MethodPost, "/v3/logout", middleware.RequireUserAuth(c.Logout))
+		rtr.MethodFunc(http.MethodPost, "/v3/logout/all", middleware.RequireUserAuth(c.LogoutAll))
+		rtr.MethodFunc(http.MethodPost, "/v3/account/password", middleware.RequireUserAuth(c.RequireUIA(uiaFlowsPassword, c.ChangePassword)))
+		rtr.MethodFunc(http.MethodPost, "/v3/account/deactivate", middleware.RequireUserAuth(c.RequireUIA(uiaFlowsPassword, c.Deactivate)))
+
+		// Devices
+		rtr.MethodFunc(http.MethodGet, "/v3/devices", middleware.RequireUserAuth(c.GetDevices))
+		rtr.MethodFunc(http.MethodGet, "/v3/devices/{deviceID}", middleware.RequireUserAuth(c.GetDevice))
+		rtr.MethodFunc(http.MethodPut, "/v3/devices/{deviceID}", middleware.RequireUserAuth(c.UpdateDevice))
+		rtr.MethodFunc(http.MethodDelete, "/v3/devices/{deviceID}", middleware.RequireUserAuth(c.RequireUIA(uiaFlowsPassword, c.DeleteDevice)))
+		rtr.MethodFunc(http.MethodPost, "/v3/delete_devices", middleware.RequireUserAuth(c.RequireUIA(uiaFlowsPassword, c.DeleteDevices)))
+
+		// Account data
+		rtr.MethodFunc(http.MethodGet, "/v3/user/{userID}/account_data/{type}", middleware.RequireUserAuth(c.GetAccountData))
+		rtr.MethodFunc(http.MethodPut, "/v3/user/{userID}/account_data/{type}", middleware.RequireUserAuth(c.PutAccountData))
+		rtr.MethodFunc(http.MethodGet, "/v3/user/{userID}/rooms/{roomID}/account_data/{type}", middleware.RequireUserAuth(c.GetAccountData))
+		rtr.MethodFunc(http.MethodPut, "/v3/user/{userID}/rooms/{roomID}/account_data/{type}", middleware.RequireUserAuth(c.PutAccountData))
+		rtr.MethodFunc(http.MethodGet, "/v3/user/{userID}/rooms/{roomID}/tags", middleware.RequireUserAuth(c.GetRoomTags))
+		rtr.MethodFunc(http.MethodPut, "/v3/user/{userID}/rooms/{roomID}/tags/{tag}", middleware.RequireUserAuth(c.PutRoomTag))
+		rtr.MethodFunc(http.MethodDelete, "/v3/user/{userID}/rooms/{roomID}/tags/{tag}", middleware.RequireUserAuth(c.DeleteRoomTag))
+
+		// Push rules
+		rtr.MethodFunc(http.MethodGet, "/v3/pushrules/", middleware.RequireUserAuth(c.GetPushRules))
+		rtr.MethodFunc(http.MethodGet, "/v3/pushrules/global/", middleware.RequireUserAuth(c.GetPushRules))
+		rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.GetPushRule))
+		rtr.MethodFunc(http.MethodPut, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.PutPushRule))
+		rtr.MethodFunc(http.MethodDelete, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.DeletePushRule))
+		rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/{kind}/{ruleID}/enabled", middleware.RequireUserAuth(c.GetPushRuleEnabled))
+		rtr.MethodFunc(http.MethodPut, "/v3/pushrules/{scope}/{kind}/{ruleID}/enabled", middleware.RequireUserAuth(c.PutPushRuleEnabled))
+		rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/{kind}/{ruleID}/actions", middleware.RequireUserAuth(c.GetPushRuleActions))
+		rtr.MethodFunc(http.MethodPut, "/v3/pushrules/{scope}/{kind}/{ruleID}/actions", middleware.RequireUserAuth(c.PutPushRuleActions))
+
+		// Pushers
+		rtr.MethodFunc(http.MethodGet, "/v3/pushers", middleware.RequireUserAuth(c.GetPushers))
+		rtr.MethodFunc(http.MethodPost, "/v3/pushers/set", middleware.RequireUserAuth(c.SetPusher))
+
+		// Filters
+		rtr.MethodFunc(http.MethodPost, "/v3/user/{userID}/filter", middleware.RequireUserAuth(c.CreateFilter))
+		rtr.MethodFunc(http.MethodGet, "/v3/user/{userID}/filter/{filterID}", middleware.RequireUserAuth(c.GetFilter))
+
+		// E2EE keys
+		rtr.MethodFunc(http.MethodPost, "/v3/keys/upload", middleware.RequireUserAuth(c.UploadKeys))
+		rtr.MethodFunc(http.MethodPost, "/v3/keys/query", middleware.RequireUserAuth(c.QueryKeys))
+		rtr.MethodFunc(http.MethodPost, "/v3/keys/claim", middleware.RequireUserAuth(c.ClaimKeys))
+		rtr.MethodFunc(http.MethodPost, "/v3/keys/device_signing/upload", middleware.RequireUserAuth(
+			c.RequireUIAUnless(c.skipUIAForFirstCrossSigningKeys, uiaFlowsPassword, c.UploadCrossSigningKeys),
+		))
+		rtr.MethodFunc(http.MethodPost, "/v3/keys/signatures/upload", middleware.RequireUserAuth(c.UploadSignatures))
+
+		// Room key backups
+		rtr.MethodFunc(http.MethodPost, "/v3/room_keys/version", middleware.RequireUserAuth(c.CreateRoomKeysVersion))
+		rtr.MethodFunc(http.MethodGet, "/v3/room_keys/version", middleware.RequireUserAuth(c.GetRoomKeysVersion))
+		rtr.MethodFunc(http.MethodGet, "/v3/room_keys/version/{version}", middleware.RequireUserAuth(c.GetRoomKeysVersion))
+		rtr.MethodFunc(http.MethodPut, "/v3/room_keys/version/{version}", middleware.RequireUserAuth(c.UpdateRoomKeysVersion))
+		rtr.MethodFunc(http.MethodDelete, "/v3/room_keys/version/{version}", middleware.RequireUserAuth(c.DeleteRoomKeysVersion))
+		rtr.MethodFunc(http.MethodPut, "/v3/room_keys/keys", middleware.RequireUserAuth(c.PutRoomKeys))
+		rtr.MethodFunc(http.MethodGet, "/v3/room_keys/keys", middleware.RequireUserAuth(c.GetRoomKeys))
+		rtr.MethodFunc(http.MethodDelete, "/v3/room_keys/keys", middleware.RequireUserAuth(c.DeleteRoomKeys))
+		rtr.MethodFunc(http.MethodPut, "/v3/room_keys/keys/{roomID}", middleware.RequireUserAuth(c.PutRoomKeys))
+		rtr.MethodFunc(http.MethodGet, "/v3/room_keys/keys/{roomID}", middleware.RequireUserAuth(c.GetRoomKeys))
+		rtr.MethodFunc(http.MethodDelete, "/v3/room_keys/keys/{roomID}", middleware.RequireUserAuth(c.DeleteRoomKeys))
+		rtr.MethodFunc(http.MethodPut, "/v3/room_keys/keys/{roomID}/{sessionID}", middleware.RequireUserAuth(c.PutRoomKeys))
+		rtr.MethodFunc(http.MethodGet, "/v3/room_keys/keys/{roomID}/{sessionID}", middleware.RequireUserAuth(c.GetRoomKeys))
+		rtr.MethodFunc(http.MethodDelete, "/v3/room_keys/keys/{roomID}/{sessionID}", middleware.RequireUserAuth(c.DeleteRoomKeys))
+	}
 
-		// the code for this doesn't exist!
-		// rtr.MethodFunc(http.MethodPost, "/v3/keys/upload", middleware.RequireUserAuth(c.UploadKeys))
+	if c.config.Rooms.Enabled && c.config.Transient.Enabled {
+		rtr.MethodFunc(http.MethodPut, "/v3/rooms/{roomID}/typing/{userID}", middleware.RequireUserAuth(c.SendRoomTyping))
 	}
 
-	if c.config.Transient.Enabled {
+	if c.config.Rooms.Enabled && c.config.Transient.Enabled && c.config.Transient.Presence.Enabled {
+		rtr.MethodFunc(http.MethodGet, "/v3/presence/{userID}/status", middleware.RequireUserAuth(c.GetPresence))
+		rtr.MethodFunc(http.MethodPut, "/v3/presence/{userID}/status", middleware.RequireUserAuth(c.SetPresence))
+	}
 
+	if c.config.Accounts.Enabled && c.config.Transient.Enabled {
+		rtr.MethodFunc(http.MethodPut, "/v3/sendToDevice/{eventType}/{txnID}", middleware.RequireUserAuth(c.SendToDevice))
 	}
 
 	if c.config.Media.Enabled {
@@ -128,9 +207,11 @@ func (c *ClientRoutes) AddClientMediaRoutes(rtr chi.Router) {
 }
 
 // https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientversions
-func (f *ClientRoutes) GetVersions(w http.ResponseWriter, r *http.Request) {
+func (c *ClientRoutes) GetVersions(w http.ResponseWriter, r *http.Request) {
 	util.ResponseJSON(w, r, http.StatusOK, map[string]any{
-		"versions":          []string{"1.11"},
-		"unstable_features": []string{},
+		"versions": []string{"1.11"},
+		"unstable_features": map[string]bool{
+			"org.matrix.simplified_msc3575": c.config.Rooms.Enabled && c.config.Accounts.Enabled && c.config.Transient.Enabled,
+		},
 	})
 }
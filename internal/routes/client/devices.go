@@ -0,0 +1,128 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type respDevice struct {
+	DeviceID    id.DeviceID `json:"device_id"`
+	DisplayName string      `json:"display_name,omitempty"`
+}
+
+type respDevices struct {
+	Devices []respDevice `json:"devices"`
+}
+
+func deviceIDFromRequestURLParam(r *http.Request) id.DeviceID {
+	return id.DeviceID(chi.URLParam(r, "deviceID"))
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3devices
+func (c *ClientRoutes) GetDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := c.db.Accounts.GetUserDevices(r.Context(), middleware.GetRequestUserID(r))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respDevices{
+		Devices: make([]respDevice, 0, len(devices)),
+	}
+	for _, device := range devices {
+		resp.Devices = append(resp.Devices, respDevice{
+			DeviceID:    device.ID,
+			DisplayName: device.DisplayName,
+		})
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3devicesdeviceid
+func (c *ClientRoutes) GetDevice(w http.ResponseWriter, r *http.Request) {
+	device, err := c.db.Accounts.GetUserDevice(r.Context(), middleware.GetRequestUserID(r), deviceIDFromRequestURLParam(r))
+	if errors.Is(err, types.ErrDeviceNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Device not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respDevice{
+		DeviceID:    device.ID,
+		DisplayName: device.DisplayName,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3devicesdeviceid
+func (c *ClientRoutes) UpdateDevice(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqDeviceInfo
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	err := c.db.Accounts.UpdateUserDeviceDisplayName(
+		r.Context(),
+		middleware.GetRequestUserID(r),
+		deviceIDFromRequestURLParam(r),
+		req.DisplayName,
+	)
+	if errors.Is(err, types.ErrDeviceNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Device not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3devicesdeviceid
+func (c *ClientRoutes) DeleteDevice(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUserID(r)
+	deviceID := deviceIDFromRequestURLParam(r)
+
+	if _, err := c.db.Accounts.GetUserDevice(r.Context(), userID, deviceID); errors.Is(err, types.ErrDeviceNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Device not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	if err := c.db.DeleteUserDevices(r.Context(), userID, []id.DeviceID{deviceID}); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3delete_devices
+func (c *ClientRoutes) DeleteDevices(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqDeleteDevices
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	if err := c.db.DeleteUserDevices(r.Context(), middleware.GetRequestUserID(r), req.Devices); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type respCreateFilter struct {
+	FilterID string `json:"filter_id"`
+}
+
+// Returns the filter from the sync filter query param, which is either inline JSON or the ID of a
+// previously uploaded filter. Responds with an error and returns false if the filter is invalid.
+func (c *ClientRoutes) filterFromRequest(w http.ResponseWriter, r *http.Request) (*types.Filter, bool) {
+	param := r.URL.Query().Get("filter")
+	if param == "" {
+		return nil, true
+	}
+
+	filterJSON := []byte(param)
+	if !strings.HasPrefix(param, "{") {
+		var err error
+		filterJSON, err = c.db.Accounts.GetFilter(r.Context(), middleware.GetRequestUserID(r), param)
+		if errors.Is(err, types.ErrFilterNotFound) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Filter not found")
+			return nil, false
+		} else if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return nil, false
+		}
+	}
+
+	filter, err := types.NewFilterFromJSON(filterJSON)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid filter: "+err.Error())
+		return nil, false
+	}
+	return filter, true
+}
+
+// Returns the room event filter from the filter query param (inline JSON only), as used by
+// /messages and /context. Responds with an error and returns false if the filter is invalid.
+func roomEventFilterFromRequest(w http.ResponseWriter, r *http.Request) (*types.Filter, bool) {
+	param := r.URL.Query().Get("filter")
+	if param == "" {
+		return nil, true
+	}
+
+	filter, err := types.NewFilterFromRoomEventFilterJSON([]byte(param))
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid filter: "+err.Error())
+		return nil, false
+	}
+	return filter, true
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3useruseridfilter
+func (c *ClientRoutes) CreateFilter(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUserID(r)
+	if util.UserIDFromRequestURLParam(r, "userID") != userID {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot create filters for other users")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !json.Valid(body) {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if _, err := types.NewFilterFromJSON(body); err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid filter: "+err.Error())
+		return
+	}
+
+	filterID, err := c.db.Accounts.CreateFilter(r.Context(), userID, body)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respCreateFilter{filterID})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3useruseridfilterfilterid
+func (c *ClientRoutes) GetFilter(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUserID(r)
+	if util.UserIDFromRequestURLParam(r, "userID") != userID {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot get filters for other users")
+		return
+	}
+	filterID, err := url.PathUnescape(chi.URLParam(r, "filterID"))
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid filter ID")
+		return
+	}
+
+	filterJSON, err := c.db.Accounts.GetFilter(r.Context(), userID, filterID)
+	if errors.Is(err, types.ErrFilterNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Filter not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, json.RawMessage(filterJSON))
+}
@@ -0,0 +1,266 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Note: keys are handled as raw JSON throughout since they are signed by the uploading device, any
+// re-serialization risks breaking the signatures.
+type reqUploadKeys struct {
+	DeviceKeys   json.RawMessage              `json:"device_keys,omitempty"`
+	OneTimeKeys  map[id.KeyID]json.RawMessage `json:"one_time_keys,omitempty"`
+	FallbackKeys map[id.KeyID]json.RawMessage `json:"fallback_keys,omitempty"`
+}
+
+type respUploadKeys struct {
+	OneTimeKeyCounts map[id.KeyAlgorithm]int `json:"one_time_key_counts"`
+}
+
+type respQueryKeys struct {
+	Failures        map[string]any                                `json:"failures"`
+	DeviceKeys      map[id.UserID]map[id.DeviceID]json.RawMessage `json:"device_keys"`
+	MasterKeys      map[id.UserID]json.RawMessage                 `json:"master_keys"`
+	SelfSigningKeys map[id.UserID]json.RawMessage                 `json:"self_signing_keys"`
+	UserSigningKeys map[id.UserID]json.RawMessage                 `json:"user_signing_keys"`
+}
+
+type respClaimKeys struct {
+	Failures    map[string]any                                             `json:"failures"`
+	OneTimeKeys map[id.UserID]map[id.DeviceID]map[id.KeyID]json.RawMessage `json:"one_time_keys"`
+}
+
+func toRawKeysMap(keys map[id.KeyID]json.RawMessage) (map[id.KeyID][]byte, bool) {
+	rawKeys := make(map[id.KeyID][]byte, len(keys))
+	for keyID, key := range keys {
+		if algorithm, _ := keyID.Parse(); algorithm == "" {
+			return nil, false
+		}
+		rawKeys[keyID] = key
+	}
+	return rawKeys, true
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keysupload
+func (c *ClientRoutes) UploadKeys(w http.ResponseWriter, r *http.Request) {
+	var req reqUploadKeys
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+
+	var deviceKeys []byte
+	if len(req.DeviceKeys) > 0 {
+		var keys mautrix.DeviceKeys
+		if err := json.Unmarshal(req.DeviceKeys, &keys); err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+			return
+		} else if keys.UserID != userID || keys.DeviceID != deviceID {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Device keys user/device ID mismatch")
+			return
+		}
+		deviceKeys = req.DeviceKeys
+	}
+
+	oneTimeKeys, ok := toRawKeysMap(req.OneTimeKeys)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid one-time key ID")
+		return
+	}
+	fallbackKeys, ok := toRawKeysMap(req.FallbackKeys)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid fallback key ID")
+		return
+	}
+
+	counts, err := c.db.Accounts.UploadKeys(r.Context(), userID, deviceID, deviceKeys, oneTimeKeys, fallbackKeys)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// TODO: notify users sharing rooms via device_lists.changed
+
+	util.ResponseJSON(w, r, http.StatusOK, respUploadKeys{OneTimeKeyCounts: counts})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keysquery
+func (c *ClientRoutes) QueryKeys(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqQueryKeys
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	query := make(map[id.UserID][]id.DeviceID, len(req.DeviceKeys))
+	for userID, deviceIDs := range req.DeviceKeys {
+		if userID.Homeserver() != c.config.ServerName {
+			// TODO: query remote users over federation
+			hlog.FromRequest(r).Warn().
+				Stringer("target_user_id", userID).
+				Msg("Ignoring key query for remote user")
+			continue
+		}
+		query[userID] = deviceIDs
+	}
+
+	results, err := c.db.Accounts.QueryKeys(r.Context(), middleware.GetRequestUserID(r), query)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respQueryKeys{
+		Failures:        map[string]any{},
+		DeviceKeys:      results.DeviceKeys,
+		MasterKeys:      results.MasterKeys,
+		SelfSigningKeys: results.SelfSigningKeys,
+		UserSigningKeys: results.UserSigningKeys,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keysclaim
+func (c *ClientRoutes) ClaimKeys(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqClaimKeys
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	claims := make(map[id.UserID]map[id.DeviceID]id.KeyAlgorithm, len(req.OneTimeKeys))
+	for userID, devices := range req.OneTimeKeys {
+		if userID.Homeserver() != c.config.ServerName {
+			// TODO: claim remote user keys over federation
+			hlog.FromRequest(r).Warn().
+				Stringer("target_user_id", userID).
+				Msg("Ignoring key claim for remote user")
+			continue
+		}
+		claims[userID] = devices
+	}
+
+	oneTimeKeys, err := c.db.Accounts.ClaimKeys(r.Context(), claims)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respClaimKeys{
+		Failures:    map[string]any{},
+		OneTimeKeys: oneTimeKeys,
+	})
+}
+
+type reqUploadCrossSigningKeys struct {
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+	UserSigningKey json.RawMessage `json:"user_signing_key,omitempty"`
+}
+
+type respUploadSignaturesFailure struct {
+	ErrCode string `json:"errcode"`
+	Err     string `json:"error"`
+}
+
+type respUploadSignatures struct {
+	Failures map[id.UserID]map[string]respUploadSignaturesFailure `json:"failures"`
+}
+
+func nilIfEmpty(b json.RawMessage) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// Uploading the first set of cross-signing keys does not require UIA, only replacing them
+func (c *ClientRoutes) skipUIAForFirstCrossSigningKeys(r *http.Request) (bool, error) {
+	hasKeys, err := c.db.Accounts.HasCrossSigningMasterKey(r.Context(), middleware.GetRequestUserID(r))
+	return !hasKeys, err
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keysdevice_signingupload
+func (c *ClientRoutes) UploadCrossSigningKeys(w http.ResponseWriter, r *http.Request) {
+	var req reqUploadCrossSigningKeys
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	err := c.db.Accounts.UploadCrossSigningKeys(
+		r.Context(),
+		middleware.GetRequestUserID(r),
+		nilIfEmpty(req.MasterKey),
+		nilIfEmpty(req.SelfSigningKey),
+		nilIfEmpty(req.UserSigningKey),
+	)
+	if errors.Is(err, types.ErrInvalidCrossSigningKey) || errors.Is(err, types.ErrInvalidSignature) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// TODO: notify users sharing rooms via device_lists.changed
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3keyssignaturesupload
+func (c *ClientRoutes) UploadSignatures(w http.ResponseWriter, r *http.Request) {
+	var req map[id.UserID]map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	signedKeys := make(map[id.UserID]map[string]json.RawMessage, len(req))
+	for userID, keys := range req {
+		if userID.Homeserver() != c.config.ServerName {
+			// TODO: send signatures of remote users keys over federation
+			hlog.FromRequest(r).Warn().
+				Stringer("target_user_id", userID).
+				Msg("Ignoring signatures upload for remote user")
+			continue
+		}
+		signedKeys[userID] = keys
+	}
+
+	failures, err := c.db.Accounts.UploadSignatures(r.Context(), middleware.GetRequestUserID(r), signedKeys)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respUploadSignatures{
+		Failures: make(map[id.UserID]map[string]respUploadSignaturesFailure, len(failures)),
+	}
+	for userID, keys := range failures {
+		resp.Failures[userID] = make(map[string]respUploadSignaturesFailure, len(keys))
+		for keyID, err := range keys {
+			errCode := "M_INVALID_SIGNATURE"
+			if errors.Is(err, types.ErrKeyNotFound) {
+				errCode = mautrix.MNotFound.ErrCode
+			}
+			resp.Failures[userID][keyID] = respUploadSignaturesFailure{
+				ErrCode: errCode,
+				Err:     err.Error(),
+			}
+		}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
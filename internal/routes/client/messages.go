@@ -0,0 +1,159 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const maxMessagesLimit = 100
+
+type respContext struct {
+	Start        string              `json:"start"`
+	End          string              `json:"end"`
+	Event        types.ClientEvent   `json:"event"`
+	EventsBefore []types.ClientEvent `json:"events_before"`
+	EventsAfter  []types.ClientEvent `json:"events_after"`
+	State        []types.ClientEvent `json:"state"`
+}
+
+type respMessages struct {
+	Start string              `json:"start"`
+	End   string              `json:"end,omitempty"`
+	Chunk []types.ClientEvent `json:"chunk"`
+	State []types.ClientEvent `json:"state,omitempty"`
+}
+
+// Pagination tokens are version maps containing only the rooms version, the same as sync's
+// next_batch, so a sync token can be used to paginate back from the timeline.
+func roomsVersionToToken(version tuple.Versionstamp) string {
+	return util.VersionMapToString(types.VersionMap{types.RoomsVersionKey: version})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3roomsroomidmessages
+func (c *ClientRoutes) GetRoomMessages(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(chi.URLParam(r, "roomID"))
+
+	from, err := util.VersionFromRequestQuery(r, "from", types.RoomsVersionKey)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid from token")
+		return
+	}
+	to, err := util.VersionFromRequestQuery(r, "to", types.RoomsVersionKey)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid to token")
+		return
+	}
+
+	dir := r.URL.Query().Get("dir")
+	if dir != "b" && dir != "f" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid dir, must be b or f")
+		return
+	}
+
+	limit, err := util.IntFromRequestQuery(r, "limit", 10)
+	if err != nil || limit < 1 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxMessagesLimit)
+
+	filter, ok := roomEventFilterFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+		return
+	}
+
+	results, err := c.db.Rooms.PaginateRoomEvents(r.Context(), roomID, rooms.PaginateRoomEventsOptions{
+		From:      from,
+		To:        to,
+		Backwards: dir == "b",
+		Limit:     limit,
+		Filter:    filter,
+	})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respMessages{
+		Start: r.URL.Query().Get("from"),
+		Chunk: util.EventsToClientEvents(results.Events),
+		State: util.EventsToClientEvents(results.State),
+	}
+	if resp.Start == "" {
+		// Paginating from the latest event backwards or from the start of the room forwards
+		if dir == "b" {
+			resp.Start = roomsVersionToToken(results.LatestVersion)
+		} else {
+			resp.Start = roomsVersionToToken(types.ZeroVersionstamp)
+		}
+	}
+	if results.End != types.ZeroVersionstamp {
+		resp.End = roomsVersionToToken(results.End)
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3roomsroomidcontexteventid
+func (c *ClientRoutes) GetRoomEventContext(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(chi.URLParam(r, "roomID"))
+	eventID := id.EventID(chi.URLParam(r, "eventID"))
+
+	limit, err := util.IntFromRequestQuery(r, "limit", 10)
+	if err != nil || limit < 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxMessagesLimit)
+
+	filter, ok := roomEventFilterFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+		return
+	}
+
+	results, err := c.db.Rooms.GetRoomEventContext(r.Context(), roomID, eventID, limit, filter)
+	if errors.Is(err, types.ErrEventNotFound) {
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respContext{
+		Start:        roomsVersionToToken(results.Start),
+		End:          roomsVersionToToken(results.End),
+		Event:        results.Event.ClientEvent(),
+		EventsBefore: util.EventsToClientEvents(results.EventsBefore),
+		EventsAfter:  util.EventsToClientEvents(results.EventsAfter),
+		State:        util.EventsToClientEvents(results.State),
+	})
+}
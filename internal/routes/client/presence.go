@@ -0,0 +1,66 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type reqSetPresence struct {
+	Presence  event.Presence `json:"presence"`
+	StatusMsg string         `json:"status_msg,omitempty"`
+}
+
+func isValidPresence(presence event.Presence) bool {
+	switch presence {
+	case event.PresenceOnline, event.PresenceUnavailable, event.PresenceOffline:
+		return true
+	default:
+		return false
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3presenceuseridstatus
+func (c *ClientRoutes) GetPresence(w http.ResponseWriter, r *http.Request) {
+	userID := util.UserIDFromRequestURLParam(r, "userID")
+
+	presence, err := c.db.Transient.GetUserPresence(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, presence.ToContent())
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3presenceuseridstatus
+func (c *ClientRoutes) SetPresence(w http.ResponseWriter, r *http.Request) {
+	var req reqSetPresence
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	if util.UserIDFromRequestURLParam(r, "userID") != userID {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot set presence for other users")
+		return
+	}
+
+	if !isValidPresence(req.Presence) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid presence")
+		return
+	}
+
+	if err := c.db.SetUserPresence(r.Context(), userID, req.Presence, req.StatusMsg); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
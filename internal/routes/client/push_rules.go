@@ -0,0 +1,264 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type pushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+type pushRuleActions struct {
+	Actions pushrules.PushActionArray `json:"actions"`
+}
+
+type reqPushRule struct {
+	Actions    pushrules.PushActionArray  `json:"actions"`
+	Conditions []*pushrules.PushCondition `json:"conditions"`
+	Pattern    string                     `json:"pattern"`
+}
+
+// Returns the rule kind & ID from the request path, only the global scope is supported
+func pushRuleParamsFromRequest(r *http.Request) (pushrules.PushRuleType, string, error) {
+	if chi.URLParam(r, "scope") != "global" {
+		return "", "", errors.New("unsupported push rule scope")
+	}
+	kind := pushrules.PushRuleType(chi.URLParam(r, "kind"))
+	if !types.IsValidPushRuleKind(kind) {
+		return "", "", errors.New("invalid push rule kind")
+	}
+	ruleID, err := url.PathUnescape(chi.URLParam(r, "ruleID"))
+	if err != nil || ruleID == "" {
+		return "", "", errors.New("invalid push rule ID")
+	}
+	return kind, ruleID, nil
+}
+
+func isValidPushActions(actions pushrules.PushActionArray) bool {
+	for _, action := range actions {
+		switch action.Action {
+		case pushrules.ActionNotify, pushrules.ActionDontNotify, pushrules.ActionCoalesce:
+		case pushrules.ActionSetTweak:
+			switch action.Tweak {
+			case pushrules.TweakSound:
+				if _, ok := action.Value.(string); !ok {
+					return false
+				}
+			case pushrules.TweakHighlight:
+				if _, ok := action.Value.(bool); !ok && action.Value != nil {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Get a single rule, responding with an error and returning nil if it can't be found
+func (c *ClientRoutes) getPushRule(w http.ResponseWriter, r *http.Request) *pushrules.PushRule {
+	kind, ruleID, err := pushRuleParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return nil
+	}
+
+	rs, err := c.db.Accounts.GetPushRules(r.Context(), middleware.GetRequestUserID(r))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return nil
+	}
+
+	rule := types.GetPushRule(rs, kind, ruleID)
+	if rule == nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Push rule not found")
+		return nil
+	}
+	return rule
+}
+
+// Update a single rule, responding with an error or empty success
+func (c *ClientRoutes) updatePushRule(w http.ResponseWriter, r *http.Request, update func(*pushrules.PushRule)) {
+	kind, ruleID, err := pushRuleParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+
+	err = c.db.Accounts.UpdatePushRules(r.Context(), middleware.GetRequestUserID(r), func(rs *pushrules.PushRuleset) error {
+		rule := types.GetPushRule(rs, kind, ruleID)
+		if rule == nil {
+			return types.ErrPushRuleNotFound
+		}
+		update(rule)
+		return nil
+	})
+	if errors.Is(err, types.ErrPushRuleNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Push rule not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrules
+func (c *ClientRoutes) GetPushRules(w http.ResponseWriter, r *http.Request) {
+	rs, err := c.db.Accounts.GetPushRules(r.Context(), middleware.GetRequestUserID(r))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Non-spec: Synapse also allows fetching the ruleset for just the global scope
+	if strings.HasSuffix(r.URL.Path, "/global/") {
+		util.ResponseJSON(w, r, http.StatusOK, rs)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, types.PushRulesContent{Global: rs})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleid
+func (c *ClientRoutes) GetPushRule(w http.ResponseWriter, r *http.Request) {
+	if rule := c.getPushRule(w, r); rule != nil {
+		util.ResponseJSON(w, r, http.StatusOK, rule)
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleid
+func (c *ClientRoutes) PutPushRule(w http.ResponseWriter, r *http.Request) {
+	kind, ruleID, err := pushRuleParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	} else if strings.HasPrefix(ruleID, ".") {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Cannot modify server-default push rules")
+		return
+	}
+
+	var req reqPushRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.Actions == nil || !isValidPushActions(req.Actions) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid push rule actions")
+		return
+	} else if kind == pushrules.ContentRule && req.Pattern == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Content push rules require a pattern")
+		return
+	}
+
+	rule := &pushrules.PushRule{
+		Type:    kind,
+		RuleID:  ruleID,
+		Actions: req.Actions,
+		Enabled: true,
+	}
+	switch kind {
+	case pushrules.OverrideRule, pushrules.UnderrideRule:
+		rule.Conditions = req.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []*pushrules.PushCondition{}
+		}
+	case pushrules.ContentRule:
+		rule.Pattern = req.Pattern
+	}
+
+	query := r.URL.Query()
+	err = c.db.Accounts.UpdatePushRules(r.Context(), middleware.GetRequestUserID(r), func(rs *pushrules.PushRuleset) error {
+		return types.SetPushRule(rs, rule, query.Get("before"), query.Get("after"))
+	})
+	if errors.Is(err, types.ErrPushRuleNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Push rule to insert before or after not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3pushrulesscopekindruleid
+func (c *ClientRoutes) DeletePushRule(w http.ResponseWriter, r *http.Request) {
+	kind, ruleID, err := pushRuleParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	} else if strings.HasPrefix(ruleID, ".") {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Cannot delete server-default push rules")
+		return
+	}
+
+	err = c.db.Accounts.UpdatePushRules(r.Context(), middleware.GetRequestUserID(r), func(rs *pushrules.PushRuleset) error {
+		return types.DeletePushRule(rs, kind, ruleID)
+	})
+	if errors.Is(err, types.ErrPushRuleNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Push rule not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleidenabled
+func (c *ClientRoutes) GetPushRuleEnabled(w http.ResponseWriter, r *http.Request) {
+	if rule := c.getPushRule(w, r); rule != nil {
+		util.ResponseJSON(w, r, http.StatusOK, pushRuleEnabled{Enabled: rule.Enabled})
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleidenabled
+func (c *ClientRoutes) PutPushRuleEnabled(w http.ResponseWriter, r *http.Request) {
+	var req pushRuleEnabled
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	c.updatePushRule(w, r, func(rule *pushrules.PushRule) {
+		rule.Enabled = req.Enabled
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleidactions
+func (c *ClientRoutes) GetPushRuleActions(w http.ResponseWriter, r *http.Request) {
+	if rule := c.getPushRule(w, r); rule != nil {
+		util.ResponseJSON(w, r, http.StatusOK, pushRuleActions{Actions: rule.Actions})
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleidactions
+func (c *ClientRoutes) PutPushRuleActions(w http.ResponseWriter, r *http.Request) {
+	var req pushRuleActions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.Actions == nil || !isValidPushActions(req.Actions) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid push rule actions")
+		return
+	}
+
+	c.updatePushRule(w, r, func(rule *pushrules.PushRule) {
+		rule.Actions = req.Actions
+	})
+}
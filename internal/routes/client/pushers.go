@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	maxPusherAppIDLength   = 64
+	maxPusherPushkeyLength = 512
+	pushGatewayNotifyPath  = "/_matrix/push/v1/notify"
+)
+
+type respPushers struct {
+	Pushers []*types.Pusher `json:"pushers"`
+}
+
+type reqSetPusher struct {
+	types.Pusher
+
+	// Null kind deletes the pusher
+	Kind   *string `json:"kind"`
+	Append bool    `json:"append"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushers
+func (c *ClientRoutes) GetPushers(w http.ResponseWriter, r *http.Request) {
+	pushers, err := c.db.Accounts.GetPushers(r.Context(), middleware.GetRequestUserID(r))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respPushers{pushers})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3pushersset
+func (c *ClientRoutes) SetPusher(w http.ResponseWriter, r *http.Request) {
+	var req reqSetPusher
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.AppID == "" || req.Pushkey == "" {
+		util.ResponseErrorMessageJSON(w, r, util.MMissingParam, "Missing app_id or pushkey")
+		return
+	} else if len(req.AppID) > maxPusherAppIDLength {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "app_id is too long")
+		return
+	} else if len(req.Pushkey) > maxPusherPushkeyLength {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "pushkey is too long")
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+
+	if req.Kind == nil {
+		if err := c.db.Accounts.DeletePusher(r.Context(), userID, req.AppID, req.Pushkey); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+		return
+	}
+
+	pusher := req.Pusher
+	pusher.Kind = *req.Kind
+
+	if pusher.Kind != types.PusherKindHTTP {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Unsupported pusher kind")
+		return
+	} else if pusher.AppDisplayName == "" || pusher.DeviceDisplayName == "" || pusher.Lang == "" || pusher.Data == nil {
+		util.ResponseErrorMessageJSON(w, r, util.MMissingParam, "Missing pusher fields")
+		return
+	}
+
+	data, err := pusher.ParseData()
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid pusher data")
+		return
+	} else if pushURL, err := url.Parse(data.URL); err != nil || pushURL.Host == "" ||
+		(pushURL.Scheme != "https" && pushURL.Scheme != "http") || pushURL.Path != pushGatewayNotifyPath {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Pusher data url must be a push gateway notify URL")
+		return
+	} else if err := util.CheckHostAddrsAllowed(r.Context(), pushURL.Hostname(), c.config.IsPushGatewayAddrDenied); err != nil {
+		// Don't let users make us send requests to internal services
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Pusher data url must resolve to a public address")
+		return
+	} else if data.Format != "" && data.Format != types.PusherFormatEventIDOnly {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Unsupported pusher data format")
+		return
+	}
+
+	if err := c.db.Accounts.SetPusher(r.Context(), userID, &pusher, req.Append); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
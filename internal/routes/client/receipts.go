@@ -1,6 +1,9 @@
 package client
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -16,13 +19,24 @@ import (
 func (c *ClientRoutes) SendRoomReadReceipt(w http.ResponseWriter, r *http.Request) {
 	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
 	eventID := util.EventIDFromRequestURLParam(r, "eventID")
-	receiptType := chi.URLParam(r, "receiptType")
+	receiptType := event.ReceiptType(chi.URLParam(r, "receiptType"))
+
+	// The body is optional, clients may send nothing at all for unthreaded receipts
+	var req mautrix.ReqSendReceipt
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.ThreadID != "" && receiptType != event.ReceiptTypeRead && receiptType != event.ReceiptTypeReadPrivate {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Only read receipts can be threaded")
+		return
+	}
 
 	rc := types.Receipt{
-		UserID:  middleware.GetRequestUserID(r),
-		RoomID:  roomID,
-		Type:    event.ReceiptType(receiptType),
-		EventID: eventID,
+		UserID:   middleware.GetRequestUserID(r),
+		RoomID:   roomID,
+		Type:     receiptType,
+		ThreadID: req.ThreadID,
+		EventID:  eventID,
 		// TODO: data
 	}
 
@@ -31,7 +45,11 @@ func (c *ClientRoutes) SendRoomReadReceipt(w http.ResponseWriter, r *http.Reques
 		return
 	} else if len(res.Rejected) > 0 {
 		err := res.Rejected[0].Error
-		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+		if errors.Is(err, types.ErrEventNotInThread) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		} else {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+		}
 		return
 	} else {
 		util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
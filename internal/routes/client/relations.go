@@ -0,0 +1,98 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type respRelations struct {
+	Chunk          []types.ClientEvent `json:"chunk"`
+	NextBatch      string              `json:"next_batch,omitempty"`
+	PrevBatch      string              `json:"prev_batch,omitempty"`
+	RecursionDepth int                 `json:"recursion_depth,omitempty"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func (c *ClientRoutes) GetRoomRelations(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(chi.URLParam(r, "roomID"))
+	eventID := id.EventID(chi.URLParam(r, "eventID"))
+	relType := event.RelationType(chi.URLParam(r, "relType"))
+	eventType := chi.URLParam(r, "eventType")
+
+	from, err := util.VersionFromRequestQuery(r, "from", types.RoomsVersionKey)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid from token")
+		return
+	}
+	to, err := util.VersionFromRequestQuery(r, "to", types.RoomsVersionKey)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid to token")
+		return
+	}
+
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		dir = "b"
+	} else if dir != "b" && dir != "f" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid dir, must be b or f")
+		return
+	}
+
+	limit, err := util.IntFromRequestQuery(r, "limit", 10)
+	if err != nil || limit < 1 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxMessagesLimit)
+
+	recurse := r.URL.Query().Get("recurse") == "true"
+
+	userID := middleware.GetRequestUserID(r)
+	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+		return
+	}
+
+	results, err := c.db.Rooms.PaginateRoomRelations(r.Context(), roomID, eventID, rooms.PaginateRoomRelationsOptions{
+		From:      from,
+		To:        to,
+		Backwards: dir == "b",
+		Limit:     limit,
+		RelType:   relType,
+		EventType: eventType,
+		Recurse:   recurse,
+	})
+	if errors.Is(err, types.ErrEventNotFound) {
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respRelations{
+		Chunk:     util.EventsToClientEvents(results.Events),
+		PrevBatch: r.URL.Query().Get("from"),
+	}
+	if results.End != types.ZeroVersionstamp {
+		resp.NextBatch = roomsVersionToToken(results.End)
+	}
+	if recurse {
+		resp.RecursionDepth = rooms.MaxRelationsRecursionDepth
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type reqRoomKeysVersion struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+}
+
+type respRoomKeysVersion struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+	Count     int                   `json:"count"`
+	Etag      string                `json:"etag"`
+	Version   id.KeyBackupVersion   `json:"version"`
+}
+
+type respWrongRoomKeysVersion struct {
+	ErrCode        string              `json:"errcode"`
+	Err            string              `json:"error"`
+	CurrentVersion id.KeyBackupVersion `json:"current_version"`
+}
+
+type roomKeysRoomSessions struct {
+	Sessions map[id.SessionID]*types.RoomKeyBackupSession `json:"sessions"`
+}
+
+type roomKeysRooms struct {
+	Rooms map[id.RoomID]roomKeysRoomSessions `json:"rooms"`
+}
+
+// Room & session IDs are optional path params, the request/response bodies vary depending on which
+// are present: all rooms, a single room's sessions or a single session.
+func roomKeysParamsFromRequest(r *http.Request) (id.KeyBackupVersion, id.RoomID, id.SessionID, bool) {
+	version := id.KeyBackupVersion(r.URL.Query().Get("version"))
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	sessionID, err := url.PathUnescape(chi.URLParam(r, "sessionID"))
+	return version, roomID, id.SessionID(sessionID), err == nil
+}
+
+func (c *ClientRoutes) responseRoomKeysError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, types.ErrRoomKeysBackupNotFound):
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Unknown backup version")
+	case errors.Is(err, types.ErrRoomKeysAlgorithmMismatch):
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+	case errors.Is(err, types.ErrWrongRoomKeysVersion):
+		backup, err := c.db.Accounts.GetRoomKeysBackup(r.Context(), middleware.GetRequestUserID(r), "")
+		if err != nil && !errors.Is(err, types.ErrRoomKeysBackupNotFound) {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		resp := respWrongRoomKeysVersion{
+			ErrCode: util.MWrongRoomKeysVersion.ErrCode,
+			Err:     "Wrong backup version",
+		}
+		if backup != nil {
+			resp.CurrentVersion = backup.Version
+		}
+		util.ResponseJSON(w, r, http.StatusForbidden, resp)
+	default:
+		util.ResponseErrorUnknownJSON(w, r, err)
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3room_keysversion
+func (c *ClientRoutes) CreateRoomKeysVersion(w http.ResponseWriter, r *http.Request) {
+	var req reqRoomKeysVersion
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.Algorithm == "" || len(req.AuthData) == 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing algorithm or auth_data")
+		return
+	}
+
+	version, err := c.db.Accounts.CreateRoomKeysBackup(r.Context(), middleware.GetRequestUserID(r), req.Algorithm, req.AuthData)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, mautrix.RespRoomKeysVersionCreate{Version: version})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3room_keysversion
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3room_keysversionversion
+func (c *ClientRoutes) GetRoomKeysVersion(w http.ResponseWriter, r *http.Request) {
+	version := id.KeyBackupVersion(chi.URLParam(r, "version"))
+
+	backup, err := c.db.Accounts.GetRoomKeysBackup(r.Context(), middleware.GetRequestUserID(r), version)
+	if err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respRoomKeysVersion{
+		Algorithm: backup.Algorithm,
+		AuthData:  backup.AuthData,
+		Count:     backup.Count,
+		Etag:      backup.EtagString(),
+		Version:   backup.Version,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3room_keysversionversion
+func (c *ClientRoutes) UpdateRoomKeysVersion(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqRoomKeysVersionUpdate[json.RawMessage]
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	version := id.KeyBackupVersion(chi.URLParam(r, "version"))
+	if req.Version != "" && req.Version != version {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Version does not match path")
+		return
+	}
+
+	err := c.db.Accounts.UpdateRoomKeysBackup(r.Context(), middleware.GetRequestUserID(r), version, req.Algorithm, req.AuthData)
+	if err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3room_keysversionversion
+func (c *ClientRoutes) DeleteRoomKeysVersion(w http.ResponseWriter, r *http.Request) {
+	version := id.KeyBackupVersion(chi.URLParam(r, "version"))
+
+	if err := c.db.Accounts.DeleteRoomKeysBackup(r.Context(), middleware.GetRequestUserID(r), version); err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3room_keyskeys
+func (c *ClientRoutes) PutRoomKeys(w http.ResponseWriter, r *http.Request) {
+	version, roomID, sessionID, ok := roomKeysParamsFromRequest(r)
+	if !ok || version == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing or invalid parameters")
+		return
+	}
+
+	var sessions map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession
+	var err error
+
+	if roomID == "" {
+		var req roomKeysRooms
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			sessions = make(map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession, len(req.Rooms))
+			for roomID, room := range req.Rooms {
+				sessions[roomID] = room.Sessions
+			}
+		}
+	} else if sessionID == "" {
+		var req roomKeysRoomSessions
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			sessions = map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession{roomID: req.Sessions}
+		}
+	} else {
+		var req types.RoomKeyBackupSession
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			sessions = map[id.RoomID]map[id.SessionID]*types.RoomKeyBackupSession{roomID: {sessionID: &req}}
+		}
+	}
+	if err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	backup, err := c.db.Accounts.PutRoomKeys(r.Context(), middleware.GetRequestUserID(r), version, sessions)
+	if err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, mautrix.RespRoomKeysUpdate{
+		Count: backup.Count,
+		ETag:  backup.EtagString(),
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3room_keyskeys
+func (c *ClientRoutes) GetRoomKeys(w http.ResponseWriter, r *http.Request) {
+	version, roomID, sessionID, ok := roomKeysParamsFromRequest(r)
+	if !ok || version == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing or invalid parameters")
+		return
+	}
+
+	sessions, err := c.db.Accounts.GetRoomKeys(r.Context(), middleware.GetRequestUserID(r), version, roomID, sessionID)
+	if err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	if roomID == "" {
+		resp := roomKeysRooms{
+			Rooms: make(map[id.RoomID]roomKeysRoomSessions, len(sessions)),
+		}
+		for roomID, roomSessions := range sessions {
+			resp.Rooms[roomID] = roomKeysRoomSessions{Sessions: roomSessions}
+		}
+		util.ResponseJSON(w, r, http.StatusOK, resp)
+	} else if sessionID == "" {
+		roomSessions := sessions[roomID]
+		if roomSessions == nil {
+			roomSessions = map[id.SessionID]*types.RoomKeyBackupSession{}
+		}
+		util.ResponseJSON(w, r, http.StatusOK, roomKeysRoomSessions{Sessions: roomSessions})
+	} else if session, found := sessions[roomID][sessionID]; found {
+		util.ResponseJSON(w, r, http.StatusOK, session)
+	} else {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Session not found")
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3room_keyskeys
+func (c *ClientRoutes) DeleteRoomKeys(w http.ResponseWriter, r *http.Request) {
+	version, roomID, sessionID, ok := roomKeysParamsFromRequest(r)
+	if !ok || version == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing or invalid parameters")
+		return
+	}
+
+	backup, err := c.db.Accounts.DeleteRoomKeys(r.Context(), middleware.GetRequestUserID(r), version, roomID, sessionID)
+	if err != nil {
+		c.responseRoomKeysError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, mautrix.RespRoomKeysUpdate{
+		Count: backup.Count,
+		ETag:  backup.EtagString(),
+	})
+}
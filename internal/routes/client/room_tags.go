@@ -0,0 +1,102 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type respRoomTags struct {
+	Tags map[string]json.RawMessage `json:"tags"`
+}
+
+func roomTagFromRequestURLParam(r *http.Request) (string, bool) {
+	tag, err := url.PathUnescape(chi.URLParam(r, "tag"))
+	return tag, err == nil && tag != ""
+}
+
+type reqRoomTag struct {
+	Order *float64 `json:"order,omitempty"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3useruseridroomsroomidtags
+func (c *ClientRoutes) GetRoomTags(w http.ResponseWriter, r *http.Request) {
+	userID, roomID, ok := accountDataParamsFromRequest(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot get tags for other users")
+		return
+	}
+
+	tags, err := c.db.Accounts.GetRoomTags(r.Context(), userID, roomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, respRoomTags{Tags: tags})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3useruseridroomsroomidtagstag
+func (c *ClientRoutes) PutRoomTag(w http.ResponseWriter, r *http.Request) {
+	userID, roomID, ok := accountDataParamsFromRequest(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot add tags for other users")
+		return
+	}
+	tag, ok := roomTagFromRequestURLParam(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid tag")
+		return
+	}
+
+	// Tag data is stored as sent, it must be a JSON object with an optional numeric order
+	tagData, err := io.ReadAll(r.Body)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	var tagObj map[string]json.RawMessage
+	if err := json.Unmarshal(tagData, &tagObj); err != nil || tagObj == nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+	var req reqRoomTag
+	if err := json.Unmarshal(tagData, &req); err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MBadJSON, "Tag order must be a number")
+		return
+	}
+
+	if err := c.db.Accounts.SetRoomTag(r.Context(), userID, roomID, tag, tagData); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3useruseridroomsroomidtagstag
+func (c *ClientRoutes) DeleteRoomTag(w http.ResponseWriter, r *http.Request) {
+	userID, roomID, ok := accountDataParamsFromRequest(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot delete tags for other users")
+		return
+	}
+	tag, ok := roomTagFromRequestURLParam(r)
+	if !ok {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid tag")
+		return
+	}
+
+	if err := c.db.Accounts.DeleteRoomTag(r.Context(), userID, roomID, tag); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
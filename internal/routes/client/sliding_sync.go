@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	maxSlidingSyncTimelineLimit = 100
+	// Maximum rooms across all list ranges and room subscriptions, each is fetched per request
+	maxSlidingSyncRooms = 500
+)
+
+// Simplified sliding sync, the position is stateless so clients should restart without a pos
+// when changing the lists or room subscriptions.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+func (c *ClientRoutes) SlidingSync(w http.ResponseWriter, r *http.Request) {
+	versions, err := util.VersionMapFromRequestQuery(r, "pos")
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+	timeout, err := util.IntFromRequestQuery(r, "timeout", 0)
+	if err != nil || timeout < 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout")
+		return
+	}
+
+	var req types.SlidingSyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	roomConfigs := make([]*types.SlidingSyncRoomConfig, 0, len(req.Lists)+len(req.RoomSubscriptions))
+	windowRooms := len(req.RoomSubscriptions)
+	for _, list := range req.Lists {
+		for _, rng := range list.Ranges {
+			if rng[0] < 0 || rng[1] < rng[0] {
+				util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid list range")
+				return
+			}
+			// Compared against the remaining rooms so huge ranges can't overflow the total
+			if rng[1]-rng[0] >= maxSlidingSyncRooms-windowRooms {
+				util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Too many rooms requested")
+				return
+			}
+			windowRooms += rng[1] - rng[0] + 1
+		}
+		roomConfigs = append(roomConfigs, &list.SlidingSyncRoomConfig)
+	}
+	if windowRooms > maxSlidingSyncRooms {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Too many rooms requested")
+		return
+	}
+	for _, config := range req.RoomSubscriptions {
+		roomConfigs = append(roomConfigs, config)
+	}
+	for _, config := range roomConfigs {
+		if config.TimelineLimit < 0 {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeline_limit")
+			return
+		}
+		config.TimelineLimit = min(config.TimelineLimit, maxSlidingSyncTimelineLimit)
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+
+	// Subscribe before the first sync so we can't miss any changes in between
+	sub, err := c.subscribeSync(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	defer sub.close()
+
+	sync, err := waitForSync(r.Context(), sub, time.Duration(timeout)*time.Millisecond, func() (*types.SlidingSync, error) {
+		return c.db.SlidingSyncForUser(r.Context(), userID, deviceID, versions, &req)
+	})
+	if errors.Is(err, context.Canceled) {
+		hlog.FromRequest(r).Debug().Msg("Sliding sync cancelled by client")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, sync)
+}
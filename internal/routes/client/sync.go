@@ -1,11 +1,16 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"maps"
 	"net/http"
 	"slices"
+	"time"
 
+	"github.com/rs/zerolog/hlog"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/databases"
@@ -26,52 +31,173 @@ func (c *ClientRoutes) Sync(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
 		return
 	}
+	timeout, err := util.IntFromRequestQuery(r, "timeout", 0)
+	if err != nil || timeout < 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout")
+		return
+	}
+
+	filter, ok := c.filterFromRequest(w, r)
+	if !ok {
+		return
+	}
 
 	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+
+	setPresence, ok := presenceFromSyncRequest(w, r)
+	if !ok {
+		return
+	}
+	c.updatePresenceFromSync(r, userID, setPresence)
 
 	var sync *types.Sync
 
 	if len(versions) == 0 {
-		if sync, err = c.db.InitForUser(r.Context(), userID); err != nil {
+		if sync, err = c.db.InitForUser(r.Context(), userID, deviceID, filter); err != nil {
 			util.ResponseErrorUnknownJSON(w, r, err)
 			return
 		}
 	} else {
-		// TODO: cache these?
-		rooms, err := c.db.Rooms.GetUserMemberships(r.Context(), userID)
+		options := databases.SyncOptions{
+			Limit:    limit,
+			DeviceID: deviceID,
+			Filter:   filter,
+		}
+		// Subscribe before the first sync so we can't miss any changes in between
+		sub, err := c.subscribeSync(r.Context(), userID)
 		if err != nil {
 			util.ResponseErrorUnknownJSON(w, r, err)
 			return
 		}
+		defer sub.close()
 
-		changeCh := make(chan any, 1)
-		c.notifiers.Subscribe(changeCh, notifier.Subscription{
-			UserIDs: []id.UserID{userID},
-			RoomIDs: slices.Collect(maps.Keys(rooms)),
-		})
-		defer c.notifiers.Unsubscribe(changeCh)
-
-		sync, err = c.db.SyncForUser(r.Context(), userID, versions, databases.SyncOptions{
-			Limit: limit,
+		sync, err = waitForSync(r.Context(), sub, time.Duration(timeout)*time.Millisecond, func() (*types.Sync, error) {
+			return c.db.SyncForUser(r.Context(), userID, versions, options)
 		})
-		if err != nil {
+		if errors.Is(err, context.Canceled) {
+			hlog.FromRequest(r).Debug().Msg("Sync cancelled by client")
+			return
+		} else if err != nil {
 			util.ResponseErrorUnknownJSON(w, r, err)
 			return
 		}
-
-		// If sync is empty, wait on notifier, re-sync
-		if sync.IsEmpty() {
-			<-changeCh
-			sync, err = c.db.SyncForUser(r.Context(), userID, versions, databases.SyncOptions{
-				Limit: limit,
-			})
-			if err != nil {
-				util.ResponseErrorUnknownJSON(w, r, err)
-				return
-			}
-		}
 	}
 
 	util.ResponseJSON(w, r, http.StatusOK, sync)
-	return
+}
+
+// Returns the set_presence query param, defaulting to online. Responds with an error and returns
+// false if the presence is invalid.
+func presenceFromSyncRequest(w http.ResponseWriter, r *http.Request) (event.Presence, bool) {
+	setPresence := event.Presence(r.URL.Query().Get("set_presence"))
+	if setPresence == "" {
+		return event.PresenceOnline, true
+	} else if !isValidPresence(setPresence) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid set_presence")
+		return "", false
+	}
+	return setPresence, true
+}
+
+func (c *ClientRoutes) updatePresenceFromSync(r *http.Request, userID id.UserID, setPresence event.Presence) {
+	if !c.config.Transient.Presence.Enabled {
+		return
+	}
+	if err := c.db.SetUserPresenceFromSync(r.Context(), userID, setPresence); err != nil {
+		// Don't fail the sync, presence is best effort
+		hlog.FromRequest(r).Err(err).Msg("Failed to update presence from sync")
+	}
+}
+
+// Notifier subscription to changes for a user and the rooms they are a member of
+type syncSubscription struct {
+	c        *ClientRoutes
+	userID   id.UserID
+	changeCh chan any
+
+	subscribed bool
+	roomIDs    []id.RoomID
+}
+
+func (c *ClientRoutes) subscribeSync(ctx context.Context, userID id.UserID) (*syncSubscription, error) {
+	sub := &syncSubscription{
+		c:        c,
+		userID:   userID,
+		changeCh: make(chan any, 1),
+	}
+	if err := sub.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Re-subscribe if the users memberships have changed, so rooms joined since are included
+func (s *syncSubscription) refresh(ctx context.Context) error {
+	rooms, err := s.c.db.Rooms.GetUserMemberships(ctx, s.userID)
+	if err != nil {
+		return err
+	}
+	roomIDs := slices.Sorted(maps.Keys(rooms))
+	if s.subscribed && slices.Equal(s.roomIDs, roomIDs) {
+		return nil
+	} else if s.subscribed {
+		s.c.notifiers.Unsubscribe(s.changeCh)
+	}
+	s.subscribed = true
+	s.roomIDs = roomIDs
+	s.c.notifiers.Subscribe(s.changeCh, notifier.Subscription{
+		UserIDs: []id.UserID{s.userID},
+		RoomIDs: roomIDs,
+	})
+	return nil
+}
+
+func (s *syncSubscription) close() {
+	s.c.notifiers.Unsubscribe(s.changeCh)
+}
+
+type syncResult interface {
+	IsEmpty() bool
+}
+
+// Runs the sync function, and if the result is empty waits up to the timeout for any changes to
+// the user or their rooms and syncs again. The subscription is refreshed on every change so rooms
+// joined mid-wait are included. Used by sync, sliding sync & the sync stream.
+func waitForSync[T syncResult](
+	ctx context.Context,
+	sub *syncSubscription,
+	timeout time.Duration,
+	doSync func() (T, error),
+) (T, error) {
+	var empty T
+
+	sync, err := doSync()
+	if err != nil || !sync.IsEmpty() || timeout <= 0 {
+		return sync, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return empty, ctx.Err()
+		case <-timer.C:
+			// Return the empty sync, the next batch is unchanged other than skipping anything
+			// excluded by the filter.
+			return sync, nil
+		case <-sub.changeCh:
+		}
+
+		// Memberships may have changed, re-subscribe before syncing again so nothing is missed
+		if err := sub.refresh(ctx); err != nil {
+			return empty, err
+		}
+
+		if sync, err = doSync(); err != nil || !sync.IsEmpty() {
+			return sync, err
+		}
+	}
 }
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	syncStreamKeepaliveInterval = 30 * time.Second
+	// Longer than the keepalive interval so a dropped connection fails a write before the
+	// position sent at the previous acknowledgement is acknowledged.
+	syncStreamToDeviceAckInterval = time.Minute
+	syncStreamEventName           = "sync"
+	syncStreamErrorEventName      = "error"
+)
+
+// Streaming sync over server-sent events. Each event is a sync response with the next batch as
+// the event ID, so clients (including browsers' EventSource) resume with Last-Event-ID when they
+// reconnect. Accepts the same since, filter, limit & set_presence query parameters as sync.
+//
+// To-device events are deleted when the client reconnects with a position, and while connected
+// up to the position sent one acknowledgement interval earlier, since a frame may be written but
+// never processed if the connection drops.
+func (c *ClientRoutes) SyncStream(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	versions, err := util.StringToVersionMap(since)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+	limit, err := util.IntFromRequestQuery(r, "limit", 10)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+
+	filter, ok := c.filterFromRequest(w, r)
+	if !ok {
+		return
+	}
+	setPresence, ok := presenceFromSyncRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+	log := hlog.FromRequest(r)
+
+	c.updatePresenceFromSync(r, userID, setPresence)
+	lastPresenceUpdate := time.Now()
+
+	if ackVersion := versions[types.DevicesVersionKey]; c.db.Transient != nil && deviceID != "" && ackVersion != types.ZeroVersionstamp {
+		if err := c.db.Transient.AckToDeviceForUserDevice(r.Context(), userID, deviceID, ackVersion); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+	}
+
+	// Subscribe before the first sync so we can't miss any changes in between, this subscription
+	// is kept for the lifetime of the connection.
+	sub, err := c.subscribeSync(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	defer sub.close()
+
+	var sync *types.Sync
+	if len(versions) == 0 {
+		if sync, err = c.db.InitForUser(r.Context(), userID, deviceID, filter); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		} else if versions, err = util.StringToVersionMap(sync.NextBatch); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+	}
+
+	if err := util.ResponseEventStream(w); err != nil {
+		log.Err(err).Msg("Failed to start sync stream")
+		return
+	}
+
+	options := databases.SyncOptions{
+		Limit:          limit,
+		DeviceID:       deviceID,
+		Filter:         filter,
+		RetainToDevice: true,
+	}
+
+	ackToDevice := c.db.Transient != nil && deviceID != ""
+	// The position sent to the client as of the last acknowledgement, acknowledged at the next
+	pendingAckVersion := types.ZeroVersionstamp
+	lastToDeviceAck := time.Now()
+
+	for {
+		if sync == nil {
+			sync, err = waitForSync(r.Context(), sub, syncStreamKeepaliveInterval, func() (*types.Sync, error) {
+				return c.db.SyncForUser(r.Context(), userID, versions, options)
+			})
+			if errors.Is(err, context.Canceled) {
+				log.Debug().Msg("Sync stream closed by client")
+				return
+			} else if err != nil {
+				log.Err(err).Msg("Failed to sync for sync stream")
+				// The response has started so send the error as an event before closing
+				util.ResponseEventStreamEvent(w, "", syncStreamErrorEventName, util.MUnknown)
+				return
+			}
+		}
+
+		// Keep presence online while connected, at least as often as the keepalives
+		if time.Since(lastPresenceUpdate) >= syncStreamKeepaliveInterval {
+			c.updatePresenceFromSync(r, userID, setPresence)
+			lastPresenceUpdate = time.Now()
+		}
+
+		if sync.IsEmpty() {
+			err = util.ResponseEventStreamEvent(w, "", "", nil)
+		} else {
+			err = util.ResponseEventStreamEvent(w, sync.NextBatch, syncStreamEventName, sync)
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to write to sync stream")
+			return
+		}
+		sync = nil
+
+		if ackToDevice && time.Since(lastToDeviceAck) >= syncStreamToDeviceAckInterval {
+			if pendingAckVersion != types.ZeroVersionstamp {
+				if err := c.db.Transient.AckToDeviceForUserDevice(r.Context(), userID, deviceID, pendingAckVersion); err != nil {
+					// Not fatal, the events are acknowledged next time or when the client reconnects
+					log.Err(err).Msg("Failed to acknowledge to-device events for sync stream")
+				}
+			}
+			pendingAckVersion = versions[types.DevicesVersionKey]
+			lastToDeviceAck = time.Now()
+		}
+	}
+}
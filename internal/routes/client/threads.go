@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type respThreads struct {
+	Chunk     []types.ClientEvent `json:"chunk"`
+	NextBatch string              `json:"next_batch,omitempty"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidthreads
+func (c *ClientRoutes) GetRoomThreads(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(chi.URLParam(r, "roomID"))
+
+	from, err := util.VersionFromRequestQuery(r, "from", types.RoomsVersionKey)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid from token")
+		return
+	}
+
+	include := r.URL.Query().Get("include")
+	if include == "" {
+		include = "all"
+	} else if include != "all" && include != "participated" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid include, must be all or participated")
+		return
+	}
+
+	limit, err := util.IntFromRequestQuery(r, "limit", 10)
+	if err != nil || limit < 1 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxMessagesLimit)
+
+	userID := middleware.GetRequestUserID(r)
+	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+		return
+	}
+
+	results, err := c.db.Rooms.PaginateRoomThreads(r.Context(), roomID, userID, rooms.PaginateRoomThreadsOptions{
+		From:         from,
+		Limit:        limit,
+		Participated: include == "participated",
+	})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respThreads{
+		Chunk: util.EventsToClientEvents(results.Events),
+	}
+	if results.End != types.ZeroVersionstamp {
+		resp.NextBatch = roomsVersionToToken(results.End)
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const allDevicesWildcard = "*"
+
+type reqSendToDevice struct {
+	Messages map[id.UserID]map[id.DeviceID]json.RawMessage `json:"messages"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3sendtodeviceeventtypetxnid
+func (c *ClientRoutes) SendToDevice(w http.ResponseWriter, r *http.Request) {
+	var req reqSendToDevice
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	evType := chi.URLParam(r, "eventType")
+	txnID := chi.URLParam(r, "txnID")
+	userID := middleware.GetRequestUserID(r)
+	deviceID := middleware.GetRequestDeviceID(r)
+
+	// Expand wildcard device IDs and drop remote users
+	messages := make(map[id.UserID]map[id.DeviceID]json.RawMessage, len(req.Messages))
+	for targetUserID, devices := range req.Messages {
+		if targetUserID.Homeserver() != c.config.ServerName {
+			// TODO: send remote to-device events over federation (m.direct_to_device EDU)
+			hlog.FromRequest(r).Warn().
+				Stringer("target_user_id", targetUserID).
+				Msg("Ignoring to-device event for remote user")
+			continue
+		}
+
+		userMessages := make(map[id.DeviceID]json.RawMessage, len(devices))
+
+		for deviceID, content := range devices {
+			if deviceID == allDevicesWildcard {
+				userDevices, err := c.db.Accounts.GetUserDevices(r.Context(), targetUserID)
+				if err != nil {
+					util.ResponseErrorUnknownJSON(w, r, err)
+					return
+				}
+				for _, device := range userDevices {
+					userMessages[device.ID] = content
+				}
+			} else {
+				userMessages[deviceID] = content
+			}
+		}
+
+		messages[targetUserID] = userMessages
+	}
+
+	if err := c.db.Transient.SendToDeviceEvents(r.Context(), userID, deviceID, txnID, evType, messages); err != nil {
+		if errors.Is(err, types.ErrTooManyToDeviceEvents) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		} else {
+			util.ResponseErrorUnknownJSON(w, r, err)
+		}
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
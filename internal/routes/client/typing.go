@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type reqTyping struct {
+	Typing  bool  `json:"typing"`
+	Timeout int64 `json:"timeout,omitempty"` // milliseconds
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3roomsroomidtypinguserid
+func (c *ClientRoutes) SendRoomTyping(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	userIDParam := util.UserIDFromRequestURLParam(r, "userID")
+
+	var req reqTyping
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	userID := middleware.GetRequestUserID(r)
+	if userIDParam != userID {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot set typing for other users")
+		return
+	}
+
+	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "User not in room")
+		return
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	if err := c.db.Transient.SetUserTyping(r.Context(), roomID, userID, req.Typing, timeout); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
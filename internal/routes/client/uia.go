@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// User-interactive authentication, handlers are wrapped with RequireUIA which only calls the
+// handler once all stages of one of the given flows have been completed. The session is deleted
+// before the handler is called, so each completed session authenticates exactly one request.
+// https://spec.matrix.org/v1.11/client-server-api/#user-interactive-authentication-api
+
+var (
+	uiaFlowsDummy = []mautrix.UIAFlow{
+		{Stages: []mautrix.AuthType{mautrix.AuthTypeDummy}},
+	}
+	uiaFlowsPassword = []mautrix.UIAFlow{
+		{Stages: []mautrix.AuthType{mautrix.AuthTypePassword}},
+	}
+)
+
+type reqUIAAuth struct {
+	Type       mautrix.AuthType        `json:"type"`
+	Session    string                  `json:"session"`
+	Identifier *mautrix.UserIdentifier `json:"identifier,omitempty"`
+	Password   string                  `json:"password,omitempty"`
+}
+
+type reqUIA struct {
+	Auth *reqUIAAuth `json:"auth"`
+}
+
+func uiaRequestFromRequest(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+func responseUIA(
+	w http.ResponseWriter,
+	r *http.Request,
+	flows []mautrix.UIAFlow,
+	session *types.UIASession,
+	errCode mautrix.RespError,
+	message string,
+) {
+	resp := mautrix.RespUserInteractive{
+		Flows:     flows,
+		Params:    map[mautrix.AuthType]any{},
+		Session:   session.ID,
+		Completed: make([]string, 0, len(session.Completed)),
+		ErrCode:   errCode.ErrCode,
+		Error:     message,
+	}
+	for _, stage := range session.Completed {
+		resp.Completed = append(resp.Completed, string(stage))
+	}
+	util.ResponseJSON(w, r, http.StatusUnauthorized, resp)
+}
+
+func (c *ClientRoutes) RequireUIA(flows []mautrix.UIAFlow, next http.HandlerFunc) http.HandlerFunc {
+	return c.RequireUIAUnless(nil, flows, next)
+}
+
+// As RequireUIA but skips authentication entirely when skip returns true
+func (c *ClientRoutes) RequireUIAUnless(
+	skip func(r *http.Request) (bool, error),
+	flows []mautrix.UIAFlow,
+	next http.HandlerFunc,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if skip != nil {
+			if ok, err := skip(r); err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			} else if ok {
+				next(w, r)
+				return
+			}
+		}
+
+		// Read the body and restore it for the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req reqUIA
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req); err != nil {
+				util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+				return
+			}
+		}
+
+		userID := middleware.MaybeGetRequestUserID(r)
+		request := uiaRequestFromRequest(r)
+
+		if req.Auth == nil || req.Auth.Session == "" {
+			session, err := c.db.Accounts.CreateUIASession(r.Context(), userID, request)
+			if err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			}
+			responseUIA(w, r, flows, session, mautrix.RespError{}, "")
+			return
+		}
+
+		session, err := c.db.Accounts.GetUIASession(r.Context(), req.Auth.Session)
+		if errors.Is(err, types.ErrUIASessionNotFound) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Unknown session")
+			return
+		} else if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		} else if session.UserID != userID || session.Request != request {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Session does not match this request")
+			return
+		}
+
+		if req.Auth.Type != "" {
+			if ok, message, err := c.checkUIAStage(r, flows, userID, req.Auth); err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			} else if !ok {
+				responseUIA(w, r, flows, session, mautrix.MForbidden, message)
+				return
+			}
+			session, err = c.db.Accounts.CompleteUIASessionStage(r.Context(), session.ID, req.Auth.Type)
+			if err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			}
+		}
+
+		if !session.IsComplete(flows) {
+			responseUIA(w, r, flows, session, mautrix.RespError{}, "")
+			return
+		}
+
+		// Delete the session before calling the handler, so a completed session can only ever
+		// authenticate a single request.
+		if err := c.db.Accounts.ConsumeUIASession(r.Context(), session.ID); errors.Is(err, types.ErrUIASessionNotFound) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Unknown session")
+			return
+		} else if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Returns whether the stage was completed, with a message for the client if not
+func (c *ClientRoutes) checkUIAStage(
+	r *http.Request,
+	flows []mautrix.UIAFlow,
+	userID id.UserID,
+	auth *reqUIAAuth,
+) (bool, string, error) {
+	if !slices.ContainsFunc(flows, func(flow mautrix.UIAFlow) bool {
+		return slices.Contains(flow.Stages, auth.Type)
+	}) {
+		return false, "Auth type not allowed for this request", nil
+	}
+
+	switch auth.Type {
+	case mautrix.AuthTypeDummy:
+		return true, "", nil
+	case mautrix.AuthTypePassword:
+		if auth.Identifier == nil || auth.Identifier.Type != mautrix.IdentifierTypeUser {
+			return false, "Invalid identifier type", nil
+		}
+		username := auth.Identifier.User
+		if userID != "" {
+			// Authenticated requests may only confirm the requesting user's own password
+			if username != userID.Localpart() && username != userID.String() {
+				return false, "Identifier does not match the requesting user", nil
+			}
+			username = userID.Localpart()
+		}
+		err := c.db.Accounts.CheckUserPassword(r.Context(), username, auth.Password)
+		if errors.Is(err, types.ErrUserNotFound) || errors.Is(err, types.ErrInvalidPassword) {
+			return false, "Invalid username or password", nil
+		} else if err != nil {
+			return false, "", err
+		}
+		return true, "", nil
+	default:
+		return false, "Unsupported auth type", nil
+	}
+}
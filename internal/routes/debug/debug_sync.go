@@ -14,7 +14,7 @@ import (
 func (b *DebugRoutes) DebugInitUser(w http.ResponseWriter, r *http.Request) {
 	userID := id.UserID(chi.URLParam(r, "userID"))
 
-	if sync, err := b.db.InitForUser(r.Context(), userID); err != nil {
+	if sync, err := b.db.InitForUser(r.Context(), userID, "", nil); err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
 	} else {
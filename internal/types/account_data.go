@@ -0,0 +1,18 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+)
+
+type AccountDataEvent struct {
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+
+	// Room the account data belongs to, empty for global account data
+	RoomID id.RoomID `json:"-"`
+	// Position in the user's account data change log
+	Version tuple.Versionstamp `json:"-"`
+}
@@ -8,9 +8,29 @@ var (
 	ErrEventRedacted = errors.New("event has been redacted")
 
 	ErrUserNotInRoom     = errors.New("user is not in this room")
+	ErrEventNotInThread  = errors.New("event is not in this thread")
 	ErrUserNotFound      = errors.New("user not found")
+	ErrDeviceNotFound    = errors.New("device not found")
 	ErrTokenExpired      = errors.New("token is expired")
+	ErrTokenNotFound     = errors.New("token not found")
+	ErrTokenReused       = errors.New("token has already been used")
 	ErrUserAlreadyExists = errors.New("username already exists")
 	ErrProfileNotChanged = errors.New("profile is unchanged")
 	ErrInvalidPassword   = errors.New("invalid password")
+
+	ErrUIASessionNotFound = errors.New("user-interactive auth session not found")
+
+	ErrAccountDataNotFound = errors.New("account data not found")
+	ErrPushRuleNotFound    = errors.New("push rule not found")
+	ErrFilterNotFound      = errors.New("filter not found")
+
+	ErrTooManyToDeviceEvents = errors.New("too many to-device events")
+
+	ErrInvalidCrossSigningKey = errors.New("invalid cross-signing key")
+	ErrInvalidSignature       = errors.New("invalid signature")
+	ErrKeyNotFound            = errors.New("key not found")
+
+	ErrRoomKeysBackupNotFound    = errors.New("room keys backup not found")
+	ErrWrongRoomKeysVersion      = errors.New("room keys backup version is not the current version")
+	ErrRoomKeysAlgorithmMismatch = errors.New("room keys backup algorithm cannot be changed")
 )
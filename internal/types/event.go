@@ -195,6 +195,23 @@ func (ev ClientEvent) MarshalJSON() ([]byte, error) {
 	return sjson.SetBytes(b, "event_id", ev.ID)
 }
 
+// Convert to a mautrix event with the raw content parsed but not the typed content, used for
+// push rule evaluation.
+func (ev *Event) MautrixEvent() *event.Event {
+	mev := &event.Event{
+		ID:        ev.ID,
+		RoomID:    ev.RoomID,
+		Sender:    ev.Sender,
+		Type:      ev.Type,
+		StateKey:  ev.StateKey,
+		Timestamp: ev.Timestamp,
+		Content:   event.Content{VeryRaw: ev.Content},
+	}
+	// Invalid content is left nil which won't match any content conditions
+	_ = json.Unmarshal(ev.Content, &mev.Content.Raw)
+	return mev
+}
+
 func (ev *Event) EventIDTup() EventIDTup {
 	return EventIDTup{
 		EventID: ev.ID,
@@ -273,6 +290,14 @@ func (ev *Event) RelatesTo() (id.EventID, event.RelationType) {
 	return rel.EventID, rel.Type
 }
 
+// Returns the thread root event ID if this event is in a thread, otherwise empty
+func (ev *Event) ThreadRootID() id.EventID {
+	if relEvID, relType := ev.RelatesTo(); relType == event.RelThread {
+		return relEvID
+	}
+	return ""
+}
+
 func (ev *Event) ReactionKey() string {
 	if ev.Type != event.EventReaction {
 		return ""
@@ -2,6 +2,8 @@ package types
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"slices"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
@@ -102,3 +104,42 @@ func ValueToMembershipTup(value []byte) MembershipTup {
 		Membership: event.Membership(tup[2].(string)),
 	}
 }
+
+// Relation tuples defined as (eventID, relType)
+type RelationTup struct {
+	EventID id.EventID
+	RelType event.RelationType
+}
+type RelationTupWithVersion struct {
+	RelationTup
+	Version tuple.Versionstamp
+}
+
+func RelationTupToValue(tup RelationTup) []byte {
+	return tuple.Tuple{tup.EventID.String(), string(tup.RelType)}.Pack()
+}
+
+var ErrInvalidRelation = errors.New("invalid relation tuple")
+
+// Legacy values stored the relation type as bytes, these are rejected as the keys they were stored
+// under are also invalid (see events.KeyToRoomRelationVersion).
+func ValueToRelationTup(value []byte) (RelationTup, error) {
+	tup, err := tuple.Unpack(value)
+	if err != nil {
+		return RelationTup{}, fmt.Errorf("%w: %w", ErrInvalidRelation, err)
+	} else if len(tup) != 2 {
+		return RelationTup{}, ErrInvalidRelation
+	}
+	eventID, ok := tup[0].(string)
+	if !ok {
+		return RelationTup{}, ErrInvalidRelation
+	}
+	relType, ok := tup[1].(string)
+	if !ok {
+		return RelationTup{}, ErrInvalidRelation
+	}
+	return RelationTup{
+		EventID: id.EventID(eventID),
+		RelType: event.RelationType(relType),
+	}, nil
+}
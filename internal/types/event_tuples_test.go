@@ -0,0 +1,27 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestRelationTup(t *testing.T) {
+	relationTup := types.RelationTup{EventID: "$abc", RelType: event.RelThread}
+
+	tupFromBytes, err := types.ValueToRelationTup(types.RelationTupToValue(relationTup))
+	require.NoError(t, err)
+	assert.Equal(t, relationTup, tupFromBytes)
+
+	// Legacy values stored the relation type as bytes
+	_, err = types.ValueToRelationTup(tuple.Tuple{"$abc", []byte(event.RelAnnotation)}.Pack())
+	assert.ErrorIs(t, err, types.ErrInvalidRelation)
+
+	_, err = types.ValueToRelationTup([]byte{0xff})
+	assert.ErrorIs(t, err, types.ErrInvalidRelation)
+}
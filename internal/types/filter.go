@@ -0,0 +1,182 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Sync filter, a nil filter matches everything. Note that slices in the filter are nil when absent
+// from the JSON, which is different to an empty list (match nothing).
+// https://spec.matrix.org/v1.11/client-server-api/#filtering
+type Filter struct {
+	mautrix.Filter
+
+	// Not supported by mautrix.FilterPart so parsed separately
+	unreadThreadNotifications bool
+}
+
+func NewFilterFromJSON(b []byte) (*Filter, error) {
+	var filter Filter
+	if err := json.Unmarshal(b, &filter); err != nil {
+		return nil, err
+	}
+	switch filter.EventFormat {
+	case "", mautrix.EventFormatClient, mautrix.EventFormatFederation:
+	default:
+		return nil, errors.New("invalid event_format")
+	}
+	filter.unreadThreadNotifications = gjson.GetBytes(b, "room.timeline.unread_thread_notifications").Bool()
+	return &filter, nil
+}
+
+// Parse a room event filter (as used by /messages) into a filter that applies it to timeline &
+// state events.
+func NewFilterFromRoomEventFilterJSON(b []byte) (*Filter, error) {
+	var part mautrix.FilterPart
+	if err := json.Unmarshal(b, &part); err != nil {
+		return nil, err
+	}
+	filter := Filter{}
+	filter.Room.Timeline = part
+	filter.Room.State = part
+	return &filter, nil
+}
+
+// Whether the room should be included at all, applies to every part of the sync
+func (f *Filter) IncludeRoom(roomID id.RoomID) bool {
+	if f == nil {
+		return true
+	}
+	return matchList(f.Room.Rooms, f.Room.NotRooms, roomID)
+}
+
+// Whether to include rooms the user has already left, note that unlike the spec this defaults to
+// true when no filter is provided.
+func (f *Filter) IncludeLeave() bool {
+	return f == nil || f.Room.IncludeLeave
+}
+
+// Returns the timeline limit, or zero if not set
+func (f *Filter) TimelineLimit() int {
+	if f == nil {
+		return 0
+	}
+	return f.Room.Timeline.Limit
+}
+
+// Whether to only send member events for timeline senders rather than all room members
+// https://spec.matrix.org/v1.11/client-server-api/#lazy-loading-room-members
+func (f *Filter) LazyLoadMembers() bool {
+	return f != nil && f.Room.State.LazyLoadMembers
+}
+
+// Whether to re-send lazy loaded member events even if already sent to the device
+func (f *Filter) IncludeRedundantMembers() bool {
+	return f != nil && f.Room.State.IncludeRedundantMembers
+}
+
+// Whether to return notification counts for each thread separately from the main timeline
+// https://spec.matrix.org/v1.11/client-server-api/#receiving-notifications
+func (f *Filter) UnreadThreadNotifications() bool {
+	return f != nil && f.unreadThreadNotifications
+}
+
+func (f *Filter) MatchTimelineEvent(ev *Event) bool {
+	if f == nil {
+		return true
+	}
+	return f.IncludeRoom(ev.RoomID) && matchFilterPart(&f.Room.Timeline, ev.RoomID, ev.Sender, ev.Type.Type, ev.Content)
+}
+
+func (f *Filter) MatchStateEvent(ev *Event) bool {
+	if f == nil {
+		return true
+	}
+	return f.IncludeRoom(ev.RoomID) && matchFilterPart(&f.Room.State, ev.RoomID, ev.Sender, ev.Type.Type, ev.Content)
+}
+
+// Match an ephemeral (typing or receipt) event by room and type
+func (f *Filter) MatchEphemeral(roomID id.RoomID, evType event.Type) bool {
+	if f == nil {
+		return true
+	}
+	return f.IncludeRoom(roomID) && matchFilterPart(&f.Room.Ephemeral, roomID, "", evType.Type, nil)
+}
+
+func (f *Filter) MatchAccountData(ev *AccountDataEvent) bool {
+	if f == nil {
+		return true
+	} else if ev.RoomID == "" {
+		return matchFilterPart(&f.AccountData, "", "", ev.Type, nil)
+	}
+	return f.IncludeRoom(ev.RoomID) && matchFilterPart(&f.Room.AccountData, ev.RoomID, "", ev.Type, nil)
+}
+
+func (f *Filter) MatchPresence(userID id.UserID) bool {
+	if f == nil {
+		return true
+	}
+	return matchFilterPart(&f.Presence, "", userID, event.EphemeralEventPresence.Type, nil)
+}
+
+// Match against a filter part, empty room ID/sender or nil content skip those checks
+func matchFilterPart(part *mautrix.FilterPart, roomID id.RoomID, sender id.UserID, evType string, content json.RawMessage) bool {
+	if roomID != "" && !matchList(part.Rooms, part.NotRooms, roomID) {
+		return false
+	} else if sender != "" && !matchList(part.Senders, part.NotSenders, sender) {
+		return false
+	}
+
+	if slices.ContainsFunc(part.NotTypes, func(t event.Type) bool { return matchTypeWildcard(t.Type, evType) }) {
+		return false
+	} else if part.Types != nil && !slices.ContainsFunc(part.Types, func(t event.Type) bool { return matchTypeWildcard(t.Type, evType) }) {
+		return false
+	}
+
+	if part.ContainsURL != nil && content != nil {
+		urlValue := gjson.GetBytes(content, "url")
+		if hasURL := urlValue.Type == gjson.String; hasURL != *part.ContainsURL {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Exclusions take precedence, a nil include list includes everything
+func matchList[T comparable](include, exclude []T, value T) bool {
+	if slices.Contains(exclude, value) {
+		return false
+	}
+	return include == nil || slices.Contains(include, value)
+}
+
+// Match an event type against a filter type, where * matches any sequence of characters
+func matchTypeWildcard(pattern, evType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == evType
+	}
+
+	if !strings.HasPrefix(evType, parts[0]) {
+		return false
+	}
+	evType = evType[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(evType, part)
+		if idx < 0 {
+			return false
+		}
+		evType = evType[idx+len(part):]
+	}
+
+	return strings.HasSuffix(evType, parts[len(parts)-1])
+}
@@ -0,0 +1,103 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func newFilterTestEvent(roomID id.RoomID, sender id.UserID, evType event.Type, content string) *types.Event {
+	return &types.Event{PartialEvent: types.PartialEvent{
+		RoomID:  roomID,
+		Sender:  sender,
+		Type:    evType,
+		Content: json.RawMessage(content),
+	}}
+}
+
+func TestFilterMatchTimelineEvent(t *testing.T) {
+	filter, err := types.NewFilterFromJSON([]byte(`{
+		"room": {
+			"not_rooms": ["!excluded:test"],
+			"timeline": {
+				"types": ["m.room.*"],
+				"not_types": ["m.room.member"],
+				"not_senders": ["@spam:test"],
+				"limit": 5
+			}
+		}
+	}`))
+	require.NoError(t, err)
+
+	assert.True(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventMessage, `{}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.StateMember, `{}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventReaction, `{}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@spam:test", event.EventMessage, `{}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!excluded:test", "@alice:test", event.EventMessage, `{}`)))
+	assert.Equal(t, 5, filter.TimelineLimit())
+	assert.False(t, filter.IncludeLeave())
+	assert.False(t, filter.IncludeRoom("!excluded:test"))
+
+	// A nil filter matches everything
+	var nilFilter *types.Filter
+	assert.True(t, nilFilter.MatchTimelineEvent(newFilterTestEvent("!excluded:test", "@spam:test", event.StateMember, `{}`)))
+	assert.True(t, nilFilter.IncludeLeave())
+}
+
+func TestFilterEmptyListMatchesNothing(t *testing.T) {
+	filter, err := types.NewFilterFromJSON([]byte(`{"room": {"rooms": []}, "presence": {"types": []}}`))
+	require.NoError(t, err)
+
+	assert.False(t, filter.IncludeRoom("!room:test"))
+	assert.False(t, filter.MatchPresence("@alice:test"))
+	assert.True(t, filter.MatchAccountData(&types.AccountDataEvent{Type: "m.push_rules"}))
+}
+
+func TestFilterContainsURL(t *testing.T) {
+	filter, err := types.NewFilterFromJSON([]byte(`{"room": {"timeline": {"contains_url": true}}}`))
+	require.NoError(t, err)
+
+	assert.True(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventMessage, `{"url": "mxc://test/abc"}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventMessage, `{"body": "hi"}`)))
+}
+
+func TestNewFilterFromJSONInvalidEventFormat(t *testing.T) {
+	_, err := types.NewFilterFromJSON([]byte(`{"event_format": "other"}`))
+	assert.Error(t, err)
+}
+
+func TestFilterLazyLoadMembers(t *testing.T) {
+	filter, err := types.NewFilterFromJSON([]byte(`{"room": {"state": {"lazy_load_members": true}}}`))
+	require.NoError(t, err)
+
+	assert.True(t, filter.LazyLoadMembers())
+	assert.False(t, filter.IncludeRedundantMembers())
+
+	var nilFilter *types.Filter
+	assert.False(t, nilFilter.LazyLoadMembers())
+}
+
+func TestNewFilterFromRoomEventFilterJSON(t *testing.T) {
+	filter, err := types.NewFilterFromRoomEventFilterJSON([]byte(`{"types": ["m.room.message"], "lazy_load_members": true}`))
+	require.NoError(t, err)
+
+	assert.True(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventMessage, `{}`)))
+	assert.False(t, filter.MatchTimelineEvent(newFilterTestEvent("!room:test", "@alice:test", event.EventReaction, `{}`)))
+	assert.True(t, filter.LazyLoadMembers())
+}
+
+func TestFilterUnreadThreadNotifications(t *testing.T) {
+	filter, err := types.NewFilterFromJSON([]byte(`{"room": {"timeline": {"unread_thread_notifications": true}}}`))
+	require.NoError(t, err)
+	assert.True(t, filter.UnreadThreadNotifications())
+
+	filter, err = types.NewFilterFromJSON([]byte(`{"room": {"timeline": {"limit": 10}}}`))
+	require.NoError(t, err)
+	assert.False(t, filter.UnreadThreadNotifications())
+}
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type JobType string
+
+const (
+	// Leave all rooms & erase the profile of a deactivated user, key is the user ID
+	JobTypeDeactivateUser JobType = "deactivate_user"
+)
+
+// Jobs are idempotent tasks that are retried until they complete, used where changes span multiple
+// databases and cannot be done in a single transaction.
+type Job struct {
+	// Populated at fetch time
+	Type JobType `msgpack:"-"`
+	Key  string  `msgpack:"-"`
+
+	Attempts      int    `msgpack:"a"`
+	NextAttemptTs int64  `msgpack:"n"`
+	LastError     string `msgpack:"e,omitempty"`
+}
+
+func NewJobFromBytes(b []byte, jobType JobType, key string) (*Job, error) {
+	var j Job
+	if err := msgpack.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	j.Type = jobType
+	j.Key = key
+	return &j, nil
+}
+
+func MustNewJobFromBytes(b []byte, jobType JobType, key string) *Job {
+	if j, err := NewJobFromBytes(b, jobType, key); err != nil {
+		panic(err)
+	} else {
+		return j
+	}
+}
+
+func (j *Job) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(j); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+)
+
+// Result of evaluating a users push rules against an event that should notify them
+type EventNotification struct {
+	UserID    id.UserID
+	Highlight bool
+	// Sound tweak to send with any push, empty for no sound
+	Sound string
+	// Whether to queue a push for the notification, only set if the user has pushers
+	Push bool
+}
+
+// Unread notification counts for a user in a room, notification count includes highlights
+type NotificationCounts struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+
+	// Counts for each thread by root event ID, these are also included in the room counts above
+	Threads map[id.EventID]*NotificationCounts `json:"-"`
+}
+
+// Returns the counts excluding any threads, ie the main timeline only
+func (c *NotificationCounts) MainCounts() *NotificationCounts {
+	main := &NotificationCounts{
+		HighlightCount:    c.HighlightCount,
+		NotificationCount: c.NotificationCount,
+	}
+	for _, threadCounts := range c.Threads {
+		main.HighlightCount -= threadCounts.HighlightCount
+		main.NotificationCount -= threadCounts.NotificationCount
+	}
+	return main
+}
+
+// A notification waiting to be sent to a users pushers
+type QueuedPush struct {
+	UserID    id.UserID
+	RoomID    id.RoomID
+	EventID   id.EventID
+	Version   tuple.Versionstamp
+	Highlight bool
+	Sound     string
+	// Set if the notification was cleared by a read receipt before it was pushed
+	Cleared bool
+}
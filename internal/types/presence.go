@@ -0,0 +1,68 @@
+package types
+
+import (
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type Presence struct {
+	Presence  event.Presence `msgpack:"p"`
+	StatusMsg string         `msgpack:"s,omitempty"`
+	// Last explicit activity (presence set by the user), unix millis
+	LastActiveTs int64 `msgpack:"a"`
+	// Last sync request, unix millis
+	LastSyncTs int64 `msgpack:"y"`
+}
+
+func NewPresenceFromBytes(b []byte) (*Presence, error) {
+	var p Presence
+	if err := msgpack.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func MustNewPresenceFromBytes(b []byte) *Presence {
+	if p, err := NewPresenceFromBytes(b); err != nil {
+		panic(err)
+	} else {
+		return p
+	}
+}
+
+func (p *Presence) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(p); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (p *Presence) ToContent() event.PresenceEventContent {
+	content := event.PresenceEventContent{
+		Presence:        p.Presence,
+		StatusMessage:   p.StatusMsg,
+		CurrentlyActive: p.Presence == event.PresenceOnline,
+	}
+	if p.LastActiveTs > 0 {
+		content.LastActiveAgo = time.Now().UnixMilli() - p.LastActiveTs
+	}
+	return content
+}
+
+type PresenceEvent struct {
+	Sender  id.UserID                  `json:"sender"`
+	Type    event.Type                 `json:"type"`
+	Content event.PresenceEventContent `json:"content"`
+}
+
+func NewPresenceEvent(userID id.UserID, p *Presence) *PresenceEvent {
+	return &PresenceEvent{
+		Sender:  userID,
+		Type:    event.EphemeralEventPresence,
+		Content: p.ToContent(),
+	}
+}
@@ -0,0 +1,324 @@
+package types
+
+import (
+	"slices"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// Push rules are stored as m.push_rules global account data, only the global scope is supported
+// https://spec.matrix.org/v1.11/client-server-api/#push-rules
+type PushRulesContent struct {
+	Global *pushrules.PushRuleset `json:"global"`
+}
+
+const (
+	PushRuleIDMaster = ".m.rule.master"
+
+	// Not supported by mautrix's push rules, so evaluated here
+	PushCondKindSenderNotificationPermission pushrules.PushCondKind = "sender_notification_permission"
+)
+
+func pushActionsNotify(tweaks ...*pushrules.PushAction) pushrules.PushActionArray {
+	return append(pushrules.PushActionArray{{Action: pushrules.ActionNotify}}, tweaks...)
+}
+
+func pushActionSound(sound string) *pushrules.PushAction {
+	return &pushrules.PushAction{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakSound, Value: sound}
+}
+
+func pushActionHighlight() *pushrules.PushAction {
+	return &pushrules.PushAction{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakHighlight, Value: true}
+}
+
+func pushCondEventMatch(key, pattern string) *pushrules.PushCondition {
+	return &pushrules.PushCondition{Kind: pushrules.KindEventMatch, Key: key, Pattern: pattern}
+}
+
+func pushCondEventPropertyIs(key string, value any) *pushrules.PushCondition {
+	return &pushrules.PushCondition{Kind: pushrules.KindEventPropertyIs, Key: key, Value: value}
+}
+
+func pushCondRoomPermission() *pushrules.PushCondition {
+	return &pushrules.PushCondition{Kind: PushCondKindSenderNotificationPermission, Key: "room"}
+}
+
+func defaultPushRule(ruleType pushrules.PushRuleType, ruleID string, actions pushrules.PushActionArray, conditions ...*pushrules.PushCondition) *pushrules.PushRule {
+	return &pushrules.PushRule{
+		Type:       ruleType,
+		RuleID:     ruleID,
+		Actions:    actions,
+		Default:    true,
+		Enabled:    true,
+		Conditions: conditions,
+	}
+}
+
+// Returns the server-default push rules for a user
+// https://spec.matrix.org/v1.11/client-server-api/#predefined-rules
+func DefaultPushRuleset(userID id.UserID) *pushrules.PushRuleset {
+	override := func(ruleID string, actions pushrules.PushActionArray, conditions ...*pushrules.PushCondition) *pushrules.PushRule {
+		return defaultPushRule(pushrules.OverrideRule, ruleID, actions, conditions...)
+	}
+	underride := func(ruleID string, actions pushrules.PushActionArray, conditions ...*pushrules.PushCondition) *pushrules.PushRule {
+		return defaultPushRule(pushrules.UnderrideRule, ruleID, actions, conditions...)
+	}
+
+	master := override(PushRuleIDMaster, pushrules.PushActionArray{})
+	master.Enabled = false
+
+	containsUserName := defaultPushRule(pushrules.ContentRule, ".m.rule.contains_user_name", pushActionsNotify(pushActionSound("default"), pushActionHighlight()))
+	containsUserName.Pattern = userID.Localpart()
+
+	return &pushrules.PushRuleset{
+		Override: pushrules.PushRuleArray{
+			master,
+			override(".m.rule.suppress_notices", pushrules.PushActionArray{},
+				pushCondEventMatch("content.msgtype", "m.notice"),
+			),
+			override(".m.rule.invite_for_me", pushActionsNotify(pushActionSound("default")),
+				pushCondEventMatch("type", event.StateMember.Type),
+				pushCondEventMatch("content.membership", string(event.MembershipInvite)),
+				pushCondEventMatch("state_key", userID.String()),
+			),
+			override(".m.rule.member_event", pushrules.PushActionArray{},
+				pushCondEventMatch("type", event.StateMember.Type),
+			),
+			override(".m.rule.is_user_mention", pushActionsNotify(pushActionSound("default"), pushActionHighlight()),
+				&pushrules.PushCondition{Kind: pushrules.KindEventPropertyContains, Key: `content.m\.mentions.user_ids`, Value: userID.String()},
+			),
+			override(".m.rule.contains_display_name", pushActionsNotify(pushActionSound("default"), pushActionHighlight()),
+				&pushrules.PushCondition{Kind: pushrules.KindContainsDisplayName},
+			),
+			override(".m.rule.is_room_mention", pushActionsNotify(pushActionHighlight()),
+				pushCondEventPropertyIs(`content.m\.mentions.room`, true),
+				pushCondRoomPermission(),
+			),
+			override(".m.rule.roomnotif", pushActionsNotify(pushActionHighlight()),
+				pushCondRoomPermission(),
+				pushCondEventMatch("content.body", "@room"),
+			),
+			override(".m.rule.tombstone", pushActionsNotify(pushActionHighlight()),
+				pushCondEventMatch("type", event.StateTombstone.Type),
+				pushCondEventMatch("state_key", ""),
+			),
+			override(".m.rule.reaction", pushrules.PushActionArray{},
+				pushCondEventMatch("type", event.EventReaction.Type),
+			),
+			override(".m.rule.room.server_acl", pushrules.PushActionArray{},
+				pushCondEventMatch("type", event.StateServerACL.Type),
+				pushCondEventMatch("state_key", ""),
+			),
+			override(".m.rule.suppress_edits", pushrules.PushActionArray{},
+				pushCondEventPropertyIs(`content.m\.relates_to.rel_type`, string(event.RelReplace)),
+			),
+		},
+		Content: pushrules.PushRuleArray{containsUserName},
+		Room:    pushrules.PushRuleMap{Map: make(map[string]*pushrules.PushRule), Type: pushrules.RoomRule},
+		Sender:  pushrules.PushRuleMap{Map: make(map[string]*pushrules.PushRule), Type: pushrules.SenderRule},
+		Underride: pushrules.PushRuleArray{
+			underride(".m.rule.call", pushActionsNotify(pushActionSound("ring")),
+				pushCondEventMatch("type", event.CallInvite.Type),
+			),
+			underride(".m.rule.encrypted_room_one_to_one", pushActionsNotify(pushActionSound("default")),
+				&pushrules.PushCondition{Kind: pushrules.KindRoomMemberCount, MemberCountCondition: "2"},
+				pushCondEventMatch("type", event.EventEncrypted.Type),
+			),
+			underride(".m.rule.room_one_to_one", pushActionsNotify(pushActionSound("default")),
+				&pushrules.PushCondition{Kind: pushrules.KindRoomMemberCount, MemberCountCondition: "2"},
+				pushCondEventMatch("type", event.EventMessage.Type),
+			),
+			underride(".m.rule.message", pushActionsNotify(),
+				pushCondEventMatch("type", event.EventMessage.Type),
+			),
+			underride(".m.rule.encrypted", pushActionsNotify(),
+				pushCondEventMatch("type", event.EventEncrypted.Type),
+			),
+		},
+	}
+}
+
+func pushRuleArrayForKind(rs *pushrules.PushRuleset, kind pushrules.PushRuleType) *pushrules.PushRuleArray {
+	switch kind {
+	case pushrules.OverrideRule:
+		return &rs.Override
+	case pushrules.ContentRule:
+		return &rs.Content
+	case pushrules.UnderrideRule:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+func pushRuleMapForKind(rs *pushrules.PushRuleset, kind pushrules.PushRuleType) *pushrules.PushRuleMap {
+	switch kind {
+	case pushrules.RoomRule:
+		return &rs.Room
+	case pushrules.SenderRule:
+		return &rs.Sender
+	default:
+		return nil
+	}
+}
+
+func IsValidPushRuleKind(kind pushrules.PushRuleType) bool {
+	switch kind {
+	case pushrules.OverrideRule, pushrules.ContentRule, pushrules.RoomRule, pushrules.SenderRule, pushrules.UnderrideRule:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a rule by kind & ID, or nil if not found
+func GetPushRule(rs *pushrules.PushRuleset, kind pushrules.PushRuleType, ruleID string) *pushrules.PushRule {
+	if rules := pushRuleArrayForKind(rs, kind); rules != nil {
+		if idx := slices.IndexFunc(*rules, func(rule *pushrules.PushRule) bool { return rule.RuleID == ruleID }); idx >= 0 {
+			return (*rules)[idx]
+		}
+	} else if ruleMap := pushRuleMapForKind(rs, kind); ruleMap != nil {
+		return ruleMap.Map[ruleID]
+	}
+	return nil
+}
+
+// Add or replace a user-defined rule. The before & after rule IDs are optional and must reference
+// other user-defined rules of the same kind, otherwise new rules are given the highest priority
+// of the user-defined rules and replaced rules keep their position.
+func SetPushRule(rs *pushrules.PushRuleset, rule *pushrules.PushRule, before, after string) error {
+	if ruleMap := pushRuleMapForKind(rs, rule.Type); ruleMap != nil {
+		if ruleMap.Map == nil {
+			ruleMap.Map = make(map[string]*pushrules.PushRule)
+		}
+		ruleMap.Map[rule.RuleID] = rule
+		return nil
+	}
+
+	rules := pushRuleArrayForKind(rs, rule.Type)
+	if rules == nil {
+		return ErrPushRuleNotFound
+	}
+
+	findRule := func(ruleID string) int {
+		return slices.IndexFunc(*rules, func(r *pushrules.PushRule) bool { return r.RuleID == ruleID })
+	}
+
+	idx := findRule(rule.RuleID)
+	if idx >= 0 {
+		*rules = slices.Delete(*rules, idx, idx+1)
+	} else {
+		// The master rule always takes priority over user-defined rules
+		idx = 0
+		if len(*rules) > 0 && (*rules)[0].RuleID == PushRuleIDMaster {
+			idx = 1
+		}
+	}
+
+	relativeRuleID, offset := before, 0
+	if relativeRuleID == "" {
+		relativeRuleID, offset = after, 1
+	}
+	if relativeRuleID != "" {
+		relativeIdx := findRule(relativeRuleID)
+		if relativeIdx < 0 || (*rules)[relativeIdx].Default {
+			return ErrPushRuleNotFound
+		}
+		idx = relativeIdx + offset
+	}
+
+	*rules = slices.Insert(*rules, idx, rule)
+	return nil
+}
+
+// Delete a rule by kind & ID, returns ErrPushRuleNotFound if the rule doesn't exist
+func DeletePushRule(rs *pushrules.PushRuleset, kind pushrules.PushRuleType, ruleID string) error {
+	if ruleMap := pushRuleMapForKind(rs, kind); ruleMap != nil {
+		if _, found := ruleMap.Map[ruleID]; !found {
+			return ErrPushRuleNotFound
+		}
+		delete(ruleMap.Map, ruleID)
+		return nil
+	}
+
+	rules := pushRuleArrayForKind(rs, kind)
+	if rules == nil {
+		return ErrPushRuleNotFound
+	}
+	idx := slices.IndexFunc(*rules, func(rule *pushrules.PushRule) bool { return rule.RuleID == ruleID })
+	if idx < 0 {
+		return ErrPushRuleNotFound
+	}
+	*rules = slices.Delete(*rules, idx, idx+1)
+	return nil
+}
+
+// Room context for evaluating push rules on behalf of a single user
+type PushRulesRoom struct {
+	MemberCount    int
+	OwnDisplayname string
+	PowerLevels    *event.PowerLevelsEventContent
+}
+
+var _ pushrules.Room = (*PushRulesRoom)(nil)
+
+func (r *PushRulesRoom) GetOwnDisplayname() string {
+	return r.OwnDisplayname
+}
+
+func (r *PushRulesRoom) GetMemberCount() int {
+	return r.MemberCount
+}
+
+func (r *PushRulesRoom) senderHasNotificationPermission(sender id.UserID, key string) bool {
+	if key != "room" {
+		return false
+	}
+	powerLevels := r.PowerLevels
+	if powerLevels == nil {
+		powerLevels = &event.PowerLevelsEventContent{}
+	}
+	return powerLevels.GetUserLevel(sender) >= powerLevels.Notifications.Room()
+}
+
+func pushRuleMatches(rule *pushrules.PushRule, room *PushRulesRoom, evt *event.Event) bool {
+	conditions := make([]*pushrules.PushCondition, 0, len(rule.Conditions))
+	for _, cond := range rule.Conditions {
+		if cond.Kind != PushCondKindSenderNotificationPermission {
+			conditions = append(conditions, cond)
+		} else if !rule.Enabled || !room.senderHasNotificationPermission(evt.Sender, cond.Key) {
+			return false
+		}
+	}
+	if len(conditions) == len(rule.Conditions) {
+		return rule.Match(room, evt)
+	}
+	ruleCopy := *rule
+	ruleCopy.Conditions = conditions
+	return ruleCopy.Match(room, evt)
+}
+
+// Evaluate a users push rules against an event, returning what the matching rule's actions
+// should do (ie notify, highlight).
+func EvaluatePushRules(rs *pushrules.PushRuleset, room *PushRulesRoom, evt *event.Event) pushrules.PushActionArrayShould {
+	for _, rules := range []pushrules.PushRuleArray{rs.Override, rs.Content} {
+		for _, rule := range rules {
+			if pushRuleMatches(rule, room, evt) {
+				return rule.Actions.Should()
+			}
+		}
+	}
+	for _, ruleMap := range []pushrules.PushRuleMap{rs.Room, rs.Sender} {
+		if rule := ruleMap.GetMatchingRule(room, evt); rule != nil {
+			return rule.Actions.Should()
+		}
+	}
+	for _, rule := range rs.Underride {
+		if pushRuleMatches(rule, room, evt) {
+			return rule.Actions.Should()
+		}
+	}
+	return pushrules.PushActionArrayShould{}
+}
@@ -0,0 +1,104 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func newPushRulesTestEvent(sender id.UserID, content string) *event.Event {
+	ev := &types.Event{
+		PartialEvent: types.PartialEvent{
+			RoomID:  "!room:localhost",
+			Sender:  sender,
+			Type:    event.EventMessage,
+			Content: json.RawMessage(content),
+		},
+	}
+	return ev.MautrixEvent()
+}
+
+func TestEvaluateDefaultPushRules(t *testing.T) {
+	userID := id.UserID("@alice:localhost")
+	rs := types.DefaultPushRuleset(userID)
+
+	room := &types.PushRulesRoom{
+		MemberCount:    3,
+		OwnDisplayname: "Alice Liddell",
+		PowerLevels: &event.PowerLevelsEventContent{
+			Users: map[id.UserID]int{"@admin:localhost": 100},
+		},
+	}
+
+	should := types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@bob:localhost", `{"msgtype":"m.text","body":"hello"}`))
+	assert.True(t, should.Notify)
+	assert.False(t, should.Highlight)
+
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@bob:localhost", `{"msgtype":"m.notice","body":"hello"}`))
+	assert.False(t, should.Notify)
+
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@bob:localhost", `{"msgtype":"m.text","body":"hi Alice Liddell!"}`))
+	assert.True(t, should.Notify)
+	assert.True(t, should.Highlight)
+
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@bob:localhost", `{"msgtype":"m.text","body":"hi","m.mentions":{"user_ids":["@alice:localhost"]}}`))
+	assert.True(t, should.Highlight)
+
+	// Room mentions require the sender to have the room notification power level
+	roomMention := `{"msgtype":"m.text","body":"hi","m.mentions":{"room":true}}`
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@bob:localhost", roomMention))
+	assert.True(t, should.Notify)
+	assert.False(t, should.Highlight)
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@admin:localhost", roomMention))
+	assert.True(t, should.Highlight)
+
+	// Enabling the master rule suppresses all notifications
+	types.GetPushRule(rs, pushrules.OverrideRule, types.PushRuleIDMaster).Enabled = true
+	should = types.EvaluatePushRules(rs, room, newPushRulesTestEvent("@admin:localhost", roomMention))
+	assert.False(t, should.Notify)
+}
+
+func TestSetPushRulePosition(t *testing.T) {
+	rs := types.DefaultPushRuleset("@alice:localhost")
+	defaultCount := len(rs.Override)
+
+	newRule := func(ruleID string) *pushrules.PushRule {
+		return &pushrules.PushRule{Type: pushrules.OverrideRule, RuleID: ruleID, Enabled: true}
+	}
+	ruleIDs := func() []string {
+		ids := make([]string, 0, len(rs.Override))
+		for _, rule := range rs.Override {
+			if !rule.Default || rule.RuleID == types.PushRuleIDMaster {
+				ids = append(ids, rule.RuleID)
+			}
+		}
+		return ids
+	}
+
+	require.NoError(t, types.SetPushRule(rs, newRule("a"), "", ""))
+	require.NoError(t, types.SetPushRule(rs, newRule("b"), "", ""))
+	assert.Equal(t, []string{types.PushRuleIDMaster, "b", "a"}, ruleIDs())
+
+	require.NoError(t, types.SetPushRule(rs, newRule("c"), "", "a"))
+	require.NoError(t, types.SetPushRule(rs, newRule("d"), "a", ""))
+	assert.Equal(t, []string{types.PushRuleIDMaster, "b", "d", "a", "c"}, ruleIDs())
+
+	// Replacing a rule keeps its position
+	require.NoError(t, types.SetPushRule(rs, newRule("d"), "", ""))
+	assert.Equal(t, []string{types.PushRuleIDMaster, "b", "d", "a", "c"}, ruleIDs())
+
+	// Rules can only be positioned relative to other user-defined rules
+	assert.ErrorIs(t, types.SetPushRule(rs, newRule("e"), ".m.rule.suppress_notices", ""), types.ErrPushRuleNotFound)
+	assert.ErrorIs(t, types.SetPushRule(rs, newRule("e"), "missing", ""), types.ErrPushRuleNotFound)
+
+	require.NoError(t, types.DeletePushRule(rs, pushrules.OverrideRule, "a"))
+	assert.ErrorIs(t, types.DeletePushRule(rs, pushrules.OverrideRule, "a"), types.ErrPushRuleNotFound)
+	assert.Len(t, rs.Override, defaultCount+3)
+}
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	PusherKindHTTP = "http"
+
+	PusherFormatEventIDOnly = "event_id_only"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushers
+type Pusher struct {
+	AppDisplayName    string          `json:"app_display_name" msgpack:"an"`
+	AppID             string          `json:"app_id" msgpack:"a"`
+	Data              json.RawMessage `json:"data" msgpack:"d"`
+	DeviceDisplayName string          `json:"device_display_name" msgpack:"dn"`
+	Kind              string          `json:"kind" msgpack:"k"`
+	Lang              string          `json:"lang" msgpack:"l"`
+	ProfileTag        string          `json:"profile_tag,omitempty" msgpack:"p,omitempty"`
+	Pushkey           string          `json:"pushkey" msgpack:"pk"`
+
+	// When the pushkey was last set, sent to the push gateway
+	PushkeyTS int64 `json:"-" msgpack:"ts"`
+}
+
+// Known fields of pusher data, any other fields are passed through to the push gateway
+type PusherData struct {
+	URL    string `json:"url,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func NewPusherFromBytes(b []byte) (*Pusher, error) {
+	var p Pusher
+	if err := msgpack.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func MustNewPusherFromBytes(b []byte) *Pusher {
+	if p, err := NewPusherFromBytes(b); err != nil {
+		panic(err)
+	} else {
+		return p
+	}
+}
+
+func (p *Pusher) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(p); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (p *Pusher) ParseData() (PusherData, error) {
+	var data PusherData
+	err := json.Unmarshal(p.Data, &data)
+	return data, err
+}
+
+// Returns the pusher data to send to the push gateway, which excludes the URL
+func (p *Pusher) GatewayData() (map[string]any, error) {
+	data := make(map[string]any)
+	if err := json.Unmarshal(p.Data, &data); err != nil {
+		return nil, err
+	}
+	delete(data, "url")
+	return data, nil
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/json"
+
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -14,3 +16,30 @@ type Receipt struct {
 	EventID id.EventID
 	Data    []byte
 }
+
+// Combine receipts (which must all be in the same room) into a single m.receipt ephemeral event
+func NewReceiptsEvent(receipts []*Receipt) *PartialEvent {
+	content := make(event.ReceiptEventContent, 0)
+
+	for _, r := range receipts {
+		var data map[string]any
+		if len(r.Data) > 0 {
+			err := json.Unmarshal(r.Data, &data)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		content.Set(r.EventID, r.Type, r.UserID, event.ReadReceipt{
+			ThreadID: id.EventID(r.ThreadID),
+			Extra:    data,
+		})
+	}
+
+	rawContent := make(map[string]any, len(content))
+	for evID, v := range content {
+		rawContent[evID.String()] = v
+	}
+
+	return NewPartialEvent(receipts[0].RoomID, event.EphemeralEventReceipt, nil, "", rawContent)
+}
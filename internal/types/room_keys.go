@@ -0,0 +1,69 @@
+package types
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+type RoomKeysBackup struct {
+	Version id.KeyBackupVersion `msgpack:"-"`
+
+	Algorithm id.KeyBackupAlgorithm `msgpack:"a"`
+	AuthData  json.RawMessage       `msgpack:"d"`
+	// Incremented every time the keys in the backup change
+	Etag  int64 `msgpack:"e"`
+	Count int   `msgpack:"c"`
+	// Deleted backups are kept (without keys) so versions are never re-used
+	Deleted bool `msgpack:"x,omitempty"`
+}
+
+func NewRoomKeysBackupFromBytes(b []byte, version id.KeyBackupVersion) (*RoomKeysBackup, error) {
+	var kb RoomKeysBackup
+	if err := msgpack.Unmarshal(b, &kb); err != nil {
+		return nil, err
+	}
+	kb.Version = version
+	return &kb, nil
+}
+
+func MustNewRoomKeysBackupFromBytes(b []byte, version id.KeyBackupVersion) *RoomKeysBackup {
+	if kb, err := NewRoomKeysBackupFromBytes(b, version); err != nil {
+		panic(err)
+	} else {
+		return kb
+	}
+}
+
+func (kb *RoomKeysBackup) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(kb); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (kb *RoomKeysBackup) EtagString() string {
+	return strconv.FormatInt(kb.Etag, 10)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#definition-keybackupdata
+type RoomKeyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// Implements the spec rules for replacing an existing backed up session:
+// https://spec.matrix.org/v1.11/client-server-api/#backup-algorithm-mmegolm_backupv1curve25519-aes-sha2
+func (s *RoomKeyBackupSession) IsBetterThan(other *RoomKeyBackupSession) bool {
+	if s.IsVerified != other.IsVerified {
+		return s.IsVerified
+	} else if s.FirstMessageIndex != other.FirstMessageIndex {
+		return s.FirstMessageIndex < other.FirstMessageIndex
+	}
+	return s.ForwardedCount < other.ForwardedCount
+}
@@ -0,0 +1,32 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestRoomKeyBackupSessionIsBetterThan(t *testing.T) {
+	existing := &types.RoomKeyBackupSession{
+		FirstMessageIndex: 5,
+		ForwardedCount:    1,
+		IsVerified:        false,
+	}
+
+	// Verified always wins
+	assert.True(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 10, ForwardedCount: 5, IsVerified: true}).IsBetterThan(existing))
+	assert.False(t, existing.IsBetterThan(&types.RoomKeyBackupSession{FirstMessageIndex: 10, IsVerified: true}))
+
+	// Then lower first message index
+	assert.True(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 4, ForwardedCount: 5}).IsBetterThan(existing))
+	assert.False(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 6}).IsBetterThan(existing))
+
+	// Then lower forwarded count
+	assert.True(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 5, ForwardedCount: 0}).IsBetterThan(existing))
+	assert.False(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 5, ForwardedCount: 2}).IsBetterThan(existing))
+
+	// Identical sessions are not replaced
+	assert.False(t, (&types.RoomKeyBackupSession{FirstMessageIndex: 5, ForwardedCount: 1}).IsBetterThan(existing))
+}
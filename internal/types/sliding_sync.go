@@ -0,0 +1,177 @@
+package types
+
+import (
+	"slices"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Simplified sliding sync request/response types
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+
+const (
+	SlidingSyncStateKeyMe = "$ME"
+	SlidingSyncWildcard   = "*"
+)
+
+type SlidingSyncRoomConfig struct {
+	// List of [event type, state key] pairs, either may be the * wildcard and the state key may
+	// be $ME for the syncing user.
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// Whether a state event type/key pair is included in the required state
+func (c *SlidingSyncRoomConfig) MatchRequiredState(userID id.UserID, evType, stateKey string) bool {
+	for _, pair := range c.RequiredState {
+		wantType, wantStateKey := pair[0], pair[1]
+		if wantStateKey == SlidingSyncStateKeyMe {
+			wantStateKey = userID.String()
+		}
+		if (wantType == SlidingSyncWildcard || wantType == evType) &&
+			(wantStateKey == SlidingSyncWildcard || wantStateKey == stateKey) {
+			return true
+		}
+	}
+	return false
+}
+
+type SlidingSyncListFilters struct {
+	IsInvite *bool `json:"is_invite,omitempty"`
+}
+
+type SlidingSyncList struct {
+	SlidingSyncRoomConfig
+
+	// Inclusive [start, end] index ranges of the list to return rooms for
+	Ranges  [][2]int                `json:"ranges"`
+	Filters *SlidingSyncListFilters `json:"filters,omitempty"`
+}
+
+type SlidingSyncExtension struct {
+	Enabled bool `json:"enabled"`
+}
+
+type SlidingSyncExtensions struct {
+	ToDevice    SlidingSyncExtension `json:"to_device"`
+	E2EE        SlidingSyncExtension `json:"e2ee"`
+	AccountData SlidingSyncExtension `json:"account_data"`
+	Receipts    SlidingSyncExtension `json:"receipts"`
+}
+
+type SlidingSyncRequest struct {
+	ConnID            string                               `json:"conn_id,omitempty"`
+	Lists             map[string]*SlidingSyncList          `json:"lists"`
+	RoomSubscriptions map[id.RoomID]*SlidingSyncRoomConfig `json:"room_subscriptions"`
+	Extensions        SlidingSyncExtensions                `json:"extensions"`
+}
+
+type SlidingSyncRoom struct {
+	Name          string   `json:"name,omitempty"`
+	Initial       bool     `json:"initial,omitempty"`
+	RequiredState []*Event `json:"required_state,omitempty"`
+	InviteState   []*Event `json:"invite_state,omitempty"`
+	Timeline      []*Event `json:"timeline,omitempty"`
+	Limited       bool     `json:"limited,omitempty"`
+	// Timestamp of the latest event in the room, used by clients to sort rooms
+	BumpStamp int64 `json:"bump_stamp,omitempty"`
+
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+
+	// Returned in the receipts extension
+	Receipts []*Receipt `json:"-"`
+}
+
+type SlidingSyncListResult struct {
+	Count int `json:"count"`
+}
+
+type slidingSyncToDevice struct {
+	NextBatch string           `json:"next_batch"`
+	Events    []*ToDeviceEvent `json:"events"`
+}
+
+type slidingSyncE2EE struct {
+	DeviceOneTimeKeysCount       map[id.KeyAlgorithm]int `json:"device_one_time_keys_count"`
+	DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm       `json:"device_unused_fallback_key_types"`
+}
+
+type slidingSyncAccountData struct {
+	Global []*AccountDataEvent               `json:"global"`
+	Rooms  map[id.RoomID][]*AccountDataEvent `json:"rooms"`
+}
+
+type slidingSyncReceipts struct {
+	Rooms map[id.RoomID]*PartialEvent `json:"rooms"`
+}
+
+type slidingSyncExtensions struct {
+	ToDevice    *slidingSyncToDevice    `json:"to_device,omitempty"`
+	E2EE        *slidingSyncE2EE        `json:"e2ee,omitempty"`
+	AccountData *slidingSyncAccountData `json:"account_data,omitempty"`
+	Receipts    *slidingSyncReceipts    `json:"receipts,omitempty"`
+}
+
+type SlidingSync struct {
+	Pos        string                            `json:"pos"`
+	Lists      map[string]*SlidingSyncListResult `json:"lists"`
+	Rooms      map[id.RoomID]*SlidingSyncRoom    `json:"rooms,omitempty"`
+	Extensions slidingSyncExtensions             `json:"extensions"`
+}
+
+func NewSlidingSync() *SlidingSync {
+	return &SlidingSync{
+		Lists: make(map[string]*SlidingSyncListResult),
+		Rooms: make(map[id.RoomID]*SlidingSyncRoom),
+	}
+}
+
+func (s *SlidingSync) SetToDeviceEvents(nextBatch string, evs []*ToDeviceEvent) {
+	s.Extensions.ToDevice = &slidingSyncToDevice{NextBatch: nextBatch, Events: evs}
+}
+
+func (s *SlidingSync) SetDeviceKeyCounts(counts map[id.KeyAlgorithm]int, unusedFallbackAlgorithms []id.KeyAlgorithm) {
+	s.Extensions.E2EE = &slidingSyncE2EE{
+		DeviceOneTimeKeysCount:       counts,
+		DeviceUnusedFallbackKeyTypes: unusedFallbackAlgorithms,
+	}
+}
+
+// Set account data events, room account data is only included for the given (visible) rooms
+func (s *SlidingSync) SetAccountDataEvents(evs []*AccountDataEvent, roomIDs []id.RoomID) {
+	accountData := &slidingSyncAccountData{
+		Global: make([]*AccountDataEvent, 0, len(evs)),
+		Rooms:  make(map[id.RoomID][]*AccountDataEvent),
+	}
+	for _, ev := range evs {
+		if ev.RoomID == "" {
+			accountData.Global = append(accountData.Global, ev)
+		} else if slices.Contains(roomIDs, ev.RoomID) {
+			accountData.Rooms[ev.RoomID] = append(accountData.Rooms[ev.RoomID], ev)
+		}
+	}
+	s.Extensions.AccountData = accountData
+}
+
+// Move receipts from the rooms into the receipts extension
+func (s *SlidingSync) SetReceipts() {
+	receipts := &slidingSyncReceipts{
+		Rooms: make(map[id.RoomID]*PartialEvent),
+	}
+	for roomID, room := range s.Rooms {
+		if len(room.Receipts) > 0 {
+			receipts.Rooms[roomID] = NewReceiptsEvent(room.Receipts)
+		}
+	}
+	s.Extensions.Receipts = receipts
+}
+
+// Whether there is anything new for the client, E2EE key counts are always included so ignored
+func (s *SlidingSync) IsEmpty() bool {
+	return len(s.Rooms) == 0 &&
+		(s.Extensions.ToDevice == nil || len(s.Extensions.ToDevice.Events) == 0) &&
+		(s.Extensions.AccountData == nil || (len(s.Extensions.AccountData.Global) == 0 &&
+			len(s.Extensions.AccountData.Rooms) == 0)) &&
+		(s.Extensions.Receipts == nil || len(s.Extensions.Receipts.Rooms) == 0)
+}
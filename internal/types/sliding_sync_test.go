@@ -0,0 +1,28 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestSlidingSyncMatchRequiredState(t *testing.T) {
+	config := types.SlidingSyncRoomConfig{
+		RequiredState: [][2]string{
+			{"m.room.name", ""},
+			{"m.room.member", "$ME"},
+			{"m.space.child", "*"},
+		},
+	}
+
+	assert.True(t, config.MatchRequiredState("@alice:test", "m.room.name", ""))
+	assert.True(t, config.MatchRequiredState("@alice:test", "m.room.member", "@alice:test"))
+	assert.False(t, config.MatchRequiredState("@alice:test", "m.room.member", "@bob:test"))
+	assert.True(t, config.MatchRequiredState("@alice:test", "m.space.child", "!child:test"))
+	assert.False(t, config.MatchRequiredState("@alice:test", "m.room.topic", ""))
+
+	wildcard := types.SlidingSyncRoomConfig{RequiredState: [][2]string{{"*", "*"}}}
+	assert.True(t, wildcard.MatchRequiredState("@alice:test", "m.room.topic", ""))
+}
@@ -19,11 +19,28 @@ type syncDeviceLists struct {
 	Left    []id.UserID `json:"left,omitempty"`
 }
 
+type syncToDevice struct {
+	Events []*ToDeviceEvent `json:"events"`
+}
+
+type syncPresence struct {
+	Events []*PresenceEvent `json:"events"`
+}
+
+type syncAccountData struct {
+	Events []*AccountDataEvent `json:"events"`
+}
+
 type Sync struct {
 	NextBatch   string           `json:"next_batch"`
 	Rooms       *syncRooms       `json:"rooms,omitempty"`
 	DeviceLists *syncDeviceLists `json:"device_lists,omitempty"`
-	AccountData []*Event         `json:"account_data,omitempty"`
+	AccountData *syncAccountData `json:"account_data,omitempty"`
+	ToDevice    *syncToDevice    `json:"to_device,omitempty"`
+	Presence    *syncPresence    `json:"presence,omitempty"`
+
+	DeviceOneTimeKeysCount       map[id.KeyAlgorithm]int `json:"device_one_time_keys_count"`
+	DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm       `json:"device_unused_fallback_key_types"`
 }
 
 func NewSyncFromRooms(rooms map[MembershipTup]*SyncRoom) *Sync {
@@ -34,6 +51,9 @@ func NewSyncFromRooms(rooms map[MembershipTup]*SyncRoom) *Sync {
 			Invite: make(map[id.RoomID]*SyncRoom, 5),
 			Knock:  make(map[id.RoomID]*SyncRoom, 5),
 		},
+		// Always sent, clients treat missing fallback key types as the server not supporting them
+		DeviceOneTimeKeysCount:       make(map[id.KeyAlgorithm]int),
+		DeviceUnusedFallbackKeyTypes: []id.KeyAlgorithm{},
 	}
 
 	for membershipTup, room := range rooms {
@@ -52,14 +72,84 @@ func NewSyncFromRooms(rooms map[MembershipTup]*SyncRoom) *Sync {
 	return &sync
 }
 
+// Get or create the sync room for a joined room, used to merge data from other databases
+func (s *Sync) JoinedRoom(roomID id.RoomID) *SyncRoom {
+	room, found := s.Rooms.Join[roomID]
+	if !found {
+		room = &SyncRoom{}
+		s.Rooms.Join[roomID] = room
+	}
+	return room
+}
+
+func (s *Sync) SetToDeviceEvents(evs []*ToDeviceEvent) {
+	if len(evs) == 0 {
+		s.ToDevice = nil
+	} else {
+		s.ToDevice = &syncToDevice{Events: evs}
+	}
+}
+
+func (s *Sync) SetPresenceEvents(evs []*PresenceEvent) {
+	if len(evs) == 0 {
+		s.Presence = nil
+	} else {
+		s.Presence = &syncPresence{Events: evs}
+	}
+}
+
+// Set account data events, room account data is added to the room (which must already exist in
+// the sync) and the rest are global.
+func (s *Sync) SetAccountDataEvents(evs []*AccountDataEvent) {
+	globalEvs := make([]*AccountDataEvent, 0, len(evs))
+	for _, ev := range evs {
+		if ev.RoomID == "" {
+			globalEvs = append(globalEvs, ev)
+		} else if room := s.Room(ev.RoomID); room != nil {
+			room.AccountData = append(room.AccountData, ev)
+		}
+	}
+	if len(globalEvs) == 0 {
+		s.AccountData = nil
+	} else {
+		s.AccountData = &syncAccountData{Events: globalEvs}
+	}
+}
+
+// Set unread notification counts, rooms are added to the joined rooms if not already in the sync.
+// If threaded the room counts only include the main timeline and thread counts are set separately.
+func (s *Sync) SetNotificationCounts(counts map[id.RoomID]*NotificationCounts, threaded bool) {
+	for roomID, roomCounts := range counts {
+		room := s.JoinedRoom(roomID)
+		if threaded {
+			room.UnreadNotifications = roomCounts.MainCounts()
+			room.UnreadThreadNotifications = roomCounts.Threads
+		} else {
+			room.UnreadNotifications = roomCounts
+		}
+	}
+}
+
+// Get the sync room for any membership, returns nil if the room is not in the sync
+func (s *Sync) Room(roomID id.RoomID) *SyncRoom {
+	for _, rooms := range []map[id.RoomID]*SyncRoom{s.Rooms.Join, s.Rooms.Leave, s.Rooms.Invite, s.Rooms.Knock} {
+		if room, found := rooms[roomID]; found {
+			return room
+		}
+	}
+	return nil
+}
+
 func (s *Sync) IsEmpty() bool {
-	return len(s.AccountData) == 0 &&
-		len(s.Rooms.Join) == 0 &&
-		len(s.Rooms.Leave) == 0 &&
-		len(s.Rooms.Invite) == 0 &&
-		len(s.Rooms.Knock) == 0 &&
-		len(s.DeviceLists.Changed) == 0 &&
-		len(s.DeviceLists.Left) == 0
+	return s.AccountData == nil &&
+		s.ToDevice == nil &&
+		s.Presence == nil &&
+		(s.Rooms == nil || (len(s.Rooms.Join) == 0 &&
+			len(s.Rooms.Leave) == 0 &&
+			len(s.Rooms.Invite) == 0 &&
+			len(s.Rooms.Knock) == 0)) &&
+		(s.DeviceLists == nil || (len(s.DeviceLists.Changed) == 0 &&
+			len(s.DeviceLists.Left) == 0))
 }
 
 type marshalSync Sync
@@ -85,8 +175,8 @@ func (s *Sync) prepareForJSON() {
 	if len(allRooms) == 0 {
 		s.Rooms = nil
 	} else {
-		for _, room := range allRooms {
-			room.prepareForJSON()
+		for roomID, room := range allRooms {
+			room.prepareForJSON(roomID)
 		}
 	}
 
@@ -101,41 +191,30 @@ type SyncRoom struct {
 	TimelineEvents []*Event        `json:"timeline,omitempty"`
 	Ephemeral      []*PartialEvent `json:"ephemeral,omitempty"`
 
+	UnreadNotifications       *NotificationCounts                `json:"unread_notifications,omitempty"`
+	UnreadThreadNotifications map[id.EventID]*NotificationCounts `json:"unread_thread_notifications,omitempty"`
+
+	// Accounts database
+	AccountData []*AccountDataEvent `json:"account_data,omitempty"`
+
 	Receipts          []*Receipt  `json:"-"`
 	DeviceListChanges []id.UserID `json:"-"`
 	Typing            []id.UserID `json:"-"`
 	PresenceEvents    []id.UserID `json:"-"`
-	AccountData       []*Event    `json:"-"`
 }
 
-func (s *SyncRoom) prepareForJSON() {
+func (s *SyncRoom) prepareForJSON(roomID id.RoomID) {
 	// Turn receipts -> ephemeral event
-	// Turn typing -> ephemeral event
 	if len(s.Receipts) > 0 {
-		content := make(event.ReceiptEventContent, 0)
-
-		for _, r := range s.Receipts {
-			var data map[string]any
-			if len(r.Data) > 0 {
-				err := json.Unmarshal(r.Data, &data)
-				if err != nil {
-					panic(err)
-				}
-			}
-
-			content.Set(r.EventID, r.Type, r.UserID, event.ReadReceipt{
-				ThreadID: id.EventID(r.ThreadID),
-				Extra:    data,
-			})
-		}
-
-		rawContent := make(map[string]any, len(content))
-		for evID, v := range content {
-			rawContent[evID.String()] = v
-		}
+		s.Ephemeral = append(s.Ephemeral, NewReceiptsEvent(s.Receipts))
+	}
 
-		rev := NewPartialEvent(s.Receipts[0].RoomID, event.EphemeralEventReceipt, nil, "", rawContent)
+	// Turn typing -> ephemeral event, an empty (but non-nil) list means everyone stopped typing
+	if s.Typing != nil {
+		tev := NewPartialEvent(roomID, event.EphemeralEventTyping, nil, "", map[string]any{
+			"user_ids": s.Typing,
+		})
 
-		s.Ephemeral = append(s.Ephemeral, rev)
+		s.Ephemeral = append(s.Ephemeral, tev)
 	}
 }
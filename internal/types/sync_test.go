@@ -0,0 +1,20 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestSyncDeviceKeyCountsDefaults(t *testing.T) {
+	data, err := json.Marshal(types.NewSyncFromRooms(nil))
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{}`, gjson.GetBytes(data, "device_one_time_keys_count").Raw)
+	assert.JSONEq(t, `[]`, gjson.GetBytes(data, "device_unused_fallback_key_types").Raw)
+}
@@ -0,0 +1,17 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+)
+
+type ToDeviceEvent struct {
+	Sender  id.UserID       `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+
+	// Position in the recipient device's inbox
+	Version tuple.Versionstamp `json:"-"`
+}
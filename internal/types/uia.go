@@ -0,0 +1,64 @@
+package types
+
+import (
+	"slices"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// User-interactive authentication session
+// https://spec.matrix.org/v1.11/client-server-api/#user-interactive-authentication-api
+type UIASession struct {
+	ID string `msgpack:"-"`
+
+	// Empty for unauthenticated requests (register)
+	UserID id.UserID `msgpack:"u,omitempty"`
+	// Sessions are bound to the request method & path they were created for
+	Request   string             `msgpack:"r"`
+	Completed []mautrix.AuthType `msgpack:"c"`
+	ExpiresTs int64              `msgpack:"e"`
+}
+
+func NewUIASessionFromBytes(b []byte, sessionID string) (*UIASession, error) {
+	var s UIASession
+	if err := msgpack.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	s.ID = sessionID
+	return &s, nil
+}
+
+func MustNewUIASessionFromBytes(b []byte, sessionID string) *UIASession {
+	if s, err := NewUIASessionFromBytes(b, sessionID); err != nil {
+		panic(err)
+	} else {
+		return s
+	}
+}
+
+func (s *UIASession) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(s); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+// Returns true if every stage of any of the flows has been completed
+func (s *UIASession) IsComplete(flows []mautrix.UIAFlow) bool {
+	for _, flow := range flows {
+		complete := true
+		for _, stage := range flow.Stages {
+			if !slices.Contains(s.Completed, stage) {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestUIASessionIsComplete(t *testing.T) {
+	flows := []mautrix.UIAFlow{
+		{Stages: []mautrix.AuthType{mautrix.AuthTypePassword}},
+		{Stages: []mautrix.AuthType{mautrix.AuthTypeDummy, mautrix.AuthTypeEmail}},
+	}
+
+	session := &types.UIASession{}
+	assert.False(t, session.IsComplete(flows))
+
+	session.Completed = []mautrix.AuthType{mautrix.AuthTypeDummy}
+	assert.False(t, session.IsComplete(flows))
+
+	session.Completed = append(session.Completed, mautrix.AuthTypeEmail)
+	assert.True(t, session.IsComplete(flows))
+
+	session.Completed = []mautrix.AuthType{mautrix.AuthTypePassword}
+	assert.True(t, session.IsComplete(flows))
+}
@@ -20,6 +20,9 @@ type User struct {
 	Email string `msgpack:"em"`
 
 	CreatedAt time.Time `msgpack:"ct"`
+
+	// Deactivated users keep their username reserved but can no longer login
+	Deactivated bool `msgpack:"da,omitempty"`
 }
 
 func NewUserFromBytes(b []byte, username, serverName string) (*User, error) {
@@ -18,6 +18,16 @@ var (
 	ErrInvalidVersion = errors.New("invalid versionstamp tuple")
 )
 
+// Whether the versionstamp is incomplete, such keys/values are only valid within the transaction
+// that sets them with SetVersionstampedKey/Value.
+func IsIncompleteVersionstamp(version tuple.Versionstamp) bool {
+	return version.TransactionVersion == incompleteVersion
+}
+
+// Range end (exclusive) before any key containing an incomplete versionstamp, used to skip keys
+// wrongly stored with an incomplete versionstamp by txn.Set.
+var IncompleteVersionstampRangeEnd = tuple.Versionstamp{TransactionVersion: incompleteVersion}
+
 func VersionstampToValue(version tuple.Versionstamp) []byte {
 	if version.TransactionVersion == incompleteVersion {
 		// Note that this seems to result in bytes that unpack to 4 tuple values (v, nil, nil, nil)
@@ -77,9 +87,10 @@ type VersionKey string
 
 var (
 	// Each maps to a database - not sure where else to put them!
-	RoomsVersionKey    VersionKey = "r"
-	AccountsVersionKey VersionKey = "a"
-	DevicesVersionKey  VersionKey = "d"
+	RoomsVersionKey     VersionKey = "r"
+	AccountsVersionKey  VersionKey = "a"
+	DevicesVersionKey   VersionKey = "d"
+	TransientVersionKey VersionKey = "t"
 )
 
 type VersionMap map[VersionKey]tuple.Versionstamp
@@ -123,3 +134,7 @@ func SortVersioners[T Versioner](versions []T) {
 		return bytes.Compare(a.GetVersion().Bytes(), b.GetVersion().Bytes())
 	})
 }
+
+func CompareVersionstamps(a, b tuple.Versionstamp) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
@@ -24,7 +24,9 @@ func TxnIterAllRange(txn fdb.ReadTransaction, rng fdb.Range, f func(fdb.KeyValue
 		if err != nil {
 			return err
 		}
-		f(kv)
+		if err := f(kv); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -37,6 +39,10 @@ func TxnGetLatestWriteVersion(ctx context.Context, txn fdb.ReadTransaction) tupl
 			Limit:   1,
 		},
 	).GetSliceOrPanic()
+	if len(kvs) == 0 {
+		// Nothing has ever been written to this database
+		return types.ZeroVersionstamp
+	}
 	return types.MustValueToVersionstamp(kvs[0].Value)
 }
 
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+var ErrDeniedAddress = errors.New("address is denied")
+
+// Returns an HTTP client that refuses to connect to any address rejected by isDenied. This is
+// checked against the resolved address when dialing, so hostnames resolving or redirecting to a
+// denied address are also refused.
+func NewRestrictedHTTPClient(isDenied func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			} else if isDenied(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrDeniedAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the target, bypassing the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Transport: transport}
+}
+
+// Resolve a host, returning ErrDeniedAddress if any of its addresses are rejected by isDenied
+func CheckHostAddrsAllowed(ctx context.Context, host string, isDenied func(netip.Addr) bool) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isDenied(addr) {
+			return fmt.Errorf("%w: %s", ErrDeniedAddress, addr)
+		}
+	}
+	return nil
+}
@@ -28,17 +28,21 @@ func Base64DecodeURLSafe(s string) ([]byte, error) {
 	return base64.RawURLEncoding.DecodeString(s)
 }
 
-func GetJSONSignature(b []byte, key ed25519.PrivateKey) (string, error) {
+// Returns the canonical JSON bytes covered by signatures, ie with signatures/unsigned removed
+func GetJSONSignableBytes(b []byte) ([]byte, error) {
 	var err error
 	if b, err = sjson.DeleteBytes(b, "signatures"); err != nil {
-		return "", err
+		return nil, err
 	}
 	if b, err = sjson.DeleteBytes(b, "unsigned"); err != nil {
-		return "", err
+		return nil, err
 	}
+	return gomatrixserverlib.CanonicalJSON(b)
+}
 
+func GetJSONSignature(b []byte, key ed25519.PrivateKey) (string, error) {
 	// Sign the canonical JSON
-	canonicalB, err := gomatrixserverlib.CanonicalJSON(b)
+	canonicalB, err := GetJSONSignableBytes(b)
 	if err != nil {
 		return "", err
 	}
@@ -107,14 +111,7 @@ func VerifyJSON(b []byte, signingName, keyID string, pubKey ed25519.PublicKey) e
 	}
 
 	// Now strip signatures/unsigned and canonicalize the JSON
-	// var err error
-	if b, err = sjson.DeleteBytes(b, "signatures"); err != nil {
-		return err
-	}
-	if b, err = sjson.DeleteBytes(b, "unsigned"); err != nil {
-		return err
-	}
-	if b, err = gomatrixserverlib.CanonicalJSON(b); err != nil {
+	if b, err = GetJSONSignableBytes(b); err != nil {
 		return err
 	}
 
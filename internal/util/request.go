@@ -82,7 +82,7 @@ func VersionMapToString(vMap types.VersionMap) string {
 }
 
 func StringToVersionMap(s string) (types.VersionMap, error) {
-	versions := make(types.VersionMap, 3) // we currently have 3 known versions (above)
+	versions := make(types.VersionMap, 4) // we currently have 4 known versions (above)
 
 	parts := strings.Split(s, ".")
 
@@ -107,6 +107,8 @@ func StringToVersionMap(s string) (types.VersionMap, error) {
 			versions[vKey] = version
 		case types.DevicesVersionKey:
 			versions[vKey] = version
+		case types.TransientVersionKey:
+			versions[vKey] = version
 		default:
 			return nil, fmt.Errorf("invalid versions key: %s", string(key))
 		}
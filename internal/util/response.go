@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/beeper/libserv/pkg/requestlog"
 	"github.com/matrix-org/gomatrix"
 	"github.com/rs/zerolog/hlog"
 	"maunium.net/go/mautrix"
@@ -29,6 +30,12 @@ var (
 	MUnprocessableContent = mautrix.RespError{
 		ErrCode: "M_UNPROCESSABLE",
 	}
+	MWrongRoomKeysVersion = mautrix.RespError{
+		ErrCode: "M_WRONG_ROOM_KEYS_VERSION",
+	}
+	MMissingParam = mautrix.RespError{
+		ErrCode: "M_MISSING_PARAM",
+	}
 )
 
 type errorMeta struct {
@@ -39,11 +46,13 @@ type errorMeta struct {
 var errorToMeta = map[string]errorMeta{
 	mautrix.MNotJSON.ErrCode:      {400, "Request body is not valid JSON"},
 	mautrix.MInvalidParam.ErrCode: {400, ""},
+	MMissingParam.ErrCode:         {400, ""},
 
 	mautrix.MMissingToken.ErrCode: {401, ""},
 	mautrix.MUnknownToken.ErrCode: {401, ""},
 	MUnauthorized.ErrCode:         {401, ""},
 	mautrix.MForbidden.ErrCode:    {403, ""},
+	MWrongRoomKeysVersion.ErrCode: {403, ""},
 	MUnprocessableContent.ErrCode: {422, ""},
 
 	mautrix.MNotFound.ErrCode: {404, "Nothing found here"},
@@ -111,6 +120,51 @@ func ResponseRawJSON(w http.ResponseWriter, r *http.Request, statusCode int, dat
 	w.Write(data)
 }
 
+// Start a server-sent events response, events are then written with ResponseEventStreamEvent
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func ResponseEventStream(w http.ResponseWriter) error {
+	addCORSHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disable proxy buffering (nginx)
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return flushResponse(w)
+}
+
+// Write a server-sent event with JSON data and flush it to the client, an empty event name writes
+// a comment instead which can be used to keep the connection alive.
+func ResponseEventStreamEvent(w http.ResponseWriter, eventID, eventName string, data any) error {
+	if eventName == "" {
+		if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		return flushResponse(w)
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if eventID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", eventID); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventName, b); err != nil {
+		return err
+	}
+	return flushResponse(w)
+}
+
+// The access log response writer doesn't implement http.Flusher or Unwrap, so unwrap it here
+func flushResponse(w http.ResponseWriter) error {
+	if crw, ok := w.(*requestlog.CountingResponseWriter); ok {
+		w = crw.ResponseWriter
+	}
+	return http.NewResponseController(w).Flush()
+}
+
 func addCORSHeaders(w http.ResponseWriter) {
 	// Recommended CORS headers can be found in https://spec.matrix.org/v1.3/client-server-api/#web-browser-clients
 	w.Header().Set("Access-Control-Allow-Origin", "*")
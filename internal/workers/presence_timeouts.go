@@ -0,0 +1,84 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	presenceTimeoutsLockName    = "PresenceTimeoutsLock"
+	presenceTimeoutsLockRetry   = time.Second * 15
+	presenceTimeoutsLockTimeout = time.Second * 30
+	presenceTimeoutsInterval    = time.Second * 15
+)
+
+// The presence timeouts worker is a singleton background worker that moves idle users to
+// unavailable and users that have stopped syncing to offline.
+type PresenceTimeouts struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPresenceTimeouts(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *PresenceTimeouts {
+	log := logger.With().
+		Str("worker", "PresenceTimeouts").
+		Logger()
+
+	return &PresenceTimeouts{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (pt *PresenceTimeouts) Start() {
+	pt.ctx, pt.cancel = context.WithCancel(pt.log.WithContext(context.Background()))
+
+	pt.wg.Add(1)
+	go func() {
+		defer pt.wg.Done()
+		lock.WithLock(pt.ctx, pt.db.Transient, presenceTimeoutsLockName, lock.LockOptions{
+			RetryInterval: presenceTimeoutsLockRetry,
+			Timeout:       presenceTimeoutsLockTimeout,
+		}, pt.handleTimeoutsLoop)
+	}()
+}
+
+func (pt *PresenceTimeouts) Stop() {
+	pt.cancel()
+	pt.wg.Wait()
+	pt.log.Info().Msg("Presence timeouts stopped")
+}
+
+func (pt *PresenceTimeouts) handleTimeoutsLoop(lock lock.Lock) {
+	for {
+		select {
+		case <-pt.ctx.Done():
+			lock.Release()
+			return
+		case <-time.After(presenceTimeoutsInterval):
+			lock.Refresh()
+			if changed, err := pt.db.TimeoutUserPresences(pt.ctx); err != nil {
+				pt.log.Err(err).Msg("Failed to timeout user presences")
+			} else if changed > 0 {
+				pt.log.Debug().Int("changed", changed).Msg("Timed out user presences")
+			}
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/elastic/go-freelru"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	userPushSenderLockNamePrefix = "PushUserSenderLock:"
+	userPushSenderLockRetry      = time.Second * 30
+	userPushSenderLockTimeout    = time.Second * 60
+	userPushSenderBatchSize      = 50
+
+	pushGatewayTimeout     = time.Second * 10
+	pushGatewayMaxAttempts = 5
+	pushGatewayBackoff     = time.Second
+)
+
+// https://spec.matrix.org/v1.11/push-gateway-api/#post_matrixpushv1notify
+type pushGatewayRequest struct {
+	Notification pushGatewayNotification `json:"notification"`
+}
+
+type pushGatewayNotification struct {
+	EventID      id.EventID          `json:"event_id"`
+	RoomID       id.RoomID           `json:"room_id"`
+	Type         string              `json:"type,omitempty"`
+	Sender       id.UserID           `json:"sender,omitempty"`
+	Content      json.RawMessage     `json:"content,omitempty"`
+	UserIsTarget bool                `json:"user_is_target,omitempty"`
+	Prio         string              `json:"prio"`
+	Counts       pushGatewayCounts   `json:"counts"`
+	Devices      []pushGatewayDevice `json:"devices"`
+}
+
+type pushGatewayCounts struct {
+	Unread int `json:"unread"`
+}
+
+type pushGatewayDevice struct {
+	AppID     string         `json:"app_id"`
+	Pushkey   string         `json:"pushkey"`
+	PushkeyTS int64          `json:"pushkey_ts,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+	Tweaks    map[string]any `json:"tweaks,omitempty"`
+}
+
+type pushGatewayResponse struct {
+	Rejected []string `json:"rejected"`
+}
+
+// The push sender sends queued notifications for local users to the push gateways of each of
+// their pushers. Like the federation sender, a sender is run per user, locked so only a single
+// process sends pushes for any given user.
+type PushSender struct {
+	log       zerolog.Logger
+	config    config.BabbleConfig
+	db        *databases.Databases
+	notifiers *notifier.Notifiers
+
+	// Refuses to connect to gateways at denied addresses, pusher URLs are checked when set but
+	// may resolve elsewhere by the time we send.
+	httpClient *http.Client
+	backoff    time.Duration
+
+	// Internal map + lock of active senders we have running in this process
+	lock        sync.RWMutex
+	lockCache   *freelru.LRU[string, string]
+	userSenders map[id.UserID]chan struct{}
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPushSender(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notifiers *notifier.Notifiers,
+) *PushSender {
+	log := logger.With().
+		Str("worker", "PushSender").
+		Logger()
+
+	lockCache, err := freelru.New[string, string](1000, func(s string) uint32 {
+		return uint32(xxhash.Sum64String(string(s)))
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return &PushSender{
+		log:         log,
+		config:      cfg,
+		db:          db,
+		notifiers:   notifiers,
+		httpClient:  util.NewRestrictedHTTPClient(cfg.IsPushGatewayAddrDenied),
+		backoff:     pushGatewayBackoff,
+		userSenders: make(map[id.UserID]chan struct{}),
+		lockCache:   lockCache,
+	}
+}
+
+func (ps *PushSender) Start() {
+	ps.ctx, ps.cancel = context.WithCancel(ps.log.WithContext(context.Background()))
+
+	initialUserIDs, err := ps.db.Rooms.GetPushUserIDs(ps.ctx)
+	if err != nil {
+		panic(fmt.Errorf("failed to get initial push users: %w", err))
+	}
+
+	ps.log.Info().
+		Int("initial_users", len(initialUserIDs)).
+		Msg("Starting push sender...")
+
+	go ps.handleUsersLoop(initialUserIDs)
+}
+
+func (ps *PushSender) Stop() {
+	ps.cancel()
+	ps.wg.Wait()
+	ps.log.Info().Msg("Push sender stopped")
+}
+
+func (ps *PushSender) handleUsersLoop(initialUserIDs []id.UserID) {
+	ps.wg.Add(1)
+	defer ps.wg.Done()
+
+	// Queued pushes are notified as room user changes alongside the notification itself
+	usersCh := make(chan any, 1000)
+	ps.notifiers.Rooms.Subscribe(usersCh, notifier.Subscription{AllUsers: true})
+	defer ps.notifiers.Rooms.Unsubscribe(usersCh)
+
+	// Kick off a goroutine to push our initial users into the queue
+	go func() {
+		for _, userID := range initialUserIDs {
+			usersCh <- userID
+		}
+	}()
+
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case user := <-usersCh:
+			userID := user.(id.UserID)
+
+			if userID.Homeserver() != ps.config.ServerName {
+				continue
+			}
+
+			// First check our in memory map of active senders, avoid the FDB lock
+			// entirely if we're already running this sender.
+			ps.lock.RLock()
+			ch, found := ps.userSenders[userID]
+			select {
+			// Wakeup the sender if needed
+			case ch <- struct{}{}:
+			default:
+			}
+			ps.lock.RUnlock()
+
+			if found {
+				ps.log.Trace().
+					Stringer("user_id", userID).
+					Msg("We are already running this user sender")
+			} else {
+				go ps.maybeRunUserSender(userID)
+			}
+		}
+	}
+}
+
+func (ps *PushSender) maybeRunUserSender(userID id.UserID) {
+	// Most user changes are unrelated to pushes, so check for any queued before taking the lock
+	if hasPushes, err := ps.db.Rooms.HasQueuedPushes(ps.ctx, userID); err != nil {
+		ps.log.Err(err).Stringer("user_id", userID).Msg("Error checking for queued pushes")
+		return
+	} else if !hasPushes {
+		return
+	}
+
+	lockName := userPushSenderLockNamePrefix + userID.String()
+
+	lockOpts := lock.LockOptions{
+		RetryInterval: userPushSenderLockRetry,
+		Timeout:       userPushSenderLockTimeout,
+	}
+
+	if hadLock, err := lock.WithLockIfAvailable(ps.ctx, ps.db.Rooms, lockName, lockOpts, ps.lockCache, func(lock lock.Lock) {
+		ps.wg.Add(1)
+		defer ps.wg.Done()
+
+		log := ps.log.With().
+			Stringer("user_id", userID).
+			Logger()
+
+		wakeCh := make(chan struct{}, 1)
+
+		// Store internal flag that we're running this sender
+		ps.lock.Lock()
+		ps.userSenders[userID] = wakeCh
+		ps.lock.Unlock()
+
+		log.Info().Msg("Starting user push sender")
+		ps.sendPushesToUserLoop(userID, lock, log, wakeCh)
+
+		// Remove the internal flag on sender
+		ps.lock.Lock()
+		delete(ps.userSenders, userID)
+		ps.lock.Unlock()
+
+		lock.Release()
+		log.Info().Msg("User push sender stopped without error")
+	}); err != nil {
+		ps.log.Err(err).Msg("Error starting user push sender")
+		return
+	} else if !hadLock {
+		ps.log.Trace().
+			Stringer("user_id", userID).
+			Msg("Someone else is already running this user push sender")
+	}
+}
+
+func (ps *PushSender) sendPushesToUserLoop(
+	userID id.UserID,
+	lock lock.Lock,
+	log zerolog.Logger,
+	wakeCh chan struct{},
+) {
+	var noSends int
+
+	trySend := func() {
+		if ps.sendPushesToUser(userID, lock, log) {
+			noSends = 0
+		} else {
+			noSends++
+		}
+	}
+
+	trySend()
+
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-wakeCh:
+			trySend()
+		case <-time.After(userPushSenderLockRetry):
+			trySend()
+		}
+		if noSends >= 10 {
+			// After 10 refreshes without sends, exit the user sender. If new
+			// pushes are queued for this user we'll start again.
+			return
+		}
+	}
+}
+
+func (ps *PushSender) sendPushesToUser(userID id.UserID, lock lock.Lock, log zerolog.Logger) bool {
+	var sent bool
+
+	for {
+		lock.Refresh()
+
+		res, err := ps.db.Rooms.GetQueuedPushes(ps.ctx, userID, userPushSenderBatchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to get queued pushes")
+			return sent
+		} else if len(res.Pushes) == 0 {
+			return sent
+		}
+		sent = true
+
+		pushers, err := ps.db.Accounts.GetPushers(ps.ctx, userID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get pushers")
+			return sent
+		}
+
+		for _, push := range res.Pushes {
+			if push.Cleared {
+				log.Trace().Stringer("event_id", push.EventID).Msg("Skipping push for read event")
+				continue
+			}
+			if err := ps.sendPushToPushers(push, pushers, res.UnreadCount, lock, log); err != nil {
+				log.Err(err).Stringer("event_id", push.EventID).Msg("Failed to send push")
+				return sent
+			}
+		}
+
+		lastVersion := res.Pushes[len(res.Pushes)-1].Version
+		if err := ps.db.Rooms.ClearQueuedPushes(ps.ctx, userID, lastVersion, lock.TxnRefresh); err != nil {
+			log.Err(err).Msg("Failed to clear queued pushes")
+			return sent
+		}
+	}
+}
+
+func (ps *PushSender) sendPushToPushers(
+	push *types.QueuedPush,
+	pushers []*types.Pusher,
+	unreadCount int,
+	lock lock.Lock,
+	log zerolog.Logger,
+) error {
+	if len(pushers) == 0 {
+		return nil
+	}
+
+	ev, err := ps.db.Rooms.GetEvent(ps.ctx, push.EventID)
+	if err != nil {
+		return err
+	}
+
+	tweaks := make(map[string]any)
+	if push.Highlight {
+		tweaks["highlight"] = true
+	}
+	if push.Sound != "" {
+		tweaks["sound"] = push.Sound
+	}
+
+	prio := "low"
+	if push.Highlight || push.Sound != "" || ev.Type == event.EventMessage || ev.Type == event.EventEncrypted {
+		prio = "high"
+	}
+
+	for _, pusher := range pushers {
+		data, err := pusher.ParseData()
+		if err != nil {
+			log.Err(err).Str("app_id", pusher.AppID).Msg("Skipping pusher with invalid data")
+			continue
+		}
+		gatewayData, err := pusher.GatewayData()
+		if err != nil {
+			log.Err(err).Str("app_id", pusher.AppID).Msg("Skipping pusher with invalid data")
+			continue
+		}
+
+		notification := pushGatewayNotification{
+			EventID: push.EventID,
+			RoomID:  push.RoomID,
+			Prio:    prio,
+			Counts:  pushGatewayCounts{Unread: unreadCount},
+			Devices: []pushGatewayDevice{{
+				AppID:     pusher.AppID,
+				Pushkey:   pusher.Pushkey,
+				PushkeyTS: pusher.PushkeyTS,
+				Data:      gatewayData,
+				Tweaks:    tweaks,
+			}},
+		}
+		if data.Format != types.PusherFormatEventIDOnly {
+			notification.Type = ev.Type.Type
+			notification.Sender = ev.Sender
+			notification.Content = ev.Content
+			notification.UserIsTarget = ev.StateKey != nil && *ev.StateKey == push.UserID.String()
+		}
+
+		rejected, err := ps.sendNotificationWithRetry(data.URL, notification, lock, log)
+		if err != nil {
+			// Give up on this pusher but continue with others, the gateway may be gone for good
+			log.Err(err).
+				Str("app_id", pusher.AppID).
+				Stringer("event_id", push.EventID).
+				Msg("Failed to send notification to push gateway")
+			continue
+		}
+
+		for _, pushkey := range rejected {
+			if pushkey != pusher.Pushkey {
+				continue
+			}
+			log.Info().Str("app_id", pusher.AppID).Msg("Push gateway rejected pushkey, deleting pusher")
+			if err := ps.db.Accounts.DeletePusher(ps.ctx, push.UserID, pusher.AppID, pusher.Pushkey); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Send a notification to the push gateway, retrying with exponential backoff. Returns any pushkeys
+// rejected by the gateway.
+func (ps *PushSender) sendNotificationWithRetry(
+	url string,
+	notification pushGatewayNotification,
+	lock lock.Lock,
+	log zerolog.Logger,
+) ([]string, error) {
+	body, err := json.Marshal(pushGatewayRequest{notification})
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := ps.backoff
+
+	for attempt := 1; ; attempt++ {
+		rejected, retry, err := ps.sendNotification(url, body)
+		if err == nil {
+			return rejected, nil
+		} else if !retry || attempt >= pushGatewayMaxAttempts {
+			return nil, err
+		}
+
+		log.Warn().Err(err).
+			Int("attempt", attempt).
+			Dur("backoff", backoff).
+			Msg("Failed to send notification to push gateway, retrying")
+
+		select {
+		case <-ps.ctx.Done():
+			return nil, ps.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		lock.Refresh()
+	}
+}
+
+// Returns any rejected pushkeys or an error and whether the request should be retried
+func (ps *PushSender) sendNotification(url string, body []byte) ([]string, bool, error) {
+	ctx, cancel := context.WithTimeout(ps.ctx, pushGatewayTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ps.httpClient.Do(req)
+	if errors.Is(err, util.ErrDeniedAddress) {
+		return nil, false, err
+	} else if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("push gateway responded with status %d", resp.StatusCode)
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, err
+	}
+
+	var gatewayResp pushGatewayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gatewayResp); err != nil {
+		return nil, false, err
+	}
+	return gatewayResp.Rejected, false, nil
+}
@@ -0,0 +1,116 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+var testNotification = pushGatewayNotification{
+	EventID: "$event",
+	RoomID:  "!room:localhost",
+	Prio:    "high",
+	Counts:  pushGatewayCounts{Unread: 1},
+	Devices: []pushGatewayDevice{{AppID: "app", Pushkey: "pushkey"}},
+}
+
+// Gateway that responds with the given statuses in order, repeating the last one
+func newTestPushGateway(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+
+		var req pushGatewayRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, testNotification.EventID, req.Notification.EventID)
+
+		status := statuses[min(n, len(statuses))-1]
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			json.NewEncoder(w).Encode(pushGatewayResponse{Rejected: []string{"rejected"}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func newTestPushSender(t *testing.T, client *http.Client) *PushSender {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &PushSender{
+		httpClient: client,
+		backoff:    time.Millisecond,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func sendTestNotification(ps *PushSender, url string) ([]string, error) {
+	noopLock := lock.Lock{Refresh: func() {}}
+	return ps.sendNotificationWithRetry(url, testNotification, noopLock, zerolog.Nop())
+}
+
+func TestPushSenderSendNotification(t *testing.T) {
+	srv, requests := newTestPushGateway(t, http.StatusOK)
+	ps := newTestPushSender(t, srv.Client())
+
+	rejected, err := sendTestNotification(ps, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rejected"}, rejected)
+	assert.EqualValues(t, 1, requests.Load())
+}
+
+func TestPushSenderSendNotificationRetries(t *testing.T) {
+	srv, requests := newTestPushGateway(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+	ps := newTestPushSender(t, srv.Client())
+
+	rejected, err := sendTestNotification(ps, srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rejected"}, rejected)
+	assert.EqualValues(t, 3, requests.Load())
+}
+
+func TestPushSenderSendNotificationGivesUp(t *testing.T) {
+	srv, requests := newTestPushGateway(t, http.StatusServiceUnavailable)
+	ps := newTestPushSender(t, srv.Client())
+
+	// The pusher is skipped for this push once every attempt fails
+	_, err := sendTestNotification(ps, srv.URL)
+	assert.Error(t, err)
+	assert.EqualValues(t, pushGatewayMaxAttempts, requests.Load())
+}
+
+func TestPushSenderSendNotificationNoRetryOnClientError(t *testing.T) {
+	srv, requests := newTestPushGateway(t, http.StatusBadRequest)
+	ps := newTestPushSender(t, srv.Client())
+
+	_, err := sendTestNotification(ps, srv.URL)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, requests.Load())
+}
+
+func TestPushSenderSendNotificationDeniedAddress(t *testing.T) {
+	srv, requests := newTestPushGateway(t, http.StatusOK)
+	ps := newTestPushSender(t, util.NewRestrictedHTTPClient(func(addr netip.Addr) bool {
+		return addr.IsLoopback()
+	}))
+
+	_, err := sendTestNotification(ps, srv.URL)
+	assert.ErrorIs(t, err, util.ErrDeniedAddress)
+	assert.EqualValues(t, 0, requests.Load())
+}
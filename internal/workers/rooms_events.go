@@ -20,17 +20,25 @@ const (
 	eventsIteratorLockRetry   = time.Second * 5
 	eventsIteratorLockTimeout = time.Second * 10
 	eventsIteratorBatchSize   = 10
+
+	// Notifications for an event are retried this many times before the event is skipped, so one
+	// bad event can't block notifications for every event after it.
+	eventsIteratorMaxNotificationAttempts = 5
 )
 
 // The events iterator is a singleton background worker that iterates over all
 // events ever stored by Babbleserv and triggers other things. Currently this
-// is just waking up federation senders.
+// is waking up federation senders and evaluating push rules for local users.
 type EventsIterator struct {
 	log       zerolog.Logger
 	config    config.BabbleConfig
 	db        *databases.Databases
 	notifiers *notifier.Notifiers
 
+	// Event that notifications last failed for and the number of attempts, only used by the loop
+	failedEventID       id.EventID
+	failedEventAttempts int
+
 	wg     sync.WaitGroup
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -79,7 +87,7 @@ func (ei *EventsIterator) handleNewEventsLoop(lock lock.Lock) {
 	defer ei.notifiers.Rooms.Unsubscribe(newEventsCh)
 
 	// Cold start case: handle anything waiting right away
-	ei.handleNewEvents(lock)
+	ok := ei.handleNewEvents(lock)
 
 	for {
 		select {
@@ -87,21 +95,30 @@ func (ei *EventsIterator) handleNewEventsLoop(lock lock.Lock) {
 			lock.Release()
 			return
 		case <-newEventsCh:
-			ei.handleNewEvents(lock)
+			ok = ei.handleNewEvents(lock)
 		case <-time.After(eventsIteratorLockRetry):
 			lock.Refresh()
+			if !ok {
+				// Retry from the last stored position
+				ok = ei.handleNewEvents(lock)
+			}
 		}
 	}
 }
 
-func (ei *EventsIterator) handleNewEvents(lock lock.Lock) {
+// Handle any events after the current position, returns false if handling failed part way, in
+// which case the position is only moved past the events that succeeded.
+func (ei *EventsIterator) handleNewEvents(lock lock.Lock) bool {
 	startVersion, err := ei.db.Rooms.GetEventsIteratorPosition(ei.ctx)
 	if err != nil {
 		ei.log.Err(err).Msg("Failed to get current position")
-		return
+		return false
 	}
 
+	ok := true
+
 	currentVersion := startVersion
+batches:
 	for {
 		// Refresh the lock before we process each batch
 		lock.Refresh()
@@ -111,7 +128,8 @@ func (ei *EventsIterator) handleNewEvents(lock lock.Lock) {
 		newEventIDTups, err := ei.db.Rooms.EventsIteratorPaginateEvents(ei.ctx, currentVersion, eventsIteratorBatchSize)
 		if err != nil {
 			ei.log.Err(err).Msg("Failed to paginate new events")
-			return
+			ok = false
+			break
 		} else if len(newEventIDTups) == 0 {
 			ei.log.Trace().Any("fromVersion", currentVersion).Msg("No events found")
 			break
@@ -126,8 +144,16 @@ func (ei *EventsIterator) handleNewEvents(lock lock.Lock) {
 			ei.log.Err(err).Msg("Failed to notify federation senders")
 		}
 
-		currentVersion = newEventIDTups[len(newEventIDTups)-1].Version
-		currentVersion.UserVersion += 1
+		for _, tup := range newEventIDTups {
+			if ei.db.Accounts != nil && !ei.handleEventNotifications(tup) {
+				// Stop here so the position is saved up to the last event handled, the failed
+				// event is retried on the next run.
+				ok = false
+				break batches
+			}
+			currentVersion = tup.Version
+			currentVersion.UserVersion += 1
+		}
 
 		if len(newEventIDTups) < eventsIteratorBatchSize {
 			break
@@ -135,7 +161,7 @@ func (ei *EventsIterator) handleNewEvents(lock lock.Lock) {
 	}
 
 	if currentVersion == startVersion {
-		return
+		return ok
 	}
 
 	// Update the position - refreshing the lock as part of the transaction to
@@ -143,8 +169,42 @@ func (ei *EventsIterator) handleNewEvents(lock lock.Lock) {
 	err = ei.db.Rooms.UpdateEventsIteratorPosition(ei.ctx, currentVersion, lock.TxnRefresh)
 	if err != nil {
 		ei.log.Err(err).Msg("Failed to update current position")
-		return
+		return false
+	}
+
+	return ok
+}
+
+// Evaluate push rules for an event, returns false if this failed and the event should be retried.
+// After eventsIteratorMaxNotificationAttempts failures the event is skipped.
+func (ei *EventsIterator) handleEventNotifications(tup types.EventIDTupWithVersion) bool {
+	err := ei.db.HandleEventNotifications(ei.ctx, tup)
+	if err == nil {
+		ei.failedEventID, ei.failedEventAttempts = "", 0
+		return true
+	} else if ei.ctx.Err() != nil {
+		// Shutting down, the next iterator will retry this event
+		return false
+	}
+
+	if ei.failedEventID != tup.EventID {
+		ei.failedEventID, ei.failedEventAttempts = tup.EventID, 0
+	}
+	ei.failedEventAttempts++
+
+	log := ei.log.With().
+		Err(err).
+		Stringer("event_id", tup.EventID).
+		Int("attempt", ei.failedEventAttempts).
+		Logger()
+
+	if ei.failedEventAttempts >= eventsIteratorMaxNotificationAttempts {
+		log.Error().Msg("Failed to handle event notifications too many times, skipping event")
+		ei.failedEventID, ei.failedEventAttempts = "", 0
+		return true
 	}
+	log.Warn().Msg("Failed to handle event notifications, will retry")
+	return false
 }
 
 func (ei *EventsIterator) notifyFederationSenders(tups []types.EventIDTupWithVersion) error {
@@ -0,0 +1,104 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	roomsJobsLockName    = "RoomsJobsLock"
+	roomsJobsLockRetry   = time.Second * 15
+	roomsJobsLockTimeout = time.Second * 30
+	roomsJobsInterval    = time.Second * 5
+	roomsJobsBatchSize   = 100
+)
+
+// The rooms jobs worker is a singleton background worker that runs queued jobs, retrying them
+// until they succeed.
+type RoomsJobs struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRoomsJobs(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *RoomsJobs {
+	log := logger.With().
+		Str("worker", "RoomsJobs").
+		Logger()
+
+	return &RoomsJobs{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (rj *RoomsJobs) Start() {
+	rj.ctx, rj.cancel = context.WithCancel(rj.log.WithContext(context.Background()))
+
+	rj.wg.Add(1)
+	go func() {
+		defer rj.wg.Done()
+		lock.WithLock(rj.ctx, rj.db.Rooms, roomsJobsLockName, lock.LockOptions{
+			RetryInterval: roomsJobsLockRetry,
+			Timeout:       roomsJobsLockTimeout,
+		}, rj.handleJobsLoop)
+	}()
+}
+
+func (rj *RoomsJobs) Stop() {
+	rj.cancel()
+	rj.wg.Wait()
+	rj.log.Info().Msg("Rooms jobs stopped")
+}
+
+func (rj *RoomsJobs) handleJobsLoop(lock lock.Lock) {
+	for {
+		select {
+		case <-rj.ctx.Done():
+			lock.Release()
+			return
+		case <-time.After(roomsJobsInterval):
+			lock.Refresh()
+			jobs, err := rj.db.Rooms.GetDueJobs(rj.ctx, roomsJobsBatchSize)
+			if err != nil {
+				rj.log.Err(err).Msg("Failed to get due jobs")
+				continue
+			}
+			for _, job := range jobs {
+				lock.Refresh()
+				log := rj.log.With().
+					Str("job_type", string(job.Type)).
+					Str("job_key", job.Key).
+					Int("attempts", job.Attempts).
+					Logger()
+
+				if jobErr := rj.db.RunJob(log.WithContext(rj.ctx), job); jobErr != nil {
+					log.Err(jobErr).Msg("Job failed, will retry")
+					if err := rj.db.Rooms.RetryJob(rj.ctx, job, jobErr); err != nil {
+						log.Err(err).Msg("Failed to reschedule job")
+					}
+				} else if err := rj.db.Rooms.CompleteJob(rj.ctx, job); err != nil {
+					log.Err(err).Msg("Failed to complete job")
+				} else {
+					log.Debug().Msg("Completed job")
+				}
+			}
+		}
+	}
+}
@@ -41,9 +41,18 @@ func NewWorkers(
 		workers = append(workers,
 			NewEventsIterator(log, cfg, db, notifiers),
 			NewFederationSender(log, cfg, db, notifiers, fclient),
+			NewRoomsJobs(log, cfg, db),
 		)
 	}
 
+	if cfg.Rooms.Enabled && cfg.Accounts.Enabled {
+		workers = append(workers, NewPushSender(log, cfg, db, notifiers))
+	}
+
+	if cfg.Rooms.Enabled && cfg.Transient.Enabled && cfg.Transient.Presence.Enabled {
+		workers = append(workers, NewPresenceTimeouts(log, cfg, db))
+	}
+
 	return &Workers{
 		log:       log,
 		config:    cfg,